@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// accessLogEnabled returns whether requests for the db should be logged. The
+// per-db setting, if there is one, overrides the global one.
+func (db *db) accessLogEnabled() bool {
+	if db.config.AccessLog != nil {
+		return *db.config.AccessLog
+	}
+
+	return db.sequins.config.AccessLog
+}
+
+// accessLogger is an http.ResponseWriter that logs a line for the request once
+// it's done.
+type accessLogger struct {
+	http.ResponseWriter
+	start  time.Time
+	status int
+	size   int64
+}
+
+func logAccess(w http.ResponseWriter) *accessLogger {
+	return &accessLogger{
+		ResponseWriter: w,
+		start:          time.Now(),
+		status:         http.StatusOK,
+	}
+}
+
+func (l *accessLogger) WriteHeader(status int) {
+	l.status = status
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *accessLogger) Write(b []byte) (int, error) {
+	n, err := l.ResponseWriter.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *accessLogger) done(r *http.Request) {
+	log.Printf("%s %s %s %d %d %s", r.RemoteAddr, r.Method, r.URL.RequestURI(),
+		l.status, l.size, time.Now().Sub(l.start))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// serveAdmin handles administrative actions on a db, which are any requests
+// other than GETs. Actions are named with a leading underscore, to distinguish
+// them from keys; for example, POST /db/_drain drains the db off of this node,
+// and DELETE /db/_drain undrains it. POST /db/_disable stops serving the db
+// altogether; requests for a disabled db, including POST /db/_enable, are
+// handled by serveDisabledDB instead. The exceptions are DELETE
+// /db/versions/<version>, which deletes a version from local storage, and POST
+// /db/versions/<version>/_repair, which loads it again from the source. If
+// 'admin_tokens' is set, every action needs one of them.
+func (db *db) serveAdmin(w http.ResponseWriter, r *http.Request, action string) {
+	if !db.sequins.checkAdminAuth(w, r) {
+		return
+	}
+
+	if strings.HasPrefix(action, storedVersionsPrefix) {
+		name := strings.TrimPrefix(action, storedVersionsPrefix)
+		if strings.HasSuffix(name, repairSuffix) {
+			db.serveRepairVersion(w, r, strings.TrimSuffix(name, repairSuffix))
+		} else {
+			db.serveDeleteVersion(w, r, name)
+		}
+
+		return
+	}
+
+	switch action {
+	case "_disable":
+		db.sequins.serveDisable(w, r, db.name)
+	case "_drain":
+		db.serveDrain(w, r)
+	case "_enable":
+		db.sequins.serveEnable(w, r, db.name)
+	case "_pin":
+		db.servePin(w, r)
+	case "_refresh":
+		db.serveRefresh(w, r)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (db *db) serveDrain(w http.ResponseWriter, r *http.Request) {
+	// Draining only makes sense in a cluster.
+	if db.peers() == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		db.drain()
+	case "DELETE":
+		db.undrain()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
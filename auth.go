@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// peerSecretHeader carries 'sharding.peer_secret' on every request to a peer,
+// so that reads proxied on behalf of a client don't need the client's token.
+const peerSecretHeader = "X-Sequins-Peer-Secret"
+
+// readTokens returns the tokens that can be used to read the db: the db's own
+// 'read_tokens', if it has them, or the global ones.
+func (db *db) readTokens() []string {
+	if db.config.ReadTokens != nil {
+		return db.config.ReadTokens
+	}
+
+	return db.sequins.config.ReadTokens
+}
+
+// checkReadAuth returns true if the request is allowed to read from the db. If
+// the db has read tokens, the request needs either one of them, as a bearer
+// token, or the peer secret. If it has neither, a 401 is written, and
+// checkReadAuth returns false.
+func (db *db) checkReadAuth(w http.ResponseWriter, r *http.Request) bool {
+	tokens := db.readTokens()
+	if len(tokens) == 0 || db.sequins.isPeerRequest(r) || hasToken(r, tokens) {
+		return true
+	}
+
+	writeUnauthorized(w)
+	return false
+}
+
+// checkAdminAuth returns true if the request is allowed to take an admin
+// action, like draining a db or deleting a version. If 'admin_tokens' is set,
+// the request needs either one of them, as a bearer token, or the peer secret.
+// If it has neither, a 401 is written, and checkAdminAuth returns false.
+func (s *sequins) checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	tokens := s.config.AdminTokens
+	if len(tokens) == 0 || s.isPeerRequest(r) || hasToken(r, tokens) {
+		return true
+	}
+
+	writeUnauthorized(w)
+	return false
+}
+
+// hasToken returns true if the request has one of the given tokens, as a
+// bearer token.
+func hasToken(r *http.Request, tokens []string) bool {
+	token := bearerToken(r)
+	if token == "" {
+		return false
+	}
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="sequins"`)
+	setErrorCode(w, codeUnauthorized)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// isPeerRequest returns true if the request came from a peer, as shown by it
+// having the peer secret.
+func (s *sequins) isPeerRequest(r *http.Request) bool {
+	secret := s.config.Sharding.PeerSecret
+	if secret == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(secret)) == 1
+}
+
+// bearerToken returns the token from an 'Authorization: Bearer <token>'
+// header, or an empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+		return ""
+	}
+
+	return strings.TrimSpace(auth[len(prefix):])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+)
+
+const availabilityCheckInterval = 10 * time.Second
+
+// watchAvailability periodically checks how many of the nodes responsible for
+// each version actually have it available, and flags any versions that have
+// been below sharding.partial_availability_threshold for longer than
+// sharding.partial_availability_timeout. That usually means a download is stuck
+// on some of the nodes. Nodes that are just a little behind during an upgrade
+// are covered by the timeout.
+func (s *sequins) watchAvailability() {
+	threshold := s.config.Sharding.PartialAvailabilityThreshold
+	timeout := s.config.Sharding.PartialAvailabilityTimeout.Duration
+	partialSince := make(map[*version]time.Time)
+	flagged := make(map[*version]bool)
+
+	ticker := time.NewTicker(availabilityCheckInterval)
+	for range ticker.C {
+		seen := make(map[*version]bool)
+		stuck := 0
+
+		s.dbsLock.RLock()
+		for _, db := range s.dbs {
+			drained := db.getDrained()
+			for _, vs := range db.mux.getAll() {
+				available, expected := vs.partitions.availability(drained)
+				if expected == 0 || float64(available)/float64(expected) >= threshold {
+					continue
+				}
+
+				seen[vs] = true
+				since, ok := partialSince[vs]
+				if !ok {
+					partialSince[vs] = time.Now()
+					continue
+				} else if time.Since(since) < timeout {
+					continue
+				}
+
+				stuck++
+				if !flagged[vs] {
+					logEvent(logFields{DB: db.name, Version: vs.name, Event: "version_partially_available"},
+						"Version %s of %s has only been available on %d of %d nodes for %v",
+						vs.name, db.name, available, expected, time.Since(since))
+					flagged[vs] = true
+				}
+			}
+		}
+		s.dbsLock.RUnlock()
+
+		for vs := range partialSince {
+			if !seen[vs] {
+				delete(partialSince, vs)
+				delete(flagged, vs)
+			}
+		}
+
+		if expStats != nil {
+			expStats.setPartiallyAvailableVersions(stuck)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package backend
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Releaser is a Backend that keeps a local copy of a version while it's
+// being read. Once the version is loaded, the copy can be released.
+type Releaser interface {
+	// Release removes the local copy of a version, if there is one.
+	Release(db, version string) error
+}
+
+// An ArchiveBackend wraps another backend in which each version of a db is a
+// single tar or zip archive, named for the version with the format as the
+// extension, rather than a directory of files. The first time a version's
+// files are needed, the archive is extracted to a local directory, and
+// everything is then read from there until it's released.
+//
+// The _SUCCESS marker, if required, is expected as an entry in the archive.
+// Any directories inside the archive are flattened.
+type ArchiveBackend struct {
+	Backend
+	format string
+	dir    string
+	local  *LocalBackend
+
+	lock      sync.Mutex
+	extracted map[string]bool
+	locks     map[string]*sync.Mutex
+	succeeded map[string]bool
+}
+
+// NewArchiveBackend creates an ArchiveBackend around b, which extracts
+// archives of the given format, either "tar" or "zip", into dir.
+func NewArchiveBackend(b Backend, format, dir string) *ArchiveBackend {
+	return &ArchiveBackend{
+		Backend:   b,
+		format:    format,
+		dir:       dir,
+		local:     NewLocalBackend(dir),
+		extracted: make(map[string]bool),
+		locks:     make(map[string]*sync.Mutex),
+		succeeded: make(map[string]bool),
+	}
+}
+
+// ListVersions lists the archives directly under the db. If checkForSuccess
+// is passed, each archive is extracted to check for a _SUCCESS entry, until
+// it's found. Archives are assumed not to change once they have one.
+func (ab *ArchiveBackend) ListVersions(db, after string, checkForSuccess bool) ([]string, error) {
+	files, err := ab.Backend.ListFiles(db, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ab.extension()) {
+			continue
+		}
+
+		version := strings.TrimSuffix(file, ab.extension())
+		if version == "" || version <= after {
+			continue
+		}
+
+		if checkForSuccess {
+			ok, err := ab.hasSuccessFile(db, version)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+
+		res = append(res, version)
+	}
+
+	return res, nil
+}
+
+func (ab *ArchiveBackend) ListFiles(db, version string) ([]string, error) {
+	err := ab.extract(db, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return ab.local.ListFiles(db, version)
+}
+
+// VersionModTime returns the modification time of the archive.
+func (ab *ArchiveBackend) VersionModTime(db, version string) (time.Time, error) {
+	return ab.Backend.VersionModTime(db, version+ab.extension())
+}
+
+// Fingerprints uses the extracted files, which keep the modification times
+// they have in the archive.
+func (ab *ArchiveBackend) Fingerprints(db, version string) (map[string]string, error) {
+	err := ab.extract(db, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return ab.local.Fingerprints(db, version)
+}
+
+// Open opens a file from the extracted archive. Files outside of a version,
+// like a version pointer, are read from the wrapped backend.
+func (ab *ArchiveBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	if version == "" {
+		return ab.Backend.Open(db, version, file)
+	}
+
+	err := ab.extract(db, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return ab.local.Open(db, version, file)
+}
+
+func (ab *ArchiveBackend) DisplayPath(parts ...string) string {
+	if len(parts) >= 2 {
+		parts = append([]string{parts[0], parts[1] + ab.extension()}, parts[2:]...)
+	}
+
+	return ab.Backend.DisplayPath(parts...)
+}
+
+// Release removes the extracted copy of a version. It's extracted again the
+// next time it's needed.
+func (ab *ArchiveBackend) Release(db, version string) error {
+	lock := ab.versionLock(db, version)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ab.lock.Lock()
+	delete(ab.extracted, path.Join(db, version))
+	ab.lock.Unlock()
+
+	return os.RemoveAll(filepath.Join(ab.dir, db, version))
+}
+
+func (ab *ArchiveBackend) extension() string {
+	return "." + ab.format
+}
+
+func (ab *ArchiveBackend) versionLock(db, version string) *sync.Mutex {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	key := path.Join(db, version)
+	lock, ok := ab.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		ab.locks[key] = lock
+	}
+
+	return lock
+}
+
+func (ab *ArchiveBackend) hasSuccessFile(db, version string) (bool, error) {
+	key := path.Join(db, version)
+	ab.lock.Lock()
+	succeeded := ab.succeeded[key]
+	ab.lock.Unlock()
+	if succeeded {
+		return true, nil
+	}
+
+	// Only keep the extracted copy around if something else asked for it.
+	ab.lock.Lock()
+	extracted := ab.extracted[key]
+	ab.lock.Unlock()
+
+	err := ab.extract(db, version)
+	if err != nil {
+		return false, err
+	}
+
+	ok := ab.local.checkForSuccessFile(filepath.Join(ab.dir, db, version))
+	if !extracted {
+		err = ab.Release(db, version)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !ok {
+		return false, nil
+	}
+
+	ab.lock.Lock()
+	ab.succeeded[key] = true
+	ab.lock.Unlock()
+	return true, nil
+}
+
+// extract extracts the archive for a version, unless it already has been.
+func (ab *ArchiveBackend) extract(db, version string) error {
+	lock := ab.versionLock(db, version)
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := path.Join(db, version)
+	ab.lock.Lock()
+	extracted := ab.extracted[key]
+	ab.lock.Unlock()
+	if extracted {
+		return nil
+	}
+
+	dest := filepath.Join(ab.dir, db, version)
+	err := os.RemoveAll(dest)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dest, 0755|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	stream, err := ab.Backend.Open(db, "", version+ab.extension())
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if ab.format == "zip" {
+		err = extractZip(stream, dest)
+	} else {
+		err = extractTar(stream, dest)
+	}
+
+	if err != nil {
+		os.RemoveAll(dest)
+		return fmt.Errorf("extracting %s: %s", ab.DisplayPath(db, version), err)
+	}
+
+	ab.lock.Lock()
+	ab.extracted[key] = true
+	ab.lock.Unlock()
+	return nil
+}
+
+// extractTar streams the entries of a tar archive into dest.
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = extractEntry(tr, dest, hdr.Name, hdr.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip extracts the entries of a zip archive into dest. Since a zip
+// archive's index is at the end, it's first copied to a temporary file next
+// to dest.
+func extractZip(r io.Reader, dest string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		err = extractEntry(rc, dest, f.Name, f.Modified)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractEntry writes a single file from an archive into dest, under its base
+// name, with the modification time it has in the archive.
+func extractEntry(r io.Reader, dest, name string, modTime time.Time) error {
+	base := path.Base(name)
+	if base == "." || base == "/" || base == ".." {
+		return nil
+	}
+
+	target := filepath.Join(dest, base)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("duplicate entry %s", base)
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	if !modTime.IsZero() {
+		return os.Chtimes(target, modTime, modTime)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestArchive writes the files from the baby-names test version into an
+// archive of the given format, with an optional _SUCCESS entry.
+func writeTestArchive(t *testing.T, dest, format string, success bool) {
+	names, err := NewLocalBackend("../test").ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	if success {
+		names = append(names, "_SUCCESS")
+	}
+
+	f, err := os.Create(dest)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var tw *tar.Writer
+	var zw *zip.Writer
+	if format == "zip" {
+		zw = zip.NewWriter(f)
+		defer zw.Close()
+	} else {
+		tw = tar.NewWriter(f)
+		defer tw.Close()
+	}
+
+	for _, name := range names {
+		var b []byte
+		if name != "_SUCCESS" {
+			b, err = ioutil.ReadFile(filepath.Join("../test/baby-names/1", name))
+			require.NoError(t, err)
+		}
+
+		// Put everything in a directory, like most tools do.
+		entry := "1/" + name
+		if zw != nil {
+			w, err := zw.Create(entry)
+			require.NoError(t, err)
+			_, err = w.Write(b)
+			require.NoError(t, err)
+		} else {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(b))}))
+			_, err = tw.Write(b)
+			require.NoError(t, err)
+		}
+	}
+}
+
+func testArchiveBackend(t *testing.T, format string) {
+	source, err := ioutil.TempDir("", "sequins-archive-source-")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+
+	staging, err := ioutil.TempDir("", "sequins-archive-staging-")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	require.NoError(t, os.Mkdir(filepath.Join(source, "baby-names"), 0755))
+	writeTestArchive(t, filepath.Join(source, "baby-names", "1."+format), format, true)
+	writeTestArchive(t, filepath.Join(source, "baby-names", "2."+format), format, false)
+
+	ab := NewArchiveBackend(NewLocalBackend(source), format, staging)
+
+	versions, err := ab.ListVersions("baby-names", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, versions, "every archive should be a version")
+
+	versions, err = ab.ListVersions("baby-names", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions, "only archives with a _SUCCESS entry should be listed")
+	_, err = os.Stat(filepath.Join(staging, "baby-names", "2"))
+	assert.True(t, os.IsNotExist(err), "checking for a _SUCCESS entry shouldn't leave anything extracted")
+
+	expected, err := NewLocalBackend("../test").ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	files, err := ab.ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, files, "the files in the archive should be listed, without _SUCCESS")
+
+	stream, err := ab.Open("baby-names", "1", files[0])
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(stream)
+	stream.Close()
+	require.NoError(t, err)
+
+	original, err := ioutil.ReadFile(filepath.Join("../test/baby-names/1", files[0]))
+	require.NoError(t, err)
+	assert.Equal(t, original, b, "the extracted file should match the original")
+
+	require.NoError(t, ab.Release("baby-names", "1"))
+	_, err = os.Stat(filepath.Join(staging, "baby-names", "1"))
+	assert.True(t, os.IsNotExist(err), "releasing a version should remove the extracted copy")
+
+	files, err = ab.ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, files, "the archive should be extracted again after it's released")
+}
+
+func TestArchiveBackendTar(t *testing.T) {
+	testArchiveBackend(t, "tar")
+}
+
+func TestArchiveBackendZip(t *testing.T) {
+	testArchiveBackend(t, "zip")
+}
+
+func TestArchiveBackendCorrupt(t *testing.T) {
+	source, err := ioutil.TempDir("", "sequins-archive-source-")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+
+	staging, err := ioutil.TempDir("", "sequins-archive-staging-")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	require.NoError(t, os.Mkdir(filepath.Join(source, "baby-names"), 0755))
+	f, err := os.Create(filepath.Join(source, "baby-names", "1.zip"))
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "not a zip file")
+	require.NoError(t, err)
+	f.Close()
+
+	ab := NewArchiveBackend(NewLocalBackend(source), "zip", staging)
+	_, err = ab.ListFiles("baby-names", "1")
+	assert.Error(t, err, "a corrupt archive should fail to extract")
+
+	_, err = os.Stat(filepath.Join(staging, "baby-names", "1"))
+	assert.True(t, os.IsNotExist(err), "a failed extraction shouldn't leave anything behind")
+}
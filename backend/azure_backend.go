@@ -0,0 +1,282 @@
+package backend
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AzureBackend reads data from a container in Azure Blob Storage, using the
+// REST API. Like S3Backend, it assumes the container is used like a
+// filesystem, with directories separated by /'s.
+type AzureBackend struct {
+	endpoint  string
+	container string
+	path      string
+	client    *http.Client
+}
+
+// NewAzureBackend creates an AzureBackend rooted at the given path in a
+// container. The endpoint is the URL of the storage account's blob service,
+// like https://myaccount.blob.core.windows.net, and the client is expected to
+// authenticate requests; see NewAzureClient.
+func NewAzureBackend(endpoint, container, azurePath string, client *http.Client) *AzureBackend {
+	return &AzureBackend{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		container: container,
+		path:      strings.TrimPrefix(path.Clean(azurePath), "/"),
+		client:    client,
+	}
+}
+
+type azureBlob struct {
+	Name          string `xml:"Name"`
+	LastModified  string `xml:"Properties>Last-Modified"`
+	ContentLength int64  `xml:"Properties>Content-Length"`
+	ContentMD5    string `xml:"Properties>Content-MD5"`
+}
+
+type azureBlobPrefix struct {
+	Name string `xml:"Name"`
+}
+
+type azureListResponse struct {
+	Blobs      []azureBlob       `xml:"Blobs>Blob"`
+	Prefixes   []azureBlobPrefix `xml:"Blobs>BlobPrefix"`
+	NextMarker string            `xml:"NextMarker"`
+}
+
+func (a *AzureBackend) ListDBs() ([]string, error) {
+	return a.listDirs(a.path, "")
+}
+
+func (a *AzureBackend) ListVersions(db, after string, checkForSuccess bool) ([]string, error) {
+	versions, err := a.listDirs(path.Join(a.path, db), after)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkForSuccess {
+		var filtered []string
+		for _, version := range versions {
+			successFile := path.Join(a.path, db, version, "_SUCCESS")
+			exists, err := a.exists(successFile)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				filtered = append(filtered, version)
+			}
+		}
+
+		versions = filtered
+	}
+
+	return versions, nil
+}
+
+// listDirs lists the "directories" directly under dir which sort after after.
+// Like GCS, Azure only returns a prefix if there are blobs under it.
+func (a *AzureBackend) listDirs(dir, after string) ([]string, error) {
+	var res []string
+	err := a.list(prefixOf(dir), "/", func(page *azureListResponse) {
+		for _, p := range page.Prefixes {
+			name := path.Base(strings.TrimSuffix(p.Name, "/"))
+			if strings.TrimSpace(name) != "" && name > after {
+				res = append(res, name)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+func (a *AzureBackend) ListFiles(db, version string) ([]string, error) {
+	var res []string
+	err := a.list(prefixOf(path.Join(a.path, db, version)), "/", func(page *azureListResponse) {
+		for _, blob := range page.Blobs {
+			name := path.Base(blob.Name)
+			// Skip placeholder blobs for the "directory" itself.
+			if strings.HasSuffix(blob.Name, "/") || strings.TrimSpace(name) == "" {
+				continue
+			}
+
+			if !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") {
+				res = append(res, name)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+// VersionModTime returns the latest modification time of any of the blobs
+// under the version, since Azure doesn't have real directories.
+func (a *AzureBackend) VersionModTime(db, version string) (time.Time, error) {
+	var modTime time.Time
+	var parseErr error
+	err := a.list(prefixOf(path.Join(a.path, db, version)), "", func(page *azureListResponse) {
+		for _, blob := range page.Blobs {
+			t, err := http.ParseTime(blob.LastModified)
+			if err != nil {
+				parseErr = fmt.Errorf("parsing modification time of %s: %s", blob.Name, err)
+				continue
+			}
+
+			if t.After(modTime) {
+				modTime = t
+			}
+		}
+	})
+
+	if err == nil && parseErr != nil {
+		err = a.azureError(parseErr)
+	}
+
+	return modTime, err
+}
+
+// Fingerprints uses the size and Content-MD5 of each blob. Blobs that were
+// uploaded without a Content-MD5 can't be fingerprinted, since Azure's ETags
+// are different for every blob, even if the contents are the same.
+func (a *AzureBackend) Fingerprints(db, version string) (map[string]string, error) {
+	res := make(map[string]string)
+	err := a.list(prefixOf(path.Join(a.path, db, version)), "/", func(page *azureListResponse) {
+		for _, blob := range page.Blobs {
+			name := path.Base(blob.Name)
+			if blob.ContentMD5 != "" && !strings.HasSuffix(blob.Name, "/") && strings.TrimSpace(name) != "" {
+				res[name] = fmt.Sprintf("%d-%s", blob.ContentLength, blob.ContentMD5)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (a *AzureBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	src := path.Join(a.path, db, version, file)
+	resp, err := a.client.Get(a.blobURL(src))
+	if err != nil {
+		return nil, fmt.Errorf("error opening Azure path %s: %s", a.displayURL(src), err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error opening Azure path %s: %s", a.displayURL(src), resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (a *AzureBackend) DisplayPath(parts ...string) string {
+	allParts := append([]string{a.path}, parts...)
+	return a.displayURL(allParts...)
+}
+
+func (a *AzureBackend) displayURL(parts ...string) string {
+	key := strings.TrimPrefix(path.Join(parts...), "/")
+	host := a.endpoint
+	if u, err := url.Parse(a.endpoint); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	return fmt.Sprintf("wasbs://%s@%s/%s", a.container, host, key)
+}
+
+// list calls fn with each page of the blobs under prefix. If delimiter is
+// set, blobs in "subdirectories" are returned as prefixes instead.
+func (a *AzureBackend) list(prefix, delimiter string, fn func(page *azureListResponse)) error {
+	marker := ""
+	for {
+		params := url.Values{}
+		params.Set("restype", "container")
+		params.Set("comp", "list")
+		params.Set("prefix", prefix)
+		if delimiter != "" {
+			params.Set("delimiter", delimiter)
+		}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+
+		listURL := fmt.Sprintf("%s/%s?%s", a.endpoint, url.PathEscape(a.container), params.Encode())
+		resp, err := a.client.Get(listURL)
+		if err != nil {
+			return a.azureError(err)
+		}
+
+		page := &azureListResponse{}
+		err = decodeAzureResponse(resp, page)
+		if err != nil {
+			return a.azureError(err)
+		}
+
+		fn(page)
+		if page.NextMarker == "" {
+			break
+		}
+
+		marker = page.NextMarker
+	}
+
+	return nil
+}
+
+func (a *AzureBackend) exists(name string) (bool, error) {
+	resp, err := a.client.Head(a.blobURL(name))
+	if err != nil {
+		return false, a.azureError(err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, a.azureError(fmt.Errorf("checking %s: %s", a.displayURL(name), resp.Status))
+	}
+}
+
+func (a *AzureBackend) blobURL(name string) string {
+	u := url.URL{Path: path.Join("/", a.container, name)}
+	return a.endpoint + u.EscapedPath()
+}
+
+func (a *AzureBackend) azureError(err error) error {
+	return fmt.Errorf("unexpected Azure error on container %s: %s", a.container, err)
+}
+
+func decodeAzureResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("%s %s", resp.Request.URL.Path, resp.Status)
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type azureTestListResponse struct {
+	XMLName    xml.Name `xml:"EnumerationResults"`
+	Blobs      azureTestBlobs
+	NextMarker string `xml:"NextMarker"`
+}
+
+type azureTestBlobs struct {
+	XMLName  xml.Name          `xml:"Blobs"`
+	Blobs    []azureBlob       `xml:"Blob"`
+	Prefixes []azureBlobPrefix `xml:"BlobPrefix"`
+}
+
+// fakeAzure serves just enough of the Blob Storage REST API for AzureBackend,
+// returning one blob or prefix per page to exercise pagination.
+func fakeAzure(t *testing.T, blobs map[string]string, updated time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const blobPrefix = "/container/"
+		if strings.HasPrefix(r.URL.Path, blobPrefix) {
+			data, ok := blobs[strings.TrimPrefix(r.URL.Path, blobPrefix)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+			} else if r.Method == "GET" {
+				w.Write([]byte(data))
+			}
+
+			return
+		}
+
+		require.Equal(t, "/container", r.URL.Path)
+		require.Equal(t, "container", r.URL.Query().Get("restype"))
+		require.Equal(t, "list", r.URL.Query().Get("comp"))
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+
+		var entries []string
+		seen := make(map[string]bool)
+		for name := range blobs {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			rest := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(rest, "/"); delimiter != "" && i >= 0 {
+				name = prefix + rest[:i+1]
+			}
+
+			if !seen[name] {
+				seen[name] = true
+				entries = append(entries, name)
+			}
+		}
+
+		sort.Strings(entries)
+		page := azureTestListResponse{}
+		start, _ := strconv.Atoi(r.URL.Query().Get("marker"))
+		if start < len(entries) {
+			entry := entries[start]
+			if strings.HasSuffix(entry, "/") {
+				page.Blobs.Prefixes = []azureBlobPrefix{{Name: entry}}
+			} else {
+				page.Blobs.Blobs = []azureBlob{{Name: entry, LastModified: updated.Format(http.TimeFormat)}}
+			}
+
+			if start+1 < len(entries) {
+				page.NextMarker = strconv.Itoa(start + 1)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(page)
+	}))
+}
+
+func TestAzureBackend(t *testing.T) {
+	updated := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := fakeAzure(t, map[string]string{
+		"test/baby-names/0/part-00000": "foo",
+		"test/baby-names/1/_SUCCESS":   "",
+		"test/baby-names/1/part-00000": "foo",
+		"test/baby-names/1/part-00001": "bar",
+		"test/baby-names/2/part-00000": "baz",
+		"test/other/1/part-00000":      "qux",
+	}, updated)
+	defer server.Close()
+
+	backend := NewAzureBackend(server.URL, "container", "/test", http.DefaultClient)
+
+	dbs, err := backend.ListDBs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"baby-names", "other"}, dbs)
+
+	versions, err := backend.ListVersions("baby-names", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "2"}, versions)
+
+	versions, err = backend.ListVersions("baby-names", "0", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, versions, "only versions after the given one should be listed")
+
+	versions, err = backend.ListVersions("baby-names", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions, "only versions with a _SUCCESS file should be listed")
+
+	files, err := backend.ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"part-00000", "part-00001"}, files)
+
+	modTime, err := backend.VersionModTime("baby-names", "1")
+	require.NoError(t, err)
+	assert.True(t, updated.Equal(modTime))
+
+	r, err := backend.Open("baby-names", "1", "part-00001")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "bar", string(data))
+
+	_, err = backend.Open("baby-names", "1", "part-00002")
+	assert.Error(t, err, "opening a missing file should fail")
+
+	assert.Equal(t, "wasbs://container@"+strings.TrimPrefix(server.URL, "http://")+"/test/baby-names",
+		backend.DisplayPath("baby-names"))
+}
+
+func TestAzureSharedKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://myaccount.blob.core.windows.net/container?restype=container&comp=list&prefix=test%2F", nil)
+	req.Header.Set("x-ms-date", "Mon, 02 Jan 2017 03:04:05 GMT")
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	signer := &azureSharedKey{account: "myaccount", key: []byte("secret")}
+	expected := "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Mon, 02 Jan 2017 03:04:05 GMT\n" +
+		"x-ms-version:" + azureAPIVersion + "\n" +
+		"/myaccount/container\ncomp:list\nprefix:test/\nrestype:container"
+	assert.Equal(t, expected, signer.stringToSign(req))
+	assert.True(t, strings.HasPrefix(signer.authorization(req), "SharedKey myaccount:"))
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	requests := 0
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "true", r.Header.Get("Metadata"), "the metadata header should be set")
+		assert.Equal(t, azureStorageResource, r.URL.Query().Get("resource"))
+		assert.Equal(t, "my-identity", r.URL.Query().Get("client_id"))
+		w.Write([]byte(`{"access_token": "token", "expires_in": "3600"}`))
+	}))
+	defer imds.Close()
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, azureAPIVersion, r.Header.Get("x-ms-version"))
+		assert.NotEmpty(t, r.Header.Get("x-ms-date"))
+	}))
+	defer storage.Close()
+
+	client, err := NewAzureClient("myaccount", "", "my-identity")
+	require.NoError(t, err)
+	client.Transport.(*azureTransport).tokens.url = imds.URL
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(storage.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, 1, requests, "the token should be cached")
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureAPIVersion       = "2019-12-12"
+	azureStorageResource  = "https://storage.azure.com/"
+	azureMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// NewAzureClient returns an http.Client that authenticates requests to Azure
+// Blob Storage for the given storage account. If accountKey is set, or the
+// AZURE_STORAGE_KEY env variable is, requests are signed with the account key.
+// Otherwise, the client uses the VM's managed identity; clientID selects a
+// user-assigned identity, if there's more than one.
+func NewAzureClient(account, accountKey, clientID string) (*http.Client, error) {
+	if accountKey == "" {
+		accountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+
+	t := &azureTransport{base: http.DefaultTransport}
+	if accountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("parsing account key: %s", err)
+		}
+
+		t.signer = &azureSharedKey{account: account, key: key}
+	} else {
+		t.tokens = &azureTokenSource{
+			client:   &http.Client{Timeout: 30 * time.Second},
+			url:      azureMetadataTokenURL,
+			clientID: clientID,
+		}
+	}
+
+	return &http.Client{Transport: t}, nil
+}
+
+// azureTransport adds the headers Azure requires to each request, and either
+// signs it with the account key or adds a managed identity access token.
+type azureTransport struct {
+	signer *azureSharedKey
+	tokens *azureTokenSource
+	base   http.RoundTripper
+}
+
+func (t *azureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers aren't supposed to modify the request.
+	authed := new(http.Request)
+	*authed = *req
+	authed.Header = make(http.Header, len(req.Header)+3)
+	for k, v := range req.Header {
+		authed.Header[k] = v
+	}
+
+	authed.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	authed.Header.Set("x-ms-version", azureAPIVersion)
+	if t.signer != nil {
+		authed.Header.Set("Authorization", t.signer.authorization(authed))
+	} else {
+		token, err := t.tokens.get()
+		if err != nil {
+			return nil, err
+		}
+
+		authed.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.base.RoundTrip(authed)
+}
+
+// azureSharedKey signs requests with a storage account key.
+type azureSharedKey struct {
+	account string
+	key     []byte
+}
+
+func (s *azureSharedKey) authorization(req *http.Request) string {
+	mac := hmac.New(sha256.New, s.key)
+	io.WriteString(mac, s.stringToSign(req))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedKey %s:%s", s.account, sig)
+}
+
+// stringToSign builds the string that's signed for Shared Key authorization.
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key.
+func (s *azureSharedKey) stringToSign(req *http.Request) string {
+	contentLength := req.Header.Get("Content-Length")
+	if contentLength == "0" {
+		contentLength = ""
+	}
+
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; we always set x-ms-date instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var msHeaders []string
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+
+	sort.Strings(msHeaders)
+	lines = append(lines, msHeaders...)
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k, v := range query {
+		sorted := append([]string(nil), v...)
+		sort.Strings(sorted)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(sorted, ","))
+	}
+
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	return strings.Join(append(lines, resource), "\n")
+}
+
+type azureToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"`
+}
+
+// azureTokenSource fetches managed identity access tokens from the instance
+// metadata service, and caches them until shortly before they expire.
+type azureTokenSource struct {
+	client   *http.Client
+	url      string
+	clientID string
+
+	token   string
+	expires time.Time
+	lock    sync.Mutex
+}
+
+func (ts *azureTokenSource) get() (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	params := url.Values{}
+	params.Set("api-version", "2018-02-01")
+	params.Set("resource", azureStorageResource)
+	if ts.clientID != "" {
+		params.Set("client_id", ts.clientID)
+	}
+
+	req, _ := http.NewRequest("GET", ts.url+"?"+params.Encode(), nil)
+	req.Header.Set("Metadata", "true")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching Azure access token: %s", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("fetching Azure access token: %s", resp.Status)
+	}
+
+	token := azureToken{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("fetching Azure access token: %s", err)
+	} else if token.AccessToken == "" {
+		return "", errors.New("fetching Azure access token: empty token")
+	}
+
+	// IMDS returns expires_in as a string.
+	expiresIn, _ := strconv.Atoi(token.ExpiresIn)
+	ts.token = token.AccessToken
+	ts.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
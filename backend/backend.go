@@ -1,11 +1,13 @@
 package backend
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Backend interface {
@@ -22,6 +24,9 @@ type Backend interface {
 	// and version. It excludes files that begin with '_' or '.'.
 	ListFiles(db, version string) ([]string, error)
 
+	// VersionModTime returns the time a version of a db was last modified.
+	VersionModTime(db, version string) (time.Time, error)
+
 	// Open returns an io.ReadCloser for a given file from a specific version
 	// of a db.
 	Open(db, version, file string) (io.ReadCloser, error)
@@ -31,6 +36,25 @@ type Backend interface {
 	DisplayPath(parts ...string) string
 }
 
+// A Fingerprinter is a Backend that can cheaply identify the contents of the
+// files in a version, using metadata like the size and checksum, without
+// reading them. Files with the same fingerprint are assumed to be identical,
+// even in different versions or databases.
+type Fingerprinter interface {
+	// Fingerprints returns a fingerprint for each of the files in a version,
+	// keyed by name. Files that can't be fingerprinted are left out.
+	Fingerprints(db, version string) (map[string]string, error)
+}
+
+// A Checksummer is a Backend that knows the MD5 of some of the files in a
+// version without reading them, so that they can be checked after they're
+// downloaded.
+type Checksummer interface {
+	// Checksums returns the hex MD5 of each of the files in a version that it's
+	// known for, keyed by name.
+	Checksums(db, version string) (map[string]string, error)
+}
+
 // A basic backend for the local filesystem
 type LocalBackend struct {
 	path string
@@ -97,6 +121,34 @@ func (lb *LocalBackend) ListFiles(db, version string) ([]string, error) {
 	return res, nil
 }
 
+func (lb *LocalBackend) VersionModTime(db, version string) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(lb.path, db, version))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// Fingerprints uses the size and modification time of each file, which are
+// preserved if files are hard linked or copied with their attributes between
+// versions.
+func (lb *LocalBackend) Fingerprints(db, version string) (map[string]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(lb.path, db, version))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			res[info.Name()] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return res, nil
+}
+
 func (lb *LocalBackend) Open(db, version, file string) (io.ReadCloser, error) {
 	return os.Open(filepath.Join(lb.path, db, version, file))
 }
@@ -20,3 +20,10 @@ func TestBackendCheckForSuccess(t *testing.T) {
 	require.NoError(t, err)
 	assert.Empty(t, versions)
 }
+
+func TestBackendVersionModTime(t *testing.T) {
+	backend := NewLocalBackend("../test")
+	modTime, err := backend.VersionModTime("baby-names", "1")
+	require.NoError(t, err)
+	assert.False(t, modTime.IsZero())
+}
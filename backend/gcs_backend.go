@@ -0,0 +1,270 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const gcsEndpoint = "https://storage.googleapis.com/storage/v1"
+
+// GCSBackend reads data from Google Cloud Storage, using the JSON API. Like
+// S3Backend, it assumes the bucket is used like a filesystem, with directories
+// separated by /'s.
+type GCSBackend struct {
+	bucket   string
+	path     string
+	client   *http.Client
+	endpoint string
+}
+
+// NewGCSBackend creates a GCSBackend rooted at the given path in a bucket.
+// The client is expected to authenticate requests; see NewGCSClient.
+func NewGCSBackend(bucket string, gcsPath string, client *http.Client) *GCSBackend {
+	return &GCSBackend{
+		bucket:   bucket,
+		path:     strings.TrimPrefix(path.Clean(gcsPath), "/"),
+		client:   client,
+		endpoint: gcsEndpoint,
+	}
+}
+
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+	Size    string    `json:"size"`
+	CRC32C  string    `json:"crc32c"`
+}
+
+type gcsListResponse struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+func (g *GCSBackend) ListDBs() ([]string, error) {
+	return g.listDirs(g.path, "")
+}
+
+func (g *GCSBackend) ListVersions(db, after string, checkForSuccess bool) ([]string, error) {
+	versions, err := g.listDirs(path.Join(g.path, db), after)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkForSuccess {
+		var filtered []string
+		for _, version := range versions {
+			successFile := path.Join(g.path, db, version, "_SUCCESS")
+			exists, err := g.exists(successFile)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				filtered = append(filtered, version)
+			}
+		}
+
+		versions = filtered
+	}
+
+	return versions, nil
+}
+
+// listDirs lists the "directories" directly under dir which sort after after.
+// Unlike S3, GCS only returns a prefix if there are objects under it, so
+// there's no need to check each one.
+func (g *GCSBackend) listDirs(dir, after string) ([]string, error) {
+	var res []string
+	err := g.list(prefixOf(dir), "/", func(page *gcsListResponse) {
+		for _, p := range page.Prefixes {
+			name := path.Base(strings.TrimSuffix(p, "/"))
+			if strings.TrimSpace(name) != "" && name > after {
+				res = append(res, name)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+func (g *GCSBackend) ListFiles(db, version string) ([]string, error) {
+	var res []string
+	err := g.list(prefixOf(path.Join(g.path, db, version)), "/", func(page *gcsListResponse) {
+		for _, obj := range page.Items {
+			name := path.Base(obj.Name)
+			// Skip placeholder objects for the "directory" itself.
+			if strings.HasSuffix(obj.Name, "/") || strings.TrimSpace(name) == "" {
+				continue
+			}
+
+			if !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") {
+				res = append(res, name)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+// VersionModTime returns the latest modification time of any of the objects
+// under the version, since GCS doesn't have real directories.
+func (g *GCSBackend) VersionModTime(db, version string) (time.Time, error) {
+	var modTime time.Time
+	err := g.list(prefixOf(path.Join(g.path, db, version)), "", func(page *gcsListResponse) {
+		for _, obj := range page.Items {
+			if obj.Updated.After(modTime) {
+				modTime = obj.Updated
+			}
+		}
+	})
+
+	return modTime, err
+}
+
+// Fingerprints uses the size and CRC32C checksum of each object, which GCS
+// keeps for every object, including composite ones.
+func (g *GCSBackend) Fingerprints(db, version string) (map[string]string, error) {
+	res := make(map[string]string)
+	err := g.list(prefixOf(path.Join(g.path, db, version)), "/", func(page *gcsListResponse) {
+		for _, obj := range page.Items {
+			name := path.Base(obj.Name)
+			if obj.CRC32C != "" && !strings.HasSuffix(obj.Name, "/") && strings.TrimSpace(name) != "" {
+				res[name] = obj.Size + "-" + obj.CRC32C
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (g *GCSBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	src := path.Join(g.path, db, version, file)
+	resp, err := g.client.Get(g.objectURL(src) + "?alt=media")
+	if err != nil {
+		return nil, fmt.Errorf("error opening GCS path %s: %s", g.displayURL(src), err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error opening GCS path %s: %s", g.displayURL(src), resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (g *GCSBackend) DisplayPath(parts ...string) string {
+	allParts := append([]string{g.path}, parts...)
+	return g.displayURL(allParts...)
+}
+
+func (g *GCSBackend) displayURL(parts ...string) string {
+	key := strings.TrimPrefix(path.Join(parts...), "/")
+	return fmt.Sprintf("gs://%s/%s", g.bucket, key)
+}
+
+// list calls fn with each page of the objects under prefix. If delimiter is
+// set, objects in "subdirectories" are returned as prefixes instead.
+func (g *GCSBackend) list(prefix, delimiter string, fn func(page *gcsListResponse)) error {
+	pageToken := ""
+	for {
+		params := url.Values{}
+		params.Set("prefix", prefix)
+		params.Set("fields", "items(name,updated,size,crc32c),prefixes,nextPageToken")
+		if delimiter != "" {
+			params.Set("delimiter", delimiter)
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		listURL := fmt.Sprintf("%s/b/%s/o?%s", g.endpoint, url.PathEscape(g.bucket), params.Encode())
+		resp, err := g.client.Get(listURL)
+		if err != nil {
+			return g.gcsError(err)
+		}
+
+		page := &gcsListResponse{}
+		err = decodeGCSResponse(resp, page)
+		if err != nil {
+			return g.gcsError(err)
+		}
+
+		fn(page)
+		if page.NextPageToken == "" {
+			break
+		}
+
+		pageToken = page.NextPageToken
+	}
+
+	return nil
+}
+
+func (g *GCSBackend) exists(name string) (bool, error) {
+	resp, err := g.client.Get(g.objectURL(name) + "?fields=name")
+	if err != nil {
+		return false, g.gcsError(err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, g.gcsError(fmt.Errorf("checking %s: %s", g.displayURL(name), resp.Status))
+	}
+}
+
+func (g *GCSBackend) objectURL(name string) string {
+	return fmt.Sprintf("%s/b/%s/o/%s", g.endpoint, url.PathEscape(g.bucket), url.PathEscape(name))
+}
+
+func (g *GCSBackend) gcsError(err error) error {
+	return fmt.Errorf("unexpected GCS error on bucket %s: %s", g.bucket, err)
+}
+
+// prefixOf returns the listing prefix for the "directory" dir. The bucket root
+// is the empty prefix.
+func prefixOf(dir string) string {
+	if dir == "" || dir == "." {
+		return ""
+	}
+
+	return dir + "/"
+}
+
+func decodeGCSResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("%s %s", resp.Request.URL.Path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCS serves just enough of the GCS JSON API for GCSBackend, returning
+// one item or prefix per page to exercise pagination.
+func fakeGCS(t *testing.T, objects map[string]string, updated time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const objectPrefix = "/b/bucket/o/"
+		if strings.HasPrefix(r.URL.Path, objectPrefix) {
+			data, ok := objects[strings.TrimPrefix(r.URL.Path, objectPrefix)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+			} else if r.URL.Query().Get("alt") == "media" {
+				w.Write([]byte(data))
+			} else {
+				w.Write([]byte("{}"))
+			}
+
+			return
+		}
+
+		require.Equal(t, "/b/bucket/o", r.URL.Path)
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+
+		var entries []string
+		seen := make(map[string]bool)
+		for name := range objects {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			rest := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(rest, "/"); delimiter != "" && i >= 0 {
+				name = prefix + rest[:i+1]
+			}
+
+			if !seen[name] {
+				seen[name] = true
+				entries = append(entries, name)
+			}
+		}
+
+		sort.Strings(entries)
+		page := gcsListResponse{}
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		if start < len(entries) {
+			entry := entries[start]
+			if strings.HasSuffix(entry, "/") {
+				page.Prefixes = []string{entry}
+			} else {
+				page.Items = []gcsObject{{Name: entry, Updated: updated}}
+			}
+
+			if start+1 < len(entries) {
+				page.NextPageToken = strconv.Itoa(start + 1)
+			}
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}))
+}
+
+func TestGCSBackend(t *testing.T) {
+	updated := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := fakeGCS(t, map[string]string{
+		"test/baby-names/0/part-00000": "foo",
+		"test/baby-names/1/_SUCCESS":   "",
+		"test/baby-names/1/part-00000": "foo",
+		"test/baby-names/1/part-00001": "bar",
+		"test/baby-names/2/part-00000": "baz",
+		"test/other/1/part-00000":      "qux",
+	}, updated)
+	defer server.Close()
+
+	backend := NewGCSBackend("bucket", "/test", http.DefaultClient)
+	backend.endpoint = server.URL
+
+	dbs, err := backend.ListDBs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"baby-names", "other"}, dbs)
+
+	versions, err := backend.ListVersions("baby-names", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "2"}, versions)
+
+	versions, err = backend.ListVersions("baby-names", "0", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, versions, "only versions after the given one should be listed")
+
+	versions, err = backend.ListVersions("baby-names", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions, "only versions with a _SUCCESS file should be listed")
+
+	files, err := backend.ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"part-00000", "part-00001"}, files)
+
+	modTime, err := backend.VersionModTime("baby-names", "1")
+	require.NoError(t, err)
+	assert.True(t, updated.Equal(modTime))
+
+	r, err := backend.Open("baby-names", "1", "part-00001")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "bar", string(data))
+
+	_, err = backend.Open("baby-names", "1", "part-00002")
+	assert.Error(t, err, "opening a missing file should fail")
+
+	assert.Equal(t, "gs://bucket/test/baby-names", backend.DisplayPath("baby-names"))
+}
@@ -0,0 +1,230 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsScope            = "https://www.googleapis.com/auth/devstorage.read_only"
+	gcsDefaultTokenURI  = "https://oauth2.googleapis.com/token"
+	gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// NewGCSClient returns an http.Client that authenticates requests to GCS. If
+// credentialsFile is set, it should be a service account JSON key. Otherwise,
+// the client uses application default credentials: the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, then the file written by
+// 'gcloud auth application-default login', and finally the GCE metadata server.
+func NewGCSClient(credentialsFile string) (*http.Client, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	if credentialsFile == "" {
+		wellKnown := filepath.Join(os.Getenv("HOME"), ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(wellKnown); err == nil {
+			credentialsFile = wellKnown
+		}
+	}
+
+	ts := &gcsTokenSource{client: &http.Client{Timeout: 30 * time.Second}}
+	if credentialsFile != "" {
+		b, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(b, &ts.creds)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %s", credentialsFile, err)
+		}
+
+		switch ts.creds.Type {
+		case "service_account":
+			ts.key, err = parseGCSPrivateKey(ts.creds.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %s", credentialsFile, err)
+			}
+		case "authorized_user":
+		default:
+			return nil, fmt.Errorf("parsing %s: unknown credentials type %q", credentialsFile, ts.creds.Type)
+		}
+
+		if ts.creds.TokenURI == "" {
+			ts.creds.TokenURI = gcsDefaultTokenURI
+		}
+	}
+
+	return &http.Client{Transport: &gcsTransport{tokens: ts, base: http.DefaultTransport}}, nil
+}
+
+// gcsCredentials is the union of the fields in service account keys and the
+// credentials written by gcloud.
+type gcsCredentials struct {
+	Type string `json:"type"`
+
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// gcsTokenSource fetches OAuth2 access tokens, and caches them until shortly
+// before they expire.
+type gcsTokenSource struct {
+	creds  gcsCredentials
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	token   string
+	expires time.Time
+	lock    sync.Mutex
+}
+
+func (ts *gcsTokenSource) get() (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	var resp *http.Response
+	var err error
+	switch ts.creds.Type {
+	case "service_account":
+		var assertion string
+		assertion, err = ts.assertion()
+		if err != nil {
+			return "", err
+		}
+
+		resp, err = ts.client.PostForm(ts.creds.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	case "authorized_user":
+		resp, err = ts.client.PostForm(ts.creds.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {ts.creds.ClientID},
+			"client_secret": {ts.creds.ClientSecret},
+			"refresh_token": {ts.creds.RefreshToken},
+		})
+	default:
+		req, _ := http.NewRequest("GET", gcsMetadataTokenURL, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = ts.client.Do(req)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("fetching GCS access token: %s", err)
+	}
+
+	token := gcsToken{}
+	err = decodeGCSResponse(resp, &token)
+	if err != nil {
+		return "", fmt.Errorf("fetching GCS access token: %s", err)
+	} else if token.AccessToken == "" {
+		return "", errors.New("fetching GCS access token: empty token")
+	}
+
+	ts.token = token.AccessToken
+	ts.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
+
+// assertion builds a signed JWT for the service account, to exchange for an
+// access token.
+func (ts *gcsTokenSource) assertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   ts.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func parseGCSPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// gcsTransport adds an access token to each request.
+type gcsTransport struct {
+	tokens *gcsTokenSource
+	base   http.RoundTripper
+}
+
+func (t *gcsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers aren't supposed to modify the request.
+	authed := new(http.Request)
+	*authed = *req
+	authed.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authed.Header[k] = v
+	}
+
+	authed.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	return t.base.RoundTrip(authed)
+}
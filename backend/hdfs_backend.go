@@ -5,6 +5,7 @@ import (
 	"io"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/colinmarc/hdfs"
 )
@@ -80,6 +81,15 @@ func (h *HdfsBackend) ListFiles(db, version string) ([]string, error) {
 	return res, nil
 }
 
+func (h *HdfsBackend) VersionModTime(db, version string) (time.Time, error) {
+	info, err := h.client.Stat(path.Join(h.path, db, version))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
 func (h *HdfsBackend) Open(db, version, file string) (io.ReadCloser, error) {
 	src := path.Join(h.path, db, version, file)
 
@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MultiBackend merges several backends into a single namespace of DBs. Each
+// DB must be found in exactly one of them; the rest of the methods are routed
+// to the backend that has the DB.
+type MultiBackend struct {
+	backends []Backend
+
+	owners     map[string]Backend
+	ownersLock sync.RWMutex
+}
+
+func NewMultiBackend(backends ...Backend) *MultiBackend {
+	return &MultiBackend{
+		backends: backends,
+		owners:   make(map[string]Backend),
+	}
+}
+
+// ListDBs lists the DBs in every backend. If two backends have a DB by the
+// same name, it returns an error.
+func (m *MultiBackend) ListDBs() ([]string, error) {
+	owners := make(map[string]Backend)
+	var res []string
+	for _, b := range m.backends {
+		dbs, err := b.ListDBs()
+		if err != nil {
+			return nil, fmt.Errorf("listing DBs from %s: %s", b.DisplayPath(), err)
+		}
+
+		for _, db := range dbs {
+			if other, ok := owners[db]; ok {
+				return nil, fmt.Errorf("db %s exists in both %s and %s", db, other.DisplayPath(), b.DisplayPath())
+			}
+
+			owners[db] = b
+			res = append(res, db)
+		}
+	}
+
+	m.ownersLock.Lock()
+	m.owners = owners
+	m.ownersLock.Unlock()
+
+	sort.Strings(res)
+	return res, nil
+}
+
+func (m *MultiBackend) ListVersions(db, after string, checkForSuccess bool) ([]string, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.ListVersions(db, after, checkForSuccess)
+}
+
+func (m *MultiBackend) ListFiles(db, version string) ([]string, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.ListFiles(db, version)
+}
+
+func (m *MultiBackend) VersionModTime(db, version string) (time.Time, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return b.VersionModTime(db, version)
+}
+
+// Fingerprints routes to the backend that has the DB. If that backend isn't a
+// Fingerprinter, it returns no fingerprints, and the version is loaded in full.
+func (m *MultiBackend) Fingerprints(db, version string) (map[string]string, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprinter, ok := b.(Fingerprinter)
+	if !ok {
+		return nil, nil
+	}
+
+	return fingerprinter.Fingerprints(db, version)
+}
+
+// Checksums routes to the backend that has the DB. If that backend isn't a
+// Checksummer, it returns no checksums.
+func (m *MultiBackend) Checksums(db, version string) (map[string]string, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return nil, err
+	}
+
+	checksummer, ok := b.(Checksummer)
+	if !ok {
+		return nil, nil
+	}
+
+	return checksummer.Checksums(db, version)
+}
+
+// Release routes to the backend that has the DB. If that backend isn't a
+// Releaser, there's nothing to release.
+func (m *MultiBackend) Release(db, version string) error {
+	b, err := m.owner(db)
+	if err != nil {
+		return err
+	}
+
+	releaser, ok := b.(Releaser)
+	if !ok {
+		return nil
+	}
+
+	return releaser.Release(db, version)
+}
+
+func (m *MultiBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	b, err := m.owner(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Open(db, version, file)
+}
+
+// DisplayPath returns the path from the backend that has the DB, if the first
+// part names one. Otherwise, it lists the roots of all the backends.
+func (m *MultiBackend) DisplayPath(parts ...string) string {
+	if len(parts) > 0 && parts[0] != "" {
+		m.ownersLock.RLock()
+		b, ok := m.owners[parts[0]]
+		m.ownersLock.RUnlock()
+
+		if ok {
+			return b.DisplayPath(parts...)
+		}
+	}
+
+	roots := make([]string, 0, len(m.backends))
+	for _, b := range m.backends {
+		roots = append(roots, b.DisplayPath(parts...))
+	}
+
+	return strings.Join(roots, ", ")
+}
+
+// owner returns the backend that has the given DB, listing the DBs again if
+// it's one we haven't seen yet.
+func (m *MultiBackend) owner(db string) (Backend, error) {
+	m.ownersLock.RLock()
+	b, ok := m.owners[db]
+	m.ownersLock.RUnlock()
+	if ok {
+		return b, nil
+	}
+
+	_, err := m.ListDBs()
+	if err != nil {
+		return nil, err
+	}
+
+	m.ownersLock.RLock()
+	b, ok = m.owners[db]
+	m.ownersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("db %s doesn't exist in any source", db)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createSource(t *testing.T, dbs ...string) string {
+	root, err := ioutil.TempDir("", "sequins-source-")
+	require.NoError(t, err)
+
+	for _, db := range dbs {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, db, "1"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, db, "1", "part-00000"), []byte(db), 0644))
+	}
+
+	return root
+}
+
+func TestMultiBackend(t *testing.T) {
+	prod := createSource(t, "foo", "bar")
+	defer os.RemoveAll(prod)
+	staging := createSource(t, "baz")
+	defer os.RemoveAll(staging)
+
+	backend := NewMultiBackend(NewLocalBackend(prod), NewLocalBackend(staging))
+	dbs, err := backend.ListDBs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "baz", "foo"}, dbs)
+
+	versions, err := backend.ListVersions("baz", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions)
+
+	r, err := backend.Open("baz", "1", "part-00000")
+	require.NoError(t, err)
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "baz", string(b), "the file should be read from the source with the db")
+	assert.Equal(t, filepath.Join(staging, "baz", "1"), backend.DisplayPath("baz", "1"))
+
+	_, err = backend.ListFiles("qux", "1")
+	assert.Error(t, err, "a db that isn't in any source should be an error")
+}
+
+func TestMultiBackendCollision(t *testing.T) {
+	prod := createSource(t, "foo", "bar")
+	defer os.RemoveAll(prod)
+	staging := createSource(t, "foo")
+	defer os.RemoveAll(staging)
+
+	backend := NewMultiBackend(NewLocalBackend(prod), NewLocalBackend(staging))
+	_, err := backend.ListDBs()
+	assert.Error(t, err, "a db in two sources should be an error")
+}
@@ -6,6 +6,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -153,6 +154,100 @@ func (s *S3Backend) ListFiles(db, version string) ([]string, error) {
 	return sorted, nil
 }
 
+// VersionModTime returns the latest modification time of any of the keys
+// under the version, since S3 doesn't have real directories.
+func (s *S3Backend) VersionModTime(db, version string) (time.Time, error) {
+	var modTime time.Time
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String(""),
+		MaxKeys:   aws.Int64(1000),
+		Prefix:    aws.String(path.Join(s.path, db, version) + "/"),
+	}
+
+	err := s.svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, isLastPage bool) bool {
+		for _, key := range page.Contents {
+			if key.LastModified != nil && key.LastModified.After(modTime) {
+				modTime = *key.LastModified
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return modTime, s.s3error(err)
+	}
+
+	return modTime, nil
+}
+
+// Fingerprints uses the size and ETag of each key. The ETag is the MD5 of the
+// contents, unless the file was uploaded in multiple parts.
+func (s *S3Backend) Fingerprints(db, version string) (map[string]string, error) {
+	versionPrefix := path.Join(s.path, db, version) + "/"
+	res := make(map[string]string)
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(1000),
+		Prefix:    aws.String(versionPrefix),
+	}
+
+	err := s.svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, isLastPage bool) bool {
+		for _, key := range page.Contents {
+			name := path.Base(*key.Key)
+			if key.ETag != nil && key.Size != nil && strings.TrimSpace(name) != "" {
+				res[name] = fmt.Sprintf("%d-%s", *key.Size, strings.Trim(*key.ETag, `"`))
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, s.s3error(err)
+	}
+
+	return res, nil
+}
+
+// Checksums uses the ETag of each key, which is the MD5 of the contents for
+// files uploaded in a single part. Files uploaded in multiple parts have ETags
+// with a '-' in them, and are left out.
+func (s *S3Backend) Checksums(db, version string) (map[string]string, error) {
+	versionPrefix := path.Join(s.path, db, version) + "/"
+	res := make(map[string]string)
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(1000),
+		Prefix:    aws.String(versionPrefix),
+	}
+
+	err := s.svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, isLastPage bool) bool {
+		for _, key := range page.Contents {
+			name := path.Base(*key.Key)
+			if key.ETag == nil || strings.TrimSpace(name) == "" {
+				continue
+			}
+
+			etag := strings.ToLower(strings.Trim(*key.ETag, `"`))
+			if !strings.Contains(etag, "-") {
+				res[name] = etag
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, s.s3error(err)
+	}
+
+	return res, nil
+}
+
 func (s *S3Backend) Open(db, version, file string) (io.ReadCloser, error) {
 	src := path.Join(s.path, db, version, file)
 	params := &s3.GetObjectInput{
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type s3ListResponse struct {
+	XMLName        xml.Name   `xml:"ListBucketResult"`
+	IsTruncated    bool       `xml:"IsTruncated"`
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []s3Prefix `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// fakeS3 serves just enough of the S3 API for S3Backend, with path-style
+// addressing, like an S3-compatible store would.
+func fakeS3(t *testing.T, objects map[string]string, updated time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, strings.HasPrefix(r.URL.Path, "/bucket"), "requests should use path-style addressing")
+
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+		if key != "" {
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			} else {
+				w.Write([]byte(data))
+			}
+
+			return
+		}
+
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+		marker := r.URL.Query().Get("marker")
+
+		var names []string
+		for name := range objects {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		page := s3ListResponse{}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if !strings.HasPrefix(name, prefix) || name <= marker {
+				continue
+			}
+
+			rest := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+				commonPrefix := prefix + rest[:i+1]
+				if !seen[commonPrefix] {
+					seen[commonPrefix] = true
+					page.CommonPrefixes = append(page.CommonPrefixes, s3Prefix{commonPrefix})
+				}
+			} else {
+				page.Contents = append(page.Contents, s3Object{Key: name, LastModified: updated})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(page)
+	}))
+}
+
+func TestS3BackendCustomEndpoint(t *testing.T) {
+	updated := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := fakeS3(t, map[string]string{
+		"data/foo/1/part-00000": "old",
+		"data/foo/2/_SUCCESS":   "",
+		"data/foo/2/part-00000": "hello",
+		"data/foo/2/part-00001": "world",
+		"data/bar/1/part-00000": "bar",
+	}, updated)
+	defer server.Close()
+
+	svc := s3.New(session.New(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+
+	s := NewS3Backend("bucket", "/data", svc)
+
+	dbs, err := s.ListDBs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, dbs)
+
+	versions, err := s.ListVersions("foo", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, versions)
+
+	versions, err = s.ListVersions("foo", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, versions, "only versions with a _SUCCESS file should be listed")
+
+	files, err := s.ListFiles("foo", "2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"part-00000", "part-00001"}, files)
+
+	modTime, err := s.VersionModTime("foo", "2")
+	require.NoError(t, err)
+	assert.True(t, updated.Equal(modTime), "the mod time should be correct")
+
+	f, err := s.Open("foo", "2", "part-00001")
+	require.NoError(t, err)
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	_, err = s.Open("foo", "2", "part-00002")
+	assert.Error(t, err, "opening a missing file should fail")
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// A VersionDirBackend serves a single db with a single version, read straight
+// from a local directory that's laid out like any version in a source. The
+// version is named after the directory. Since the directory is given
+// explicitly, it's always considered complete, whether or not it has a
+// _SUCCESS file.
+type VersionDirBackend struct {
+	db      string
+	version string
+	local   *LocalBackend
+}
+
+// NewVersionDirBackend creates a VersionDirBackend serving dir as the only
+// version of db.
+func NewVersionDirBackend(db, dir string) *VersionDirBackend {
+	dir = filepath.Clean(dir)
+	return &VersionDirBackend{
+		db:      db,
+		version: filepath.Base(dir),
+		local:   NewLocalBackend(filepath.Dir(dir)),
+	}
+}
+
+func (vb *VersionDirBackend) ListDBs() ([]string, error) {
+	return []string{vb.db}, nil
+}
+
+func (vb *VersionDirBackend) ListVersions(db, after string, checkForSuccess bool) ([]string, error) {
+	if db != vb.db || vb.version <= after {
+		return nil, nil
+	}
+
+	return []string{vb.version}, nil
+}
+
+// The rest of the methods are passed on to a LocalBackend rooted at the
+// directory's parent, with an empty db, so that the db name doesn't have to
+// match anything on disk.
+
+func (vb *VersionDirBackend) ListFiles(db, version string) ([]string, error) {
+	return vb.local.ListFiles("", version)
+}
+
+func (vb *VersionDirBackend) VersionModTime(db, version string) (time.Time, error) {
+	return vb.local.VersionModTime("", version)
+}
+
+func (vb *VersionDirBackend) Fingerprints(db, version string) (map[string]string, error) {
+	return vb.local.Fingerprints("", version)
+}
+
+func (vb *VersionDirBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	return vb.local.Open("", version, file)
+}
+
+func (vb *VersionDirBackend) DisplayPath(parts ...string) string {
+	if len(parts) > 0 {
+		parts = parts[1:]
+	}
+
+	return vb.local.DisplayPath(parts...)
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionDirBackend(t *testing.T) {
+	vb := NewVersionDirBackend("names", "../test/baby-names/1/")
+
+	dbs, err := vb.ListDBs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"names"}, dbs, "the db should be named as given, not after the directory")
+
+	versions, err := vb.ListVersions("names", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions, "the version should be listed even without a _SUCCESS file")
+
+	versions, err = vb.ListVersions("names", "1", false)
+	require.NoError(t, err)
+	assert.Empty(t, versions, "there should be nothing after the only version")
+
+	versions, err = vb.ListVersions("baby-names", "", false)
+	require.NoError(t, err)
+	assert.Empty(t, versions, "other dbs shouldn't have any versions")
+
+	expected, err := NewLocalBackend("../test").ListFiles("baby-names", "1")
+	require.NoError(t, err)
+	files, err := vb.ListFiles("names", "1")
+	require.NoError(t, err)
+	assert.Equal(t, expected, files, "the files in the directory should be listed")
+
+	stream, err := vb.Open("names", "1", files[0])
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(stream)
+	stream.Close()
+	require.NoError(t, err)
+
+	original, err := ioutil.ReadFile("../test/baby-names/1/" + files[0])
+	require.NoError(t, err)
+	assert.Equal(t, original, b, "the file should be read from the directory")
+}
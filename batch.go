@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// batchConcurrency is the number of keys in a batch that can be proxied to
+// peers at once.
+const batchConcurrency = 16
+
+// serveBatch handles POST /db, which fetches many keys from the current version
+// at once. The body is a JSON array of keys, and the response is a JSON object
+// mapping each key to its value, or null if it's missing. Values are base64
+// encoded, unless the db's 'value_encoding' is "raw".
+func (db *db) serveBatch(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	err := json.NewDecoder(r.Body).Decode(&keys)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !db.sequins.checkConverged(w, r) {
+		return
+	}
+
+	vs := db.mux.getCurrent()
+	if vs == nil {
+		setErrorCode(w, codeNoVersion)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	defer db.mux.release(vs)
+	vs.serveBatch(w, r, keys)
+}
+
+// serveBatch looks up each key locally, or, failing that, asks a peer that has
+// it, just like serveKey. If any key can't be fetched, or has a value larger
+// than 'max_value_size', the whole batch fails.
+func (vs *version) serveBatch(w http.ResponseWriter, r *http.Request, keys []string) {
+	values := make(map[string]*string, len(keys))
+	var remote []string
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			continue
+		}
+
+		values[key] = nil
+		if vs.numPartitions == 0 {
+			continue
+		}
+
+		normalized := string(vs.blockStore.NormalizeKey([]byte(key)))
+		partition, alternatePartition := vs.blockStore.KeyPartition([]byte(normalized))
+		if vs.partitions.have(partition) || vs.partitions.have(alternatePartition) {
+			value, err := vs.getLocal(normalized)
+			if err != nil {
+				vs.serveError(w, key, err)
+				return
+			}
+
+			values[key] = value
+		} else {
+			remote = append(remote, key)
+		}
+	}
+
+	// Proxy the rest concurrently, since there could be a lot of them.
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var proxyErr error
+	var proxyErrKey string
+	sem := make(chan bool, batchConcurrency)
+	for _, key := range remote {
+		wg.Add(1)
+		sem <- true
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// The peer normalizes the key itself, so it's sent as it was requested;
+			// not every normalization can be applied twice.
+			normalized := string(vs.blockStore.NormalizeKey([]byte(key)))
+			partition, alternatePartition := vs.blockStore.KeyPartition([]byte(normalized))
+			value, err := vs.getProxied(r, key, partition, alternatePartition)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && proxyErr == nil {
+				proxyErr = err
+				proxyErrKey = key
+			}
+
+			values[key] = value
+		}(key)
+	}
+
+	wg.Wait()
+	if proxyErr != nil {
+		vs.serveProxyError(w, proxyErrKey, proxyErr)
+		return
+	}
+
+	if vs.db.encodeValues() {
+		for key, value := range values {
+			if value != nil {
+				encoded := encodeValue([]byte(*value))
+				values[key] = &encoded
+			}
+		}
+	}
+
+	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(values)
+	if err != nil {
+		log.Printf("Error writing batch response for /%s (version %s): %s", vs.db.name, vs.name, err)
+	}
+}
+
+// getLocal reads the value for a key from the local blockStore. It returns nil
+// if the key is missing.
+func (vs *version) getLocal(key string) (*string, error) {
+	record, err := vs.blockStore.Get(key)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	defer record.Close()
+	if vs.sequins.tooLarge(record.ValueLen) {
+		return nil, errValueTooLarge
+	}
+
+	b, err := ioutil.ReadAll(record)
+	if err != nil {
+		return nil, err
+	}
+
+	value := string(b)
+	return &value, nil
+}
+
+// getProxied fetches the value for a key from a peer, in the same way as
+// serveProxied. It returns nil if the key is missing.
+func (vs *version) getProxied(r *http.Request, key string, partition, alternatePartition int) (*string, error) {
+	resp, _, err := vs.fetchProxied(vs.keyRequest(r, key), key, partition, alternatePartition)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, errValueTooLarge
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	value := string(b)
+	return &value, nil
+}
+
+// keyRequest returns a copy of r as a GET for a single key, which is what
+// proxying and falling back to the remote cluster expect.
+func (vs *version) keyRequest(r *http.Request, key string) *http.Request {
+	u := *r.URL
+	u.Path = "/" + vs.db.name + "/" + key
+	u.RawPath = ""
+	u.RawQuery = ""
+
+	keyRequest := new(http.Request)
+	*keyRequest = *r
+	keyRequest.Method = "GET"
+	keyRequest.URL = &u
+	keyRequest.Body = nil
+	return keyRequest
+}
@@ -3,6 +3,7 @@ package blocks
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 
@@ -17,24 +18,36 @@ import (
 //
 // So we can easily have blocks line up with files in a dataset.
 type Block struct {
-	ID        string
-	Name      string
-	Partition int
-	Count     int
-
-	minKey        []byte
-	maxKey        []byte
-	sparkeyReader *sparkey.HashReader
-	iterPool      iterPool
+	ID           string
+	Name         string
+	Partition    int
+	Count        int
+	MetadataName string
+	BloomName    string
+
+	// source is the file the block was built from, if the block store was built
+	// one file at a time. See SetSource.
+	source string
+
+	minKey         []byte
+	maxKey         []byte
+	sparkeyReader  *sparkey.HashReader
+	iterPool       iterPool
+	metadataReader *sparkey.HashReader
+	metadataPool   iterPool
+	bloom          *bloomFilter
 	sync.RWMutex
 }
 
 func loadBlock(storePath string, manifest BlockManifest) (*Block, error) {
 	b := &Block{
-		ID:        manifest.ID,
-		Name:      manifest.Name,
-		Partition: manifest.Partition,
-		Count:     manifest.Count,
+		ID:           manifest.ID,
+		Name:         manifest.Name,
+		Partition:    manifest.Partition,
+		Count:        manifest.Count,
+		MetadataName: manifest.MetadataName,
+		BloomName:    manifest.BloomName,
+		source:       manifest.Source,
 
 		minKey: manifest.MinKey,
 		maxKey: manifest.MaxKey,
@@ -47,6 +60,23 @@ func loadBlock(storePath string, manifest BlockManifest) (*Block, error) {
 
 	b.sparkeyReader = reader
 	b.iterPool = newIterPool(reader)
+
+	if b.MetadataName != "" {
+		err = b.openMetadata(storePath)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+
+	if b.BloomName != "" {
+		err = b.openBloomFilter(storePath)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+
 	return b, nil
 }
 
@@ -58,6 +88,8 @@ func (b *Block) Get(key []byte) (*Record, error) {
 		return nil, nil
 	} else if b.maxKey != nil && bytes.Compare(key, b.maxKey) > 0 {
 		return nil, nil
+	} else if b.bloom != nil && !b.bloom.mayContain(key) {
+		return nil, nil
 	}
 
 	return b.get(key)
@@ -68,15 +100,33 @@ func (b *Block) Close() {
 	defer b.Unlock()
 
 	b.sparkeyReader.Close()
+	if b.metadataReader != nil {
+		b.metadataReader.Close()
+	}
+}
+
+// delete removes the block's files. The block must already be closed.
+func (b *Block) delete(storePath string) {
+	os.Remove(filepath.Join(storePath, b.Name))
+	if b.MetadataName != "" {
+		os.Remove(filepath.Join(storePath, b.MetadataName))
+	}
+
+	if b.BloomName != "" {
+		os.Remove(filepath.Join(storePath, b.BloomName))
+	}
 }
 
 func (b *Block) manifest() BlockManifest {
 	return BlockManifest{
-		ID:        b.ID,
-		Name:      b.Name,
-		Partition: b.Partition,
-		Count:     b.Count,
-		MinKey:    b.minKey,
-		MaxKey:    b.maxKey,
+		ID:           b.ID,
+		Name:         b.Name,
+		Partition:    b.Partition,
+		Count:        b.Count,
+		MinKey:       b.minKey,
+		MaxKey:       b.maxKey,
+		MetadataName: b.MetadataName,
+		BloomName:    b.BloomName,
+		Source:       b.source,
 	}
 }
@@ -20,43 +20,75 @@ const NoCompression Compression = "none"
 // as a separate CDB file. The blocks are arranged and sorted in a way that
 // takes advantage of the way that the output of hadoop jobs are laid out.
 type BlockStore struct {
-	path          string
-	compression   Compression
-	blockSize     int
-	numPartitions int
+	path             string
+	compression      Compression
+	blockSize        int
+	numPartitions    int
+	keyNormalization []KeyNormalization
+	keyPrefix        KeyPrefix
+	partitionHash    PartitionHash
 
 	newBlocks map[int]*blockWriter
+	spilled   []*Block
 	Blocks    []*Block
 	BlockMap  map[int][]*Block
+	dropped   []*Block
+	replaced  []*Block
+
+	maxBlockEntries    int
+	peakIndexingMemory int64
+
+	bloomFalsePositiveRate float64
+
+	selected       map[int]bool
+	source         string
+	sourceFiles    map[string]string
+	pendingSources map[string]string
 
 	blockMapLock sync.RWMutex
 }
 
-func New(path string, numPartitions int, compression Compression, blockSize int) *BlockStore {
+func New(path string, numPartitions int, compression Compression, blockSize int, keyNormalization []KeyNormalization, keyPrefix KeyPrefix, partitionHash PartitionHash) *BlockStore {
 	return &BlockStore{
-		path:          path,
-		compression:   compression,
-		blockSize:     blockSize,
-		numPartitions: numPartitions,
+		path:             path,
+		compression:      compression,
+		blockSize:        blockSize,
+		numPartitions:    numPartitions,
+		keyNormalization: keyNormalization,
+		keyPrefix:        keyPrefix,
+		partitionHash:    partitionHash,
 
 		newBlocks: make(map[int]*blockWriter),
 		Blocks:    make([]*Block, 0),
 		BlockMap:  make(map[int][]*Block),
+
+		pendingSources: make(map[string]string),
+	}
+}
+
+// ReadManifest reads the manifest of the block store in a directory, without
+// loading any of the blocks.
+func ReadManifest(path string) (Manifest, error) {
+	manifest, err := readManifest(filepath.Join(path, ".manifest"))
+	if os.IsNotExist(err) {
+		return manifest, ErrNoManifest
 	}
+
+	return manifest, err
 }
 
 // NewFromManifest loads a block store from a directory with a manifest, and
 // returns it, the parsed manifest, and any error encountered while loading.
 func NewFromManifest(path string) (*BlockStore, Manifest, error) {
-	manifestPath := filepath.Join(path, ".manifest")
-	manifest, err := readManifest(manifestPath)
-	if os.IsNotExist(err) {
-		return nil, manifest, ErrNoManifest
-	} else if err != nil {
+	manifest, err := ReadManifest(path)
+	if err != nil {
 		return nil, manifest, err
 	}
 
-	store := New(path, manifest.NumPartitions, manifest.Compression, manifest.BlockSize)
+	store := New(path, manifest.NumPartitions, manifest.Compression, manifest.BlockSize,
+		manifest.KeyNormalization, manifest.KeyPrefix, manifest.PartitionHash)
+	store.selected = partitionSet(manifest.SelectedPartitions)
+	store.sourceFiles = manifest.SourceFiles
 	for _, blockManifest := range manifest.Blocks {
 		block, err := loadBlock(path, blockManifest)
 		if err != nil {
@@ -73,17 +105,11 @@ func NewFromManifest(path string) (*BlockStore, Manifest, error) {
 
 // Add adds a single key/value pair to the block store.
 func (store *BlockStore) Add(key, value []byte) error {
-	partition, _ := KeyPartition(key, store.numPartitions)
-
-	block, ok := store.newBlocks[partition]
-	var err error
-	if !ok {
-		block, err = newBlock(store.path, partition, store.compression, store.blockSize)
-		if err != nil {
-			return err
-		}
+	partition, _ := store.KeyPartition(key)
 
-		store.newBlocks[partition] = block
+	block, err := store.getNewBlock(partition)
+	if err != nil {
+		return err
 	}
 
 	err = block.add(key, value)
@@ -91,18 +117,62 @@ func (store *BlockStore) Add(key, value []byte) error {
 		return err
 	}
 
+	if store.maxBlockEntries > 0 && block.count >= store.maxBlockEntries {
+		return store.spill(partition, block)
+	}
+
 	return nil
 }
 
-// Save saves flushes any newly created blocks, and writes a manifest file to
-// the directory.
-func (store *BlockStore) Save(selectedPartitions map[int]bool) error {
+// AddMetadata adds a metadata blob for a key to the block store. It's stored
+// in the same block that the key's value is, or will be, added to, and is
+// returned with the value by Get. Keys don't need to have metadata.
+func (store *BlockStore) AddMetadata(key, metadata []byte) error {
+	partition, _ := store.KeyPartition(key)
+
+	block, err := store.getNewBlock(partition)
+	if err != nil {
+		return err
+	}
+
+	return block.addMetadata(key, metadata)
+}
+
+// getNewBlock returns the block being built for a partition, creating it if
+// there isn't one yet.
+func (store *BlockStore) getNewBlock(partition int) (*blockWriter, error) {
+	if block, ok := store.newBlocks[partition]; ok {
+		return block, nil
+	}
+
+	block, err := newBlock(store.path, partition, store.compression, store.blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	block.bloomFalsePositiveRate = store.bloomFalsePositiveRate
+	store.newBlocks[partition] = block
+	return block, nil
+}
+
+// Flush flushes any newly created blocks, making them available to Get,
+// without writing a manifest file.
+func (store *BlockStore) Flush() error {
 	store.blockMapLock.Lock()
 	defer store.blockMapLock.Unlock()
 
-	// Flush any buffered blocks.
+	return store.flush()
+}
+
+func (store *BlockStore) flush() error {
+	for _, savedBlock := range store.spilled {
+		store.Blocks = append(store.Blocks, savedBlock)
+		store.BlockMap[savedBlock.Partition] = append(store.BlockMap[savedBlock.Partition], savedBlock)
+	}
+
+	store.spilled = nil
 	for partition, block := range store.newBlocks {
-		savedBlock, err := block.save()
+		savedBlock, err := store.saveBlock(block)
 		if err != nil {
 			return err
 		}
@@ -112,6 +182,20 @@ func (store *BlockStore) Save(selectedPartitions map[int]bool) error {
 	}
 
 	store.newBlocks = make(map[int]*blockWriter)
+	return nil
+}
+
+// Save saves flushes any newly created blocks, and writes a manifest file to
+// the directory.
+func (store *BlockStore) Save(selectedPartitions map[int]bool) error {
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	// Flush any buffered blocks.
+	err := store.flush()
+	if err != nil {
+		return err
+	}
 
 	// Save the manifest.
 	var partitions []int
@@ -121,12 +205,31 @@ func (store *BlockStore) Save(selectedPartitions map[int]bool) error {
 	}
 
 	manifest := Manifest{
-		Version:            manifestVersion,
 		Blocks:             make([]BlockManifest, len(store.Blocks)),
 		NumPartitions:      store.numPartitions,
 		SelectedPartitions: partitions,
+		Compression:        store.compression,
+		BlockSize:          store.blockSize,
+		KeyNormalization:   store.keyNormalization,
+		KeyPrefix:          store.keyPrefix,
+		PartitionHash:      store.partitionHash,
+	}
+
+	store.selected = selectedPartitions
+	store.source = ""
+	if len(store.pendingSources) > 0 {
+		if store.sourceFiles == nil {
+			store.sourceFiles = make(map[string]string)
+		}
+
+		for name, fingerprint := range store.pendingSources {
+			store.sourceFiles[name] = fingerprint
+		}
+
+		store.pendingSources = make(map[string]string)
 	}
 
+	manifest.SourceFiles = store.sourceFiles
 	for i, block := range store.Blocks {
 		blockManifest := block.manifest()
 		manifest.Blocks[i] = blockManifest
@@ -147,7 +250,15 @@ func (store *BlockStore) Revert() {
 		block.delete()
 	}
 
+	for _, block := range store.spilled {
+		block.Close()
+		block.delete(store.path)
+	}
+
 	store.newBlocks = make(map[int]*blockWriter)
+	store.spilled = nil
+	store.source = ""
+	store.pendingSources = make(map[string]string)
 	return
 }
 
@@ -157,7 +268,7 @@ func (store *BlockStore) Get(key string) (*Record, error) {
 	store.blockMapLock.RLock()
 	defer store.blockMapLock.RUnlock()
 
-	partition, alternatePartition := KeyPartition([]byte(key), store.numPartitions)
+	partition, alternatePartition := store.KeyPartition([]byte(key))
 	if store.BlockMap[partition] == nil && store.BlockMap[alternatePartition] == nil {
 		return nil, ErrPartitionNotFound
 	}
@@ -188,6 +299,105 @@ func (store *BlockStore) Get(key string) (*Record, error) {
 	return nil, nil
 }
 
+// DropPartition removes the blocks for a partition from the store, so that
+// the partition can be added again from scratch. The dropped blocks are left
+// open until the store is closed, since records may still be being read from
+// them.
+func (store *BlockStore) DropPartition(partition int) {
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	blocks := make([]*Block, 0, len(store.Blocks))
+	for _, block := range store.Blocks {
+		if block.Partition == partition {
+			store.dropped = append(store.dropped, block)
+		} else {
+			blocks = append(blocks, block)
+		}
+	}
+
+	store.Blocks = blocks
+	delete(store.BlockMap, partition)
+}
+
+// GetDropped returns the value for a given key from the blocks that were
+// removed by DropPartition, if they have it. It's for serving stale data for a
+// partition that isn't available anywhere else, and returns nil if the key
+// isn't found.
+func (store *BlockStore) GetDropped(key string) (*Record, error) {
+	store.blockMapLock.RLock()
+	defer store.blockMapLock.RUnlock()
+
+	partition, alternatePartition := store.KeyPartition([]byte(key))
+	for _, block := range store.dropped {
+		if block.Partition != partition && block.Partition != alternatePartition {
+			continue
+		}
+
+		res, err := block.Get([]byte(key))
+		if err != nil {
+			return nil, err
+		} else if res != nil {
+			return res, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Replace swaps in the blocks of another store, which must have been built in
+// the same directory and already saved, in place of this store's blocks. The
+// replaced blocks are left open until the store is closed, since records may
+// still be being read from them, and their files are removed then. The other
+// store is left empty.
+func (store *BlockStore) Replace(other *BlockStore) {
+	other.blockMapLock.Lock()
+	defer other.blockMapLock.Unlock()
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	store.replaced = append(store.replaced, store.Blocks...)
+	store.Blocks = other.Blocks
+	store.BlockMap = other.BlockMap
+	store.selected = other.selected
+	store.sourceFiles = other.sourceFiles
+
+	other.Blocks = make([]*Block, 0)
+	other.BlockMap = make(map[int][]*Block)
+}
+
+// Discard closes the store and removes the files for all of its blocks,
+// including unsaved ones, but leaves the directory and manifest alone. It's
+// for cleaning up after a store built next to another one, in the same
+// directory, that isn't going to be used.
+func (store *BlockStore) Discard() {
+	store.Revert()
+
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	for _, block := range store.Blocks {
+		block.Close()
+		block.delete(store.path)
+	}
+
+	store.Blocks = make([]*Block, 0)
+	store.BlockMap = make(map[int][]*Block)
+}
+
+// NumKeys returns the number of keys stored in flushed blocks.
+func (store *BlockStore) NumKeys() int {
+	store.blockMapLock.RLock()
+	defer store.blockMapLock.RUnlock()
+
+	n := 0
+	for _, block := range store.Blocks {
+		n += block.Count
+	}
+
+	return n
+}
+
 // Close closes the BlockStore, and any files it has open.
 func (store *BlockStore) Close() {
 	store.blockMapLock.Lock()
@@ -197,6 +407,19 @@ func (store *BlockStore) Close() {
 		block.Close()
 	}
 
+	for _, block := range store.dropped {
+		block.Close()
+	}
+
+	for _, block := range store.replaced {
+		block.Close()
+		block.delete(store.path)
+	}
+
+	for _, block := range store.spilled {
+		block.Close()
+	}
+
 	for _, newBlock := range store.newBlocks {
 		newBlock.close()
 	}
@@ -1,8 +1,17 @@
 package blocks
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -12,7 +21,7 @@ func testBlockStoreCompression(t *testing.T, compression Compression) {
 	tmpDir, err := ioutil.TempDir("", "sequins-test-")
 	require.NoError(t, err, "creating a test tmpdir")
 
-	bs := New(tmpDir, 2, compression, 8192)
+	bs := New(tmpDir, 2, compression, 8192, nil, KeyPrefix{}, JavaHash)
 
 	err = bs.Add([]byte("Alice"), []byte("Practice"))
 	require.NoError(t, err, "adding keys to the block store")
@@ -49,6 +58,33 @@ func testBlockStoreCompression(t *testing.T, compression Compression) {
 	assert.Equal(t, "Hope", readAll(t, res), "fetching value for 'Bob'")
 }
 
+func TestManifestVersion(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	bs.Close()
+
+	manifest, err := ReadManifest(tmpDir)
+	require.NoError(t, err, "reading the manifest")
+	assert.Equal(t, baseManifestVersion, manifest.Version, "a store without any newer features should be readable by older binaries")
+
+	// A manifest written by a newer binary might describe a store that can't be
+	// read correctly, so it shouldn't be loaded at all.
+	manifest.Version = manifestVersion + 1
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, ".manifest"), b, 0644))
+
+	_, _, err = NewFromManifest(tmpDir)
+	assert.Equal(t, ErrWrongVersion, err, "a manifest with a newer version should be rejected")
+}
+
 func TestBlockStoreSnappy(t *testing.T) {
 	testBlockStoreCompression(t, SnappyCompression)
 }
@@ -56,3 +92,568 @@ func TestBlockStoreSnappy(t *testing.T) {
 func TestBlockStoreNoCompression(t *testing.T) {
 	testBlockStoreCompression(t, NoCompression)
 }
+
+func TestBlockStoreKeyNormalization(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	normalization := []KeyNormalization{LowercaseNormalization, NFCNormalization}
+	bs := New(tmpDir, 2, SnappyCompression, 8192, normalization, KeyPrefix{}, JavaHash)
+
+	// This is "ZOE" followed by a combining diaeresis, which NFC composes into
+	// a single rune.
+	key := bs.NormalizeKey([]byte("ZOE\u0308"))
+	assert.Equal(t, "zo\u00eb", string(key), "the key should be lowercased and composed")
+
+	err = bs.Add(key, []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	bs.Close()
+
+	bs, manifest, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, normalization, bs.KeyNormalization(), "the normalization should be loaded from the manifest")
+	assert.Equal(t, manifestVersion, manifest.Version, "older binaries shouldn't be able to load the store")
+
+	res, err := bs.Get(string(bs.NormalizeKey([]byte("Zo\u00cb"))))
+	require.NoError(t, err, "fetching value for 'Zoë'")
+	require.NotNil(t, res, "fetching value for 'Zoë'")
+	assert.Equal(t, "Practice", readAll(t, res), "fetching value for 'Zoë'")
+}
+
+func TestNormalizeKeyURLDecode(t *testing.T) {
+	bs := New("", 2, SnappyCompression, 8192, []KeyNormalization{URLDecodeNormalization}, KeyPrefix{}, JavaHash)
+
+	assert.Equal(t, "foo bar/baz", string(bs.NormalizeKey([]byte("foo%20bar%2Fbaz"))), "escapes should be decoded")
+	assert.Equal(t, "foo+bar", string(bs.NormalizeKey([]byte("foo+bar"))), "'+' should be left alone")
+	assert.Equal(t, "100%", string(bs.NormalizeKey([]byte("100%"))), "keys with invalid escapes should be left alone")
+}
+
+func TestBlockStoreKeyPrefix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	prefix := KeyPrefix{Delimiter: ":"}
+	bs := New(tmpDir, 20, SnappyCompression, 8192, nil, prefix, JavaHash)
+
+	keys := []string{"tenant1:Alice", "tenant1:Bob", "tenant1:Carol", "tenant1:Dave", "tenant1"}
+	for _, key := range keys {
+		partition, _ := bs.KeyPartition([]byte(key))
+		expected, _ := KeyPartition([]byte("tenant1"), 20)
+		assert.Equal(t, expected, partition, "keys with the same prefix should be in the same partition")
+
+		err = bs.Add([]byte(key), []byte(key))
+		require.NoError(t, err, "adding keys to the block store")
+	}
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	bs.Close()
+
+	bs, manifest, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, prefix, bs.KeyPrefix(), "the key prefix should be loaded from the manifest")
+	assert.Equal(t, manifestVersion, manifest.Version, "older binaries shouldn't be able to load the store")
+	assert.Equal(t, 1, len(bs.BlockMap), "all the keys should be in one partition")
+
+	for _, key := range keys {
+		res, err := bs.Get(key)
+		require.NoError(t, err, "fetching value for %q", key)
+		require.NotNil(t, res, "fetching value for %q", key)
+		assert.Equal(t, key, readAll(t, res), "fetching value for %q", key)
+	}
+
+	assert.Equal(t, []byte("abc"), KeyPrefix{Length: 3}.prefix([]byte("abcdef")), "the prefix should be the first 3 bytes")
+	assert.Equal(t, []byte("ab"), KeyPrefix{Length: 3}.prefix([]byte("ab")), "short keys should be used whole")
+	assert.Equal(t, []byte("ab/c"), KeyPrefix{Delimiter: ":"}.prefix([]byte("ab/c")), "keys without the delimiter should be used whole")
+}
+
+func TestBlockStorePartitionHash(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 20, SnappyCompression, 8192, nil, KeyPrefix{}, Murmur3Hash)
+
+	keys := []string{"Alice", "Bob", "Carol", "Dave", "Eve"}
+	for _, key := range keys {
+		err = bs.Add([]byte(key), []byte(key))
+		require.NoError(t, err, "adding keys to the block store")
+	}
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	bs.Close()
+
+	bs, manifest, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, manifestVersion, manifest.Version, "older binaries shouldn't be able to load the store")
+
+	for _, key := range keys {
+		partition, _ := bs.KeyPartition([]byte(key))
+		expected, _ := Murmur3Hash.KeyPartition([]byte(key), 20)
+		assert.Equal(t, expected, partition, "the partition hash should be loaded from the manifest")
+
+		res, err := bs.Get(key)
+		require.NoError(t, err, "fetching value for %q", key)
+		require.NotNil(t, res, "fetching value for %q", key)
+		assert.Equal(t, key, readAll(t, res), "fetching value for %q", key)
+	}
+}
+
+func TestBlockStoreDropPartition(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Flush()
+	require.NoError(t, err, "flushing the block store")
+
+	res, err := bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	require.NotNil(t, res, "fetching value for 'Alice'")
+
+	bs.DropPartition(0)
+	assert.Equal(t, "Practice", readAll(t, res), "records should still be readable after dropping the partition")
+	res.Close()
+
+	res, err = bs.GetDropped("Alice")
+	require.NoError(t, err, "fetching dropped value for 'Alice'")
+	require.NotNil(t, res, "fetching dropped value for 'Alice'")
+	assert.Equal(t, "Practice", readAll(t, res), "the dropped block should still be readable")
+	res.Close()
+
+	_, err = bs.Get("Alice")
+	assert.Equal(t, ErrPartitionNotFound, err, "the partition should be gone")
+
+	err = bs.Add([]byte("Alice"), []byte("Hope"))
+	require.NoError(t, err, "adding keys to the block store again")
+
+	err = bs.Save(map[int]bool{0: true})
+	require.NoError(t, err, "saving the manifest")
+
+	res, err = bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	require.NotNil(t, res, "fetching value for 'Alice'")
+	assert.Equal(t, "Hope", readAll(t, res), "the partition should have the new value")
+	res.Close()
+	bs.Close()
+
+	bs, _, err = NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, 1, len(bs.Blocks), "the dropped block shouldn't be in the manifest")
+}
+
+func TestBlockStoreReplace(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Save(map[int]bool{0: true})
+	require.NoError(t, err, "saving the manifest")
+
+	res, err := bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	require.NotNil(t, res, "fetching value for 'Alice'")
+	oldName := bs.Blocks[0].Name
+
+	other := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = other.Add([]byte("Alice"), []byte("Hope"))
+	require.NoError(t, err, "adding keys to the other block store")
+
+	err = other.Save(map[int]bool{0: true})
+	require.NoError(t, err, "saving the other manifest")
+
+	bs.Replace(other)
+	assert.Equal(t, "Practice", readAll(t, res), "records should still be readable after replacing the blocks")
+	res.Close()
+
+	res, err = bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	require.NotNil(t, res, "fetching value for 'Alice'")
+	assert.Equal(t, "Hope", readAll(t, res), "the store should have the new value")
+	res.Close()
+	assert.Empty(t, other.Blocks, "the other store should be left empty")
+
+	bs.Close()
+	_, err = os.Stat(filepath.Join(tmpDir, oldName))
+	assert.True(t, os.IsNotExist(err), "the replaced block should be removed once the store is closed")
+
+	bs, _, err = NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, 1, len(bs.Blocks), "only the new block should be in the manifest")
+}
+
+func TestBlockStoreDiscard(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Flush()
+	require.NoError(t, err, "flushing the block store")
+	name := bs.Blocks[0].Name
+
+	bs.Discard()
+	_, err = os.Stat(filepath.Join(tmpDir, name))
+	assert.True(t, os.IsNotExist(err), "the discarded block should be removed")
+
+	_, err = os.Stat(tmpDir)
+	assert.NoError(t, err, "the directory should be left alone")
+}
+
+func TestBlockStoreIndexingMemoryBudget(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	bs.SetIndexingMemoryBudget(2 * indexBytesPerEntry)
+
+	keys := []string{"Alice", "Bob", "Carol", "Dave", "Eve"}
+	for _, key := range keys {
+		err = bs.Add([]byte(key), []byte(key))
+		require.NoError(t, err, "adding keys to the block store")
+	}
+
+	err = bs.Save(map[int]bool{0: true})
+	require.NoError(t, err, "saving the manifest")
+	assert.Equal(t, 3, len(bs.Blocks), "the partition should be split into blocks that fit in the budget")
+	assert.Equal(t, int64(2*indexBytesPerEntry), bs.PeakIndexingMemory(), "the peak indexing memory should be tracked")
+	bs.Close()
+
+	bs, _, err = NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+
+	for _, key := range keys {
+		res, err := bs.Get(key)
+		require.NoError(t, err, "fetching value for %q", key)
+		require.NotNil(t, res, "fetching value for %q", key)
+		assert.Equal(t, key, readAll(t, res), "fetching value for %q", key)
+	}
+}
+
+func TestBlockStoreMetadata(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Add([]byte("Bob"), []byte("Hope"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.AddMetadata([]byte("Alice"), []byte(`{"source_timestamp": 1234}`))
+	require.NoError(t, err, "adding metadata to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	bs.Close()
+
+	bs, manifest, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	assert.Equal(t, manifestVersion, manifest.Version, "older binaries shouldn't be able to load the store")
+
+	res, err := bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	assert.Equal(t, `{"source_timestamp": 1234}`, string(res.Metadata), "fetching metadata for 'Alice'")
+	assert.Equal(t, "Practice", readAll(t, res), "fetching value for 'Alice'")
+
+	res, err = bs.Get("Bob")
+	require.NoError(t, err, "fetching value for 'Bob'")
+	assert.Nil(t, res.Metadata, "'Bob' should have no metadata")
+	assert.Equal(t, "Hope", readAll(t, res), "fetching value for 'Bob'")
+}
+
+func TestBlockStoreEmptyValue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 1, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+
+	err = bs.Add([]byte("Alice"), []byte(""))
+	require.NoError(t, err, "adding an empty value to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+
+	res, err := bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	require.NotNil(t, res, "an empty value should be distinct from a missing key")
+	assert.Equal(t, uint64(0), res.ValueLen, "fetching value for 'Alice'")
+	assert.Equal(t, "", readAll(t, res), "fetching value for 'Alice'")
+
+	res, err = bs.Get("Bob")
+	require.NoError(t, err, "fetching value for 'Bob'")
+	assert.Nil(t, res, "a missing key should have no record")
+}
+
+func TestBlockStoreScanPrefix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	for _, key := range []string{"Alice", "Alicia", "Allen", "Bob", "Al"} {
+		err = bs.Add([]byte(key), []byte(strings.ToUpper(key)))
+		require.NoError(t, err, "adding keys to the block store")
+	}
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	defer bs.Close()
+
+	assert.Equal(t, []int{0, 1}, bs.PrefixPartitions([]byte("Ali")), "the prefix could be in any partition")
+
+	found := make(map[string]string)
+	for _, partition := range bs.PrefixPartitions([]byte("Ali")) {
+		more, err := bs.ScanPrefix(partition, []byte("Ali"), func(key, value []byte) bool {
+			found[string(key)] = string(value)
+			return true
+		})
+
+		require.NoError(t, err, "scanning for a prefix")
+		assert.True(t, more, "the scan shouldn't be stopped")
+	}
+
+	assert.Equal(t, map[string]string{"Alice": "ALICE", "Alicia": "ALICIA"}, found, "the scan should find all the keys with the prefix")
+
+	n := 0
+	more, err := bs.ScanPrefix(0, []byte(""), func(key, value []byte) bool {
+		n++
+		return false
+	})
+
+	require.NoError(t, err, "scanning for a prefix")
+	assert.False(t, more, "the scan should be stopped")
+	assert.Equal(t, 1, n, "the scan should stop when asked")
+
+	_, err = bs.ScanPrefix(5, []byte("Ali"), func(key, value []byte) bool { return true })
+	assert.Equal(t, ErrPartitionNotFound, err, "scanning a missing partition should fail")
+}
+
+func TestBlockStorePrefixPartitions(t *testing.T) {
+	bs := New("", 20, SnappyCompression, 8192, nil, KeyPrefix{Delimiter: ":"}, JavaHash)
+	expected, _ := KeyPartition([]byte("tenant1"), 20)
+	assert.Equal(t, []int{expected}, bs.PrefixPartitions([]byte("tenant1:A")), "a prefix with the delimiter should be in one partition")
+	assert.Len(t, bs.PrefixPartitions([]byte("tenant1")), 20, "a prefix without the delimiter could be in any partition")
+
+	bs = New("", 20, SnappyCompression, 8192, nil, KeyPrefix{Length: 3}, JavaHash)
+	expected, _ = KeyPartition([]byte("abc"), 20)
+	assert.Equal(t, []int{expected}, bs.PrefixPartitions([]byte("abcd")), "a prefix longer than the length should be in one partition")
+	assert.Len(t, bs.PrefixPartitions([]byte("abc")), 20, "a prefix that isn't longer than the length could be in any partition")
+}
+
+func TestBlockStoreCheckSample(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Add([]byte("Bob"), []byte("Hope"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+
+	checked, failed := bs.CheckSample(1.0)
+	assert.Equal(t, 2, checked, "every key should be checked")
+	assert.Empty(t, failed, "no partitions should fail")
+
+	checked, failed = bs.CheckSample(0.0)
+	assert.Equal(t, 0, checked, "no keys should be checked")
+	assert.Empty(t, failed, "no partitions should fail")
+}
+
+func TestBlockStoreWarm(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+	defer os.RemoveAll(tmpDir)
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	require.NoError(t, bs.Add([]byte("Alice"), []byte("Practice")))
+	require.NoError(t, bs.Add([]byte("Bob"), []byte("Hope")))
+	require.NoError(t, bs.Save(nil))
+	defer bs.Close()
+
+	indexes, err := filepath.Glob(filepath.Join(tmpDir, "*.spi"))
+	require.NoError(t, err)
+	var expected int64
+	for _, index := range indexes {
+		info, err := os.Stat(index)
+		require.NoError(t, err)
+		expected += info.Size()
+	}
+
+	n, err := bs.Warm(time.Time{})
+	require.NoError(t, err, "warming should succeed")
+	assert.Equal(t, expected, n, "every index file should be read")
+
+	n, err = bs.Warm(time.Now().Add(-time.Second))
+	require.NoError(t, err, "warming should succeed")
+	assert.EqualValues(t, 0, n, "nothing should be read once the deadline has passed")
+}
+
+// benchmarkBlockStoreCompression measures random reads from a store that's
+// been saved and loaded again from its manifest, like a version on disk. The
+// values are repetitive, so that compression has something to do.
+func TestBlockStoreBloomFilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+	defer os.RemoveAll(tmpDir)
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	bs.SetBloomFilter(0.01)
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		require.NoError(t, bs.Add([]byte(keys[i]), []byte(keys[i])), "adding keys to the block store")
+	}
+
+	require.NoError(t, bs.Save(nil), "saving the manifest")
+	bs.Close()
+
+	bs, manifest, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	defer bs.Close()
+	assert.Equal(t, manifestVersion, manifest.Version, "older binaries shouldn't be able to load the store")
+
+	for _, block := range bs.Blocks {
+		require.NotNil(t, block.bloom, "every block should have its bloom filter loaded")
+		_, err := os.Stat(filepath.Join(tmpDir, block.BloomName))
+		assert.NoError(t, err, "the bloom filter should be saved next to the block")
+	}
+
+	for _, key := range keys {
+		res, err := bs.Get(key)
+		require.NoError(t, err, "fetching value for %q", key)
+		require.NotNil(t, res, "the bloom filter shouldn't hide keys that exist")
+		assert.Equal(t, key, readAll(t, res), "fetching value for %q", key)
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		missing := []byte(fmt.Sprintf("missing-%d", i))
+		partition, _ := bs.KeyPartition(missing)
+		for _, block := range bs.BlockMap[partition] {
+			if block.bloom.mayContain(missing) {
+				falsePositives++
+			}
+		}
+
+		res, err := bs.Get(string(missing))
+		require.NoError(t, err)
+		assert.Nil(t, res, "a missing key should still be missing")
+	}
+
+	assert.True(t, falsePositives < 300, "the false positive rate should be close to what it was sized for, but was %d/10000", falsePositives)
+}
+
+// benchmarkBlockStoreMisses looks up keys that are missing nine times out of
+// ten, with or without bloom filters.
+func benchmarkBlockStoreMisses(b *testing.B, bloom bool) {
+	tmpDir, err := ioutil.TempDir("", "sequins-bench-")
+	require.NoError(b, err, "creating a test tmpdir")
+	defer os.RemoveAll(tmpDir)
+
+	const numKeys = 10000
+	bs := New(tmpDir, 1, SnappyCompression, 4096, nil, KeyPrefix{}, JavaHash)
+	if bloom {
+		bs.SetBloomFilter(DefaultBloomFalsePositiveRate)
+	}
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		require.NoError(b, bs.Add([]byte(keys[i]), randBytes(64, 64)), "adding keys to the block store")
+	}
+
+	require.NoError(b, bs.Save(nil), "saving the manifest")
+	bs.Close()
+
+	bs, _, err = NewFromManifest(tmpDir)
+	require.NoError(b, err, "loading from manifest")
+	defer bs.Close()
+
+	// The missing keys sort between the existing ones, so the block's min and
+	// max keys don't rule them out.
+	lookups := make([]string, 1000)
+	for i := range lookups {
+		if i%10 == 0 {
+			lookups[i] = keys[rand.Intn(numKeys)]
+		} else {
+			lookups[i] = fmt.Sprintf("key-%d-missing", rand.Intn(numKeys))
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := bs.Get(lookups[i%len(lookups)])
+		if err != nil {
+			b.Fatal("fetching a key:", err)
+		} else if res != nil {
+			res.Close()
+		}
+	}
+}
+
+func BenchmarkBlockStoreGetMisses(b *testing.B) {
+	benchmarkBlockStoreMisses(b, false)
+}
+
+func BenchmarkBlockStoreGetMissesBloomFilter(b *testing.B) {
+	benchmarkBlockStoreMisses(b, true)
+}
+
+func benchmarkBlockStoreCompression(b *testing.B, compression Compression) {
+	tmpDir, err := ioutil.TempDir("", "sequins-bench-")
+	require.NoError(b, err, "creating a test tmpdir")
+	defer os.RemoveAll(tmpDir)
+
+	const numKeys = 10000
+	bs := New(tmpDir, 1, compression, 4096, nil, KeyPrefix{}, JavaHash)
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		value := bytes.Repeat(randBytes(8, 8), 64)
+		require.NoError(b, bs.Add([]byte(keys[i]), value), "adding keys to the block store")
+	}
+
+	require.NoError(b, bs.Save(nil), "saving the manifest")
+	bs.Close()
+
+	bs, _, err = NewFromManifest(tmpDir)
+	require.NoError(b, err, "loading from manifest")
+	defer bs.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := bs.Get(keys[rand.Intn(numKeys)])
+		if err != nil || res == nil {
+			b.Fatal("fetching a key:", err)
+		}
+
+		io.Copy(ioutil.Discard, res)
+		res.Close()
+	}
+}
+
+func BenchmarkBlockStoreGetSnappy(b *testing.B) {
+	benchmarkBlockStoreCompression(b, SnappyCompression)
+}
+
+func BenchmarkBlockStoreGetNoCompression(b *testing.B) {
+	benchmarkBlockStoreCompression(b, NoCompression)
+}
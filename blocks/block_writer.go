@@ -19,7 +19,15 @@ type blockWriter struct {
 
 	path          string
 	id            string
+	options       *sparkey.Options
 	sparkeyWriter *sparkey.LogWriter
+
+	metadataWriter *sparkey.LogWriter
+
+	// bloomHashes holds the hash of every key added, if the block is going to
+	// have a bloom filter; see BlockStore.SetBloomFilter.
+	bloomHashes            []uint64
+	bloomFalsePositiveRate float64
 }
 
 func newBlock(storePath string, partition int, compression Compression, blockSize int) (*blockWriter, error) {
@@ -43,6 +51,7 @@ func newBlock(storePath string, partition int, compression Compression, blockSiz
 		partition:     partition,
 		path:          path,
 		id:            id,
+		options:       options,
 		sparkeyWriter: sparkeyWriter,
 	}
 
@@ -52,6 +61,9 @@ func newBlock(storePath string, partition int, compression Compression, blockSiz
 func (bw *blockWriter) add(key, value []byte) error {
 	// Update the count.
 	bw.count++
+	if bw.bloomFalsePositiveRate > 0 {
+		bw.bloomHashes = append(bw.bloomHashes, xxhash64(key))
+	}
 
 	// Update the minimum and maximum keys seen.
 	if bw.maxKey == nil || bytes.Compare(key, bw.maxKey) > 0 {
@@ -67,6 +79,23 @@ func (bw *blockWriter) add(key, value []byte) error {
 	return bw.sparkeyWriter.Put(key, value)
 }
 
+// addMetadata adds a metadata blob for a key. The metadata is stored in a
+// separate sparkey file alongside the block, which is only created once the
+// first blob is added.
+func (bw *blockWriter) addMetadata(key, metadata []byte) error {
+	if bw.metadataWriter == nil {
+		path := metadataPath(bw.path)
+		metadataWriter, err := sparkey.CreateLogWriter(path, bw.options)
+		if err != nil {
+			return fmt.Errorf("initializing block metadata %s: %s", path, err)
+		}
+
+		bw.metadataWriter = metadataWriter
+	}
+
+	return bw.metadataWriter.Put(key, metadata)
+}
+
 func (bw *blockWriter) save() (*Block, error) {
 	err := bw.sparkeyWriter.WriteHashFile(0)
 	if err != nil {
@@ -95,13 +124,48 @@ func (bw *blockWriter) save() (*Block, error) {
 		iterPool:      newIterPool(reader),
 	}
 
+	if bw.bloomFalsePositiveRate > 0 {
+		b.bloom, err = bw.saveBloomFilter()
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+
+		b.BloomName = filepath.Base(bloomPath(bw.path))
+	}
+
+	if bw.metadataWriter != nil {
+		err = bw.metadataWriter.WriteHashFile(0)
+		if err != nil {
+			return nil, err
+		}
+
+		err = bw.metadataWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		b.MetadataName = filepath.Base(metadataPath(bw.path))
+		err = b.openMetadata(filepath.Dir(bw.path))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return b, nil
 }
 
 func (bw *blockWriter) close() {
 	bw.sparkeyWriter.Close()
+	if bw.metadataWriter != nil {
+		bw.metadataWriter.Close()
+	}
 }
 
 func (bw *blockWriter) delete() {
 	os.Remove(bw.path)
+	os.Remove(bloomPath(bw.path))
+	if bw.metadataWriter != nil {
+		os.Remove(metadataPath(bw.path))
+	}
 }
@@ -0,0 +1,173 @@
+package blocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultBloomFalsePositiveRate is the false positive rate bloom filters are
+// sized for, if none is given.
+const DefaultBloomFalsePositiveRate = 0.01
+
+var errCorruptBloomFilter = errors.New("corrupt bloom filter")
+
+// A bloomFilter records which keys a block has, so that a lookup for a key
+// that's definitely missing can skip the block's hash index entirely. There
+// are no false negatives, and false positives just fall through to the index.
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+// SetBloomFilter makes every block created from now on build a bloom filter
+// of its keys, sized for the given false positive rate, which Get checks
+// before the block's index. The filters are saved next to the blocks, and kept
+// in memory while they're open. Zero means no filters are built.
+func (store *BlockStore) SetBloomFilter(falsePositiveRate float64) {
+	store.bloomFalsePositiveRate = falsePositiveRate
+}
+
+// bloomPath returns the path of the bloom filter for the block at the given
+// path.
+func bloomPath(blockPath string) string {
+	return strings.TrimSuffix(blockPath, ".spl") + ".bloom"
+}
+
+// newBloomFilter returns an empty filter with room for n keys at the given
+// false positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint32(k),
+	}
+}
+
+// addHash adds a key to the filter, by its xxhash64. The k bit positions are
+// derived from the two halves of the hash, as in Kirsch and Mitzenmacher, so
+// each key is only hashed once.
+func (bf *bloomFilter) addHash(hash uint64) {
+	m := uint64(len(bf.bits)) * 64
+	h1, h2 := hash&math.MaxUint32, hash>>32
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns false if the key was definitely never added to the
+// filter.
+func (bf *bloomFilter) mayContain(key []byte) bool {
+	hash := xxhash64(key)
+	m := uint64(len(bf.bits)) * 64
+	h1, h2 := hash&math.MaxUint32, hash>>32
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// write saves the filter to a file: the number of hash functions, the number
+// of words, and then the words, all little-endian.
+func (bf *bloomFilter) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	binary.Write(w, binary.LittleEndian, bf.k)
+	binary.Write(w, binary.LittleEndian, uint64(len(bf.bits)))
+	err = binary.Write(w, binary.LittleEndian, bf.bits)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+func readBloomFilter(path string) (*bloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	bf := &bloomFilter{}
+	var words uint64
+	binary.Read(r, binary.LittleEndian, &bf.k)
+	err = binary.Read(r, binary.LittleEndian, &words)
+	if err != nil {
+		return nil, err
+	} else if bf.k == 0 || words == 0 || info.Size() != int64(12+words*8) {
+		return nil, errCorruptBloomFilter
+	}
+
+	bf.bits = make([]uint64, words)
+	err = binary.Read(r, binary.LittleEndian, bf.bits)
+	if err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// saveBloomFilter builds the filter for a new block from the hashes of its
+// keys, and writes it next to the block.
+func (bw *blockWriter) saveBloomFilter() (*bloomFilter, error) {
+	bf := newBloomFilter(len(bw.bloomHashes), bw.bloomFalsePositiveRate)
+	for _, hash := range bw.bloomHashes {
+		bf.addHash(hash)
+	}
+
+	bw.bloomHashes = nil
+	err := bf.write(bloomPath(bw.path))
+	if err != nil {
+		return nil, fmt.Errorf("writing bloom filter: %s", err)
+	}
+
+	return bf, nil
+}
+
+func (b *Block) openBloomFilter(storePath string) error {
+	bf, err := readBloomFilter(filepath.Join(storePath, b.BloomName))
+	if err != nil {
+		return fmt.Errorf("opening bloom filter: %s", err)
+	}
+
+	b.bloom = bf
+	return nil
+}
@@ -0,0 +1,62 @@
+package blocks
+
+import "sync/atomic"
+
+// indexBytesPerEntry is a conservative estimate of the memory sparkey needs
+// for each entry while it writes a block's hash index, which it builds in
+// memory all at once.
+const indexBytesPerEntry = 24
+
+// SetIndexingMemoryBudget bounds the memory used to index each new block, in
+// bytes. Once a block has as many entries as fit in the budget, it's saved,
+// and the rest of the partition goes into a new block. Zero means no limit.
+func (store *BlockStore) SetIndexingMemoryBudget(budget int64) {
+	store.maxBlockEntries = int(budget / indexBytesPerEntry)
+}
+
+// PeakIndexingMemory returns an estimate of the most memory used to index a
+// single block since the block store was created, in bytes. It doesn't block
+// on builds in progress.
+func (store *BlockStore) PeakIndexingMemory() int64 {
+	return atomic.LoadInt64(&store.peakIndexingMemory)
+}
+
+// spill saves a new block that has reached the indexing memory budget, so that
+// any more keys for the partition go into a new block. Like any other new
+// block, it isn't available until the store is flushed.
+func (store *BlockStore) spill(partition int, block *blockWriter) error {
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	savedBlock, err := store.saveBlock(block)
+	if err != nil {
+		return err
+	}
+
+	store.spilled = append(store.spilled, savedBlock)
+	delete(store.newBlocks, partition)
+	return nil
+}
+
+// saveBlock saves a new block, keeping track of the memory used to index it.
+// The blockMapLock must be held.
+func (store *BlockStore) saveBlock(block *blockWriter) (*Block, error) {
+	memory := int64(block.count) * indexBytesPerEntry
+	if memory > store.peakIndexingMemory {
+		atomic.StoreInt64(&store.peakIndexingMemory, memory)
+	}
+
+	savedBlock, err := block.save()
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks built without a source make the record of which blocks came from
+	// which files incomplete, so it can't be used anymore.
+	savedBlock.source = store.source
+	if store.source == "" {
+		store.sourceFiles = nil
+	}
+
+	return savedBlock, nil
+}
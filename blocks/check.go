@@ -0,0 +1,122 @@
+package blocks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+
+	"github.com/bsm/go-sparkey"
+)
+
+// Check does a quick sanity check of the block store's data, by reading back
+// the smallest and largest key in each block. This exercises both the hash
+// and log files for every block, so it catches most truncated or otherwise
+// corrupted files without reading everything.
+func (store *BlockStore) Check() error {
+	store.blockMapLock.RLock()
+	defer store.blockMapLock.RUnlock()
+
+	for _, block := range store.Blocks {
+		for _, key := range [][]byte{block.minKey, block.maxKey} {
+			if key == nil {
+				continue
+			}
+
+			err := block.check(key)
+			if err != nil {
+				return fmt.Errorf("checking block %s: %s", block.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Block) check(key []byte) error {
+	record, err := b.Get(key)
+	if err != nil {
+		return err
+	} else if record == nil {
+		return fmt.Errorf("key %q is missing", key)
+	}
+
+	defer record.Close()
+	n, err := io.Copy(ioutil.Discard, record)
+	if err != nil {
+		return fmt.Errorf("reading key %q: %s", key, err)
+	} else if uint64(n) != record.ValueLen {
+		return fmt.Errorf("reading key %q: value is truncated", key)
+	}
+
+	return nil
+}
+
+// CheckSample reads back a random sample of the keys in the block store, with
+// each key picked with probability rate. Every sampled key is looked up
+// through the hash index, and its whole value is read. This walks the log of
+// every block to pick the keys, so it's more thorough than Check, but also
+// much more expensive; the rate mostly bounds the cost of the lookups. It
+// returns the number of keys checked, and the first error for each partition
+// where something couldn't be read back.
+func (store *BlockStore) CheckSample(rate float64) (int, map[int]error) {
+	store.blockMapLock.RLock()
+	blocks := make([]*Block, len(store.Blocks))
+	copy(blocks, store.Blocks)
+	store.blockMapLock.RUnlock()
+
+	checked := 0
+	failed := make(map[int]error)
+	for _, block := range blocks {
+		if failed[block.Partition] != nil {
+			continue
+		}
+
+		keys, err := block.sampleKeys(rate)
+		if err != nil {
+			failed[block.Partition] = fmt.Errorf("sampling block %s: %s", block.Name, err)
+			continue
+		}
+
+		for _, key := range keys {
+			checked++
+			err := block.check(key)
+			if err != nil {
+				failed[block.Partition] = fmt.Errorf("checking block %s: %s", block.Name, err)
+				break
+			}
+		}
+	}
+
+	return checked, failed
+}
+
+// sampleKeys walks the block's log, and returns a copy of each key with
+// probability rate.
+func (b *Block) sampleKeys(rate float64) ([][]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	iter, err := b.sparkeyReader.Iterator()
+	if err != nil {
+		return nil, fmt.Errorf("opening block iter: %s", err)
+	}
+
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.NextLive(); iter.State() == sparkey.ITERATOR_ACTIVE; iter.NextLive() {
+		if rand.Float64() >= rate {
+			continue
+		}
+
+		key, err := iter.Key()
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, append([]byte(nil), key...))
+	}
+
+	return keys, iter.Err()
+}
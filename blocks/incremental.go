@@ -0,0 +1,200 @@
+package blocks
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bsm/go-sparkey"
+)
+
+// SetSource flushes any new blocks, and marks the blocks created from then on
+// as coming from the given source file, which has the given fingerprint. If
+// every file is added this way, then no block contains keys from more than one
+// file, and ReuseSource can later reuse the blocks for files that haven't
+// changed. The record of which files were added is saved with the manifest.
+func (store *BlockStore) SetSource(name, fingerprint string) error {
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	err := store.flush()
+	if err != nil {
+		return err
+	}
+
+	store.source = name
+	store.pendingSources[name] = fingerprint
+	return nil
+}
+
+// ReuseSource adds the blocks that were built from a source file in another
+// block store, if the other store was built one file at a time with SetSource,
+// it read a file with the same name and fingerprint, it has the same
+// partitioning and storage settings, and it had all of the given partitions
+// selected when it read the file. The blocks' files are hard linked into this
+// store, or copied, if that's not possible.
+//
+// It returns false if the blocks can't be reused, in which case the file
+// should be read normally.
+func (store *BlockStore) ReuseSource(other *BlockStore, name, fingerprint string, partitions map[int]bool) (bool, error) {
+	if other == store || fingerprint == "" {
+		return false, nil
+	}
+
+	other.blockMapLock.RLock()
+	defer other.blockMapLock.RUnlock()
+
+	previous, ok := other.sourceFiles[name]
+	if !ok || previous != fingerprint || !store.compatible(other) {
+		return false, nil
+	}
+
+	for partition := range partitions {
+		if !other.selected[partition] {
+			return false, nil
+		}
+	}
+
+	var reused []*Block
+	cleanup := func() {
+		for _, block := range reused {
+			block.Close()
+			removeBlockFiles(store.path, block.Name)
+		}
+	}
+
+	for _, block := range other.Blocks {
+		if block.source != name || !partitions[block.Partition] {
+			continue
+		}
+
+		// Metadata is added separately from the files, so it could have come from
+		// anywhere.
+		if block.MetadataName != "" {
+			cleanup()
+			return false, nil
+		}
+
+		err := linkBlockFiles(other.path, store.path, block.Name)
+		if err == nil && block.BloomName != "" {
+			err = linkOrCopy(filepath.Join(other.path, block.BloomName), filepath.Join(store.path, block.BloomName))
+			if err != nil {
+				removeBlockFiles(store.path, block.Name)
+			}
+		}
+
+		if err != nil {
+			cleanup()
+			return false, err
+		}
+
+		linked, err := loadBlock(store.path, block.manifest())
+		if err != nil {
+			removeBlockFiles(store.path, block.Name)
+			cleanup()
+			return false, err
+		}
+
+		reused = append(reused, linked)
+	}
+
+	store.blockMapLock.Lock()
+	defer store.blockMapLock.Unlock()
+
+	// Anything still buffered came from an earlier file, and has to come first.
+	err := store.flush()
+	if err != nil {
+		cleanup()
+		return false, err
+	}
+
+	for _, block := range reused {
+		store.Blocks = append(store.Blocks, block)
+		store.BlockMap[block.Partition] = append(store.BlockMap[block.Partition], block)
+	}
+
+	store.source = ""
+	store.pendingSources[name] = fingerprint
+	return true, nil
+}
+
+// compatible returns whether blocks from the other store can be used as-is in
+// this one.
+func (store *BlockStore) compatible(other *BlockStore) bool {
+	if store.numPartitions != other.numPartitions ||
+		store.compression != other.compression ||
+		store.blockSize != other.blockSize ||
+		store.keyPrefix != other.keyPrefix ||
+		store.partitionHash != other.partitionHash ||
+		len(store.keyNormalization) != len(other.keyNormalization) {
+		return false
+	}
+
+	for i, n := range store.keyNormalization {
+		if other.keyNormalization[i] != n {
+			return false
+		}
+	}
+
+	return true
+}
+
+func partitionSet(partitions []int) map[int]bool {
+	set := make(map[int]bool, len(partitions))
+	for _, partition := range partitions {
+		set[partition] = true
+	}
+
+	return set
+}
+
+// linkBlockFiles links both the log and index files for a block from one
+// directory into another.
+func linkBlockFiles(srcDir, dstDir, name string) error {
+	for _, file := range []string{sparkey.LogFileName(name), sparkey.HashFileName(name)} {
+		err := linkOrCopy(filepath.Join(srcDir, file), filepath.Join(dstDir, file))
+		if err != nil {
+			removeBlockFiles(dstDir, name)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeBlockFiles(dir, name string) {
+	os.Remove(filepath.Join(dir, sparkey.LogFileName(name)))
+	os.Remove(filepath.Join(dir, sparkey.HashFileName(name)))
+	os.Remove(filepath.Join(dir, bloomPath(name)))
+}
+
+// linkOrCopy hard links src to dst, or, failing that (for example, if they're
+// on different filesystems), copies it.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
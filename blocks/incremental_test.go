@@ -0,0 +1,69 @@
+package blocks
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockStoreReuseSource(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	partitions := map[int]bool{0: true, 1: true}
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+
+	require.NoError(t, bs.SetSource("part-00000", "3-abc"))
+	require.NoError(t, bs.Add([]byte("Alice"), []byte("Practice")))
+	require.NoError(t, bs.SetSource("part-00001", "4-def"))
+	require.NoError(t, bs.Add([]byte("Bob"), []byte("Hope")))
+	require.NoError(t, bs.Save(partitions), "saving the manifest")
+	bs.Close()
+
+	// The sources should survive a round trip through the manifest.
+	prev, _, err := NewFromManifest(tmpDir)
+	require.NoError(t, err, "loading from manifest")
+	defer prev.Close()
+
+	nextDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	next := New(nextDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	reused, err := next.ReuseSource(prev, "part-00000", "3-abc", partitions)
+	require.NoError(t, err, "reusing an unchanged file")
+	assert.True(t, reused, "an unchanged file should be reused")
+
+	reused, err = next.ReuseSource(prev, "part-00001", "5-xyz", partitions)
+	require.NoError(t, err, "reusing a changed file")
+	assert.False(t, reused, "a changed file shouldn't be reused")
+
+	require.NoError(t, next.SetSource("part-00001", "5-xyz"))
+	require.NoError(t, next.Add([]byte("Bob"), []byte("Change")))
+	require.NoError(t, next.Save(partitions), "saving the manifest")
+
+	res, err := next.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	assert.Equal(t, "Practice", readAll(t, res), "fetching value for 'Alice'")
+
+	res, err = next.Get("Bob")
+	require.NoError(t, err, "fetching value for 'Bob'")
+	assert.Equal(t, "Change", readAll(t, res), "fetching value for 'Bob'")
+
+	// The reused blocks have to stay around after the old version is deleted.
+	prev.Delete()
+	next.Close()
+	next, _, err = NewFromManifest(nextDir)
+	require.NoError(t, err, "loading from manifest")
+	defer next.Close()
+
+	res, err = next.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	assert.Equal(t, "Practice", readAll(t, res), "fetching value for 'Alice'")
+
+	other := New(tmpDir, 4, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	reused, err = other.ReuseSource(next, "part-00000", "3-abc", partitions)
+	require.NoError(t, err)
+	assert.False(t, reused, "blocks with different partitioning shouldn't be reused")
+}
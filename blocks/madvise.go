@@ -0,0 +1,36 @@
+package blocks
+
+import (
+	"errors"
+)
+
+var ErrAdviceUnsupported = errors.New("madvise isn't supported on this platform")
+
+// Advice is a hint to the OS about how block files will be accessed, applied
+// with madvise(2) to the memory-mapped files.
+type Advice string
+
+const NormalAdvice Advice = "normal"
+const RandomAdvice Advice = "random"
+const SequentialAdvice Advice = "sequential"
+const WillNeedAdvice Advice = "willneed"
+
+// Advise applies the given advice to all of the block files in the store.
+// Sparkey always memory-maps the files it reads, so this is applied to those
+// existing mappings. It should be called again after new blocks are added.
+func (store *BlockStore) Advise(advice Advice) error {
+	store.blockMapLock.RLock()
+	defer store.blockMapLock.RUnlock()
+
+	files := make(map[string]bool)
+	for _, block := range store.Blocks {
+		files[block.sparkeyReader.Name()] = true
+		files[block.sparkeyReader.LogName()] = true
+		if block.metadataReader != nil {
+			files[block.metadataReader.Name()] = true
+			files[block.metadataReader.LogName()] = true
+		}
+	}
+
+	return adviseFiles(files, advice)
+}
@@ -0,0 +1,71 @@
+package blocks
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var adviceValues = map[Advice]uintptr{
+	NormalAdvice:     syscall.MADV_NORMAL,
+	RandomAdvice:     syscall.MADV_RANDOM,
+	SequentialAdvice: syscall.MADV_SEQUENTIAL,
+	WillNeedAdvice:   syscall.MADV_WILLNEED,
+}
+
+// adviseFiles finds the existing mappings of the given files in
+// /proc/self/maps, and calls madvise on each of them.
+func adviseFiles(files map[string]bool, advice Advice) error {
+	value, ok := adviceValues[advice]
+	if !ok {
+		return fmt.Errorf("unknown advice: %s", advice)
+	}
+
+	abs := make(map[string]bool, len(files))
+	for file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		abs[path] = true
+	}
+
+	maps, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return err
+	}
+	defer maps.Close()
+
+	// Each line looks like:
+	//   7f0c2c1e4000-7f0c2c1e8000 r--s 00000000 fd:01 1234 /path/to/file
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !abs[fields[5]] {
+			continue
+		}
+
+		bounds := strings.SplitN(fields[0], "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 16, 64)
+		if err != nil {
+			return err
+		}
+
+		end, err := strconv.ParseUint(bounds[1], 16, 64)
+		if err != nil {
+			return err
+		}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_MADVISE, uintptr(start), uintptr(end-start), value)
+		if errno != 0 {
+			return fmt.Errorf("madvise %s: %s", fields[5], errno)
+		}
+	}
+
+	return scanner.Err()
+}
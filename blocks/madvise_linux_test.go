@@ -0,0 +1,32 @@
+package blocks
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockStoreAdvise(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "creating a test tmpdir")
+
+	bs := New(tmpDir, 2, SnappyCompression, 8192, nil, KeyPrefix{}, JavaHash)
+	err = bs.Add([]byte("Alice"), []byte("Practice"))
+	require.NoError(t, err, "adding keys to the block store")
+
+	err = bs.Save(nil)
+	require.NoError(t, err, "saving the manifest")
+	defer bs.Close()
+
+	for _, advice := range []Advice{RandomAdvice, SequentialAdvice, WillNeedAdvice, NormalAdvice} {
+		assert.NoError(t, bs.Advise(advice), "applying advice %s", advice)
+	}
+
+	assert.Error(t, bs.Advise("bogus"), "applying unknown advice should fail")
+
+	res, err := bs.Get("Alice")
+	require.NoError(t, err, "fetching value for 'Alice'")
+	assert.Equal(t, "Practice", readAll(t, res), "fetching value for 'Alice'")
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package blocks
+
+func adviseFiles(files map[string]bool, advice Advice) error {
+	return ErrAdviceUnsupported
+}
@@ -7,26 +7,41 @@ import (
 	"os"
 )
 
-const manifestVersion = 3
+// manifestVersion is the newest manifest version that can be read. Stores that
+// use any of the features that change how they have to be read, like key
+// normalization, are saved with it, so that older binaries, which only know
+// baseManifestVersion, refuse to load them rather than silently looking keys
+// up the wrong way. Other stores are still saved with baseManifestVersion.
+const manifestVersion = 4
+
+// baseManifestVersion is the oldest manifest version that can be read.
+const baseManifestVersion = 3
 
 var ErrWrongVersion = errors.New("wrong manifest version")
 
 type Manifest struct {
-	Version            int             `json:"version"`
-	Blocks             []BlockManifest `json:"blocks"`
-	NumPartitions      int             `json:"num_partitions"`
-	SelectedPartitions []int           `json:"selected_partitions"`
-	Compression        Compression     `json:"compression"`
-	BlockSize          int             `json:"block_size"`
+	Version            int                `json:"version"`
+	Blocks             []BlockManifest    `json:"blocks"`
+	NumPartitions      int                `json:"num_partitions"`
+	SelectedPartitions []int              `json:"selected_partitions"`
+	Compression        Compression        `json:"compression"`
+	BlockSize          int                `json:"block_size"`
+	KeyNormalization   []KeyNormalization `json:"key_normalization,omitempty"`
+	KeyPrefix          KeyPrefix          `json:"key_prefix"`
+	PartitionHash      PartitionHash      `json:"partition_hash,omitempty"`
+	SourceFiles        map[string]string  `json:"source_files,omitempty"`
 }
 
 type BlockManifest struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Partition int    `json:"partition"`
-	Count     int    `json:"count"`
-	MinKey    []byte `json:"min_key"`
-	MaxKey    []byte `json:"max_key"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Partition    int    `json:"partition"`
+	Count        int    `json:"count"`
+	MinKey       []byte `json:"min_key"`
+	MaxKey       []byte `json:"max_key"`
+	MetadataName string `json:"metadata_name,omitempty"`
+	BloomName    string `json:"bloom_name,omitempty"`
+	Source       string `json:"source,omitempty"`
 }
 
 func readManifest(path string) (Manifest, error) {
@@ -48,7 +63,7 @@ func readManifest(path string) (Manifest, error) {
 		return m, err
 	}
 
-	if m.Version != manifestVersion {
+	if m.Version < baseManifestVersion || m.Version > manifestVersion {
 		return m, ErrWrongVersion
 	}
 
@@ -68,7 +83,29 @@ func readManifest(path string) (Manifest, error) {
 	return m, nil
 }
 
+// requiredVersion returns the oldest manifest version that can describe the
+// store.
+func (m Manifest) requiredVersion() int {
+	if len(m.KeyNormalization) > 0 || m.KeyPrefix != (KeyPrefix{}) {
+		return manifestVersion
+	}
+
+	// Older binaries always partition with JavaHash.
+	if m.PartitionHash != "" && m.PartitionHash != JavaHash {
+		return manifestVersion
+	}
+
+	for _, block := range m.Blocks {
+		if block.MetadataName != "" || block.BloomName != "" {
+			return manifestVersion
+		}
+	}
+
+	return baseManifestVersion
+}
+
 func writeManifest(path string, m Manifest) error {
+	m.Version = m.requiredVersion()
 	bytes, err := json.Marshal(m)
 	if err != nil {
 		return err
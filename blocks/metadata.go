@@ -0,0 +1,43 @@
+package blocks
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bsm/go-sparkey"
+)
+
+// metadataPath returns the path of the sparkey file that holds per-key
+// metadata for the block at the given path.
+func metadataPath(blockPath string) string {
+	return strings.TrimSuffix(blockPath, ".spl") + "-metadata.spl"
+}
+
+func (b *Block) openMetadata(storePath string) error {
+	reader, err := sparkey.Open(filepath.Join(storePath, b.MetadataName))
+	if err != nil {
+		return fmt.Errorf("opening block metadata: %s", err)
+	}
+
+	b.metadataReader = reader
+	b.metadataPool = newIterPool(reader)
+	return nil
+}
+
+// getMetadata returns the metadata blob for a key, or nil if it doesn't have
+// one.
+func (b *Block) getMetadata(key []byte) ([]byte, error) {
+	iter, err := b.metadataPool.getIter()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := iter.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b.metadataPool.Put(iter)
+	return metadata, nil
+}
@@ -0,0 +1,57 @@
+package blocks
+
+import (
+	"bytes"
+	"net/url"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A KeyNormalization is a transformation applied to keys before they're
+// partitioned and stored, and to keys being looked up, so that lookups can
+// match keys that aren't byte-for-byte identical.
+type KeyNormalization string
+
+const LowercaseNormalization KeyNormalization = "lowercase"
+const NFCNormalization KeyNormalization = "nfc"
+const URLDecodeNormalization KeyNormalization = "urldecode"
+
+// NormalizeKey applies the block store's key normalizations, in order, to the
+// key. Keys must be normalized before they are passed to Add, Get, or
+// KeyPartition. Normalization happens before the key prefix is taken.
+func (store *BlockStore) NormalizeKey(key []byte) []byte {
+	for _, n := range store.keyNormalization {
+		switch n {
+		case LowercaseNormalization:
+			key = bytes.ToLower(key)
+		case NFCNormalization:
+			key = norm.NFC.Bytes(key)
+		case URLDecodeNormalization:
+			key = urlDecode(key)
+		}
+	}
+
+	return key
+}
+
+// urlDecode decodes percent-encoded characters in the key. '+' is left alone,
+// since it's only a space in query strings. Keys that aren't validly encoded
+// are left as they are.
+func urlDecode(key []byte) []byte {
+	if bytes.IndexByte(key, '%') == -1 {
+		return key
+	}
+
+	decoded, err := url.PathUnescape(string(key))
+	if err != nil {
+		return key
+	}
+
+	return []byte(decoded)
+}
+
+// KeyNormalization returns the key normalizations the block store was created
+// with.
+func (store *BlockStore) KeyNormalization() []KeyNormalization {
+	return store.keyNormalization
+}
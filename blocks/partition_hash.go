@@ -0,0 +1,159 @@
+package blocks
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+)
+
+// A PartitionHash is the hash function used to map keys to partitions. The
+// default, JavaHash, matches the way hadoop shuffles keys to reducers, which
+// lets sequins skip files that only contain partitions it doesn't need. The
+// others spread keys more evenly, but since the input won't be laid out the
+// same way, every node has to read every file.
+type PartitionHash string
+
+const (
+	JavaHash    PartitionHash = "java"
+	FNVHash     PartitionHash = "fnv"
+	Murmur3Hash PartitionHash = "murmur3"
+	XXHash      PartitionHash = "xxhash"
+)
+
+// KeyPartition returns the partition for a key using the hash function. For
+// JavaHash (or an empty PartitionHash), this is the same as the package-level
+// KeyPartition. The other hash functions never return an alternate partition.
+func (h PartitionHash) KeyPartition(key []byte, totalPartitions int) (int, int) {
+	var partition int
+	switch h {
+	case FNVHash:
+		hash := fnv.New32a()
+		hash.Write(key)
+		partition = int(hash.Sum32() % uint32(totalPartitions))
+	case Murmur3Hash:
+		partition = int(murmur3(key) % uint32(totalPartitions))
+	case XXHash:
+		partition = int(xxhash64(key) % uint64(totalPartitions))
+	default:
+		return KeyPartition(key, totalPartitions)
+	}
+
+	return partition, partition
+}
+
+// murmur3 implements the 32-bit (x86) variant of MurmurHash3, with a seed of 0.
+func murmur3(b []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	var h uint32
+	n := len(b)
+	for ; len(b) >= 4; b = b[4:] {
+		k := binary.LittleEndian.Uint32(b)
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(b) {
+	case 3:
+		k ^= uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(b[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// These are vars rather than consts so that arithmetic on them wraps around.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 implements XXH64, with a seed of 0.
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+
+	var h uint64
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+
+	for ; len(b) > 0; b = b[1:] {
+		h ^= uint64(b[0]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,110 @@
+package blocks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/colinmarc/sequencefile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The expected values are from the reference implementations.
+func TestMurmur3(t *testing.T) {
+	assert.EqualValues(t, 0, murmur3([]byte("")))
+	assert.EqualValues(t, 0x248bfa47, murmur3([]byte("hello")))
+	assert.EqualValues(t, 0x2e4ff723, murmur3([]byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestXXHash64(t *testing.T) {
+	assert.EqualValues(t, uint64(0xef46db3751d8e999), xxhash64([]byte("")))
+	assert.EqualValues(t, uint64(0xd24ec4f1a98c6e5b), xxhash64([]byte("a")))
+	assert.EqualValues(t, uint64(0x44bc2cf5ad770999), xxhash64([]byte("abc")))
+	assert.EqualValues(t, uint64(0xfbcea83c8a378bf1), xxhash64([]byte("Nobody inspects the spammish repetition")))
+}
+
+func TestPartitionHashDefault(t *testing.T) {
+	key := []byte("foo bar baz")
+	normal, alternate := KeyPartition(key, 20)
+
+	p1, p2 := PartitionHash("").KeyPartition(key, 20)
+	assert.Equal(t, normal, p1, "an empty partition hash should behave like java")
+	assert.Equal(t, alternate, p2, "an empty partition hash should behave like java")
+
+	p1, p2 = JavaHash.KeyPartition(key, 20)
+	assert.Equal(t, normal, p1)
+	assert.Equal(t, alternate, p2)
+}
+
+func TestPartitionHashStable(t *testing.T) {
+	for _, hash := range []PartitionHash{FNVHash, Murmur3Hash, XXHash} {
+		for _, key := range []string{"", "a", "Alice", "The quick brown fox jumps over the lazy dog"} {
+			p1, p2 := hash.KeyPartition([]byte(key), 7)
+			assert.Equal(t, p1, p2, "%s should never return an alternate partition", hash)
+			assert.True(t, p1 >= 0 && p1 < 7, "%s should return a partition in range", hash)
+
+			again, _ := hash.KeyPartition([]byte(key), 7)
+			assert.Equal(t, p1, again, "%s should be deterministic", hash)
+		}
+	}
+}
+
+func TestPartitionHashDistribution(t *testing.T) {
+	const numPartitions = 20
+
+	files, err := filepath.Glob("../test/baby-names/1/part-*")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	counts := make([]int, numPartitions)
+	total := 0
+	for _, file := range files {
+		for _, key := range readTestKeys(t, file) {
+			partition, _ := Murmur3Hash.KeyPartition(key, numPartitions)
+			counts[partition]++
+			total++
+		}
+	}
+
+	// With a uniform hash, the partition sizes are binomially distributed, so we
+	// compare the observed variance to that. The dataset is small, so even a
+	// perfect hash won't split it exactly evenly.
+	mean := float64(total) / numPartitions
+	variance := 0.0
+	for _, count := range counts {
+		variance += (float64(count) - mean) * (float64(count) - mean)
+	}
+
+	variance /= numPartitions
+	expected := mean * (1 - 1.0/numPartitions)
+	assert.True(t, variance < 2*expected,
+		"the variance of the partition sizes (%.1f) should be less than twice that of a uniform hash (%.1f): %v", variance, expected, counts)
+}
+
+func readTestKeys(t *testing.T, path string) [][]byte {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	sf := sequencefile.NewReader(f)
+	require.NoError(t, sf.ReadHeader())
+
+	var keys [][]byte
+	for sf.Scan() {
+		var key []byte
+		switch sf.Header.KeyClassName {
+		case sequencefile.BytesWritableClassName:
+			key = sequencefile.BytesWritable(sf.Key())
+		case sequencefile.TextClassName:
+			key = []byte(sequencefile.Text(sf.Key()))
+		default:
+			key = sf.Key()
+		}
+
+		keys = append(keys, append([]byte(nil), key...))
+	}
+
+	require.NoError(t, sf.Err())
+	return keys
+}
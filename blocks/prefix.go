@@ -0,0 +1,48 @@
+package blocks
+
+import "bytes"
+
+// A KeyPrefix configures partitioning by only the beginning of each key, so
+// that keys sharing a prefix (for example, a tenant ID) end up in the same
+// partition. The prefix ends before the first Delimiter, or after Length bytes;
+// if neither is set, or the key is too short, the whole key is used. Keys are
+// still stored and looked up by the whole key.
+type KeyPrefix struct {
+	Delimiter string `json:"delimiter,omitempty"`
+	Length    int    `json:"length,omitempty"`
+}
+
+func (p KeyPrefix) prefix(key []byte) []byte {
+	if p.Delimiter != "" {
+		if i := bytes.Index(key, []byte(p.Delimiter)); i != -1 {
+			return key[:i]
+		}
+	} else if p.Length > 0 && len(key) > p.Length {
+		return key[:p.Length]
+	}
+
+	return key
+}
+
+// KeyPartition returns the partition for a key in this block store, like
+// the package-level KeyPartition, but taking into account the key prefix and
+// partition hash the block store was created with. The key must already be
+// normalized.
+func (store *BlockStore) KeyPartition(key []byte) (int, int) {
+	return store.partitionHash.KeyPartition(store.keyPrefix.prefix(key), store.numPartitions)
+}
+
+// KeyPrefix returns the key prefix the block store was created with.
+func (store *BlockStore) KeyPrefix() KeyPrefix {
+	return store.keyPrefix
+}
+
+// covers returns true if every key starting with scanPrefix has the same key
+// prefix, and so is in the same partition.
+func (p KeyPrefix) covers(scanPrefix []byte) bool {
+	if p.Delimiter != "" {
+		return bytes.Contains(scanPrefix, []byte(p.Delimiter))
+	}
+
+	return p.Length > 0 && len(scanPrefix) > p.Length
+}
@@ -10,6 +10,9 @@ import (
 type Record struct {
 	ValueLen uint64
 
+	// Metadata is the metadata blob stored with the value, if there is one.
+	Metadata []byte
+
 	iterPool iterPool
 	iter     *sparkey.HashIter
 	reader   io.Reader
@@ -33,8 +36,18 @@ func (b *Block) get(key []byte) (*Record, error) {
 		return nil, nil
 	}
 
+	var metadata []byte
+	if b.metadataReader != nil {
+		metadata, err = b.getMetadata(key)
+		if err != nil {
+			b.iterPool.Put(iter)
+			return nil, err
+		}
+	}
+
 	return &Record{
 		ValueLen: iter.ValueLen(),
+		Metadata: metadata,
 		iterPool: b.iterPool,
 		iter:     iter,
 		reader:   iter.ValueReader(),
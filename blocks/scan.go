@@ -0,0 +1,98 @@
+package blocks
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bsm/go-sparkey"
+)
+
+// ScanPrefix calls fn with each key in the partition that starts with prefix,
+// along with its value, until fn returns false. The prefix must already be
+// normalized. Keys are visited in the order they were written to each block,
+// which is not necessarily sorted. It returns false if fn stopped the scan, and
+// ErrPartitionNotFound if the partition is not available locally.
+//
+// This reads every block in the partition that could have a matching key, so
+// it's much more expensive than Get.
+func (store *BlockStore) ScanPrefix(partition int, prefix []byte, fn func(key, value []byte) bool) (bool, error) {
+	store.blockMapLock.RLock()
+	blocks, ok := store.BlockMap[partition]
+	store.blockMapLock.RUnlock()
+	if !ok {
+		return false, ErrPartitionNotFound
+	}
+
+	for _, block := range blocks {
+		more, err := block.scanPrefix(prefix, fn)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+
+	return true, nil
+}
+
+// PrefixPartitions returns the partitions that could have keys starting with
+// prefix, which must already be normalized. Usually that's every partition,
+// but if the block store has a KeyPrefix and the prefix is long enough to
+// include it, then all the matching keys are in the same partition.
+func (store *BlockStore) PrefixPartitions(prefix []byte) []int {
+	if store.keyPrefix.covers(prefix) {
+		partition, alternatePartition := store.KeyPartition(prefix)
+		if partition == alternatePartition {
+			return []int{partition}
+		}
+
+		return []int{partition, alternatePartition}
+	}
+
+	partitions := make([]int, store.numPartitions)
+	for i := range partitions {
+		partitions[i] = i
+	}
+
+	return partitions
+}
+
+func (b *Block) scanPrefix(prefix []byte, fn func(key, value []byte) bool) (bool, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	// Skip the block entirely if all of its keys sort before or after the keys
+	// with the prefix.
+	if b.maxKey != nil && bytes.Compare(b.maxKey, prefix) < 0 {
+		return true, nil
+	} else if b.minKey != nil && bytes.Compare(b.minKey, prefix) > 0 && !bytes.HasPrefix(b.minKey, prefix) {
+		return true, nil
+	}
+
+	// Iterators from the pool may have been left anywhere by Seek, so this needs
+	// a fresh one that starts at the beginning of the log.
+	iter, err := b.sparkeyReader.Iterator()
+	if err != nil {
+		return false, fmt.Errorf("opening block iter: %s", err)
+	}
+
+	defer iter.Close()
+
+	for iter.NextLive(); iter.State() == sparkey.ITERATOR_ACTIVE; iter.NextLive() {
+		key, err := iter.Key()
+		if err != nil {
+			return false, err
+		} else if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+
+		value, err := iter.Value()
+		if err != nil {
+			return false, err
+		}
+
+		if !fn(key, value) {
+			return false, nil
+		}
+	}
+
+	return true, iter.Err()
+}
@@ -0,0 +1,63 @@
+package blocks
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// warmChunkSize is how much of a file Warm reads at a time.
+const warmChunkSize = 1024 * 1024
+
+// Warm reads the index file of every block in the store from start to finish,
+// so that the OS pulls it into the page cache, and the first lookups don't
+// have to wait on the disk. If deadline isn't zero, it stops early once the
+// deadline has passed. It returns the number of bytes read.
+func (store *BlockStore) Warm(deadline time.Time) (int64, error) {
+	store.blockMapLock.RLock()
+	files := make([]string, 0, len(store.Blocks))
+	for _, block := range store.Blocks {
+		files = append(files, block.sparkeyReader.Name())
+		if block.metadataReader != nil {
+			files = append(files, block.metadataReader.Name())
+		}
+	}
+	store.blockMapLock.RUnlock()
+
+	var total int64
+	buf := make([]byte, warmChunkSize)
+	for _, file := range files {
+		n, err := warmFile(file, buf, deadline)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+	}
+
+	return total, nil
+}
+
+func warmFile(file string, buf []byte, deadline time.Time) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var total int64
+	for deadline.IsZero() || time.Now().Before(deadline) {
+		n, err := f.Read(buf)
+		total += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
@@ -9,10 +9,13 @@ import (
 	"time"
 
 	"github.com/colinmarc/sequencefile"
-
-	"github.com/stripe/sequins/blocks"
+	"github.com/stripe/sequins/backend"
 )
 
+// maxLoadRetryBackoff caps how long to wait between retries of a failed load,
+// however many times it has failed.
+const maxLoadRetryBackoff = 5 * time.Minute
+
 var (
 	errWrongPartition = errors.New("the file is cleanly partitioned, but doesn't contain a partition we want")
 	errCanceled       = errors.New("build canceled")
@@ -28,6 +31,19 @@ func (vs *version) build() {
 		return
 	}
 
+	// With a read-only store, we serve what we have, and never load anything.
+	if vs.sequins.config.ReadOnlyStore {
+		vs.built = true
+		return
+	}
+
+	// Any local copy the backend made of the version is only needed while
+	// it's being loaded.
+	defer vs.releaseSource()
+
+	// The load is queued until we have all the locks below.
+	vs.load = vs.sequins.loads.queue(vs.db.name, vs.name)
+
 	// Then the db-wide lock, and check that a newer version didn't obsolete us.
 	vs.db.buildLock.Lock()
 	defer vs.db.buildLock.Unlock()
@@ -40,45 +56,121 @@ func (vs *version) build() {
 
 	partitions := vs.partitions.needed()
 	if len(partitions) == 0 {
+		vs.sequins.loads.remove(vs.load)
 		vs.built = true
 		return
 	}
 
-	log.Println("Loading", len(partitions), "partitions of", vs.db.name, "version", vs.name,
-		"from", vs.sequins.backend.DisplayPath(vs.db.name, vs.name))
+	logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_loading"},
+		"Loading %d partitions of %s version %s from %s",
+		len(partitions), vs.db.name, vs.name, vs.sequins.backend.DisplayPath(vs.db.name, vs.name))
+	start := time.Now()
 
 	// We create the directory right before we load data into it, so we don't
 	// leave empty directories laying around.
 	err := os.MkdirAll(vs.path, 0755|os.ModeDir)
 	if err != nil && !os.IsExist(err) {
 		log.Printf("Error initializing version %s of %s: %s", vs.name, vs.db.name, err)
+		vs.load.fail(err)
 		vs.setState(versionError)
 		return
 	}
 
-	err = vs.addFiles(partitions)
+	err = vs.addFilesWithRetries(partitions)
 	if err != nil {
 		if err != errCanceled {
-			log.Printf("Error building version %s of %s: %s", vs.name, vs.db.name, err)
+			logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_load_failed"},
+				"Error building version %s of %s: %s", vs.name, vs.db.name, err)
+			vs.load.fail(err)
 			vs.setState(versionError)
+		} else {
+			vs.sequins.loads.remove(vs.load)
 		}
 
 		vs.blockStore.Revert()
 		return
 	}
 
+	vs.advise()
+	vs.warm()
 	vs.partitions.updateLocalPartitions(partitions)
+	vs.setLoadDuration(time.Since(start))
+	vs.load.setState(loadDone)
 	vs.built = true
 }
 
+// addFilesWithRetries calls addFiles, retrying it with exponential backoff if
+// it fails, up to 'load_max_retries' times. The version stays in the building
+// state in the meantime. The backoff doubles after each attempt, up to
+// maxLoadRetryBackoff.
+func (vs *version) addFilesWithRetries(partitions map[int]bool) error {
+	backoff := vs.sequins.config.LoadRetryBackoff.Duration
+	maxRetries := vs.sequins.config.LoadMaxRetries
+
+	err := vs.addFiles(partitions)
+	for attempt := 1; attempt <= maxRetries && err != nil && err != errCanceled; attempt++ {
+		log.Printf("Error building version %s of %s (attempt %d of %d), retrying in %s: %s",
+			vs.name, vs.db.name, attempt, maxRetries+1, backoff, err)
+		vs.blockStore.Revert()
+
+		if !vs.waitToRetry(backoff) {
+			return errCanceled
+		}
+
+		backoff *= 2
+		if backoff > maxLoadRetryBackoff {
+			backoff = maxLoadRetryBackoff
+		}
+
+		err = vs.addFiles(partitions)
+	}
+
+	return err
+}
+
+// waitToRetry waits for the given backoff before a load is retried, and
+// returns false if the version is canceled in the meantime. The global build
+// lock is released while waiting, so that a db that keeps failing to load
+// doesn't take up a 'max_parallel_loads' slot that other dbs could use.
+func (vs *version) waitToRetry(backoff time.Duration) bool {
+	if vs.sequins.buildLock != nil {
+		vs.sequins.buildLock.Unlock()
+		defer vs.sequins.buildLock.Lock()
+	}
+
+	select {
+	case <-vs.cancel:
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
+
 // addFiles adds the given files to the block store, selecting only the
-// given partitions.
+// given partitions. If configured to, it then reads back a random sample of the
+// keys it added, before saving the block store.
 func (vs *version) addFiles(partitions map[int]bool) error {
+	vs.load.setState(loadDownloading)
 	if len(vs.files) == 0 {
 		log.Println("Version", vs.name, "of", vs.db.name, "has no data. Loading it anyway.")
 		return nil
 	}
 
+	var sample *keySample
+	if n := vs.sequins.config.Storage.VerifySampleSize; n > 0 {
+		sample = newKeySample(n)
+	}
+
+	checksums, err := vs.expectedChecksums()
+	if err != nil {
+		return err
+	}
+
+	fingerprints, previous := vs.incrementalSource()
+	if previous != nil {
+		defer vs.db.mux.release(previous)
+	}
+
 	// TODO: parallelize files?
 	for _, file := range vs.files {
 		select {
@@ -87,16 +179,53 @@ func (vs *version) addFiles(partitions map[int]bool) error {
 		default:
 		}
 
-		err := vs.addFile(file, partitions)
+		var err error
+		if fingerprints != nil {
+			err = vs.addFileIncremental(file, fingerprints[file], checksums[file], previous, partitions, sample)
+		} else {
+			err = vs.addFile(file, checksums[file], partitions, sample)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range vs.metadataFiles {
+		select {
+		case <-vs.cancel:
+			return errCanceled
+		default:
+		}
+
+		err := vs.addMetadataFile(file, partitions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Everything's been read; what's left is writing out the index.
+	vs.load.setState(loadIndexing)
+
+	if sample != nil {
+		err := vs.blockStore.Flush()
+		if err != nil {
+			return err
+		}
+
+		err = vs.verify(sample)
 		if err != nil {
 			return err
 		}
 	}
 
-	return vs.blockStore.Save(vs.partitions.selected)
+	return vs.blockStore.Save(vs.partitions.getSelected())
 }
 
-func (vs *version) addFile(file string, partitions map[int]bool) error {
+// addFile reads a file into the block store. If checksum is set, the file is
+// checked against it once it's been read, and the whole build fails if it
+// doesn't match; nothing is saved until every file has been read.
+func (vs *version) addFile(file, checksum string, partitions map[int]bool, sample *keySample) error {
 	disp := vs.sequins.backend.DisplayPath(vs.db.name, vs.name, file)
 	log.Println("Reading records from", disp)
 
@@ -106,23 +235,102 @@ func (vs *version) addFile(file string, partitions map[int]bool) error {
 	}
 	defer stream.Close()
 
-	sf := sequencefile.NewReader(bufio.NewReader(stream))
+	reader := vs.load.reader(stream)
+	var cr *checksumReader
+	if checksum != "" {
+		cr = newChecksumReader(reader, checksum)
+		reader = cr
+	}
+
+	sf := sequencefile.NewReader(bufio.NewReader(reader))
 	err = sf.ReadHeader()
 	if err != nil {
 		return fmt.Errorf("reading header from %s: %s", disp, err)
 	}
 
-	err = vs.addFileKeys(sf, partitions)
+	err = vs.addFileKeys(sf, partitions, sample)
 	if err == errWrongPartition {
+		// Nothing from the file was added, so there's nothing to verify.
 		log.Println("Skipping", disp, "because it contains no relevant partitions")
 	} else if err != nil {
 		return fmt.Errorf("reading %s: %s", disp, err)
+	} else if cr != nil {
+		err = cr.verify()
+		if err != nil {
+			return fmt.Errorf("verifying %s: %s", disp, err)
+		}
 	}
 
 	return nil
 }
 
-func (vs *version) addFileKeys(reader *sequencefile.Reader, partitions map[int]bool) error {
+// releaseSource releases the backend's local copy of the version, if it keeps
+// one, like an extracted archive.
+func (vs *version) releaseSource() {
+	releaser, ok := vs.sequins.backend.(backend.Releaser)
+	if !ok {
+		return
+	}
+
+	err := releaser.Release(vs.db.name, vs.name)
+	if err != nil {
+		log.Printf("Error releasing the local copy of version %s of %s: %s", vs.name, vs.db.name, err)
+	}
+}
+
+// incrementalSource returns the fingerprints of the version's files, and the
+// version to reuse unchanged files from, if incremental_load is enabled and the
+// backend supports it. Versions with metadata files are always loaded in full.
+// If a previous version is returned, it must be released.
+func (vs *version) incrementalSource() (map[string]string, *version) {
+	if !vs.sequins.config.IncrementalLoad || len(vs.metadataFiles) > 0 {
+		return nil, nil
+	}
+
+	fingerprinter, ok := vs.sequins.backend.(backend.Fingerprinter)
+	if !ok {
+		return nil, nil
+	}
+
+	fingerprints, err := fingerprinter.Fingerprints(vs.db.name, vs.name)
+	if err != nil {
+		log.Printf("Error fingerprinting files for version %s of %s, loading it in full: %s", vs.name, vs.db.name, err)
+		return nil, nil
+	}
+
+	// The current version can't be reused from if it's the one being loaded,
+	// including when it's being repaired.
+	previous := vs.db.mux.getCurrent()
+	if previous != nil && previous.name == vs.name {
+		vs.db.mux.release(previous)
+		previous = nil
+	}
+
+	return fingerprints, previous
+}
+
+// addFileIncremental adds a file in a way that lets later versions reuse it,
+// first trying to reuse it from the previous version, if it hasn't changed.
+func (vs *version) addFileIncremental(file, fingerprint, checksum string, previous *version, partitions map[int]bool, sample *keySample) error {
+	if previous != nil {
+		reused, err := vs.blockStore.ReuseSource(previous.blockStore, file, fingerprint, partitions)
+		if err != nil {
+			log.Printf("Error reusing %s from version %s of %s, reading it again: %s", file, previous.name, vs.db.name, err)
+		} else if reused {
+			log.Printf("Reusing %s from version %s of %s", file, previous.name, vs.db.name)
+			return nil
+		}
+	}
+
+	err := vs.blockStore.SetSource(file, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	return vs.addFile(file, checksum, partitions, sample)
+}
+
+func (vs *version) addFileKeys(reader *sequencefile.Reader, partitions map[int]bool, sample *keySample) error {
 	throttle := vs.sequins.config.ThrottleLoads.Duration
 	canAssumePartition := true
 	assumedPartition := -1
@@ -138,7 +346,9 @@ func (vs *version) addFileKeys(reader *sequencefile.Reader, partitions map[int]b
 			return err
 		}
 
-		partition, alternatePartition := blocks.KeyPartition(key, vs.numPartitions)
+		key = vs.blockStore.NormalizeKey(key)
+
+		partition, alternatePartition := vs.blockStore.KeyPartition(key)
 
 		// If we see the same partition (which is based on the hash) for the first
 		// 5000 keys, it's safe to assume that this file only contains that
@@ -173,6 +383,8 @@ func (vs *version) addFileKeys(reader *sequencefile.Reader, partitions map[int]b
 		if err != nil {
 			return err
 		}
+
+		sample.add(key, value)
 	}
 
 	if reader.Err() != nil {
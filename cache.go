@@ -0,0 +1,149 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// maxCachedFraction limits the size of a single cached value to a fraction of
+// the cache, so that one big value can't flush everything else out.
+const maxCachedFraction = 16
+
+// A valueCache is an LRU cache of values, bounded by their total size, which
+// sits in front of the block store for hot keys. It's shared by every db, and
+// entries are keyed by db and version as well as key, so that when a db
+// upgrades, the new version starts with a cold cache rather than serving stale
+// values. Entries for old versions are never requested again, and just age out.
+// If a version's block store is replaced or partly reloaded, for example
+// because it was corrupt, its entries are dropped right away.
+type valueCache struct {
+	capacity int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+	lock     sync.Mutex
+
+	hits   int64
+	misses int64
+}
+
+type cachedValue struct {
+	id       string
+	value    []byte
+	metadata []byte
+}
+
+type cacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Bytes   int64 `json:"bytes"`
+	Entries int   `json:"entries"`
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func cacheID(vs *version, key string) string {
+	return cacheVersionPrefix(vs) + key
+}
+
+func cacheVersionPrefix(vs *version) string {
+	return vs.db.name + "/" + vs.name + "/"
+}
+
+// get returns the cached value for a key in the given version, if there is
+// one, and counts the hit or miss.
+func (c *valueCache) get(vs *version, key string) (*cachedValue, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[cacheID(vs, key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedValue), true
+}
+
+// fits returns true if a value of the given length is small enough to cache.
+func (c *valueCache) fits(valueLen uint64) bool {
+	return valueLen <= uint64(c.capacity/maxCachedFraction)
+}
+
+// add caches a value, evicting the least recently used values to make room.
+// The value and metadata must not be modified afterwards.
+func (c *valueCache) add(vs *version, key string, value, metadata []byte) {
+	entry := &cachedValue{
+		id:       cacheID(vs, key),
+		value:    value,
+		metadata: metadata,
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[entry.id]; ok {
+		return
+	}
+
+	c.entries[entry.id] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+
+		evicted := oldest.Value.(*cachedValue)
+		delete(c.entries, evicted.id)
+		c.size -= evicted.size()
+	}
+}
+
+// dropVersion removes every cached value for the given version.
+func (c *valueCache) dropVersion(vs *version) {
+	prefix := cacheVersionPrefix(vs)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for id, el := range c.entries {
+		if strings.HasPrefix(id, prefix) {
+			c.lru.Remove(el)
+			delete(c.entries, id)
+			c.size -= el.Value.(*cachedValue).size()
+		}
+	}
+}
+
+// dropCachedValues drops the version's values from the cache, if there is one,
+// so that values read from a block store that's since been replaced aren't
+// served any more.
+func (vs *version) dropCachedValues() {
+	if cache := vs.sequins.cache; cache != nil {
+		cache.dropVersion(vs)
+	}
+}
+
+func (c *valueCache) stats() *cacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return &cacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Bytes:   c.size,
+		Entries: len(c.entries),
+	}
+}
+
+func (cv *cachedValue) size() int64 {
+	return int64(len(cv.id) + len(cv.value) + len(cv.metadata))
+}
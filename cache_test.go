@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueCacheEviction(t *testing.T) {
+	vs := &version{name: "1", db: &db{name: "foo"}}
+	cache := newValueCache(160)
+
+	cache.add(vs, "a", make([]byte, 50), nil)
+	cache.add(vs, "b", make([]byte, 50), nil)
+	_, ok := cache.get(vs, "a")
+	require.True(t, ok, "a should be cached")
+
+	// Adding c pushes the cache over capacity, so the least recently used value,
+	// b, should be evicted.
+	cache.add(vs, "c", make([]byte, 50), nil)
+	_, ok = cache.get(vs, "b")
+	assert.False(t, ok, "b should have been evicted")
+	_, ok = cache.get(vs, "a")
+	assert.True(t, ok, "a should still be cached")
+	_, ok = cache.get(vs, "c")
+	assert.True(t, ok, "c should be cached")
+
+	st := cache.stats()
+	assert.EqualValues(t, 3, st.Hits)
+	assert.EqualValues(t, 1, st.Misses)
+	assert.Equal(t, 2, st.Entries)
+	assert.True(t, st.Bytes <= 160, "the cache should stay under capacity")
+}
+
+func TestValueCacheVersions(t *testing.T) {
+	db := &db{name: "foo"}
+	v1 := &version{name: "1", db: db}
+	v2 := &version{name: "2", db: db}
+	cache := newValueCache(1024)
+
+	cache.add(v1, "a", []byte("old"), nil)
+	_, ok := cache.get(v2, "a")
+	assert.False(t, ok, "values shouldn't be shared between versions")
+
+	assert.True(t, cache.fits(64))
+	assert.False(t, cache.fits(65), "values bigger than a fraction of the cache shouldn't fit")
+}
+
+func TestValueCacheDropVersion(t *testing.T) {
+	db := &db{name: "foo"}
+	v1 := &version{name: "1", db: db}
+	v10 := &version{name: "10", db: db}
+	cache := newValueCache(1024)
+
+	cache.add(v1, "a", []byte("old"), nil)
+	cache.add(v1, "b", []byte("old"), nil)
+	cache.add(v10, "a", []byte("new"), nil)
+	cache.dropVersion(v1)
+
+	_, ok := cache.get(v1, "a")
+	assert.False(t, ok, "values for the dropped version should be gone")
+	_, ok = cache.get(v10, "a")
+	assert.True(t, ok, "values for other versions should still be cached")
+
+	st := cache.stats()
+	assert.Equal(t, 1, st.Entries)
+	assert.EqualValues(t, len("foo/10/a")+len("new"), st.Bytes, "the dropped values shouldn't count towards the size")
+}
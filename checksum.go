@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/stripe/sequins/backend"
+)
+
+// checksumSuffix marks sidecar files with the MD5 of a data file, when
+// 'verify_checksums' is set. For a data file named 'part-00000', the sidecar
+// would be 'part-00000.md5'. It's in the format md5sum(1) produces: the hex
+// digest, optionally followed by the file name.
+const checksumSuffix = ".md5"
+
+// splitChecksumFiles separates any checksum sidecar files from the data files
+// in a version.
+func splitChecksumFiles(files []string) (data []string, checksums []string) {
+	for _, file := range files {
+		if strings.HasSuffix(file, checksumSuffix) {
+			checksums = append(checksums, file)
+		} else {
+			data = append(data, file)
+		}
+	}
+
+	return data, checksums
+}
+
+// expectedChecksums returns the MD5 each data file in the version should have,
+// keyed by name, if 'verify_checksums' is set. Sidecar files take precedence
+// over checksums from the backend, like S3 ETags. Files without either aren't
+// verified.
+func (vs *version) expectedChecksums() (map[string]string, error) {
+	if !vs.sequins.config.Storage.VerifyChecksums {
+		return nil, nil
+	}
+
+	checksums := make(map[string]string)
+	if checksummer, ok := vs.sequins.backend.(backend.Checksummer); ok {
+		fromBackend, err := checksummer.Checksums(vs.db.name, vs.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for file, checksum := range fromBackend {
+			checksums[file] = checksum
+		}
+	}
+
+	for _, file := range vs.checksumFiles {
+		checksum, err := vs.readChecksumFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		checksums[strings.TrimSuffix(file, checksumSuffix)] = checksum
+	}
+
+	for _, file := range vs.files {
+		if checksums[file] == "" {
+			log.Printf("No checksum for %s, loading it without verification",
+				vs.sequins.backend.DisplayPath(vs.db.name, vs.name, file))
+		}
+	}
+
+	return checksums, nil
+}
+
+func (vs *version) readChecksumFile(file string) (string, error) {
+	disp := vs.sequins.backend.DisplayPath(vs.db.name, vs.name, file)
+	stream, err := vs.sequins.backend.Open(vs.db.name, vs.name, file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %s", disp, err)
+	}
+	defer stream.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(stream, 1024))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %s", disp, err)
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("reading %s: no checksum", disp)
+	}
+
+	checksum := strings.ToLower(fields[0])
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != md5.Size {
+		return "", fmt.Errorf("reading %s: invalid checksum %q", disp, fields[0])
+	}
+
+	return checksum, nil
+}
+
+// A checksumReader computes the MD5 of everything read through it, so that it
+// can be compared to the expected checksum once the file has been read.
+type checksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func newChecksumReader(r io.Reader, expected string) *checksumReader {
+	return &checksumReader{r: r, hash: md5.New(), expected: expected}
+}
+
+func (cr *checksumReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.hash.Write(b[:n])
+	return n, err
+}
+
+// verify reads anything left in the file, and then checks the checksum.
+func (cr *checksumReader) verify() error {
+	_, err := io.Copy(ioutil.Discard, cr)
+	if err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(cr.hash.Sum(nil))
+	if actual != cr.expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", cr.expected, actual)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -113,7 +114,7 @@ func (tc *testCluster) addSequins() *testSequins {
 	config.Sharding.TimeToConverge = duration{100 * time.Millisecond}
 	config.Sharding.ProxyTimeout = duration{600 * time.Millisecond}
 	config.Sharding.AdvertisedHostname = "localhost"
-	config.ZK.Servers = []string{tc.zk.addr}
+	config.ZK.Servers = zkServers{{tc.zk.addr}}
 	config.Test.AllowLocalCluster = true
 
 	// Slow everything down to an observable level.
@@ -309,6 +310,13 @@ func (ts *testSequins) stop() {
 	ts.process.Process.Wait()
 }
 
+// kill stops the process without giving it a chance to shut down cleanly, so
+// that it's still registered with zookeeper until its session times out.
+func (ts *testSequins) kill() {
+	ts.process.Process.Kill()
+	ts.process.Process.Wait()
+}
+
 func (ts *testSequins) assertProgression() {
 	var actualProgression []testVersion
 
@@ -346,6 +354,16 @@ Progression:
 	assert.Equal(ts.T, expected, actual, "unexpected progression for %s", ts.name)
 }
 
+// assertNoProgression checks that the node hasn't switched versions since the
+// last call to assertProgression.
+func (ts *testSequins) assertNoProgression() {
+	select {
+	case v := <-ts.progression:
+		assert.Fail(ts.T, "unexpected progression", "%s switched to %s", ts.name, v)
+	default:
+	}
+}
+
 // TestClusterEmptySingleNode tests that a node with no preexisting state can start up
 // and serve requests.
 func TestClusterEmptySingleNode(t *testing.T) {
@@ -616,6 +634,36 @@ func TestClusterRollingRestart(t *testing.T) {
 	tc.assertProgression()
 }
 
+// TestClusterReplicaKilled tests that if a node dies without deregistering,
+// its peers keep serving every key by proxying to the other replicas, without
+// going down.
+func TestClusterReplicaKilled(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster test in short mode.")
+	}
+	t.Parallel()
+
+	tc := newTestCluster(t)
+	defer tc.tearDown()
+
+	tc.addSequinses(3)
+	tc.makeVersionAvailable(v1)
+	tc.sequinses[0].expectProgression(down, noVersion, v1, down)
+	tc.sequinses[1].expectProgression(down, noVersion, v1)
+	tc.sequinses[2].expectProgression(down, noVersion, v1)
+
+	tc.setup()
+	tc.startTest()
+	time.Sleep(expectTimeout)
+
+	tc.sequinses[0].kill()
+	time.Sleep(expectTimeout)
+
+	tc.assertProgression()
+	tc.sequinses[1].assertNoProgression()
+	tc.sequinses[2].assertNoProgression()
+}
+
 // TestClusterNodeVacation tests that if a node is down while the rest of a
 // cluster upgrades without it, it can rejoin without issue.
 func TestClusterNodeVacation(t *testing.T) {
@@ -648,3 +696,103 @@ func TestClusterNodeVacation(t *testing.T) {
 	tc.sequinses[0].start()
 	tc.assertProgression()
 }
+
+// TestClusterMinReplication tests that a new version is held back until every
+// partition is available on at least min_replication nodes.
+func TestClusterMinReplication(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster test in short mode.")
+	}
+	t.Parallel()
+
+	tc := newTestCluster(t)
+	defer tc.tearDown()
+
+	tc.addSequinses(3)
+	for _, ts := range tc.sequinses {
+		ts.config.Sharding.MinReplication = 2
+	}
+
+	tc.expectProgression(down, noVersion, v1)
+	tc.makeVersionAvailable(v1)
+	tc.setup()
+	tc.startTest()
+	tc.assertProgression()
+
+	// With only two of the three nodes loading v3, the partitions the third node
+	// is responsible for only have one replica, so nobody should switch.
+	tc.sequinses[0].makeVersionAvailable(v3)
+	tc.sequinses[1].makeVersionAvailable(v3)
+	tc.sequinses[0].hup()
+	tc.sequinses[1].hup()
+	time.Sleep(expectTimeout)
+
+	for _, ts := range tc.sequinses {
+		ts.assertNoProgression()
+	}
+
+	tc.sequinses[2].makeVersionAvailable(v3)
+	tc.sequinses[2].hup()
+
+	tc.expectProgression(v3)
+	tc.assertProgression()
+}
+
+// TestClusterRejoin tests that a node can leave and rejoin the cluster with
+// POST /_rejoin, without any node going down or changing versions.
+func TestClusterVersions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster test in short mode.")
+	}
+	t.Parallel()
+
+	tc := newTestCluster(t)
+	defer tc.tearDown()
+
+	tc.addSequinses(3)
+	tc.expectProgression(down, noVersion, v1)
+	tc.makeVersionAvailable(v1)
+	tc.setup()
+	tc.startTest()
+	tc.assertProgression()
+
+	resp, err := tc.testClient.Get(fmt.Sprintf("http://%s/cluster/versions/%s", tc.sequinses[0].name, dbName))
+	require.NoError(t, err, "fetching the cluster versions should work")
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode, "fetching the cluster versions should 200")
+
+	var versions map[string]*string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions), "the cluster versions should be valid json")
+	assert.Equal(t, 3, len(versions), "every node should be listed")
+	for node, version := range versions {
+		require.NotNil(t, version, "%s should be reachable", node)
+		assert.Equal(t, string(v1), *version, "%s should be serving v1", node)
+	}
+}
+
+func TestClusterRejoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster test in short mode.")
+	}
+	t.Parallel()
+
+	tc := newTestCluster(t)
+	defer tc.tearDown()
+
+	tc.addSequinses(3)
+	tc.expectProgression(down, noVersion, v1)
+	tc.makeVersionAvailable(v1)
+	tc.setup()
+	tc.startTest()
+	tc.assertProgression()
+
+	resp, err := tc.testClient.Post(fmt.Sprintf("http://%s/_rejoin", tc.sequinses[0].name), "", nil)
+	require.NoError(t, err, "rejoining should work")
+	resp.Body.Close()
+	assert.Equal(t, 202, resp.StatusCode, "rejoining should 202")
+
+	time.Sleep(expectTimeout)
+	for _, ts := range tc.sequinses {
+		ts.assertNoProgression()
+	}
+}
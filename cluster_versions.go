@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterVersionsPath serves the version of a db that each node in the cluster
+// is currently serving, at /cluster/versions/<db>.
+const clusterVersionsPath = "/cluster/versions/"
+
+// clusterVersionsTimeout bounds how long to wait for each peer's stats.
+const clusterVersionsTimeout = 5 * time.Second
+
+// serveClusterVersions handles GET /cluster/versions/<db>. It asks every peer
+// for its stats, and returns a JSON object mapping the address of each node,
+// including this one, to the version of the db it's serving. Nodes that aren't
+// serving any version map to an empty string, and peers that couldn't be
+// reached map to null.
+func (s *sequins) serveClusterVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, clusterVersionsPath)
+	s.dbsLock.RLock()
+	db := s.dbs[name]
+	s.dbsLock.RUnlock()
+
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	current := db.stats().CurrentVersion
+	versions := map[string]*string{s.selfAddress(): &current}
+	if s.peers != nil {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		for _, peer := range s.peers.getAll() {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+
+				var version *string
+				v, err := s.getPeerCurrentVersion(r.Context(), peer, name)
+				if err != nil {
+					log.Printf("Error fetching stats from peer %s: %s", peer, err)
+				} else {
+					version = &v
+				}
+
+				lock.Lock()
+				versions[peer] = version
+				lock.Unlock()
+			}(peer)
+		}
+
+		wg.Wait()
+	}
+
+	jsonBytes, err := json.Marshal(versions)
+	if err != nil {
+		log.Println("Error serving cluster versions:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// getPeerCurrentVersion fetches a peer's stats, and returns the version of the
+// db it's currently serving.
+func (s *sequins) getPeerCurrentVersion(ctx context.Context, peer, db string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clusterVersionsTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s://%s%s", s.peerScheme(), peer, statsPath)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.peerClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %d", resp.StatusCode)
+	}
+
+	st := stats{}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	if err != nil {
+		return "", err
+	}
+
+	return st.DBs[db].CurrentVersion, nil
+}
+
+// selfAddress returns the address this node advertises to its peers, or, if
+// it's not part of a cluster, the address it's bound to.
+func (s *sequins) selfAddress() string {
+	if s.peers != nil {
+		return s.peers.address
+	}
+
+	return s.config.Bind
+}
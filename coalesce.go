@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A coalescer makes sure that concurrent identical fetches share a single
+// underlying fetch. Each version has its own, so results are never shared
+// between versions.
+type coalescer struct {
+	calls map[string]*coalescedCall
+	lock  sync.Mutex
+}
+
+type coalescedCall struct {
+	done    chan bool
+	res     coalescedResponse
+	waiters int // for tests
+}
+
+// coalescedResponse is a fully buffered response from a peer, which can be
+// served to any number of waiting clients.
+type coalescedResponse struct {
+	resp *http.Response
+	peer string
+	body []byte
+	err  error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		calls: make(map[string]*coalescedCall),
+	}
+}
+
+// do calls fetch and returns the result, unless there's already a call in
+// flight for the same key, in which case it waits for that call and returns
+// its result instead (including any error).
+func (c *coalescer) do(key string, fetch func() coalescedResponse) coalescedResponse {
+	c.lock.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.lock.Unlock()
+		<-call.done
+		return call.res
+	}
+
+	call := &coalescedCall{done: make(chan bool)}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	call.res = fetch()
+
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+
+	close(call.done)
+	return call.res
+}
+
+// errNotCoalesced is given to the requests waiting on a coalesced fetch if the
+// value turns out to be too large to buffer. Each of them fetches it for itself
+// instead.
+var errNotCoalesced = errors.New("value is too large to coalesce")
+
+// serveCoalesced is like serveProxied, but shares the fetch from peers between
+// any concurrent requests for the same key. Since the response has to be shared,
+// it's buffered in memory, unless the value is at least 'stream_threshold', in
+// which case it's streamed to the request that fetched it.
+func (vs *version) serveCoalesced(w http.ResponseWriter, r *http.Request,
+	key string, partition, alternatePartition int) {
+
+	start := time.Now()
+	var streamed *http.Response
+	res := vs.coalescer.do(key, func() coalescedResponse {
+		// The fetch shouldn't be canceled if the client that happened to start it
+		// goes away, since other clients might be waiting on it. It's still
+		// bounded by the proxy timeout.
+		resp, peer, err := vs.fetchProxied(r.WithContext(context.Background()), key, partition, alternatePartition)
+		if err != nil {
+			return coalescedResponse{err: err}
+		} else if vs.sequins.shouldStream(resp.ContentLength) {
+			streamed = resp
+			return coalescedResponse{peer: peer, err: errNotCoalesced}
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return coalescedResponse{err: err}
+		}
+
+		return coalescedResponse{resp: resp, peer: peer, body: body}
+	})
+
+	if streamed != nil {
+		vs.setLookupTime(w.Header(), start)
+		vs.copyProxied(w, r, key, streamed, res.peer)
+		return
+	} else if res.err == errNotCoalesced {
+		vs.serveUncoalesced(w, r, key, partition, alternatePartition)
+		return
+	} else if res.err != nil {
+		vs.serveProxyError(w, key, res.err)
+		return
+	}
+
+	vs.setLookupTime(w.Header(), start)
+	vs.writeProxiedHeader(w, res.resp, res.peer)
+	_, err := w.Write(res.body)
+	if err != nil {
+		log.Printf("Error writing response for /%s/%s (version %s): %s", vs.db.name, key, vs.name, err)
+	}
+}
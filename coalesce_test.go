@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+	release := make(chan bool)
+	started := make(chan bool)
+	var calls int32
+
+	fetch := func() coalescedResponse {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+
+		<-release
+		return coalescedResponse{body: []byte("value")}
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan coalescedResponse, 10)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results <- c.do("key", fetch)
+	}()
+
+	// Wait for the first fetch to start, then pile on.
+	<-started
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- c.do("key", fetch)
+		}()
+	}
+
+	// Give the waiters a chance to block on the in-flight call.
+	for {
+		c.lock.Lock()
+		waiters := c.calls["key"].waiters
+		c.lock.Unlock()
+		if waiters == 9 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for res := range results {
+		assert.Equal(t, "value", string(res.body), "all callers should get the result")
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "concurrent calls should be coalesced")
+
+	// Errors are shared too, and aren't cached once the call is done.
+	err := errors.New("oh no")
+	res := c.do("key", func() coalescedResponse { return coalescedResponse{err: err} })
+	assert.Equal(t, err, res.err, "errors should be returned")
+
+	res = c.do("key", func() coalescedResponse { return coalescedResponse{body: []byte("again")} })
+	assert.Equal(t, "again", string(res.body), "results shouldn't be cached after the call is done")
+}
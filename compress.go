@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressedLength is the smallest value worth compressing. Below this, the
+// gzip header and footer eat most of the savings.
+const minCompressedLength = 512
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// shouldCompress returns whether the response to a read should be compressed.
+// Requests from peers are never compressed, so that values are only ever
+// compressed once, by the node the client is talking to. Peers don't ask for
+// gzip in the first place (see initPeerClient), but checking the peer secret
+// as well means that the proxy parameter alone can't turn compression off.
+func (s *sequins) shouldCompress(r *http.Request) bool {
+	return s.config.CompressResponses && !s.isPeerRequest(r) &&
+		acceptsGzip(r.Header.Get("Accept-Encoding"))
+}
+
+// acceptsGzip parses an Accept-Encoding header, and returns whether gzip is
+// acceptable. An explicit entry for gzip takes precedence over a wildcard.
+func acceptsGzip(header string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+
+				q = parsed
+			}
+		}
+
+		switch coding {
+		case "gzip":
+			gzipQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+
+	return wildcardQ > 0
+}
+
+// compressedResponseWriter gzips the body of successful responses as it's
+// written, so that large values are never buffered in memory. Whether to
+// compress is decided when the header is written, based on the status and
+// Content-Length.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func compressResponse(w http.ResponseWriter) *compressedResponseWriter {
+	return &compressedResponseWriter{ResponseWriter: w}
+}
+
+func (cw *compressedResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.wroteHeader = true
+	h := cw.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" {
+		h.Add("Vary", "Accept-Encoding")
+
+		length, err := strconv.Atoi(h.Get("Content-Length"))
+		if err != nil || length >= minCompressedLength {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+
+			cw.gz = gzipWriters.Get().(*gzip.Writer)
+			cw.gz.Reset(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressedResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// close flushes any compressed data. It must be called once the handler is
+// done writing the response.
+func (cw *compressedResponseWriter) close() {
+	if cw.gz == nil {
+		return
+	}
+
+	cw.gz.Close()
+	cw.gz.Reset(nil)
+	gzipWriters.Put(cw.gz)
+	cw.gz = nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -18,56 +21,230 @@ const defaultSearchPath = "sequins.conf:/etc/sequins.conf"
 
 var errNoConfig = errors.New("no config file found")
 
+// configJSONEnv is an environment variable that can hold a JSON object of
+// config properties, which override the ones in the config file.
+const configJSONEnv = "SEQUINS_CONFIG_JSON"
+
+// defaultContentType is the Content-Type for values if no 'content_type' is
+// set.
+const defaultContentType = "application/octet-stream"
+
 type sequinsConfig struct {
 	Source             string   `toml:"source"`
+	Sources            []string `toml:"sources"`
 	Bind               string   `toml:"bind"`
 	MaxParallelLoads   int      `toml:"max_parallel_loads"`
 	ThrottleLoads      duration `toml:"throttle_loads"`
+	IncrementalLoad    bool     `toml:"incremental_load"`
+	LoadMaxRetries     int      `toml:"load_max_retries"`
+	LoadRetryBackoff   duration `toml:"load_retry_backoff"`
 	LocalStore         string   `toml:"local_store"`
+	ReadOnlyStore      bool     `toml:"read_only_store"`
+	MaxLocalStoreBytes int64    `toml:"max_local_store_bytes"`
+	CacheBytes         int64    `toml:"cache_bytes"`
 	RefreshPeriod      duration `toml:"refresh_period"`
 	RequireSuccessFile bool     `toml:"require_success_file"`
 	ContentType        string   `toml:"content_type"`
+	VersionSelection   string   `toml:"version_selection"`
+	UpgradeHookURL     string   `toml:"upgrade_hook_url"`
+	UpgradeHookCommand string   `toml:"upgrade_hook_command"`
+	AccessLog          bool     `toml:"access_log"`
+	LogFormat          string   `toml:"log_format"`
+	ShutdownTimeout    duration `toml:"shutdown_timeout"`
+
+	ReadTimeout  duration `toml:"read_timeout"`
+	WriteTimeout duration `toml:"write_timeout"`
+	IdleTimeout  duration `toml:"idle_timeout"`
+
+	ListenBacklog int  `toml:"listen_backlog"`
+	ReusePort     bool `toml:"reuse_port"`
+	Listeners     int  `toml:"listeners"`
+
+	WaitForVersionOnStartup bool     `toml:"wait_for_version_on_startup"`
+	WaitForVersionTimeout   duration `toml:"wait_for_version_timeout"`
+
+	ArchiveFormat string `toml:"archive_format"`
+
+	DisabledDatabases []string `toml:"disabled_databases"`
+
+	ReadTokens  []string `toml:"read_tokens"`
+	AdminTokens []string `toml:"admin_tokens"`
+
+	StreamThreshold int64 `toml:"stream_threshold"`
+	MaxValueSize    int64 `toml:"max_value_size"`
+
+	VersionSkewTolerance duration `toml:"version_skew_tolerance"`
+	DBETags              bool     `toml:"db_etags"`
+	LookupTimeHeader     bool     `toml:"lookup_time_header"`
+	PrometheusEnabled    bool     `toml:"prometheus_enabled"`
+	CompressResponses    bool     `toml:"compress_responses"`
+	MaxRequestsPerSecond float64  `toml:"max_requests_per_second"`
+	RateLimitPerIP       bool     `toml:"rate_limit_per_ip"`
+
+	TLSCert     string `toml:"tls_cert"`
+	TLSKey      string `toml:"tls_key"`
+	TLSClientCA string `toml:"tls_client_ca"`
 
 	Storage  storageConfig  `toml:"storage"`
 	S3       s3Config       `toml:"s3"`
+	GCS      gcsConfig      `toml:"gcs"`
+	Azure    azureConfig    `toml:"azure"`
 	Sharding shardingConfig `toml:"sharding"`
 	ZK       zkConfig       `toml:"zk"`
+	Etcd     etcdConfig     `toml:"etcd"`
+	Consul   consulConfig   `toml:"consul"`
+	Failover failoverConfig `toml:"failover"`
 	Debug    debugConfig    `toml:"debug"`
 	Test     testConfig     `toml:"test"`
+
+	DBs map[string]dbConfig `toml:"dbs"`
 }
 
 type storageConfig struct {
-	Compression blocks.Compression `toml:"compression"`
-	BlockSize   int                `toml:"block_size"`
+	Compression      blocks.Compression `toml:"compression"`
+	BlockSize        int                `toml:"block_size"`
+	VerifySampleSize int                `toml:"verify_sample_size"`
+	Madvise          blocks.Advice      `toml:"madvise"`
+	WarmOnLoad       bool               `toml:"warm_on_load"`
+
+	VerifyChecksums        bool `toml:"verify_checksums"`
+	RecoverCorruptStore    bool `toml:"recover_corrupt_store"`
+	IndexingMemoryBudgetMB int  `toml:"indexing_memory_budget_mb"`
+
+	IntegrityScanPeriod     duration `toml:"integrity_scan_period"`
+	IntegrityScanSampleRate float64  `toml:"integrity_scan_sample_rate"`
 }
 
 type s3Config struct {
 	Region          string `toml:"region"`
 	AccessKeyId     string `toml:"access_key_id"`
 	SecretAccessKey string `toml:"secret_access_key"`
+	Endpoint        string `toml:"endpoint"`
+	PathStyle       bool   `toml:"path_style"`
+}
+
+type gcsConfig struct {
+	CredentialsFile string `toml:"credentials_file"`
+}
+
+type azureConfig struct {
+	Account    string `toml:"account"`
+	AccountKey string `toml:"account_key"`
+	ClientID   string `toml:"client_id"`
 }
 
 type shardingConfig struct {
 	Enabled            bool     `toml:"enabled"`
 	Replication        int      `toml:"replication"`
+	MinReplication     int      `toml:"min_replication"`
 	TimeToConverge     duration `toml:"time_to_converge"`
 	ProxyTimeout       duration `toml:"proxy_timeout"`
 	ProxyStageTimeout  duration `toml:"proxy_stage_timeout"`
+	ProxyRetries       int      `toml:"proxy_retries"`
+	ProxyMaxIdleConns  int      `toml:"proxy_max_idle_conns"`
+	ProxyIdleTimeout   duration `toml:"proxy_idle_timeout"`
 	ClusterName        string   `toml:"cluster_name"`
 	AdvertisedHostname string   `toml:"advertised_hostname"`
+	AdvertisedPort     int      `toml:"advertised_port"`
 	ShardID            string   `toml:"shard_id"`
+	NodeWeight         int      `toml:"node_weight"`
+	Zone               string   `toml:"zone"`
+	ZoneAwareProxying  bool     `toml:"zone_aware_proxying"`
+	Rebalance          bool     `toml:"rebalance"`
+	RebalanceThrottle  duration `toml:"rebalance_throttle"`
+	Reconvergence      string   `toml:"reconvergence"`
+	Coordinator        string   `toml:"coordinator"`
+
+	CoalesceProxiedRequests bool `toml:"coalesce_proxied_requests"`
+
+	ReadRepairSampleRate float64 `toml:"read_repair_sample_rate"`
+	ReadRepairReload     bool    `toml:"read_repair_reload"`
+
+	PartialAvailabilityThreshold float64  `toml:"partial_availability_threshold"`
+	PartialAvailabilityTimeout   duration `toml:"partial_availability_timeout"`
+
+	ProxyConnectTimeout duration `toml:"proxy_connect_timeout"`
+	ProxyReadTimeout    duration `toml:"proxy_read_timeout"`
+
+	StaleServeWindow duration `toml:"stale_serve_window"`
+
+	PeerWarmupPeriod duration `toml:"peer_warmup_period"`
+
+	VirtualNodes int `toml:"virtual_nodes"`
+
+	PeerSecret string `toml:"peer_secret"`
 }
 
 type zkConfig struct {
-	Servers        []string `toml:"servers"`
+	Servers         zkServers `toml:"servers"`
+	ConnectTimeout  duration  `toml:"connect_timeout"`
+	SessionTimeout  duration  `toml:"session_timeout"`
+	FailoverTimeout duration  `toml:"failover_timeout"`
+}
+
+type etcdConfig struct {
+	Endpoints      []string `toml:"endpoints"`
+	ConnectTimeout duration `toml:"connect_timeout"`
+	SessionTimeout duration `toml:"session_timeout"`
+}
+
+type consulConfig struct {
+	Address        string   `toml:"address"`
+	Token          string   `toml:"token"`
 	ConnectTimeout duration `toml:"connect_timeout"`
 	SessionTimeout duration `toml:"session_timeout"`
 }
 
+type failoverConfig struct {
+	RemoteCluster string   `toml:"remote_cluster"`
+	Timeout       duration `toml:"timeout"`
+}
+
+// dbConfig has options for a single db, set in a [dbs.<name>] section.
+type dbConfig struct {
+	KeyNormalization []blocks.KeyNormalization `toml:"key_normalization"`
+	AccessLog        *bool                     `toml:"access_log"`
+	RefreshPeriod    *duration                 `toml:"refresh_period"`
+	MetadataHeaders  map[string]string         `toml:"metadata_headers"`
+	ContentType      string                    `toml:"content_type"`
+	ValueEncoding    string                    `toml:"value_encoding"`
+
+	RequireSuccessFile *bool `toml:"require_success_file"`
+
+	PartitionDelimiter    string               `toml:"partition_delimiter"`
+	PartitionPrefixLength int                  `toml:"partition_prefix_length"`
+	PartitionHash         blocks.PartitionHash `toml:"partition_hash"`
+	Partitions            int                  `toml:"partitions"`
+
+	TimeToConverge duration `toml:"time_to_converge"`
+
+	PinnedVersion string `toml:"pinned_version"`
+
+	ReadTokens []string `toml:"read_tokens"`
+
+	ServeLocal string `toml:"serve_local"`
+
+	FallbackToPreviousVersion bool `toml:"fallback_to_previous_version"`
+
+	BuildBloomFilter       bool    `toml:"build_bloom_filter"`
+	BloomFalsePositiveRate float64 `toml:"bloom_false_positive_rate"`
+}
+
+// keyPrefix returns the part of each key that new versions of the db should be
+// partitioned by.
+func (c dbConfig) keyPrefix() blocks.KeyPrefix {
+	return blocks.KeyPrefix{
+		Delimiter: c.PartitionDelimiter,
+		Length:    c.PartitionPrefixLength,
+	}
+}
+
 type debugConfig struct {
-	Bind    string `toml:"bind"`
-	Expvars bool   `toml:"expvars"`
-	Pprof   bool   `toml:"pprof"`
+	Bind       string `toml:"bind"`
+	Expvars    bool   `toml:"expvars"`
+	Pprof      bool   `toml:"pprof"`
+	Partitions bool   `toml:"partitions"`
+	Loads      bool   `toml:"loads"`
 }
 
 // testConfig has some options used in functional tests to slow sequins down
@@ -84,38 +261,136 @@ func defaultConfig() sequinsConfig {
 		Source:             "",
 		Bind:               "0.0.0.0:9599",
 		LocalStore:         "/var/sequins/",
+		ReadOnlyStore:      false,
 		MaxParallelLoads:   0,
+		IncrementalLoad:    false,
+		LoadMaxRetries:     0,
+		LoadRetryBackoff:   duration{1 * time.Second},
 		RefreshPeriod:      duration{time.Duration(0)},
 		RequireSuccessFile: false,
 		ContentType:        "",
+		VersionSelection:   versionSelectionName,
+		UpgradeHookURL:     "",
+		UpgradeHookCommand: "",
+		AccessLog:          false,
+		LogFormat:          logFormatText,
+		ShutdownTimeout:    duration{10 * time.Second},
+
+		ReadTimeout:  duration{30 * time.Second},
+		WriteTimeout: duration{0},
+		IdleTimeout:  duration{2 * time.Minute},
+
+		ListenBacklog: 0,
+		ReusePort:     false,
+		Listeners:     1,
+
+		WaitForVersionOnStartup: false,
+		WaitForVersionTimeout:   duration{10 * time.Minute},
+
+		ArchiveFormat: "",
+
+		VersionSkewTolerance: duration{time.Duration(0)},
+		DBETags:              false,
+		LookupTimeHeader:     false,
+		PrometheusEnabled:    false,
+		CompressResponses:    true,
+
+		TLSCert:     "",
+		TLSKey:      "",
+		TLSClientCA: "",
+
 		Storage: storageConfig{
-			Compression: blocks.SnappyCompression,
-			BlockSize:   4096,
+			Compression:      blocks.SnappyCompression,
+			BlockSize:        4096,
+			VerifySampleSize: 0,
+			Madvise:          "",
+			WarmOnLoad:       false,
+
+			VerifyChecksums:        false,
+			RecoverCorruptStore:    false,
+			IndexingMemoryBudgetMB: 0,
+
+			IntegrityScanPeriod:     duration{time.Duration(0)},
+			IntegrityScanSampleRate: 0.01,
 		},
 		S3: s3Config{
 			Region:          "",
 			AccessKeyId:     "",
 			SecretAccessKey: "",
+			Endpoint:        "",
+			PathStyle:       false,
+		},
+		GCS: gcsConfig{
+			CredentialsFile: "",
+		},
+		Azure: azureConfig{
+			Account:    "",
+			AccountKey: "",
+			ClientID:   "",
 		},
 		Sharding: shardingConfig{
 			Enabled:            false,
 			Replication:        2,
+			MinReplication:     1,
 			TimeToConverge:     duration{10 * time.Second},
 			ProxyTimeout:       duration{100 * time.Millisecond},
 			ProxyStageTimeout:  duration{time.Duration(0)},
+			ProxyRetries:       0,
+			ProxyMaxIdleConns:  32,
+			ProxyIdleTimeout:   duration{90 * time.Second},
 			ClusterName:        "sequins",
 			AdvertisedHostname: "",
 			ShardID:            "",
+			NodeWeight:         1,
+			Rebalance:          false,
+			RebalanceThrottle:  duration{time.Duration(0)},
+			Reconvergence:      reconvergenceServe,
+			Coordinator:        coordinatorZookeeper,
+
+			CoalesceProxiedRequests: false,
+
+			ReadRepairSampleRate: 0,
+			ReadRepairReload:     false,
+
+			PartialAvailabilityThreshold: 0,
+			PartialAvailabilityTimeout:   duration{10 * time.Minute},
+
+			ProxyConnectTimeout: duration{time.Duration(0)},
+			ProxyReadTimeout:    duration{time.Duration(0)},
+
+			StaleServeWindow: duration{time.Duration(0)},
+
+			PeerWarmupPeriod: duration{time.Duration(0)},
+
+			VirtualNodes: 0,
 		},
 		ZK: zkConfig{
-			Servers:        []string{"localhost:2181"},
+			Servers:         zkServers{{"localhost:2181"}},
+			ConnectTimeout:  duration{1 * time.Second},
+			SessionTimeout:  duration{10 * time.Second},
+			FailoverTimeout: duration{30 * time.Second},
+		},
+		Etcd: etcdConfig{
+			Endpoints:      []string{"localhost:2379"},
+			ConnectTimeout: duration{1 * time.Second},
+			SessionTimeout: duration{10 * time.Second},
+		},
+		Consul: consulConfig{
+			Address:        "localhost:8500",
+			Token:          "",
 			ConnectTimeout: duration{1 * time.Second},
 			SessionTimeout: duration{10 * time.Second},
 		},
+		Failover: failoverConfig{
+			RemoteCluster: "",
+			Timeout:       duration{1 * time.Second},
+		},
 		Debug: debugConfig{
-			Bind:    "",
-			Expvars: true,
-			Pprof:   false,
+			Bind:       "",
+			Expvars:    true,
+			Pprof:      false,
+			Partitions: true,
+			Loads:      true,
 		},
 		Test: testConfig{
 			UpgradeDelay:         duration{time.Duration(0)},
@@ -136,6 +411,7 @@ func loadConfig(searchPath string) (sequinsConfig, error) {
 
 	config := defaultConfig()
 	paths := filepath.SplitList(searchPath)
+	found := false
 	for _, path := range paths {
 		md, err := toml.DecodeFile(path, &config)
 		if os.IsNotExist(err) {
@@ -146,42 +422,256 @@ func loadConfig(searchPath string) (sequinsConfig, error) {
 			return config, fmt.Errorf("found unrecognized properties: %v", md.Undecoded())
 		}
 
-		return config, nil
+		found = true
+		break
 	}
 
-	return config, errNoConfig
+	overlay := os.Getenv(configJSONEnv)
+	if overlay != "" {
+		err := applyConfigJSON(&config, overlay)
+		if err != nil {
+			return config, fmt.Errorf("parsing %s: %s", configJSONEnv, err)
+		}
+	} else if !found {
+		return config, errNoConfig
+	}
+
+	return config, nil
 }
 
-func validateConfig(config sequinsConfig) (sequinsConfig, error) {
-	if !filepath.IsAbs(config.LocalStore) {
-		return config, fmt.Errorf("local store path must be absolute: %s", config.LocalStore)
+// applyConfigJSON merges a JSON object over the config, overriding any
+// properties it sets. The keys are the same as in the TOML file, and nested
+// under the same headers, for example {"zk": {"servers": ["zk1:2181"]}}. To
+// reuse all the parsing and checking of the file, the JSON is re-encoded as
+// TOML and decoded on top of the existing config.
+func applyConfigJSON(config *sequinsConfig, overlay string) error {
+	dec := json.NewDecoder(strings.NewReader(overlay))
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
 	}
 
-	if config.Source == "" {
-		return config, errors.New("source must be set")
+	v, err := jsonToTOML(m)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.Buffer{}
+	err = toml.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
 	}
 
-	parsed, err := url.Parse(config.Source)
+	md, err := toml.Decode(buf.String(), config)
 	if err != nil {
-		return config, fmt.Errorf("parsing source: %s", err)
+		return err
+	} else if len(md.Undecoded()) > 0 {
+		return fmt.Errorf("found unrecognized properties: %v", md.Undecoded())
+	}
+
+	return nil
+}
+
+// jsonToTOML converts decoded JSON into values that the TOML encoder will
+// write out the same way they'd be written in the file. Numbers without a
+// decimal point or exponent become integers, and nulls are dropped, leaving
+// the existing value in place.
+func jsonToTOML(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			if elem == nil {
+				continue
+			}
+
+			converted, err := jsonToTOML(elem)
+			if err != nil {
+				return nil, err
+			}
+
+			m[key] = converted
+		}
+
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			if elem == nil {
+				return nil, errors.New("lists can't contain null")
+			}
+
+			converted, err := jsonToTOML(elem)
+			if err != nil {
+				return nil, err
+			}
+
+			list[i] = converted
+		}
+
+		return list, nil
+	case json.Number:
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return v.Int64()
+		}
+
+		return v.Float64()
+	default:
+		return v, nil
+	}
+}
+
+// allSources returns every source root, whether there's one, set with
+// 'source', or several, set with 'sources'.
+func (config sequinsConfig) allSources() []string {
+	if config.Source != "" {
+		return []string{config.Source}
+	}
+
+	return config.Sources
+}
+
+func validateSource(config sequinsConfig, source string) error {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("parsing source: %s", err)
 	}
 
 	if parsed.Scheme == "" || parsed.Scheme == "file" {
 		if parsed.Host != "" {
-			return config, fmt.Errorf("local source path is invalid (likely missing a '/'): %s", config.Source)
+			return fmt.Errorf("local source path is invalid (likely missing a '/'): %s", source)
 		}
 
 		if !filepath.IsAbs(parsed.Path) {
-			return config, fmt.Errorf("local source path must be absolute: %s", config.Source)
+			return fmt.Errorf("local source path must be absolute: %s", source)
 		}
 
 		if strings.HasPrefix(filepath.Dir(config.LocalStore), filepath.Clean(parsed.Path)) {
-			return config, fmt.Errorf("local store can't be within source root: %s", config.LocalStore)
+			return fmt.Errorf("local store can't be within source root: %s", config.LocalStore)
 		}
 
 		if config.Sharding.Enabled && !config.Test.AllowLocalCluster {
-			return config, errors.New("you can't run sequins with sharding enabled on local paths")
+			return errors.New("you can't run sequins with sharding enabled on local paths")
+		}
+	}
+
+	switch parsed.Scheme {
+	case "wasbs":
+		if parsed.User == nil || parsed.User.Username() == "" {
+			return fmt.Errorf("wasbs source is missing a container (it should look like wasbs://<container>@<account>.blob.core.windows.net/path): %s", source)
 		}
+	case "az":
+		if config.Azure.Account == "" {
+			return errors.New("azure.account must be set for az:// sources")
+		}
+	}
+
+	return nil
+}
+
+func validateConfig(config sequinsConfig) (sequinsConfig, error) {
+	if !filepath.IsAbs(config.LocalStore) {
+		return config, fmt.Errorf("local store path must be absolute: %s", config.LocalStore)
+	}
+
+	if config.Source != "" && len(config.Sources) > 0 {
+		return config, errors.New("only one of source and sources can be set")
+	} else if len(config.allSources()) == 0 && !config.ReadOnlyStore && len(config.localDBs()) == 0 {
+		return config, errors.New("source must be set")
+	}
+
+	switch config.ArchiveFormat {
+	case "", "tar", "zip":
+	default:
+		return config, fmt.Errorf("invalid archive_format: %s", config.ArchiveFormat)
+	}
+
+	// A read-only store has no '_CURRENT' files to point at versions.
+	if config.ReadOnlyStore && config.VersionSelection == versionSelectionPointer {
+		return config, errors.New("read_only_store can't be used with version_selection = \"pointer\"")
+	}
+
+	for _, source := range config.allSources() {
+		err := validateSource(config, source)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.MaxParallelLoads < 0 {
+		return config, fmt.Errorf("invalid max parallel loads: %d", config.MaxParallelLoads)
+	}
+
+	if config.LoadMaxRetries < 0 {
+		return config, fmt.Errorf("invalid load_max_retries: %d", config.LoadMaxRetries)
+	} else if config.LoadMaxRetries > 0 && config.LoadRetryBackoff.Duration <= 0 {
+		return config, fmt.Errorf("load_retry_backoff must be positive if load_max_retries is set: %s", config.LoadRetryBackoff.Duration)
+	} else if config.LoadRetryBackoff.Duration > maxLoadRetryBackoff {
+		return config, fmt.Errorf("load_retry_backoff can't be more than %s: %s", maxLoadRetryBackoff, config.LoadRetryBackoff.Duration)
+	}
+
+	if config.S3.Endpoint != "" {
+		endpoint, err := url.Parse(config.S3.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return config, fmt.Errorf("invalid S3 endpoint (it must be an http or https URL): %s", config.S3.Endpoint)
+		}
+	}
+
+	switch config.VersionSelection {
+	case versionSelectionName, versionSelectionMtime, versionSelectionPointer:
+	default:
+		return config, fmt.Errorf("unrecognized version selection strategy: %s", config.VersionSelection)
+	}
+
+	switch config.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return config, fmt.Errorf("unrecognized log format: %s", config.LogFormat)
+	}
+
+	if config.StreamThreshold < 0 {
+		return config, fmt.Errorf("invalid stream_threshold: %d", config.StreamThreshold)
+	}
+
+	if config.MaxValueSize < 0 {
+		return config, fmt.Errorf("invalid max_value_size: %d", config.MaxValueSize)
+	}
+
+	if config.ShutdownTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid shutdown timeout: %s", config.ShutdownTimeout.Duration)
+	}
+
+	if config.ReadTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid read_timeout: %s", config.ReadTimeout.Duration)
+	} else if config.WriteTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid write_timeout: %s", config.WriteTimeout.Duration)
+	} else if config.IdleTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid idle_timeout: %s", config.IdleTimeout.Duration)
+	}
+
+	if config.ListenBacklog < 0 {
+		return config, fmt.Errorf("invalid listen_backlog: %d", config.ListenBacklog)
+	} else if config.Listeners < 1 {
+		return config, fmt.Errorf("invalid listeners: %d", config.Listeners)
+	}
+
+	if config.WaitForVersionOnStartup && config.WaitForVersionTimeout.Duration <= 0 {
+		return config, fmt.Errorf("wait_for_version_timeout must be positive if wait_for_version_on_startup is set: %s", config.WaitForVersionTimeout.Duration)
+	}
+
+	if config.VersionSkewTolerance.Duration < 0 {
+		return config, fmt.Errorf("invalid version skew tolerance: %s", config.VersionSkewTolerance.Duration)
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return config, errors.New("tls_cert and tls_key must be set together")
+	}
+
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		return config, errors.New("tls_client_ca requires tls_cert and tls_key to be set")
 	}
 
 	switch config.Storage.Compression {
@@ -190,10 +680,223 @@ func validateConfig(config sequinsConfig) (sequinsConfig, error) {
 		return config, fmt.Errorf("unrecognized compression option: %s", config.Storage.Compression)
 	}
 
+	if config.Storage.IndexingMemoryBudgetMB < 0 {
+		return config, fmt.Errorf("invalid indexing memory budget: %d", config.Storage.IndexingMemoryBudgetMB)
+	}
+
+	if config.Storage.IntegrityScanPeriod.Duration < 0 {
+		return config, fmt.Errorf("invalid integrity_scan_period: %s", config.Storage.IntegrityScanPeriod.Duration)
+	}
+
+	if config.Storage.IntegrityScanSampleRate <= 0 || config.Storage.IntegrityScanSampleRate > 1 {
+		return config, fmt.Errorf("invalid integrity_scan_sample_rate: %v", config.Storage.IntegrityScanSampleRate)
+	}
+
+	switch config.Storage.Madvise {
+	case "", blocks.NormalAdvice, blocks.RandomAdvice, blocks.SequentialAdvice, blocks.WillNeedAdvice:
+	default:
+		return config, fmt.Errorf("unrecognized madvise option: %s", config.Storage.Madvise)
+	}
+
+	if config.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(config.ContentType); err != nil {
+			return config, fmt.Errorf("invalid content type: %s", config.ContentType)
+		}
+	}
+
+	for name, dbConfig := range config.DBs {
+		for _, n := range dbConfig.KeyNormalization {
+			switch n {
+			case blocks.LowercaseNormalization, blocks.NFCNormalization, blocks.URLDecodeNormalization:
+			default:
+				return config, fmt.Errorf("unrecognized key normalization for %s: %s", name, n)
+			}
+		}
+
+		if dbConfig.RefreshPeriod != nil && dbConfig.RefreshPeriod.Duration < 0 {
+			return config, fmt.Errorf("invalid refresh period for %s: %s", name, dbConfig.RefreshPeriod.Duration)
+		}
+
+		if dbConfig.TimeToConverge.Duration < 0 {
+			return config, fmt.Errorf("invalid time to converge for %s: %s", name, dbConfig.TimeToConverge.Duration)
+		}
+
+		if dbConfig.PartitionPrefixLength < 0 {
+			return config, fmt.Errorf("invalid partition prefix length for %s: %d", name, dbConfig.PartitionPrefixLength)
+		} else if dbConfig.PartitionDelimiter != "" && dbConfig.PartitionPrefixLength != 0 {
+			return config, fmt.Errorf("only one of partition_delimiter and partition_prefix_length can be set for %s", name)
+		}
+
+		if dbConfig.Partitions < 0 {
+			return config, fmt.Errorf("invalid partitions for %s: %d", name, dbConfig.Partitions)
+		}
+
+		if dbConfig.BloomFalsePositiveRate < 0 || dbConfig.BloomFalsePositiveRate >= 1 {
+			return config, fmt.Errorf("invalid bloom_false_positive_rate for %s: %g", name, dbConfig.BloomFalsePositiveRate)
+		}
+
+		switch dbConfig.PartitionHash {
+		case "", blocks.JavaHash, blocks.FNVHash, blocks.Murmur3Hash, blocks.XXHash:
+		default:
+			return config, fmt.Errorf("unrecognized partition hash for %s: %s", name, dbConfig.PartitionHash)
+		}
+
+		if dbConfig.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(dbConfig.ContentType); err != nil {
+				return config, fmt.Errorf("invalid content type for %s: %s", name, dbConfig.ContentType)
+			}
+		}
+
+		if dbConfig.ServeLocal != "" && !filepath.IsAbs(dbConfig.ServeLocal) {
+			return config, fmt.Errorf("serve_local path for %s must be absolute: %s", name, dbConfig.ServeLocal)
+		} else if dbConfig.ServeLocal != "" && config.ReadOnlyStore {
+			return config, fmt.Errorf("serve_local can't be set for %s with read_only_store", name)
+		}
+
+		switch dbConfig.ValueEncoding {
+		case "", valueEncodingBase64, valueEncodingRaw:
+		default:
+			return config, fmt.Errorf("unrecognized value encoding for %s: %s", name, dbConfig.ValueEncoding)
+		}
+	}
+
+	// Without the peer secret, peers couldn't proxy reads to each other.
+	if config.Sharding.Enabled && config.Sharding.PeerSecret == "" {
+		if len(config.ReadTokens) > 0 {
+			return config, errors.New("sharding.peer_secret must be set if read_tokens is")
+		}
+
+		for name, dbConfig := range config.DBs {
+			if len(dbConfig.ReadTokens) > 0 {
+				return config, fmt.Errorf("sharding.peer_secret must be set if read_tokens is set for %s", name)
+			}
+		}
+	}
+
+	// Without the peer secret, reads proxied from peers would count against the
+	// rate limit a second time.
+	if config.Sharding.Enabled && config.Sharding.PeerSecret == "" && config.MaxRequestsPerSecond > 0 {
+		return config, errors.New("sharding.peer_secret must be set if max_requests_per_second is")
+	}
+
+	// Without the peer secret, a refresh couldn't be passed on to peers.
+	if config.Sharding.Enabled && config.Sharding.PeerSecret == "" && len(config.AdminTokens) > 0 {
+		return config, errors.New("sharding.peer_secret must be set if admin_tokens is")
+	}
+
+	// Otherwise, anyone who can't read a db could still drain or disable it.
+	if len(config.AdminTokens) == 0 {
+		if len(config.ReadTokens) > 0 {
+			return config, errors.New("admin_tokens must be set if read_tokens is")
+		}
+
+		for name, dbConfig := range config.DBs {
+			if len(dbConfig.ReadTokens) > 0 {
+				return config, fmt.Errorf("admin_tokens must be set if read_tokens is set for %s", name)
+			}
+		}
+	}
+
 	if config.Sharding.Replication <= 0 {
 		return config, fmt.Errorf("invalid replication factor: %d", config.Sharding.Replication)
 	}
 
+	if config.Sharding.MinReplication <= 0 || config.Sharding.MinReplication > config.Sharding.Replication {
+		return config, fmt.Errorf("invalid minimum replication: %d", config.Sharding.MinReplication)
+	}
+
+	if config.Sharding.VirtualNodes < 0 {
+		return config, fmt.Errorf("invalid virtual_nodes: %d", config.Sharding.VirtualNodes)
+	}
+
+	if config.Sharding.NodeWeight <= 0 {
+		return config, fmt.Errorf("invalid node weight: %d", config.Sharding.NodeWeight)
+	}
+
+	if config.Sharding.AdvertisedPort < 0 || config.Sharding.AdvertisedPort > 65535 {
+		return config, fmt.Errorf("invalid advertised port: %d", config.Sharding.AdvertisedPort)
+	}
+
+	if strings.ContainsAny(config.Sharding.Zone, "/;@") {
+		return config, fmt.Errorf("invalid zone (it can't contain '/', ';', or '@'): %s", config.Sharding.Zone)
+	}
+
+	if config.Sharding.ProxyRetries < 0 {
+		return config, fmt.Errorf("invalid proxy retries: %d", config.Sharding.ProxyRetries)
+	}
+
+	if config.MaxLocalStoreBytes < 0 {
+		return config, fmt.Errorf("invalid max_local_store_bytes: %d", config.MaxLocalStoreBytes)
+	}
+
+	if config.MaxRequestsPerSecond < 0 {
+		return config, fmt.Errorf("invalid max_requests_per_second: %v", config.MaxRequestsPerSecond)
+	}
+
+	if config.CacheBytes < 0 {
+		return config, fmt.Errorf("invalid cache_bytes: %d", config.CacheBytes)
+	}
+
+	if config.Sharding.ProxyConnectTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid proxy_connect_timeout: %s", config.Sharding.ProxyConnectTimeout.Duration)
+	}
+
+	if config.Sharding.ProxyReadTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid proxy_read_timeout: %s", config.Sharding.ProxyReadTimeout.Duration)
+	}
+
+	if config.Sharding.StaleServeWindow.Duration < 0 {
+		return config, fmt.Errorf("invalid stale_serve_window: %s", config.Sharding.StaleServeWindow.Duration)
+	}
+
+	if config.Sharding.PeerWarmupPeriod.Duration < 0 {
+		return config, fmt.Errorf("invalid peer_warmup_period: %s", config.Sharding.PeerWarmupPeriod.Duration)
+	}
+
+	if config.Sharding.ProxyMaxIdleConns < 0 {
+		return config, fmt.Errorf("invalid proxy_max_idle_conns: %d", config.Sharding.ProxyMaxIdleConns)
+	}
+
+	if config.Sharding.ProxyIdleTimeout.Duration < 0 {
+		return config, fmt.Errorf("invalid proxy_idle_timeout: %s", config.Sharding.ProxyIdleTimeout.Duration)
+	}
+
+	switch config.Sharding.Reconvergence {
+	case reconvergenceServe, reconvergenceRetry:
+	default:
+		return config, fmt.Errorf("unrecognized reconvergence option: %s", config.Sharding.Reconvergence)
+	}
+
+	switch config.Sharding.Coordinator {
+	case coordinatorZookeeper, coordinatorEtcd, coordinatorConsul:
+	default:
+		return config, fmt.Errorf("unrecognized coordinator: %s", config.Sharding.Coordinator)
+	}
+
+	// Consul doesn't allow session TTLs outside of this range.
+	if timeout := config.Consul.SessionTimeout.Duration; timeout < 10*time.Second || timeout > 24*time.Hour {
+		return config, fmt.Errorf("invalid consul session_timeout: %s", timeout)
+	}
+
+	if config.Sharding.ReadRepairSampleRate < 0 || config.Sharding.ReadRepairSampleRate > 1 {
+		return config, fmt.Errorf("invalid read repair sample rate: %g", config.Sharding.ReadRepairSampleRate)
+	}
+
+	if config.Sharding.PartialAvailabilityThreshold < 0 || config.Sharding.PartialAvailabilityThreshold > 1 {
+		return config, fmt.Errorf("invalid partial availability threshold: %g", config.Sharding.PartialAvailabilityThreshold)
+	}
+
+	if config.Failover.RemoteCluster != "" {
+		remote, err := url.Parse(config.Failover.RemoteCluster)
+		if err != nil {
+			return config, fmt.Errorf("parsing remote cluster: %s", err)
+		}
+
+		if (remote.Scheme != "http" && remote.Scheme != "https") || remote.Host == "" {
+			return config, fmt.Errorf("remote cluster must be an http url: %s", config.Failover.RemoteCluster)
+		}
+	}
+
 	return config, nil
 }
 
@@ -210,3 +913,47 @@ func (d *duration) UnmarshalText(text []byte) error {
 func (d duration) MarshalText() ([]byte, error) {
 	return []byte(d.Duration.String()), nil
 }
+
+// zkServers is a list of zookeeper ensembles, each of which is a list of
+// addresses. In the config, it can either be a list of addresses, for a single
+// ensemble, or a list of lists.
+type zkServers [][]string
+
+func (s *zkServers) UnmarshalTOML(v interface{}) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid zookeeper servers: %v", v)
+	}
+
+	var ensembles zkServers
+	var single []string
+	for _, elem := range list {
+		switch elem := elem.(type) {
+		case string:
+			single = append(single, elem)
+		case []interface{}:
+			var ensemble []string
+			for _, addr := range elem {
+				addr, ok := addr.(string)
+				if !ok {
+					return fmt.Errorf("invalid zookeeper server: %v", addr)
+				}
+
+				ensemble = append(ensemble, addr)
+			}
+
+			ensembles = append(ensembles, ensemble)
+		default:
+			return fmt.Errorf("invalid zookeeper server: %v", elem)
+		}
+	}
+
+	if single != nil && ensembles != nil {
+		return errors.New("zookeeper servers must be either a list of addresses or a list of lists")
+	} else if single != nil {
+		ensembles = zkServers{single}
+	}
+
+	*s = ensembles
+	return nil
+}
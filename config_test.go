@@ -11,6 +11,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/sequins/blocks"
 )
 
 var commentedDefaultRegex = regexp.MustCompile(`# (\w+ = .+)\n(?:#.*\n)*\n*`)
@@ -97,7 +99,7 @@ func TestSimpleConfig(t *testing.T) {
 	assert.Equal(t, "s3://foo/bar", config.Source, "Source should be set")
 	assert.Equal(t, true, config.RequireSuccessFile, "RequireSuccessFile should be set")
 	assert.Equal(t, time.Hour, config.RefreshPeriod.Duration, "RefreshPeriod (a duration) should be set")
-	assert.Equal(t, []string{"zk:2181"}, config.ZK.Servers, "ZK.Servers should be set")
+	assert.Equal(t, zkServers{{"zk:2181"}}, config.ZK.Servers, "ZK.Servers should be set")
 
 	defaults := defaultConfig()
 	defaults.Source = config.Source
@@ -109,6 +111,23 @@ func TestSimpleConfig(t *testing.T) {
 	os.Remove(path)
 }
 
+func TestConfigZKEnsembles(t *testing.T) {
+	path := createTestConfig(t, `
+		source = "s3://foo/bar"
+
+		[zk]
+		servers = [["zk1a:2181", "zk1b:2181"], ["zk2a:2181", "zk2b:2181"]]
+	`)
+
+	config, err := loadAndValidateConfig(path)
+	require.NoError(t, err, "loading a config with multiple zookeeper ensembles should work")
+
+	expected := zkServers{{"zk1a:2181", "zk1b:2181"}, {"zk2a:2181", "zk2b:2181"}}
+	assert.Equal(t, expected, config.ZK.Servers, "ZK.Servers should be set")
+
+	os.Remove(path)
+}
+
 func TestEmptyConfig(t *testing.T) {
 	path := createTestConfig(t, "source = \"/foo\"")
 
@@ -133,6 +152,51 @@ func TestConfigSearchPath(t *testing.T) {
 	os.Remove(path)
 }
 
+func TestConfigJSONOverlay(t *testing.T) {
+	path := createTestConfig(t, `
+		source = "s3://foo/bar"
+		require_success_file = true
+		max_parallel_loads = 4
+
+		[zk]
+		servers = ["zk:2181"]
+	`)
+
+	os.Setenv(configJSONEnv, `{
+		"source": "s3://foo/baz",
+		"max_parallel_loads": 8,
+		"refresh_period": "1h",
+		"max_requests_per_second": 100.5,
+		"zk": {"servers": [["zk1a:2181", "zk1b:2181"], ["zk2a:2181"]]}
+	}`)
+	defer os.Unsetenv(configJSONEnv)
+
+	config, err := loadAndValidateConfig(path)
+	require.NoError(t, err, "loading a config with a JSON overlay should work")
+
+	assert.Equal(t, "s3://foo/baz", config.Source, "Source should be overridden")
+	assert.Equal(t, true, config.RequireSuccessFile, "RequireSuccessFile should be kept from the file")
+	assert.Equal(t, 8, config.MaxParallelLoads, "MaxParallelLoads (an int) should be overridden")
+	assert.Equal(t, time.Hour, config.RefreshPeriod.Duration, "RefreshPeriod (a duration) should be set")
+	assert.Equal(t, 100.5, config.MaxRequestsPerSecond, "MaxRequestsPerSecond (a float) should be set")
+	assert.Equal(t, zkServers{{"zk1a:2181", "zk1b:2181"}, {"zk2a:2181"}}, config.ZK.Servers, "ZK.Servers should be overridden")
+
+	os.Setenv(configJSONEnv, `{"zk": {"foo": "bar"}}`)
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if there are extra properties in the JSON")
+
+	os.Setenv(configJSONEnv, `{"source": `)
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if the JSON is invalid")
+
+	os.Setenv(configJSONEnv, `{"source": "s3://foo/baz"}`)
+	config, err = loadAndValidateConfig("/this/doesnt/exist.conf")
+	require.NoError(t, err, "the JSON overlay should work without a config file")
+	assert.Equal(t, "s3://foo/baz", config.Source, "Source should be set")
+
+	os.Remove(path)
+}
+
 func TestConfigExtraKeys(t *testing.T) {
 	path := createTestConfig(t, `
 		source = "s3://foo/bar"
@@ -151,6 +215,18 @@ func TestConfigExtraKeys(t *testing.T) {
 	os.Remove(path)
 }
 
+func TestConfigInvalidMaxParallelLoads(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    max_parallel_loads = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if max_parallel_loads is negative")
+
+	os.Remove(path)
+}
+
 func TestConfigInvalidCompression(t *testing.T) {
 	path := createTestConfig(t, `
     source = "s3://foo/bar"
@@ -167,6 +243,409 @@ func TestConfigInvalidCompression(t *testing.T) {
 	os.Remove(path)
 }
 
+func TestConfigInvalidCoordinator(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    coordinator = "chubby"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid coordinator is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidMinReplication(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    replication = 2
+    min_replication = 3
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if min_replication is greater than replication")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidNodeWeight(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    node_weight = 0
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if node_weight isn't positive")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidLoadRetries(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    load_max_retries = 3
+    load_retry_backoff = "0s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if load_retry_backoff isn't positive")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidLoadRetryBackoff(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    load_max_retries = 3
+    load_retry_backoff = "1h"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if load_retry_backoff is too long")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidSources(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    sources = ["s3://foo/baz"]
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if both source and sources are set")
+
+	os.Remove(path)
+
+	path = createTestConfig(t, `
+    sources = ["s3://foo/bar", "foo/baz"]
+  `)
+
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if any of the sources is invalid")
+
+	os.Remove(path)
+}
+
+func TestConfigSources(t *testing.T) {
+	path := createTestConfig(t, `
+    sources = ["s3://foo/bar", "gs://foo/baz"]
+  `)
+
+	config, err := loadAndValidateConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s3://foo/bar", "gs://foo/baz"}, config.allSources())
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidPartitions(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    partitions = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if partitions is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidMaxLocalStoreBytes(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    max_local_store_bytes = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if max_local_store_bytes is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidCacheBytes(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    cache_bytes = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if cache_bytes is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidZone(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    zone = "us-east-1a;weight=2"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if the zone contains a ';'")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidWaitForVersionTimeout(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    wait_for_version_on_startup = true
+    wait_for_version_timeout = "0s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if wait_for_version_timeout isn't positive")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidProxyMaxIdleConns(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    proxy_max_idle_conns = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if proxy_max_idle_conns is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidTLS(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    tls_cert = "/etc/sequins/cert.pem"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if tls_cert is set without tls_key")
+	os.Remove(path)
+
+	path = createTestConfig(t, `
+    source = "s3://foo/bar"
+    tls_client_ca = "/etc/sequins/ca.pem"
+  `)
+
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if tls_client_ca is set without tls_cert")
+	os.Remove(path)
+}
+
+func TestConfigDBs(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    access_log = true
+
+    [dbs.foo]
+    key_normalization = ["lowercase", "nfc"]
+
+    [dbs.bar]
+    access_log = false
+    refresh_period = "1h"
+  `)
+
+	config, err := loadAndValidateConfig(path)
+	require.NoError(t, err, "loading a config with per-db options should work")
+
+	expected := []blocks.KeyNormalization{blocks.LowercaseNormalization, blocks.NFCNormalization}
+	assert.Equal(t, expected, config.DBs["foo"].KeyNormalization, "DBs.foo.KeyNormalization should be set")
+	assert.Nil(t, config.DBs["bar"].KeyNormalization, "other dbs should have the default options")
+
+	assert.Nil(t, config.DBs["foo"].AccessLog, "DBs.foo.AccessLog should be unset")
+	require.NotNil(t, config.DBs["bar"].AccessLog, "DBs.bar.AccessLog should be set")
+	assert.False(t, *config.DBs["bar"].AccessLog, "DBs.bar.AccessLog should be set")
+
+	assert.Nil(t, config.DBs["foo"].RefreshPeriod, "DBs.foo.RefreshPeriod should be unset")
+	require.NotNil(t, config.DBs["bar"].RefreshPeriod, "DBs.bar.RefreshPeriod should be set")
+	assert.Equal(t, time.Hour, config.DBs["bar"].RefreshPeriod.Duration, "DBs.bar.RefreshPeriod should be set")
+
+	s := &sequins{config: config}
+	assert.True(t, newDB(s, "foo").accessLogEnabled(), "foo should use the global access log setting")
+	assert.False(t, newDB(s, "bar").accessLogEnabled(), "bar should override the global access log setting")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidKeyNormalization(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    key_normalization = ["notanormalization"]
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid key normalization is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidPartitionPrefix(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    partition_delimiter = ":"
+    partition_prefix_length = 8
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if both a partition delimiter and prefix length are specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidPartitionHash(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    partition_hash = "crc32"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid partition hash is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidContentType(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    content_type = "application/"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid content type is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigReadOnlyStore(t *testing.T) {
+	path := createTestConfig(t, `
+    read_only_store = true
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.NoError(t, err, "the source shouldn't be required with a read-only store")
+
+	os.Remove(path)
+
+	path = createTestConfig(t, `
+    read_only_store = true
+    version_selection = "pointer"
+  `)
+
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if a read-only store is used with pointer version selection")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidAdvertisedPort(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    advertised_port = 70000
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid advertised port is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidTimeToConverge(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    time_to_converge = "-1s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if a negative time to converge is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidValueEncoding(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    value_encoding = "hex"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid value encoding is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidLogFormat(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    log_format = "xml"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if an invalid log format is specified")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidS3Endpoint(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [s3]
+    endpoint = "minio.internal:9000"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if the S3 endpoint isn't a URL")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidAzureSource(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "az://container/path"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if az:// is used without an account")
+
+	os.Remove(path)
+
+	path = createTestConfig(t, `
+    source = "wasbs://myaccount.blob.core.windows.net/path"
+  `)
+
+	_, err = loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if a wasbs:// source has no container")
+
+	os.Remove(path)
+}
+
 func TestConfigRelativeSource(t *testing.T) {
 	path := createTestConfig(t, `
     source = "foo/bar"
@@ -206,3 +685,224 @@ func TestConfigLocalStoreWithinRoot(t *testing.T) {
 	_, err := loadAndValidateConfig(path)
 	assert.Error(t, err, "it should throw an error if the local store is within the source root")
 }
+
+func TestConfigInvalidMaxRequestsPerSecond(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    max_requests_per_second = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if max_requests_per_second is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidIntegrityScanSampleRate(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [storage]
+    integrity_scan_period = "1h"
+    integrity_scan_sample_rate = 1.5
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if integrity_scan_sample_rate is greater than 1")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidProxyConnectTimeout(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    proxy_connect_timeout = "-1s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if proxy_connect_timeout is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidVirtualNodes(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    virtual_nodes = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if virtual_nodes is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidArchiveFormat(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    archive_format = "rar"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if archive_format isn't tar or zip")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidConsulSessionTimeout(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [consul]
+    session_timeout = "5s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if consul.session_timeout is shorter than consul allows")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidPeerSecret(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    enabled = true
+
+    [dbs.foo]
+    read_tokens = ["secret"]
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if read_tokens is set without sharding.peer_secret")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidAdminTokens(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    read_tokens = ["secret"]
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if read_tokens is set without admin_tokens")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidAdminTokensPeerSecret(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    admin_tokens = ["secret"]
+
+    [sharding]
+    enabled = true
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if admin_tokens is set without sharding.peer_secret")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidRateLimitPeerSecret(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    max_requests_per_second = 1000
+
+    [sharding]
+    enabled = true
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if max_requests_per_second is set without sharding.peer_secret")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidMaxValueSize(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    max_value_size = -1
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if max_value_size is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidServeLocal(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    serve_local = "foo/1"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if serve_local isn't an absolute path")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidBloomFalsePositiveRate(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [dbs.foo]
+    build_bloom_filter = true
+    bloom_false_positive_rate = 1.5
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if bloom_false_positive_rate isn't less than one")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidPeerWarmupPeriod(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+
+    [sharding]
+    peer_warmup_period = "-1s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if peer_warmup_period is negative")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidListeners(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    listeners = 0
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if listeners is less than one")
+
+	os.Remove(path)
+}
+
+func TestConfigInvalidWriteTimeout(t *testing.T) {
+	path := createTestConfig(t, `
+    source = "s3://foo/bar"
+    write_timeout = "-1s"
+  `)
+
+	_, err := loadAndValidateConfig(path)
+	assert.Error(t, err, "it should throw an error if write_timeout is negative")
+
+	os.Remove(path)
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	consulReconnectPeriod = 1 * time.Second
+	defaultConsulPort     = 8500
+
+	// consulWatchWait is how long each blocking query waits for a change
+	// before returning anyway.
+	consulWatchWait = 5 * time.Minute
+)
+
+var errConsulShutdown = errors.New("shutting down")
+
+// A consulWatcher is the Consul equivalent of a zkWatcher. It uses the Consul
+// HTTP API directly, through a local agent.
+//
+// Like etcd, Consul's KV store doesn't have a tree of nodes, so each node is
+// just a key, and the children of a node are the distinct path components
+// directly under it. Ephemeral nodes are acquired by a session with the
+// 'delete' behavior, which is renewed for as long as the watcher is connected,
+// so that Consul removes them if it isn't. Watches are blocking queries. Like
+// zkWatcher, it reconnects lazily, and on every reconnect it creates a new
+// session, recreates ephemeral nodes, and resets watches.
+type consulWatcher struct {
+	sync.RWMutex
+	address        string
+	token          string
+	connectTimeout time.Duration
+	sessionTimeout time.Duration
+	prefix         string
+	client         *http.Client
+	streamClient   *http.Client
+	session        string
+	stopRenew      chan bool
+	errs           chan error
+	shutdown       chan bool
+	isConnected    int32
+
+	hooksLock      sync.Mutex
+	ephemeralNodes map[string]bool
+	watchedNodes   map[string]watchedNode
+
+	// activeWatches is the number of running blocking queries, for tests.
+	activeWatches int32
+}
+
+func connectConsul(address, token, prefix string, connectTimeout, sessionTimeout time.Duration) (*consulWatcher, error) {
+	if address == "" {
+		return nil, errors.New("consul error: no address configured")
+	}
+
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	if strings.Index(strings.SplitN(address, "://", 2)[1], ":") < 0 {
+		address = fmt.Sprintf("%s:%d", address, defaultConsulPort)
+	}
+
+	w := &consulWatcher{
+		address:        strings.TrimSuffix(address, "/"),
+		token:          token,
+		connectTimeout: connectTimeout,
+		sessionTimeout: sessionTimeout,
+		prefix:         path.Join(prefix, coordinationVersion),
+		client:         &http.Client{Timeout: connectTimeout},
+		streamClient:   &http.Client{},
+		errs:           make(chan error, 1),
+		shutdown:       make(chan bool),
+		ephemeralNodes: make(map[string]bool),
+		watchedNodes:   make(map[string]watchedNode),
+	}
+
+	err := w.reconnect()
+	if err != nil {
+		return nil, fmt.Errorf("consul error: %s", err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// reconnect creates a new session, and starts renewing it. The previous
+// session, if there is one, is destroyed first, so that its ephemeral nodes
+// don't block ours from being recreated.
+func (w *consulWatcher) reconnect() error {
+	w.Lock()
+	defer w.Unlock()
+
+	select {
+	case <-w.shutdown:
+		return errConsulShutdown
+	default:
+	}
+
+	if w.stopRenew != nil {
+		close(w.stopRenew)
+		w.stopRenew = nil
+	}
+
+	log.Println("Connecting to consul at", w.address)
+	if w.session != "" {
+		w.call("PUT", "/v1/session/destroy/"+w.session, nil, nil, nil)
+		w.session = ""
+	}
+
+	session, err := w.createSession()
+	if err != nil {
+		log.Printf("Error connecting to consul at %s: %s", w.address, err)
+		return err
+	}
+
+	w.session = session
+	w.stopRenew = make(chan bool)
+	go w.renew(session, w.stopRenew)
+	return nil
+}
+
+func (w *consulWatcher) createSession() (string, error) {
+	// The lock delay would stop us from recreating our own ephemeral nodes
+	// right after a reconnect.
+	resp := consulSessionResponse{}
+	err := w.call("PUT", "/v1/session/create", nil, consulSessionRequest{
+		Name:      "sequins",
+		TTL:       w.sessionTimeout.String(),
+		Behavior:  "delete",
+		LockDelay: "0s",
+	}, &resp)
+	if err != nil {
+		return "", err
+	} else if resp.ID == "" {
+		return "", errors.New("creating session: empty session ID")
+	}
+
+	return resp.ID, nil
+}
+
+// renew renews the session a few times per TTL, until stop is closed. If the
+// session is lost, it triggers a reconnect.
+func (w *consulWatcher) renew(session string, stop chan bool) {
+	ticker := time.NewTicker(w.sessionTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		w.RLock()
+		select {
+		case <-stop:
+			w.RUnlock()
+			return
+		default:
+		}
+
+		err := w.call("PUT", "/v1/session/renew/"+session, nil, nil, nil)
+		w.RUnlock()
+
+		if err != nil {
+			sendErr(w.errs, fmt.Errorf("renewing session %s: %s", session, err))
+			return
+		}
+	}
+}
+
+func (w *consulWatcher) runHooks() error {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	for node := range w.ephemeralNodes {
+		err := w.hookCreateEphemeral(node)
+		if err != nil {
+			return err
+		}
+	}
+
+	for node, wn := range w.watchedNodes {
+		err := w.hookWatchChildren(node, wn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *consulWatcher) notifyDisconnected() {
+	for _, wn := range w.watchedNodes {
+		select {
+		case wn.disconnected <- true:
+		default:
+		}
+	}
+}
+
+func (w *consulWatcher) cancelWatches() {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	w.notifyDisconnected()
+
+	for _, wn := range w.watchedNodes {
+		wn.cancel <- true
+	}
+}
+
+// run runs the main loop. On any errors, it resets the connection.
+func (w *consulWatcher) run() {
+	first := true
+
+Reconnect:
+	for {
+		if !first {
+			// Wait before trying to reconnect again.
+			wait := time.NewTimer(consulReconnectPeriod)
+			select {
+			case <-w.shutdown:
+				break Reconnect
+			case <-wait.C:
+			}
+
+			err := w.reconnect()
+			if err != nil {
+				log.Println("Error reconnecting to consul:", err)
+				continue Reconnect
+			}
+
+			// Every time we connect, reset watches and recreate ephemeral nodes.
+			err = w.runHooks()
+			if err != nil {
+				log.Println("Error running consul hooks:", err)
+				continue Reconnect
+			}
+
+			log.Println("Reconnected to consul")
+		} else {
+			first = false
+		}
+
+		atomic.StoreInt32(&w.isConnected, 1)
+		select {
+		case <-w.shutdown:
+			break Reconnect
+		case err := <-w.errs:
+			log.Println("Disconnecting from consul because of error:", err)
+			atomic.StoreInt32(&w.isConnected, 0)
+			w.cancelWatches()
+			continue Reconnect
+		}
+	}
+
+	w.cancelWatches()
+}
+
+func (w *consulWatcher) createEphemeral(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	w.ephemeralNodes[node] = true
+	err := w.hookCreateEphemeral(node)
+	if err != nil {
+		sendErr(w.errs, err)
+	}
+}
+
+func (w *consulWatcher) removeEphemeral(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	w.RLock()
+	defer w.RUnlock()
+
+	node = path.Join(w.prefix, node)
+	w.call("DELETE", consulKVPath(node), nil, nil, nil)
+	delete(w.ephemeralNodes, node)
+}
+
+func (w *consulWatcher) hookCreateEphemeral(node string) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	var acquired bool
+	err := w.call("PUT", consulKVPath(node), url.Values{"acquire": {w.session}}, nil, &acquired)
+	if err == nil && !acquired {
+		err = errors.New("the key is held by another session")
+	}
+
+	if err != nil {
+		return fmt.Errorf("create %s: %s", node, err)
+	}
+
+	return nil
+}
+
+// setPersistentChild replaces the children of node with a single persistent
+// child, or removes them all if child is empty. The child isn't acquired by
+// any session, so it outlives the watcher.
+func (w *consulWatcher) setPersistentChild(node, child string) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	node = path.Join(w.prefix, node)
+	if child != "" {
+		err := w.call("PUT", consulKVPath(path.Join(node, child)), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	children, _, err := w.listChildren(context.Background(), node, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		if c == child {
+			continue
+		}
+
+		err = w.call("DELETE", consulKVPath(path.Join(node, c)), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// children returns the children of node once, without watching it.
+func (w *consulWatcher) children(node string) ([]string, error) {
+	children, _, err := w.listChildren(context.Background(), path.Join(w.prefix, node), 0)
+	return children, err
+}
+
+func (w *consulWatcher) watchChildren(node string) (chan []string, chan bool) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	updates := make(chan []string)
+	disconnected := make(chan bool)
+	cancel := make(chan bool)
+
+	wn := watchedNode{updates: updates, disconnected: disconnected, cancel: cancel}
+	w.watchedNodes[node] = wn
+	err := w.hookWatchChildren(node, wn)
+	if err != nil {
+		sendErr(w.errs, err)
+		go func() {
+			<-cancel
+		}()
+	}
+
+	return updates, disconnected
+}
+
+func (w *consulWatcher) removeWatch(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	if wn, ok := w.watchedNodes[node]; ok {
+		delete(w.watchedNodes, node)
+		close(wn.cancel)
+	}
+}
+
+type consulListResult struct {
+	children []string
+	index    uint64
+	err      error
+}
+
+func (w *consulWatcher) hookWatchChildren(node string, wn watchedNode) error {
+	children, index, err := w.listChildren(context.Background(), node, 0)
+	if err != nil {
+		return err
+	} else if index < 1 {
+		index = 1
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	atomic.AddInt32(&w.activeWatches, 1)
+	go func() {
+		// As with zkWatcher, wn.cancel gets an update when we're reconnecting,
+		// and is closed when the watch is removed for good.
+		reconnecting := true
+		defer func() {
+			stop()
+			atomic.AddInt32(&w.activeWatches, -1)
+			if !reconnecting {
+				close(wn.updates)
+				close(wn.disconnected)
+			}
+		}()
+
+		for {
+			select {
+			case reconnecting = <-wn.cancel:
+				return
+			case wn.updates <- children:
+			}
+
+			// Blocking queries can return without the list of children changing,
+			// for example if they time out, or a key nested under a child is
+			// added. Wait for a real change.
+			for {
+				results := make(chan consulListResult, 1)
+				go func(index uint64) {
+					children, index, err := w.listChildren(ctx, node, index)
+					results <- consulListResult{children, index, err}
+				}(index)
+
+				var res consulListResult
+				select {
+				case reconnecting = <-wn.cancel:
+					return
+				case res = <-results:
+				}
+
+				if res.err != nil {
+					sendErr(w.errs, fmt.Errorf("watch %s: %s", node, res.err))
+					reconnecting = <-wn.cancel
+					return
+				}
+
+				// The index can go backwards if the agent is restarted, in which case
+				// it has to be reset. An index of 1 returns right away.
+				if res.index < 1 || res.index < index {
+					index = 1
+				} else {
+					index = res.index
+				}
+
+				if !reflect.DeepEqual(res.children, children) {
+					children = res.children
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listChildren returns the sorted children of node, along with the index they
+// were read at. If index is nonzero, it's a blocking query, which waits until
+// something under the node changes after that index, or consulWatchWait
+// passes.
+func (w *consulWatcher) listChildren(ctx context.Context, node string, index uint64) ([]string, uint64, error) {
+	dir := strings.TrimPrefix(node, "/") + "/"
+	query := url.Values{"keys": {""}, "separator": {"/"}}
+	client := w.client
+	if index != 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWatchWait.String())
+		client = w.streamClient
+	}
+
+	req, err := w.newRequest(ctx, "GET", consulKVPath(dir), query, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	// Consul returns a 404 if there's nothing under the prefix.
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, newIndex, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, 0, consulError(resp)
+	}
+
+	var keys []string
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return consulChildren(dir, keys), newIndex, nil
+}
+
+// consulChildren returns the sorted, distinct children of dir, given the keys
+// and prefixes listed under it.
+func consulChildren(dir string, keys []string) []string {
+	var children []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		child := strings.SplitN(strings.TrimPrefix(key, dir), "/", 2)[0]
+		if child != "" && !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+
+	sort.Strings(children)
+	return children
+}
+
+// call makes a request to the agent. If req is non-nil, it's sent as JSON, and
+// if resp is nil, the response body is discarded.
+func (w *consulWatcher) call(method, p string, query url.Values, req, resp interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	httpReq, err := w.newRequest(context.Background(), method, p, query, body)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := w.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return consulError(httpResp)
+	}
+
+	if resp == nil {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (w *consulWatcher) newRequest(ctx context.Context, method, p string, query url.Values, body []byte) (*http.Request, error) {
+	u := w.address + (&url.URL{Path: p}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+
+	return req, nil
+}
+
+func consulError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(b)))
+}
+
+// consulKVPath returns the API path for a key. Consul keys don't start with a
+// slash.
+func consulKVPath(key string) string {
+	return "/v1/kv/" + strings.TrimPrefix(key, "/")
+}
+
+// triggerCleanup is a no-op for Consul, for the same reasons as for etcd.
+// Ephemeral keys are removed along with their session, so the only persistent
+// keys left behind are pins, which have to stick around anyway.
+func (w *consulWatcher) triggerCleanup() {
+}
+
+func (w *consulWatcher) close() {
+	close(w.shutdown)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stopRenew != nil {
+		close(w.stopRenew)
+		w.stopRenew = nil
+	}
+
+	// Destroying the session removes our ephemeral nodes right away, rather
+	// than after the TTL.
+	if w.session != "" {
+		w.call("PUT", "/v1/session/destroy/"+w.session, nil, nil, nil)
+	}
+}
+
+func (w *consulWatcher) connected() bool {
+	return atomic.LoadInt32(&w.isConnected) == 1
+}
+
+type consulSessionRequest struct {
+	Name      string `json:"Name"`
+	TTL       string `json:"TTL"`
+	Behavior  string `json:"Behavior"`
+	LockDelay string `json:"LockDelay"`
+}
+
+type consulSessionResponse struct {
+	ID string `json:"ID"`
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConsul struct {
+	*testing.T
+	bin  string
+	dir  string
+	port int
+	addr string
+	cmd  *exec.Cmd
+}
+
+func (tc *testConsul) start() {
+	log, err := os.OpenFile(filepath.Join(tc.dir, "log.txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(tc.T, err, "consul start")
+
+	// A dev agent keeps everything in memory, so restarting it loses all of our
+	// sessions and keys, just like losing a real agent and its server.
+	tc.cmd = exec.Command(tc.bin, "agent", "-dev",
+		"-bind", "127.0.0.1",
+		"-client", "127.0.0.1",
+		"-http-port", strconv.Itoa(tc.port),
+		"-server-port", strconv.Itoa(tc.port+1),
+		"-serf-lan-port", strconv.Itoa(tc.port+2),
+		"-serf-wan-port", strconv.Itoa(tc.port+3),
+		"-dns-port", "-1",
+		"-grpc-port", "-1")
+	tc.cmd.Stdout = log
+	tc.cmd.Stderr = log
+
+	err = tc.cmd.Start()
+	require.NoError(tc.T, err, "consul start")
+	time.Sleep(3 * time.Second)
+}
+
+func (tc *testConsul) stop() {
+	tc.cmd.Process.Kill()
+	tc.cmd.Wait()
+}
+
+func (tc *testConsul) close() {
+	tc.stop()
+
+	log, err := ioutil.TempFile("", "sequins-test-consul-")
+	require.NoError(tc.T, err, "setup: copying log")
+	log.Close()
+
+	err = os.Rename(filepath.Join(tc.dir, "log.txt"), log.Name())
+	require.NoError(tc.T, err, "setup: copying log")
+
+	tc.T.Logf("consul output at %s", log.Name())
+	os.RemoveAll(tc.dir)
+}
+
+func (tc *testConsul) restart() {
+	tc.stop()
+	time.Sleep(time.Second)
+	tc.start()
+}
+
+func createTestConsul(t *testing.T) *testConsul {
+	bin := os.Getenv("CONSUL_BIN")
+	if bin == "" {
+		t.Skip("Skipping consul tests because CONSUL_BIN isn't set")
+	}
+
+	dir, err := ioutil.TempDir("", "sequins-consul")
+	require.NoError(t, err, "consul setup")
+
+	port := randomPort()
+	tc := testConsul{
+		T:    t,
+		bin:  bin,
+		dir:  dir,
+		port: port,
+		addr: fmt.Sprintf("127.0.0.1:%d", port),
+	}
+
+	tc.start()
+	return &tc
+}
+
+func connectConsulTest(t *testing.T) (*consulWatcher, *testConsul) {
+	tc := createTestConsul(t)
+
+	w, err := connectConsul(tc.addr, "", "/sequins-test", 5*time.Second, 10*time.Second)
+	require.NoError(t, err, "consulWatcher should connect")
+
+	return w, tc
+}
+
+func TestConsulChildren(t *testing.T) {
+	keys := []string{"foo/bar", "foo/baz/", "foo/baz/qux", "foo/"}
+	assert.Equal(t, []string{"bar", "baz"}, consulChildren("foo/", keys))
+	assert.Empty(t, consulChildren("foo/", nil))
+}
+
+func TestConsulWatcher(t *testing.T) {
+	w, tc := connectConsulTest(t)
+	defer w.close()
+	defer tc.close()
+
+	updates, _ := w.watchChildren("/foo")
+	go func() {
+		w.createEphemeral("/foo/bar")
+		time.Sleep(100 * time.Millisecond)
+		w.removeEphemeral("/foo/bar")
+	}()
+
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty again")
+}
+
+func TestConsulWatcherReconnect(t *testing.T) {
+	w, tc := connectConsulTest(t)
+	defer w.close()
+	defer tc.close()
+
+	updates, _ := w.watchChildren("/foo")
+	go func() {
+		w.createEphemeral("/foo/bar")
+		time.Sleep(100 * time.Millisecond)
+		tc.restart()
+		w.createEphemeral("/foo/baz")
+	}()
+
+	assert.True(t, w.connected(), "the watcher should be connected at first")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+	expectEventualWatchUpdate(t, []string{"bar", "baz"}, updates, "the list of children should be updated with the second new node")
+	assert.True(t, w.connected(), "the watcher should be connected again after reconnecting")
+}
+
+func TestConsulWatchesCanceled(t *testing.T) {
+	w, tc := connectConsulTest(t)
+	defer w.close()
+	defer tc.close()
+
+	w.watchChildren("/foo")
+
+	for i := 0; i < 3; i++ {
+		tc.restart()
+	}
+
+	// Wait for the watcher to notice the last restart and reconnect.
+	for i := 0; i < 50 && atomic.LoadInt32(&w.activeWatches) != 1; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	time.Sleep(time.Second)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&w.activeWatches), "there should only be a single watch open")
+}
+
+func TestConsulRemoveWatch(t *testing.T) {
+	w, tc := connectConsulTest(t)
+	defer w.close()
+	defer tc.close()
+
+	updates, disconnected := w.watchChildren("/foo")
+
+	w.createEphemeral("/foo/bar")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+
+	w.removeWatch("/foo")
+
+	closed := make(chan bool)
+	go func() {
+		for range updates {
+		}
+		closed <- true
+	}()
+
+	timer := time.NewTimer(100 * time.Millisecond)
+	select {
+	case <-closed:
+	case <-timer.C:
+		assert.Fail(t, "the updates channel should be closed")
+	}
+
+	go func() {
+		for range disconnected {
+		}
+		closed <- true
+	}()
+
+	timer.Reset(100 * time.Millisecond)
+	select {
+	case <-closed:
+	case <-timer.C:
+		assert.Fail(t, "the disconnected channel should be closed")
+	}
+}
+
+func TestConsulPersistentChild(t *testing.T) {
+	w, tc := connectConsulTest(t)
+	defer w.close()
+	defer tc.close()
+
+	require.NoError(t, w.setPersistentChild("/pinned/foo", "1"))
+	require.NoError(t, w.setPersistentChild("/pinned/foo", "2"))
+
+	children, err := w.children("/pinned/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, children, "the old child should be replaced")
+
+	require.NoError(t, w.setPersistentChild("/pinned/foo", ""))
+	children, err = w.children("/pinned/foo")
+	require.NoError(t, err)
+	assert.Empty(t, children, "all children should be removed")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"time"
+)
+
+// convergenceTimesZKPath is the path under which the time to converge on each
+// version is recorded. Like partition counts, each version has a single
+// persistent child, named after the duration.
+const convergenceTimesZKPath = "convergence_times"
+
+func (db *db) convergenceTimeZKPath(version string) string {
+	return path.Join(convergenceTimesZKPath, db.name, version)
+}
+
+// timeToConverge returns how long to wait after every partition of a version
+// is available before switching to it: the db's 'time_to_converge'. In a
+// cluster, it's recorded with the coordinator the same way as the number of
+// partitions, so that every node waits the same amount of time.
+func (db *db) timeToConverge(version string) (time.Duration, error) {
+	d := db.config.TimeToConverge.Duration
+	if db.coordinator() == nil {
+		return d, nil
+	}
+
+	node := db.convergenceTimeZKPath(version)
+	recorded, err := db.agreeOn(node, d.String())
+	if err != nil {
+		return 0, err
+	}
+
+	d, err = time.ParseDuration(recorded)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid time to converge at %s: %s", node, recorded)
+	}
+
+	return d, nil
+}
+
+// forgetConvergenceTime removes the recorded time to converge for a version,
+// once it's been removed.
+func (db *db) forgetConvergenceTime(version string) {
+	if db.coordinator() == nil {
+		return
+	}
+
+	err := db.coordinator().setPersistentChild(db.convergenceTimeZKPath(version), "")
+	if err != nil {
+		log.Printf("Error removing the time to converge for version %s of %s: %s", version, db.name, err)
+	}
+}
+
+// waitToConverge waits for the version's time to converge, so that every peer
+// has a chance to see that its partitions are available before any of them
+// switch to it. It returns false if the version is canceled in the meantime.
+func (vs *version) waitToConverge() bool {
+	if vs.timeToConverge == 0 {
+		return true
+	}
+
+	t := time.NewTimer(vs.timeToConverge)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-vs.cancel:
+		return false
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"path"
+)
+
+const (
+	coordinatorZookeeper = "zookeeper"
+	coordinatorEtcd      = "etcd"
+	coordinatorConsul    = "consul"
+)
+
+// degradedHeader is set on responses from a node that's lost its connection to
+// the coordinator, and is serving what it has without cluster coordination.
+const degradedHeader = "X-Sequins-Degraded"
+
+// A coordinator is the shared state that peers in a cluster use to find each
+// other and to agree on who has which partitions. It's modeled on zookeeper:
+// nodes form a tree, separated by /'s, and nodes are either ephemeral, in which
+// case they disappear when the process that created them goes away, or
+// persistent.
+//
+// Implementations lazily connect and reconnect, and recreate ephemeral nodes
+// and watches every time they do. While they're disconnected, watches just
+// don't get updates, and the node keeps serving the versions it already has.
+type coordinator interface {
+	// createEphemeral creates an ephemeral node, which is recreated on
+	// reconnect until it's removed with removeEphemeral.
+	createEphemeral(node string)
+	removeEphemeral(node string)
+
+	// watchChildren sends the list of children of node to the first channel,
+	// and again every time it changes. The second channel gets a value
+	// whenever the connection is lost. Both are closed after removeWatch is
+	// called for the node.
+	watchChildren(node string) (chan []string, chan bool)
+	removeWatch(node string)
+
+	// children returns the children of node once, without watching it.
+	children(node string) ([]string, error)
+
+	// setPersistentChild replaces the children of node with a single
+	// persistent child, or removes them all if child is empty.
+	setPersistentChild(node, child string) error
+
+	// triggerCleanup removes any stale persistent state, like the nodes for
+	// deleted versions.
+	triggerCleanup()
+	close()
+
+	// connected returns whether the coordinator is currently connected, and has
+	// recreated its ephemeral nodes and watches.
+	connected() bool
+}
+
+// connectCoordinator connects to the coordinator selected by
+// 'sharding.coordinator'.
+func (s *sequins) connectCoordinator() (coordinator, error) {
+	prefix := path.Join("/", s.config.Sharding.ClusterName)
+	switch s.config.Sharding.Coordinator {
+	case coordinatorEtcd:
+		return connectEtcd(s.config.Etcd.Endpoints, prefix,
+			s.config.Etcd.ConnectTimeout.Duration, s.config.Etcd.SessionTimeout.Duration)
+	case coordinatorConsul:
+		return connectConsul(s.config.Consul.Address, s.config.Consul.Token, prefix,
+			s.config.Consul.ConnectTimeout.Duration, s.config.Consul.SessionTimeout.Duration)
+	default:
+		return connectZookeeperEnsembles(s.config.ZK.Servers, prefix,
+			s.config.ZK.ConnectTimeout.Duration, s.config.ZK.SessionTimeout.Duration,
+			s.config.ZK.FailoverTimeout.Duration)
+	}
+}
+
+// degraded returns whether sharding is enabled, but the node has lost its
+// connection to the coordinator. The list of peers and the partitions they
+// have are frozen until it reconnects.
+func (s *sequins) degraded() bool {
+	return s.coordinator != nil && !s.coordinator.connected()
+}
+
+// sendErr sends the error over the channel, or discards it if the error is full.
+func sendErr(errs chan error, err error) {
+	log.Println("Coordination error:", err)
+
+	select {
+	case errs <- err:
+	default:
+	}
+}
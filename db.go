@@ -7,28 +7,59 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
-var errNoVersions = errors.New("no versions available")
+var (
+	errNoVersions      = errors.New("no versions available")
+	errVersionRemoving = errors.New("version is still being removed")
+)
 
 type db struct {
 	sequins *sequins
 
 	name        string
+	config      dbConfig
 	mux         *versionMux
 	refreshLock sync.Mutex
 	buildLock   sync.Mutex
 	upgradeLock sync.Mutex
 	cleanupLock sync.Mutex
+
+	drained     map[string]bool
+	drainedLock sync.RWMutex
+
+	pinned     string
+	pinnedLock sync.RWMutex
+
+	removing     map[string]int
+	removingLock sync.Mutex
+
+	modTimes     map[string]time.Time
+	inversions   map[string]bool
+	modTimesLock sync.Mutex
+
+	// refreshTicker is nil unless the db has its own 'refresh_period'.
+	refreshTicker *time.Ticker
+	refreshDone   chan bool
 }
 
 func newDB(sequins *sequins, name string) *db {
 	db := &db{
-		sequins: sequins,
-		name:    name,
-		mux:     newVersionMux(sequins.config.Test.VersionRemoveTimeout.Duration),
+		sequins:    sequins,
+		name:       name,
+		config:     sequins.config.DBs[name],
+		mux:        newVersionMux(sequins.config.Test.VersionRemoveTimeout.Duration),
+		modTimes:   make(map[string]time.Time),
+		inversions: make(map[string]bool),
+		removing:   make(map[string]int),
+	}
+
+	if db.coordinator() != nil {
+		db.watchDrained()
+		db.watchPinned()
 	}
 
 	return db
@@ -43,7 +74,7 @@ func (db *db) backfillVersions() error {
 	db.refreshLock.Lock()
 	defer db.refreshLock.Unlock()
 
-	versions, err := db.sequins.backend.ListVersions(db.name, "", db.sequins.config.RequireSuccessFile)
+	versions, err := db.listVersions("")
 	if err != nil {
 		return err
 	} else if len(versions) == 0 {
@@ -83,6 +114,38 @@ func (db *db) backfillVersions() error {
 	return nil
 }
 
+// hasOwnRefreshPeriod returns whether the db has a per-db 'refresh_period',
+// in which case it's refreshed on its own schedule rather than the global one.
+func (db *db) hasOwnRefreshPeriod() bool {
+	return db.config.RefreshPeriod != nil
+}
+
+// refreshPeriodically starts checking for new versions on the db's own
+// schedule, if it has one and it's nonzero.
+func (db *db) refreshPeriodically() {
+	if !db.hasOwnRefreshPeriod() || db.config.RefreshPeriod.Duration == 0 {
+		return
+	}
+
+	refresh := db.config.RefreshPeriod.Duration
+	db.refreshTicker = time.NewTicker(refresh)
+	db.refreshDone = make(chan bool)
+	go func() {
+		log.Println("Automatically checking for new versions of", db.name, "every", refresh.String())
+		for {
+			select {
+			case <-db.refreshTicker.C:
+				err := db.refresh()
+				if err != nil {
+					log.Printf("Error refreshing %s: %s", db.name, err)
+				}
+			case <-db.refreshDone:
+				return
+			}
+		}
+	}()
+}
+
 // refresh finds the latest version in S3 and then triggers an upgrade.
 func (db *db) refresh() error {
 	db.refreshLock.Lock()
@@ -95,7 +158,7 @@ func (db *db) refresh() error {
 		after = currentVersion.name
 	}
 
-	versions, err := db.sequins.backend.ListVersions(db.name, after, db.sequins.config.RequireSuccessFile)
+	versions, err := db.listVersions(after)
 	if err != nil {
 		return err
 	} else if len(versions) == 0 {
@@ -108,6 +171,12 @@ func (db *db) refresh() error {
 
 	latest := versions[len(versions)-1]
 
+	// If we're rolling back to a version that we're still cleaning up, we have
+	// to wait until it's gone before we can load it again.
+	if db.isRemoving(latest) {
+		return errVersionRemoving
+	}
+
 	// Check if we already have this version in the pipeline.
 	existingVersion := db.mux.getVersion(latest)
 	db.mux.release(existingVersion)
@@ -159,10 +228,13 @@ func (db *db) switchVersion(version *version) bool {
 	// they switch before us, that's fine; the new version has been 'prepared' and
 	// we can serve it to peers (but not clients). If they switch after us, that's
 	// also fine, since we'll keep the old version around for a bit before
-	// deleting it.
+	// deleting it. With 'time_to_converge' set, we wait a bit longer, to give
+	// the peers a better chance of switching together.
 	go func() {
 		<-version.ready
-		db.upgrade(version)
+		if version.waitToConverge() {
+			db.upgrade(version)
+		}
 	}()
 
 	return false
@@ -181,30 +253,49 @@ func (db *db) upgrade(version *version) {
 		time.Sleep(delay)
 	}
 
+	// The version may have been preempted while it was building, and be on its
+	// way out. That can happen even if it would otherwise win, for example if
+	// it was pinned in the meantime.
+	if db.isRemoving(version.name) || !db.mux.has(version) {
+		return
+	}
+
 	// Make sure we always roll forward.
 	current := db.mux.getCurrent()
 	db.mux.release(current)
-	if current != nil && version.name < current.name {
+	if current != nil && db.newer(current, version) {
 		// The version is already out of date, so get rid of it.
-		go db.removeVersion(version, false)
+		db.scheduleRemoval(version, false)
 		return
 	} else if version == current {
 		return
 	}
 
-	log.Printf("Switching to version %s of %s!", version.name, db.name)
+	logEvent(logFields{DB: db.name, Version: version.name, Event: "version_switched"},
+		"Switching to version %s of %s!", version.name, db.name)
 	db.mux.upgrade(version)
 	version.setState(versionAvailable)
 
+	oldVersion := ""
+	if current != nil {
+		oldVersion = current.name
+	}
+
+	db.notifyUpgrade(oldVersion, version.name)
+
 	// Close the current version, and any older versions that were
 	// also being prepared (effectively preempting them).
 	for _, old := range db.mux.getAll() {
 		if old == current {
-			go db.removeVersion(old, true)
-		} else if old.name < version.name {
-			go db.removeVersion(old, false)
+			db.scheduleRemoval(old, true)
+		} else if db.newer(version, old) {
+			db.scheduleRemoval(old, false)
 		}
 	}
+
+	// Now that the old versions are on their way out, make sure there's room for
+	// the next one.
+	go db.sequins.evictVersions(db.sequins.config.MaxLocalStoreBytes)
 }
 
 // removeVersion removes a version, blocking until it is no longer being
@@ -216,22 +307,66 @@ func (db *db) removeVersion(old *version, shouldWait bool) {
 	old.setState(versionRemoving)
 
 	// If we don't have any peers, we never need to wait until the versions
-	// aren't being used.
-	if db.sequins.peers == nil {
+	// aren't being used, unless misses fall back to the previous version.
+	if db.peers() == nil && !db.config.FallbackToPreviousVersion {
 		shouldWait = false
 	}
 
 	// This will block until the version is no longer being used.
 	if removed := db.mux.remove(old, shouldWait); removed != nil {
 		removed.close()
+
+		// With a read-only store, the process that loaded the version deletes it.
+		if db.sequins.config.ReadOnlyStore {
+			return
+		}
+
 		err := removed.delete()
 		if err != nil {
 			log.Printf("Error cleaning up version %s of %s: %s", removed.name, db.name, err)
 		}
+
+		db.forgetPartitions(removed.name)
+		db.forgetConvergenceTime(removed.name)
+	}
+}
+
+// scheduleRemoval removes a version in the background. The version is marked as
+// being removed right away, so that refresh won't try to load it again until
+// it's completely gone.
+func (db *db) scheduleRemoval(old *version, shouldWait bool) {
+	db.setRemoving(old.name, true)
+	go func() {
+		defer db.setRemoving(old.name, false)
+		db.removeVersion(old, shouldWait)
+	}()
+}
+
+// setRemoving tracks which versions are being removed, by name.
+func (db *db) setRemoving(name string, removing bool) {
+	db.removingLock.Lock()
+	defer db.removingLock.Unlock()
+
+	if removing {
+		db.removing[name]++
+	} else if db.removing[name]--; db.removing[name] <= 0 {
+		delete(db.removing, name)
 	}
 }
 
+// isRemoving returns true if the version with the given name is being removed.
+func (db *db) isRemoving(name string) bool {
+	db.removingLock.Lock()
+	defer db.removingLock.Unlock()
+
+	return db.removing[name] > 0
+}
+
 func (db *db) cleanupStore() {
+	if db.sequins.config.ReadOnlyStore {
+		return
+	}
+
 	db.cleanupLock.Lock()
 	defer db.cleanupLock.Unlock()
 
@@ -255,11 +390,24 @@ func (db *db) cleanupStore() {
 			continue
 		}
 
-		log.Println("Clearing defunct version", v, "of", db.name)
+		logEvent(logFields{DB: db.name, Version: v, Event: "version_cleared"},
+			"Clearing defunct version %s of %s", v, db.name)
 		os.RemoveAll(db.localPath(v))
 	}
 }
 
+// contentType returns the Content-Type to serve the db's values with: the db's
+// own 'content_type', the global one, or application/octet-stream.
+func (db *db) contentType() string {
+	if db.config.ContentType != "" {
+		return db.config.ContentType
+	} else if db.sequins.config.ContentType != "" {
+		return db.sequins.config.ContentType
+	}
+
+	return defaultContentType
+}
+
 func (db *db) localPath(version string) string {
 	return filepath.Join(db.sequins.config.LocalStore, "data", db.name, version)
 }
@@ -268,21 +416,92 @@ func (db *db) serveKey(w http.ResponseWriter, r *http.Request, key string) {
 	if key == "" {
 		db.serveStatus(w, r)
 		return
+	} else if key == dbETagKey && db.sequins.config.DBETags {
+		db.serveETag(w, r)
+		return
+	} else if key == planKey {
+		db.servePlan(w, r)
+		return
+	}
+
+	if !db.sequins.checkConverged(w, r) {
+		return
+	}
+
+	// Requests for /db/_v/<version>/<key> are for a specific version.
+	if strings.HasPrefix(key, "_v/") {
+		parts := strings.SplitN(strings.TrimPrefix(key, "_v/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		db.mux.serveVersionKey(w, r, parts[0], parts[1])
+		return
+	}
+
+	// Requests for /db/_prefix/<prefix> scan for all the keys with that prefix.
+	if strings.HasPrefix(key, prefixScanKey) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		db.mux.servePrefix(w, r, strings.TrimPrefix(key, prefixScanKey))
+		return
+	}
+
+	// Clients can also ask for a specific version with a header or parameter,
+	// for example to canary a new version. Peers ask with ?proxy instead.
+	if name := overrideVersion(r); name != "" && proxiedVersion(r) == "" {
+		db.mux.serveVersionKey(w, r, name, key)
+		return
+	}
+
+	// Peers ask for a specific version, so only requests from clients fall back.
+	if db.config.FallbackToPreviousVersion && proxiedVersion(r) == "" {
+		db.serveKeyWithFallback(w, r, key)
+		return
 	}
 
 	db.mux.serveKey(w, r, key)
 }
 
+// overrideVersion returns the version a client asked for with an
+// X-Sequins-Version header or a ?version parameter, or an empty string if it
+// didn't. The parameter wins if both are set.
+func overrideVersion(r *http.Request) string {
+	if v := r.URL.Query().Get(versionParam); v != "" {
+		return v
+	}
+
+	return r.Header.Get(versionHeader)
+}
+
 func (db *db) close() {
+	if db.refreshTicker != nil {
+		db.refreshTicker.Stop()
+		close(db.refreshDone)
+	}
+
 	db.refreshLock.Lock()
 	defer db.refreshLock.Unlock()
 
 	for _, vs := range db.mux.getAll() {
 		vs.close()
 	}
+
+	if db.coordinator() != nil {
+		db.coordinator().removeWatch(drainedZKPath(db.name))
+		db.coordinator().removeWatch(db.pinnedZKPath())
+	}
 }
 
 func (db *db) delete() {
+	if db.sequins.config.ReadOnlyStore {
+		return
+	}
+
 	for _, vs := range db.mux.getAll() {
 		vs.delete()
 	}
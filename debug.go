@@ -7,8 +7,6 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
-	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +28,7 @@ type sequinsStats struct {
 		status500 int64
 		status501 int64
 		status502 int64
+		status503 int64
 		status504 int64
 	}
 	Latency struct {
@@ -48,7 +47,37 @@ type sequinsStats struct {
 	queries     chan queryStats
 
 	DiskUsed int64
-	lock     sync.RWMutex
+
+	// PartiallyAvailableVersions is the number of versions that have been
+	// available on too few nodes for too long. See watchAvailability.
+	PartiallyAvailableVersions int
+
+	// RemoteFallbacks is the total number of requests that have fallen back to
+	// the remote cluster. See fetchRemote.
+	RemoteFallbacks int64
+
+	// VersionInversions is the total number of versions that were skipped
+	// because they were modified before the current version, despite sorting
+	// after it. See warnInversions.
+	VersionInversions int64
+
+	// ReadRepairChecks and ReadRepairMismatches are the total number of reads
+	// cross-checked against another replica, and how many of those didn't match.
+	// See readRepair.
+	ReadRepairChecks     int64
+	ReadRepairMismatches int64
+
+	// Evictions is the total number of versions evicted to keep the local store
+	// under 'max_local_store_bytes'. See evictVersions.
+	Evictions int64
+
+	// IntegrityScanChecks and IntegrityScanFailures are the total number of keys
+	// read back by integrity scans, and the number of partitions that failed a
+	// scan. See scanIntegrity.
+	IntegrityScanChecks   int64
+	IntegrityScanFailures int64
+
+	lock sync.RWMutex
 }
 
 type queryStats struct {
@@ -56,7 +85,7 @@ type queryStats struct {
 	status   int
 }
 
-func startDebugServer(config sequinsConfig) {
+func startDebugServer(config sequinsConfig, sequins *sequins) {
 	mux := http.NewServeMux()
 
 	s := &http.Server{
@@ -78,6 +107,14 @@ func startDebugServer(config sequinsConfig) {
 		mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 	}
 
+	if config.Debug.Partitions {
+		mux.HandleFunc(debugPartitionsPath, sequins.serveDebugPartitions)
+	}
+
+	if config.Debug.Loads {
+		mux.HandleFunc(debugLoadsPath, sequins.serveDebugLoads)
+	}
+
 	go s.ListenAndServe()
 }
 
@@ -123,6 +160,7 @@ func (s *sequinsStats) updateRequestStats() {
 			s.Qps.status500 = 0
 			s.Qps.status501 = 0
 			s.Qps.status502 = 0
+			s.Qps.status503 = 0
 			s.Qps.status504 = 0
 		case q := <-s.queries:
 			s.latencyHist.RecordValue(int64(q.duration / time.Microsecond))
@@ -141,6 +179,8 @@ func (s *sequinsStats) updateRequestStats() {
 				s.Qps.status501++
 			case 502:
 				s.Qps.status502++
+			case 503:
+				s.Qps.status503++
 			case 504:
 				s.Qps.status504++
 			default:
@@ -162,6 +202,7 @@ func (s *sequinsStats) snapshotRequestStats() {
 	s.Qps.ByStatus["500"] = s.Qps.status500
 	s.Qps.ByStatus["501"] = s.Qps.status501
 	s.Qps.ByStatus["502"] = s.Qps.status502
+	s.Qps.ByStatus["503"] = s.Qps.status503
 	s.Qps.ByStatus["504"] = s.Qps.status504
 
 	ms := float64(1000)
@@ -186,14 +227,7 @@ func (s *sequinsStats) updateDiskStats(path string) {
 }
 
 func (s *sequinsStats) calculateDiskUsage(path string) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if info != nil && !info.IsDir() {
-			size += info.Size()
-		}
-		return err
-	})
-
+	size, err := diskUsage(path)
 	if err == nil {
 		s.lock.Lock()
 		defer s.lock.Unlock()
@@ -202,6 +236,52 @@ func (s *sequinsStats) calculateDiskUsage(path string) {
 	}
 }
 
+func (s *sequinsStats) setPartiallyAvailableVersions(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.PartiallyAvailableVersions = n
+}
+
+func (s *sequinsStats) incrRemoteFallbacks() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.RemoteFallbacks++
+}
+
+func (s *sequinsStats) incrVersionInversions() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.VersionInversions++
+}
+
+func (s *sequinsStats) incrReadRepair(mismatch bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ReadRepairChecks++
+	if mismatch {
+		s.ReadRepairMismatches++
+	}
+}
+
+func (s *sequinsStats) incrEvictions() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Evictions++
+}
+
+func (s *sequinsStats) incrIntegrityScan(checked, failed int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.IntegrityScanChecks += int64(checked)
+	s.IntegrityScanFailures += int64(failed)
+}
+
 func (s *sequinsStats) String() string {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -224,10 +304,10 @@ func trackQueries(s *sequins) trackingHandler {
 }
 
 func (t trackingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Don't track queries to the status pages, and don't track proxied
-	// queries.
+	// Don't track queries to the status pages or admin actions, and don't track
+	// proxied queries.
 	path := strings.TrimPrefix(r.URL.Path, "/")
-	if strings.Index(path, "/") > 0 && r.URL.Query().Get("proxy") == "" {
+	if r.Method == "GET" && strings.Index(path, "/") > 0 && proxiedVersion(r) == "" {
 		w = trackQuery(w)
 		defer w.(*queryTracker).done()
 	}
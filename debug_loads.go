@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// debugLoadsPath serves the state of every load, at /debug/loads, on the
+// debug server.
+const debugLoadsPath = "/debug/loads"
+
+// loadHistory is how long finished loads are kept around to be listed.
+const loadHistory = time.Hour
+
+type loadState string
+
+const (
+	loadQueued      loadState = "queued"
+	loadDownloading loadState = "downloading"
+	loadIndexing    loadState = "indexing"
+	loadDone        loadState = "done"
+	loadFailed      loadState = "failed"
+)
+
+// loadStatus is a snapshot of a single load, as listed by /debug/loads. Bytes
+// is the number of bytes read from the source so far.
+type loadStatus struct {
+	DB       string     `json:"db"`
+	Version  string     `json:"version"`
+	State    loadState  `json:"state"`
+	Bytes    int64      `json:"bytes"`
+	Queued   time.Time  `json:"queued_at"`
+	Started  *time.Time `json:"started_at,omitempty"`
+	Finished *time.Time `json:"finished_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// loadProgress tracks a single load of a version, from when it starts waiting
+// for the build locks to when it finishes. A nil loadProgress ignores
+// everything, so that builds that aren't tracked, like repairs, don't need to
+// check.
+type loadProgress struct {
+	bytes  int64
+	status loadStatus
+	lock   sync.Mutex
+}
+
+// loadTracker keeps track of every load on the node.
+type loadTracker struct {
+	loads map[string]*loadProgress
+	lock  sync.Mutex
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{loads: make(map[string]*loadProgress)}
+}
+
+// queue starts tracking a load of the given version, replacing any earlier
+// load of it, and drops loads that finished long enough ago.
+func (lt *loadTracker) queue(db, version string) *loadProgress {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	now := time.Now()
+	for key, lp := range lt.loads {
+		lp.lock.Lock()
+		expired := lp.status.Finished != nil && now.Sub(*lp.status.Finished) > loadHistory
+		lp.lock.Unlock()
+
+		if expired {
+			delete(lt.loads, key)
+		}
+	}
+
+	lp := &loadProgress{status: loadStatus{
+		DB:      db,
+		Version: version,
+		State:   loadQueued,
+		Queued:  now,
+	}}
+
+	lt.loads[path.Join(db, version)] = lp
+	return lp
+}
+
+// remove stops tracking a load, if it's still the latest one for its version.
+func (lt *loadTracker) remove(lp *loadProgress) {
+	if lp == nil {
+		return
+	}
+
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	key := path.Join(lp.status.DB, lp.status.Version)
+	if lt.loads[key] == lp {
+		delete(lt.loads, key)
+	}
+}
+
+// list returns a copy of every load, oldest first.
+func (lt *loadTracker) list() []loadStatus {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	res := make([]loadStatus, 0, len(lt.loads))
+	for _, lp := range lt.loads {
+		lp.lock.Lock()
+		status := lp.status
+		lp.lock.Unlock()
+
+		status.Bytes = atomic.LoadInt64(&lp.bytes)
+		res = append(res, status)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Queued.Equal(res[j].Queued) {
+			return res[i].Queued.Before(res[j].Queued)
+		}
+
+		return path.Join(res[i].DB, res[i].Version) < path.Join(res[j].DB, res[j].Version)
+	})
+
+	return res
+}
+
+func (lp *loadProgress) setState(state loadState) {
+	if lp == nil {
+		return
+	}
+
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+
+	now := time.Now()
+	lp.status.State = state
+	switch state {
+	case loadDownloading:
+		if lp.status.Started == nil {
+			lp.status.Started = &now
+		}
+	case loadDone, loadFailed:
+		lp.status.Finished = &now
+	}
+}
+
+func (lp *loadProgress) fail(err error) {
+	if lp == nil {
+		return
+	}
+
+	lp.setState(loadFailed)
+	lp.lock.Lock()
+	lp.status.Error = err.Error()
+	lp.lock.Unlock()
+}
+
+// err returns the reason the load failed, if it did.
+func (lp *loadProgress) err() error {
+	if lp == nil {
+		return nil
+	}
+
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+
+	if lp.status.State != loadFailed {
+		return nil
+	}
+
+	return errors.New(lp.status.Error)
+}
+
+// reader wraps r, counting the bytes read from it towards the load's
+// progress.
+func (lp *loadProgress) reader(r io.Reader) io.Reader {
+	if lp == nil {
+		return r
+	}
+
+	return progressReader{r, lp}
+}
+
+type progressReader struct {
+	io.Reader
+	lp *loadProgress
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.Reader.Read(b)
+	atomic.AddInt64(&pr.lp.bytes, int64(n))
+	return n, err
+}
+
+// serveDebugLoads handles GET /debug/loads. It lists every version that's
+// waiting to be loaded or is being loaded, along with how far along it is,
+// and the ones that finished in the last hour. Loads wait in the queued state
+// for the db's previous load and for a slot under 'max_parallel_loads'.
+func (s *sequins) serveDebugLoads(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(s.loads.list())
+	if err != nil {
+		log.Println("Error serving loads:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// debugPartitionsPath serves the partition ownership map for a db, at
+// /debug/partitions/<db>, on the debug server.
+const debugPartitionsPath = "/debug/partitions/"
+
+type debugPartitions struct {
+	DB         string               `json:"db"`
+	Version    string               `json:"version"`
+	Partitions []partitionOwnership `json:"partitions"`
+}
+
+// serveDebugPartitions handles GET /debug/partitions/<db>. It lists every
+// partition of the current version of the db, along with the peers that have
+// advertised it, and whether this node has it locally or is responsible for
+// it. This is the same view of the cluster that's used to decide where to
+// proxy requests, so it doesn't touch the coordinator.
+func (s *sequins) serveDebugPartitions(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, debugPartitionsPath)
+
+	s.dbsLock.RLock()
+	db := s.dbs[name]
+	s.dbsLock.RUnlock()
+
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	vs := db.mux.getCurrent()
+	defer db.mux.release(vs)
+	if vs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(debugPartitions{
+		DB:         db.name,
+		Version:    vs.name,
+		Partitions: vs.partitions.ownership(),
+	})
+
+	if err != nil {
+		log.Println("Error serving partitions:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+)
+
+// isDisabled returns true if the db has been disabled on this node, either
+// with 'disabled_databases' or with POST /<db>/_disable.
+func (s *sequins) isDisabled(name string) bool {
+	s.disabledLock.RLock()
+	defer s.disabledLock.RUnlock()
+
+	return s.disabled[name]
+}
+
+// serveDisabledDB handles any request for a disabled db. Everything but
+// enabling it again gets a 503. Like any other admin action, enabling it needs
+// one of the 'admin_tokens', if they're set.
+func (s *sequins) serveDisabledDB(w http.ResponseWriter, r *http.Request, name, key string) {
+	switch key {
+	case "_enable":
+		if s.checkAdminAuth(w, r) {
+			s.serveEnable(w, r, name)
+		}
+	case "_disable":
+		if s.checkAdminAuth(w, r) {
+			s.serveDisable(w, r, name)
+		}
+	default:
+		setErrorCode(w, codeDatabaseDisabled)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// serveDisable handles POST /<db>/_disable, which stops serving the db on
+// this node.
+func (s *sequins) serveDisable(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("Disabling", name, "triggered by request from", r.RemoteAddr)
+	s.disableDB(name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveEnable handles POST /<db>/_enable, which reverses POST /<db>/_disable.
+// The db is loaded again in the background.
+func (s *sequins) serveEnable(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("Enabling", name, "triggered by request from", r.RemoteAddr)
+	s.enableDB(name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// disableDB stops serving the db on this node, and stops checking it for new
+// versions. Its partitions are no longer advertised, and the node drains
+// itself of the db, so that peers take over its share and stop proxying to it.
+// Nothing is removed from the local store, so a version that's still there can
+// be picked up again right away when the db is enabled.
+func (s *sequins) disableDB(name string) {
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+
+	s.disabledLock.Lock()
+	if s.disabled[name] {
+		s.disabledLock.Unlock()
+		return
+	}
+
+	s.disabled[name] = true
+	s.disabledLock.Unlock()
+
+	logEvent(logFields{DB: name, Event: "db_disabled"}, "Disabling %s on this node", name)
+	if s.peers != nil {
+		s.coordinator.createEphemeral(path.Join(drainedZKPath(name), s.peers.address))
+	}
+
+	s.dbsLock.Lock()
+	db := s.dbs[name]
+	delete(s.dbs, name)
+	s.dbsLock.Unlock()
+
+	if db == nil {
+		return
+	}
+
+	for _, vs := range db.mux.getAll() {
+		vs.partitions.unadvertisePartitions()
+	}
+
+	db.close()
+}
+
+// enableDB reverses disableDB, and then triggers a refresh, which loads the db
+// from scratch. Since the node undrains itself of the db, this also undoes any
+// earlier POST /<db>/_drain.
+func (s *sequins) enableDB(name string) {
+	s.disabledLock.Lock()
+	if !s.disabled[name] {
+		s.disabledLock.Unlock()
+		return
+	}
+
+	delete(s.disabled, name)
+	s.disabledLock.Unlock()
+
+	logEvent(logFields{DB: name, Event: "db_enabled"}, "Enabling %s on this node", name)
+	if s.peers != nil {
+		s.coordinator.removeEphemeral(path.Join(drainedZKPath(name), s.peers.address))
+	}
+
+	go s.refreshAll()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"path"
+)
+
+// drainedZKPath returns the path under which nodes advertise that they've
+// been drained of a db. Each drained node has an ephemeral child named after
+// its address.
+func drainedZKPath(db string) string {
+	return path.Join("drained", db)
+}
+
+// watchDrained starts watching the set of nodes which have been drained of the
+// db. It blocks until the initial set is known, so that the first version we
+// load already takes it into account.
+func (db *db) watchDrained() {
+	updates, _ := db.coordinator().watchChildren(drainedZKPath(db.name))
+	db.updateDrained(<-updates)
+
+	go func() {
+		for {
+			nodes, ok := <-updates
+			if !ok {
+				break
+			}
+
+			db.updateDrained(nodes)
+		}
+	}()
+}
+
+// updateDrained updates the set of drained nodes, and if it changed, gives
+// each version a chance to reshuffle its partitions.
+func (db *db) updateDrained(nodes []string) {
+	drained := make(map[string]bool)
+	for _, node := range nodes {
+		drained[node] = true
+	}
+
+	db.drainedLock.Lock()
+	changed := len(drained) != len(db.drained)
+	for node := range drained {
+		if !db.drained[node] {
+			changed = true
+		}
+	}
+
+	db.drained = drained
+	db.drainedLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	log.Printf("Nodes drained of %s: %d", db.name, len(drained))
+	for _, vs := range db.mux.getAll() {
+		vs.rebalance(drained)
+	}
+}
+
+// getDrained returns the set of nodes, by address, which have been drained of
+// the db.
+func (db *db) getDrained() map[string]bool {
+	db.drainedLock.RLock()
+	defer db.drainedLock.RUnlock()
+
+	return db.drained
+}
+
+// drain removes this node from the replica set for every partition of the db.
+// Peers pick up the slack and stop proxying requests to this node, but it keeps
+// serving any requests that it receives directly.
+func (db *db) drain() {
+	log.Println("Draining", db.name, "off of this node")
+	db.coordinator().createEphemeral(path.Join(drainedZKPath(db.name), db.peers().address))
+}
+
+// undrain reverses drain.
+func (db *db) undrain() {
+	log.Println("Undraining", db.name, "on this node")
+	db.coordinator().removeEphemeral(path.Join(drainedZKPath(db.name), db.peers().address))
+}
+
+// rebalance recomputes the partitions this node is responsible for, given a new
+// set of drained nodes, and builds any that it doesn't have yet.
+func (vs *version) rebalance(drained map[string]bool) {
+	if vs.partitions.repick(drained) {
+		go vs.rebuild()
+	}
+}
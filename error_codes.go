@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// errorCodeHeader is set on error responses to reads, with a machine-readable
+// code for what went wrong. The codes are stable, so clients can rely on them
+// rather than guessing from the status.
+const errorCodeHeader = "X-Sequins-Error"
+
+const (
+	codeDatabaseNotFound    = "database_not_found"
+	codeDatabaseDisabled    = "database_disabled"
+	codeNoVersion           = "no_version"
+	codeVersionNotAvailable = "version_not_available"
+	codeKeyNotFound         = "key_not_found"
+	codeKeyNotLocal         = "key_not_local"
+	codeValueTooLarge       = "value_too_large"
+	codeProxyUnavailable    = "proxy_unavailable"
+	codeProxyTimeout        = "proxy_timeout"
+	codeDegraded            = "degraded"
+	codeNotConverged        = "not_converged"
+	codeMaintenance         = "maintenance"
+	codeRateLimited         = "rate_limited"
+	codeUnauthorized        = "unauthorized"
+	codeInternalError       = "internal_error"
+)
+
+// errorResponse is the body of an error response, for clients that accept
+// JSON.
+type errorResponse struct {
+	Code   string `json:"code"`
+	Status int    `json:"status"`
+}
+
+func setErrorCode(w http.ResponseWriter, code string) {
+	w.Header().Set(errorCodeHeader, code)
+}
+
+// jsonErrorWriter gives every error response a JSON body with its error code.
+// Responses that don't set a code get one derived from the status, like
+// "method_not_allowed". Anything the handler writes after an error status is
+// dropped, so that the body stays valid JSON.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (jw *jsonErrorWriter) WriteHeader(status int) {
+	if status < 400 {
+		jw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	h := jw.Header()
+	code := h.Get(errorCodeHeader)
+	if code == "" {
+		code = strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+	}
+
+	body, _ := json.Marshal(errorResponse{Code: code, Status: status})
+	h.Set("Content-Type", "application/json")
+	h.Del("Content-Length")
+	jw.ResponseWriter.WriteHeader(status)
+	jw.ResponseWriter.Write(append(body, '\n'))
+	jw.failed = true
+}
+
+func (jw *jsonErrorWriter) Write(b []byte) (int, error) {
+	if jw.failed {
+		return len(b), nil
+	}
+
+	return jw.ResponseWriter.Write(b)
+}
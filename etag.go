@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// dbETagKey is the key used to fetch the fingerprint of a db, with
+// GET /<db>/_etag, when 'db_etags' is enabled.
+const dbETagKey = "_etag"
+
+// computeFingerprint calculates a fingerprint for the version from its name
+// and the parts of its manifest that are the same on every node: the files
+// it was built from and the way keys are partitioned. It doesn't look at any
+// values.
+func (vs *version) computeFingerprint() string {
+	files := make([]string, len(vs.files)+len(vs.metadataFiles))
+	copy(files, vs.files)
+	copy(files[len(vs.files):], vs.metadataFiles)
+	sort.Strings(files)
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n", vs.db.name, vs.name, vs.numPartitions)
+	fmt.Fprintf(h, "%s\n", strings.Join(files, "\n"))
+	fmt.Fprintf(h, "%v\n%+v\n", vs.blockStore.KeyNormalization(), vs.blockStore.KeyPrefix())
+
+	return fmt.Sprintf("%s-%s", vs.name, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// serveETag serves the fingerprint of the current version of the db, as an
+// ETag header, so that caches can cheaply check whether anything has changed.
+// For GETs, the fingerprint is also the body. Conditional requests with
+// If-None-Match are supported.
+func (db *db) serveETag(w http.ResponseWriter, r *http.Request) {
+	vs := db.mux.getCurrent()
+	if vs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	defer db.mux.release(vs)
+	etag := fmt.Sprintf("%q", vs.fingerprint)
+	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	fmt.Fprintln(w, vs.fingerprint)
+}
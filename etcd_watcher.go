@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	etcdReconnectPeriod = 1 * time.Second
+	defaultEtcdPort     = 2379
+)
+
+var errEtcdShutdown = errors.New("shutting down")
+
+// An etcdWatcher is the etcd equivalent of a zkWatcher. It uses the etcd v3
+// API, through the JSON gateway, so that it doesn't need a gRPC client.
+//
+// etcd doesn't have a tree of nodes like zookeeper, so each node is just a key,
+// and the children of a node are the distinct path components directly under
+// it. Ephemeral nodes are attached to a lease, which is kept alive for as long
+// as the watcher is connected. Like zkWatcher, it reconnects lazily, and on
+// every reconnect it grants itself a new lease, recreates ephemeral nodes, and
+// resets watches.
+type etcdWatcher struct {
+	sync.RWMutex
+	endpoints      []string
+	current        int
+	connectTimeout time.Duration
+	sessionTimeout time.Duration
+	prefix         string
+	client         *http.Client
+	streamClient   *http.Client
+	lease          int64
+	stopKeepAlive  chan bool
+	errs           chan error
+	shutdown       chan bool
+	isConnected    int32
+
+	hooksLock      sync.Mutex
+	ephemeralNodes map[string]bool
+	watchedNodes   map[string]watchedNode
+
+	// activeWatches is the number of open watch streams, for tests.
+	activeWatches int32
+}
+
+func connectEtcd(endpoints []string, prefix string, connectTimeout, sessionTimeout time.Duration) (*etcdWatcher, error) {
+	normalized := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		if !strings.Contains(e, "://") {
+			e = "http://" + e
+		}
+
+		if strings.Index(strings.SplitN(e, "://", 2)[1], ":") < 0 {
+			e = fmt.Sprintf("%s:%d", e, defaultEtcdPort)
+		}
+
+		normalized[i] = strings.TrimSuffix(e, "/")
+	}
+
+	if len(normalized) == 0 {
+		return nil, errors.New("etcd error: no endpoints configured")
+	}
+
+	w := &etcdWatcher{
+		endpoints:      normalized,
+		connectTimeout: connectTimeout,
+		sessionTimeout: sessionTimeout,
+		prefix:         path.Join(prefix, coordinationVersion),
+		client:         &http.Client{Timeout: connectTimeout},
+		streamClient:   &http.Client{},
+		errs:           make(chan error, 1),
+		shutdown:       make(chan bool),
+		ephemeralNodes: make(map[string]bool),
+		watchedNodes:   make(map[string]watchedNode),
+	}
+
+	err := w.reconnect()
+	if err != nil {
+		return nil, fmt.Errorf("etcd error: %s", err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// reconnect grants a new lease, trying each endpoint in turn, and starts
+// keeping it alive.
+func (w *etcdWatcher) reconnect() error {
+	w.Lock()
+	defer w.Unlock()
+
+	select {
+	case <-w.shutdown:
+		return errEtcdShutdown
+	default:
+	}
+
+	if w.stopKeepAlive != nil {
+		close(w.stopKeepAlive)
+		w.stopKeepAlive = nil
+	}
+
+	var lease int64
+	var err error
+	for i := 0; i < len(w.endpoints); i++ {
+		log.Println("Connecting to etcd at", w.endpoints[w.current])
+		lease, err = w.grantLease()
+		if err == nil {
+			break
+		}
+
+		log.Printf("Error connecting to etcd at %s: %s", w.endpoints[w.current], err)
+		w.current = (w.current + 1) % len(w.endpoints)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w.lease = lease
+	w.stopKeepAlive = make(chan bool)
+	go w.keepAlive(lease, w.stopKeepAlive)
+	return nil
+}
+
+func (w *etcdWatcher) grantLease() (int64, error) {
+	ttl := int64(w.sessionTimeout / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	resp := etcdLeaseResponse{}
+	err := w.call("/v3/lease/grant", etcdLeaseRequest{TTL: ttl}, &resp)
+	if err != nil {
+		return 0, err
+	} else if resp.ID == 0 {
+		return 0, errors.New("granting lease: empty lease ID")
+	}
+
+	return resp.ID, nil
+}
+
+// keepAlive refreshes the lease a few times per TTL, until stop is closed. If
+// the lease is lost, it triggers a reconnect.
+func (w *etcdWatcher) keepAlive(lease int64, stop chan bool) {
+	ticker := time.NewTicker(w.sessionTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		w.RLock()
+		select {
+		case <-stop:
+			w.RUnlock()
+			return
+		default:
+		}
+
+		resp := etcdKeepAliveResponse{}
+		err := w.call("/v3/lease/keepalive", etcdLeaseRequest{ID: lease}, &resp)
+		w.RUnlock()
+
+		if err == nil && resp.Result.TTL <= 0 {
+			err = fmt.Errorf("lease %x expired", lease)
+		}
+
+		if err != nil {
+			sendErr(w.errs, err)
+			return
+		}
+	}
+}
+
+func (w *etcdWatcher) runHooks() error {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	for node := range w.ephemeralNodes {
+		err := w.hookCreateEphemeral(node)
+		if err != nil {
+			return err
+		}
+	}
+
+	for node, wn := range w.watchedNodes {
+		err := w.hookWatchChildren(node, wn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *etcdWatcher) notifyDisconnected() {
+	for _, wn := range w.watchedNodes {
+		select {
+		case wn.disconnected <- true:
+		default:
+		}
+	}
+}
+
+func (w *etcdWatcher) cancelWatches() {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	w.notifyDisconnected()
+
+	for _, wn := range w.watchedNodes {
+		wn.cancel <- true
+	}
+}
+
+// run runs the main loop. On any errors, it resets the connection.
+func (w *etcdWatcher) run() {
+	first := true
+
+Reconnect:
+	for {
+		if !first {
+			// Wait before trying to reconnect again.
+			wait := time.NewTimer(etcdReconnectPeriod)
+			select {
+			case <-w.shutdown:
+				break Reconnect
+			case <-wait.C:
+			}
+
+			err := w.reconnect()
+			if err != nil {
+				log.Println("Error reconnecting to etcd:", err)
+				continue Reconnect
+			}
+
+			// Every time we connect, reset watches and recreate ephemeral nodes.
+			err = w.runHooks()
+			if err != nil {
+				log.Println("Error running etcd hooks:", err)
+				continue Reconnect
+			}
+
+			log.Println("Reconnected to etcd")
+		} else {
+			first = false
+		}
+
+		atomic.StoreInt32(&w.isConnected, 1)
+		select {
+		case <-w.shutdown:
+			break Reconnect
+		case err := <-w.errs:
+			log.Println("Disconnecting from etcd because of error:", err)
+			atomic.StoreInt32(&w.isConnected, 0)
+			w.cancelWatches()
+			continue Reconnect
+		}
+	}
+
+	w.cancelWatches()
+}
+
+func (w *etcdWatcher) createEphemeral(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	w.ephemeralNodes[node] = true
+	err := w.hookCreateEphemeral(node)
+	if err != nil {
+		sendErr(w.errs, err)
+	}
+}
+
+func (w *etcdWatcher) removeEphemeral(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	w.RLock()
+	defer w.RUnlock()
+
+	node = path.Join(w.prefix, node)
+	w.call("/v3/kv/deleterange", etcdRangeRequest{Key: []byte(node)}, nil)
+	delete(w.ephemeralNodes, node)
+}
+
+func (w *etcdWatcher) hookCreateEphemeral(node string) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	err := w.call("/v3/kv/put", etcdPutRequest{Key: []byte(node), Value: []byte{}, Lease: w.lease}, nil)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", node, err)
+	}
+
+	return nil
+}
+
+// setPersistentChild replaces the children of node with a single persistent
+// child, or removes them all if child is empty. The child isn't attached to
+// any lease, so it outlives the watcher.
+func (w *etcdWatcher) setPersistentChild(node, child string) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	node = path.Join(w.prefix, node)
+	if child != "" {
+		err := w.call("/v3/kv/put", etcdPutRequest{Key: []byte(path.Join(node, child)), Value: []byte{}}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	children, _, err := w.listChildren(node)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		if c == child {
+			continue
+		}
+
+		err = w.call("/v3/kv/deleterange", etcdRangeRequest{Key: []byte(path.Join(node, c))}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// children returns the children of node once, without watching it.
+func (w *etcdWatcher) children(node string) ([]string, error) {
+	w.RLock()
+	defer w.RUnlock()
+
+	children, _, err := w.listChildren(path.Join(w.prefix, node))
+	return children, err
+}
+
+func (w *etcdWatcher) watchChildren(node string) (chan []string, chan bool) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	updates := make(chan []string)
+	disconnected := make(chan bool)
+	cancel := make(chan bool)
+
+	wn := watchedNode{updates: updates, disconnected: disconnected, cancel: cancel}
+	w.watchedNodes[node] = wn
+	err := w.hookWatchChildren(node, wn)
+	if err != nil {
+		sendErr(w.errs, err)
+		go func() {
+			<-cancel
+		}()
+	}
+
+	return updates, disconnected
+}
+
+func (w *etcdWatcher) removeWatch(node string) {
+	w.hooksLock.Lock()
+	defer w.hooksLock.Unlock()
+
+	node = path.Join(w.prefix, node)
+	if wn, ok := w.watchedNodes[node]; ok {
+		delete(w.watchedNodes, node)
+		close(wn.cancel)
+	}
+}
+
+func (w *etcdWatcher) hookWatchChildren(node string, wn watchedNode) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	children, revision, err := w.listChildren(node)
+	if err != nil {
+		return err
+	}
+
+	// Watch from just after the listing, so that no changes are missed.
+	events, stop, err := w.watchPrefix(node, revision+1)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// As with zkWatcher, wn.cancel gets an update when we're reconnecting,
+		// and is closed when the watch is removed for good.
+		reconnecting := true
+		defer func() {
+			stop()
+			if !reconnecting {
+				close(wn.updates)
+				close(wn.disconnected)
+			}
+		}()
+
+		for {
+			select {
+			case reconnecting = <-wn.cancel:
+				return
+			case wn.updates <- children:
+			}
+
+			// Keys can change without the list of children changing, for example
+			// if a key nested under a child is added. Wait for a real change.
+			for {
+				select {
+				case reconnecting = <-wn.cancel:
+					return
+				case err := <-events:
+					if err != nil {
+						sendErr(w.errs, err)
+						reconnecting = <-wn.cancel
+						return
+					}
+				}
+
+				w.RLock()
+				newChildren, _, err := w.listChildren(node)
+				w.RUnlock()
+
+				if err != nil {
+					sendErr(w.errs, err)
+					reconnecting = <-wn.cancel
+					return
+				}
+
+				if !reflect.DeepEqual(newChildren, children) {
+					children = newChildren
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listChildren returns the sorted children of node, along with the revision
+// they were read at.
+func (w *etcdWatcher) listChildren(node string) ([]string, int64, error) {
+	dir := node + "/"
+	resp := etcdRangeResponse{}
+	err := w.call("/v3/kv/range", etcdRangeRequest{
+		Key:      []byte(dir),
+		RangeEnd: etcdPrefixEnd([]byte(dir)),
+		KeysOnly: true,
+	}, &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var children []string
+	seen := make(map[string]bool)
+	for _, kv := range resp.Kvs {
+		child := strings.SplitN(strings.TrimPrefix(string(kv.Key), dir), "/", 2)[0]
+		if child != "" && !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+
+	sort.Strings(children)
+	return children, resp.Header.Revision, nil
+}
+
+// watchPrefix opens a watch stream for all the keys under node, starting at
+// the given revision. The returned channel gets a nil for every batch of
+// changes, and then a single error if the stream fails. Calling stop closes the
+// stream.
+func (w *etcdWatcher) watchPrefix(node string, revision int64) (chan error, func(), error) {
+	dir := node + "/"
+	body, err := json.Marshal(etcdWatchRequest{CreateRequest: etcdWatchCreateRequest{
+		Key:           []byte(dir),
+		RangeEnd:      etcdPrefixEnd([]byte(dir)),
+		StartRevision: revision,
+	}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", w.endpoints[w.current]+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	resp, err := w.streamClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("watch %s: %s", node, err)
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("watch %s: %s", node, resp.Status)
+	}
+
+	atomic.AddInt32(&w.activeWatches, 1)
+	events := make(chan error)
+	done := make(chan bool)
+	go func() {
+		defer atomic.AddInt32(&w.activeWatches, -1)
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			msg := etcdWatchResponse{}
+			err := dec.Decode(&msg)
+			if err == nil && msg.Error != nil {
+				err = fmt.Errorf("watch %s: %s", node, msg.Error)
+			} else if err == nil && msg.Result.Canceled {
+				err = fmt.Errorf("watch %s canceled: %s", node, msg.Result.CancelReason)
+			} else if err == io.EOF {
+				err = fmt.Errorf("watch %s: stream closed", node)
+			}
+
+			if err == nil && len(msg.Result.Events) == 0 {
+				continue
+			}
+
+			select {
+			case events <- err:
+			case <-done:
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+
+	return events, stop, nil
+}
+
+// call makes a unary request to the JSON gateway on the current endpoint. If
+// resp is nil, the response body is discarded.
+func (w *etcdWatcher) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := w.client.Post(w.endpoints[w.current]+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", method, httpResp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if resp == nil {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// triggerCleanup is a no-op for etcd. There are no directories, and ephemeral
+// keys are removed along with their lease, so the only persistent keys left
+// behind are pins, which have to stick around anyway.
+func (w *etcdWatcher) triggerCleanup() {
+}
+
+func (w *etcdWatcher) close() {
+	close(w.shutdown)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stopKeepAlive != nil {
+		close(w.stopKeepAlive)
+		w.stopKeepAlive = nil
+	}
+
+	// Revoking the lease removes our ephemeral nodes right away, rather than
+	// after the TTL.
+	w.call("/v3/lease/revoke", etcdLeaseRequest{ID: w.lease}, nil)
+}
+
+func (w *etcdWatcher) connected() bool {
+	return atomic.LoadInt32(&w.isConnected) == 1
+}
+
+// etcdPrefixEnd returns the end of the range of keys starting with prefix.
+func etcdPrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// The prefix is all 0xff's, so the range goes to the end of the keyspace.
+	return []byte{0}
+}
+
+// These mirror the etcd v3 protobuf messages, as rendered by the JSON
+// gateway. Bytes are base64 encoded, which encoding/json does for []byte, and
+// 64-bit integers are strings.
+type etcdResponseHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdKeyValue struct {
+	Key []byte `json:"key"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdResponseHeader `json:"header"`
+	Kvs    []etcdKeyValue     `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type etcdLeaseRequest struct {
+	ID  int64 `json:"ID,string,omitempty"`
+	TTL int64 `json:"TTL,string,omitempty"`
+}
+
+type etcdLeaseResponse struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string"`
+}
+
+type etcdKeepAliveResponse struct {
+	Result etcdLeaseResponse `json:"result"`
+}
+
+type etcdWatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest etcdWatchCreateRequest `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Canceled     bool              `json:"canceled"`
+		CancelReason string            `json:"cancel_reason"`
+		Events       []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error json.RawMessage `json:"error"`
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEtcd struct {
+	*testing.T
+	bin  string
+	dir  string
+	port int
+	addr string
+	cmd  *exec.Cmd
+}
+
+func (te *testEtcd) start() {
+	log, err := os.OpenFile(filepath.Join(te.dir, "log.txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(te.T, err, "etcd start")
+
+	clientURL := fmt.Sprintf("http://%s", te.addr)
+	peerURL := fmt.Sprintf("http://127.0.0.1:%d", te.port+1)
+	te.cmd = exec.Command(te.bin,
+		"--data-dir", filepath.Join(te.dir, "data"),
+		"--listen-client-urls", clientURL,
+		"--advertise-client-urls", clientURL,
+		"--listen-peer-urls", peerURL,
+		"--initial-advertise-peer-urls", peerURL,
+		"--initial-cluster", "default="+peerURL)
+	te.cmd.Stdout = log
+	te.cmd.Stderr = log
+
+	err = te.cmd.Start()
+	require.NoError(te.T, err, "etcd start")
+	time.Sleep(time.Second)
+}
+
+func (te *testEtcd) stop() {
+	te.cmd.Process.Kill()
+	te.cmd.Wait()
+}
+
+func (te *testEtcd) close() {
+	te.stop()
+
+	log, err := ioutil.TempFile("", "sequins-test-etcd-")
+	require.NoError(te.T, err, "setup: copying log")
+	log.Close()
+
+	err = os.Rename(filepath.Join(te.dir, "log.txt"), log.Name())
+	require.NoError(te.T, err, "setup: copying log")
+
+	te.T.Logf("etcd output at %s", log.Name())
+	os.RemoveAll(te.dir)
+}
+
+func (te *testEtcd) restart() {
+	te.stop()
+	time.Sleep(time.Second)
+	te.start()
+}
+
+func createTestEtcd(t *testing.T) *testEtcd {
+	bin := os.Getenv("ETCD_BIN")
+	if bin == "" {
+		t.Skip("Skipping etcd tests because ETCD_BIN isn't set")
+	}
+
+	dir, err := ioutil.TempDir("", "sequins-etcd")
+	require.NoError(t, err, "etcd setup")
+
+	port := randomPort()
+	te := testEtcd{
+		T:    t,
+		bin:  bin,
+		dir:  dir,
+		port: port,
+		addr: fmt.Sprintf("127.0.0.1:%d", port),
+	}
+
+	te.start()
+	return &te
+}
+
+func connectEtcdTest(t *testing.T) (*etcdWatcher, *testEtcd) {
+	te := createTestEtcd(t)
+
+	w, err := connectEtcd([]string{te.addr}, "/sequins-test", 5*time.Second, 5*time.Second)
+	require.NoError(t, err, "etcdWatcher should connect")
+
+	return w, te
+}
+
+// expectEventualWatchUpdate is like expectWatchUpdate, but skips over any
+// updates that don't match, like the ones sent again after a reconnect.
+func expectEventualWatchUpdate(t *testing.T, expected []string, updates chan []string, msg string) {
+	sort.Strings(expected)
+	timer := time.NewTimer(20 * time.Second)
+	for {
+		select {
+		case update := <-updates:
+			sort.Strings(update)
+			if assert.ObjectsAreEqual(expected, update) {
+				return
+			}
+		case <-timer.C:
+			require.FailNow(t, "timed out waiting for update", msg)
+		}
+	}
+}
+
+func TestEtcdPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("foo0"), etcdPrefixEnd([]byte("foo/")))
+	assert.Equal(t, []byte("fp"), etcdPrefixEnd([]byte("fo\xff")))
+	assert.Equal(t, []byte{0}, etcdPrefixEnd([]byte("\xff\xff")))
+}
+
+func TestEtcdWatcher(t *testing.T) {
+	w, te := connectEtcdTest(t)
+	defer w.close()
+	defer te.close()
+
+	updates, _ := w.watchChildren("/foo")
+	go func() {
+		w.createEphemeral("/foo/bar")
+		time.Sleep(100 * time.Millisecond)
+		w.removeEphemeral("/foo/bar")
+	}()
+
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty again")
+}
+
+func TestEtcdWatcherReconnect(t *testing.T) {
+	w, te := connectEtcdTest(t)
+	defer w.close()
+	defer te.close()
+
+	updates, _ := w.watchChildren("/foo")
+	go func() {
+		w.createEphemeral("/foo/bar")
+		time.Sleep(100 * time.Millisecond)
+		te.restart()
+		w.createEphemeral("/foo/baz")
+	}()
+
+	assert.True(t, w.connected(), "the watcher should be connected at first")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+	expectEventualWatchUpdate(t, []string{"bar", "baz"}, updates, "the list of children should be updated with the second new node")
+	assert.True(t, w.connected(), "the watcher should be connected again after reconnecting")
+}
+
+func TestEtcdWatchesCanceled(t *testing.T) {
+	w, te := connectEtcdTest(t)
+	defer w.close()
+	defer te.close()
+
+	w.watchChildren("/foo")
+
+	for i := 0; i < 3; i++ {
+		te.restart()
+	}
+
+	// Wait for the watcher to notice the last restart and reconnect.
+	for i := 0; i < 50 && atomic.LoadInt32(&w.activeWatches) != 1; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	time.Sleep(time.Second)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&w.activeWatches), "there should only be a single watch open")
+}
+
+func TestEtcdRemoveWatch(t *testing.T) {
+	w, te := connectEtcdTest(t)
+	defer w.close()
+	defer te.close()
+
+	updates, disconnected := w.watchChildren("/foo")
+
+	w.createEphemeral("/foo/bar")
+	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
+	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
+
+	w.removeWatch("/foo")
+
+	closed := make(chan bool)
+	go func() {
+		for range updates {
+		}
+		closed <- true
+	}()
+
+	timer := time.NewTimer(100 * time.Millisecond)
+	select {
+	case <-closed:
+	case <-timer.C:
+		assert.Fail(t, "the updates channel should be closed")
+	}
+
+	go func() {
+		for range disconnected {
+		}
+		closed <- true
+	}()
+
+	timer.Reset(100 * time.Millisecond)
+	select {
+	case <-closed:
+	case <-timer.C:
+		assert.Fail(t, "the disconnected channel should be closed")
+	}
+}
+
+func TestEtcdPersistentChild(t *testing.T) {
+	w, te := connectEtcdTest(t)
+	defer w.close()
+	defer te.close()
+
+	require.NoError(t, w.setPersistentChild("/pinned/foo", "1"))
+	require.NoError(t, w.setPersistentChild("/pinned/foo", "2"))
+
+	children, err := w.children("/pinned/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, children, "the old child should be replaced")
+
+	require.NoError(t, w.setPersistentChild("/pinned/foo", ""))
+	children, err = w.children("/pinned/foo")
+	require.NoError(t, err)
+	assert.Empty(t, children, "all children should be removed")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type evictionCandidate struct {
+	db *db
+	vs *version
+}
+
+// evictVersions evicts old versions, oldest first, until the local store is
+// back under limit bytes (that is, 'max_local_store_bytes'). Normally, an old
+// version is kept around until peers stop requesting it; evicting it cuts that
+// short. The current version of each db, its pinned version, and any version
+// that peers still have partitions for are never evicted.
+func (s *sequins) evictVersions(limit int64) {
+	if limit <= 0 || s.config.ReadOnlyStore {
+		return
+	}
+
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	used, err := diskUsage(filepath.Join(s.config.LocalStore, "data"))
+	if err != nil {
+		log.Println("Error checking the size of the local store:", err)
+		return
+	} else if used <= limit {
+		return
+	}
+
+	candidates := s.evictionCandidates()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].vs.created.Before(candidates[j].vs.created)
+	})
+
+	for _, c := range candidates {
+		if used <= limit {
+			break
+		}
+
+		size, err := diskUsage(c.db.localPath(c.vs.name))
+		if err != nil {
+			log.Printf("Error checking the size of version %s of %s: %s", c.vs.name, c.db.name, err)
+			continue
+		}
+
+		if !c.db.mux.evict(c.vs) {
+			continue
+		}
+
+		used -= size
+		logEvent(logFields{DB: c.db.name, Version: c.vs.name, Event: "version_evicted"},
+			"Evicting version %s of %s (%d bytes), since the local store is over max_local_store_bytes",
+			c.vs.name, c.db.name, size)
+		if expStats != nil {
+			expStats.incrEvictions()
+		}
+	}
+
+	if used > limit {
+		log.Printf("The local store is still using %d bytes, over the limit of %d, but no more versions can be evicted", used, limit)
+	}
+}
+
+// evictionCandidates returns the versions that are older than their db's
+// current version, and that aren't pinned or still available from peers.
+func (s *sequins) evictionCandidates() []evictionCandidate {
+	s.dbsLock.RLock()
+	defer s.dbsLock.RUnlock()
+
+	var candidates []evictionCandidate
+	for _, db := range s.dbs {
+		current := db.mux.getCurrent()
+		if current == nil {
+			continue
+		}
+
+		pinned := db.pinnedVersion()
+		for _, vs := range db.mux.getAll() {
+			if vs == current || vs.name == pinned || !db.newer(current, vs) {
+				continue
+			} else if vs.partitions != nil && vs.partitions.hasRemote() {
+				continue
+			}
+
+			candidates = append(candidates, evictionCandidate{db: db, vs: vs})
+		}
+
+		db.mux.release(current)
+	}
+
+	return candidates
+}
+
+// diskUsage returns the total size of the files under path.
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if info != nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+
+	return size, err
+}
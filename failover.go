@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// failoverHeader is set on requests to the remote cluster, so that it doesn't
+// fall back to yet another cluster (or back to us).
+const failoverHeader = "X-Sequins-Failover"
+
+// canFailover returns whether a request can fall back to the remote cluster
+// configured with 'failover.remote_cluster'.
+func (vs *version) canFailover(r *http.Request) bool {
+	return vs.sequins.config.Failover.RemoteCluster != "" && r.Header.Get(failoverHeader) == ""
+}
+
+// fetchRemote fetches the key from the remote cluster. It's used when none of
+// the local peers responsible for a partition could serve a request.
+func (vs *version) fetchRemote(r *http.Request) (*http.Response, string, error) {
+	remote := strings.TrimSuffix(vs.sequins.config.Failover.RemoteCluster, "/")
+	req, err := http.NewRequest(proxyMethod(r), remote+r.URL.Path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req = req.WithContext(r.Context())
+	req.Header.Set(failoverHeader, vs.sequins.config.Sharding.ClusterName)
+
+	// The remote cluster checks the client's token for itself.
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	if expStats != nil {
+		expStats.incrRemoteFallbacks()
+	}
+
+	vs.sequins.metrics.countRemoteFallback(vs.db.name)
+	resp, err := vs.sequins.remoteClient().Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("got %d", resp.StatusCode)
+	}
+
+	return resp, req.URL.Host, nil
+}
+
+// fallBack is called with the result of proxying a request to local peers. If
+// all of them failed, it tries the remote cluster instead, if there is one.
+func (vs *version) fallBack(r *http.Request, key string, resp *http.Response, peer string, err error) (*http.Response, string, error) {
+	if (err != errNoAvailablePeers && err != errProxyTimeout) || !vs.canFailover(r) {
+		return resp, peer, err
+	}
+
+	remoteResp, remote, remoteErr := vs.fetchRemote(r)
+	if remoteErr != nil {
+		log.Printf("Error falling back to remote cluster for /%s/%s (version %s): %s", vs.db.name, key, vs.name, remoteErr)
+		return resp, peer, err
+	}
+
+	return remoteResp, remote, nil
+}
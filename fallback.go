@@ -0,0 +1,86 @@
+package main
+
+import "net/http"
+
+// serveKeyWithFallback serves a key from the current version, like
+// versionMux.serveKey, but if it's missing, it tries the previous version
+// before returning a 404, for dbs with 'fallback_to_previous_version' set. The
+// previous version is only consulted while it's still in the mux, which is
+// until 'version_remove_timeout' after the upgrade, or until it's evicted to
+// make room for another one. The version header is set to the version the
+// value was actually served from.
+func (db *db) serveKeyWithFallback(w http.ResponseWriter, r *http.Request, key string) {
+	current := db.mux.getRequested(w, r)
+	if current == nil {
+		return
+	}
+
+	defer db.mux.release(current)
+
+	// The previous version shouldn't see any headers the current one set while
+	// missing, like the peer it was proxied to.
+	header := cloneHeader(w.Header())
+	mw := &missWriter{ResponseWriter: w}
+	current.serveKey(mw, r, key)
+	if !mw.missed {
+		return
+	}
+
+	if previous := db.mux.getPrevious(current, db.newer); previous != nil {
+		defer db.mux.release(previous)
+
+		resetHeader(w.Header(), header)
+		mw = &missWriter{ResponseWriter: w}
+		previous.serveKey(mw, r, key)
+		if !mw.missed {
+			return
+		}
+	}
+
+	resetHeader(w.Header(), header)
+	current.serveNotFound(w)
+}
+
+// missWriter swallows a 404 response, so that the request can be served again
+// from a different version.
+type missWriter struct {
+	http.ResponseWriter
+	missed bool
+}
+
+func (mw *missWriter) WriteHeader(code int) {
+	if code == http.StatusNotFound {
+		mw.missed = true
+		return
+	}
+
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+func (mw *missWriter) Write(b []byte) (int, error) {
+	if mw.missed {
+		return len(b), nil
+	}
+
+	return mw.ResponseWriter.Write(b)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+
+	return clone
+}
+
+// resetHeader replaces everything in h with the contents of saved.
+func resetHeader(h, saved http.Header) {
+	for k := range h {
+		delete(h, k)
+	}
+
+	for k, v := range saved {
+		h[k] = append([]string(nil), v...)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// livenessPath just checks that the process is responsive.
+	livenessPath = "/healthz"
+
+	// readinessPath checks that the node can serve reads itself, rather than
+	// proxying them all to peers.
+	readinessPath = "/readyz"
+)
+
+// serveLiveness handles GET /healthz, which always succeeds if the process is
+// able to handle requests at all.
+func (s *sequins) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadiness handles GET /readyz. It returns a 200 once the node is ready
+// to take traffic, and a 503 with the reason otherwise.
+func (s *sequins) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	reason := s.notReadyReason()
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, reason)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// notReadyReason returns why the node isn't ready to serve reads, or an empty
+// string if it is. A node is ready once the list of peers has converged, and
+// every db that has a version has a current one, with all of the partitions
+// this node is responsible for available locally. Dbs without any versions are
+// ignored, since there's nothing to wait for. A node in maintenance mode is
+// never ready.
+func (s *sequins) notReadyReason() string {
+	if s.inMaintenance() {
+		return "in maintenance mode"
+	} else if !s.converged() {
+		return "waiting for the cluster to converge"
+	}
+
+	s.dbsLock.RLock()
+	defer s.dbsLock.RUnlock()
+
+	for name, db := range s.dbs {
+		reason := db.notReadyReason()
+		if reason != "" {
+			return fmt.Sprintf("%s: %s", name, reason)
+		}
+	}
+
+	return ""
+}
+
+func (db *db) notReadyReason() string {
+	vs := db.mux.getCurrent()
+	if vs == nil {
+		if len(db.mux.getAll()) > 0 {
+			return "no version is available yet"
+		}
+
+		return ""
+	}
+
+	defer db.mux.release(vs)
+	needed := len(vs.partitions.needed())
+	if needed > 0 {
+		return fmt.Sprintf("%d partitions of version %s are still loading", needed, vs.name)
+	}
+
+	if vs.unhealthy() {
+		return fmt.Sprintf("version %s failed integrity scans", vs.name)
+	}
+
+	return ""
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const upgradeHookTimeout = 10 * time.Second
+
+// upgradeHookRetries is how many more times a POST to 'upgrade_hook_url' is
+// tried if it fails, waiting upgradeHookBackoff before the first retry, and
+// twice as long before each one after that.
+const upgradeHookRetries = 3
+const upgradeHookBackoff = 1 * time.Second
+
+// upgradeEvent is the payload sent to the upgrade hooks.
+type upgradeEvent struct {
+	DB         string    `json:"db"`
+	OldVersion string    `json:"old_version"`
+	NewVersion string    `json:"new_version"`
+	Node       string    `json:"node"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// notifyUpgrade fires the configured upgrade hooks, if any, in the background.
+// Hooks are best-effort; a failed POST is retried a few times, but otherwise
+// errors are only logged.
+func (db *db) notifyUpgrade(oldVersion, newVersion string) {
+	url := db.sequins.config.UpgradeHookURL
+	command := db.sequins.config.UpgradeHookCommand
+	if url == "" && command == "" {
+		return
+	}
+
+	event := upgradeEvent{
+		DB:         db.name,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+		Node:       db.sequins.selfAddress(),
+		Timestamp:  time.Now().UTC(),
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error serializing upgrade event:", err)
+		return
+	}
+
+	if url != "" {
+		go func() {
+			backoff := upgradeHookBackoff
+			err := postUpgradeHook(url, payload)
+			for attempt := 1; attempt <= upgradeHookRetries && err != nil; attempt++ {
+				log.Printf("Error notifying %s of upgrade of %s (attempt %d of %d), retrying in %s: %s",
+					url, db.name, attempt, upgradeHookRetries+1, backoff, err)
+				time.Sleep(backoff)
+				backoff *= 2
+				err = postUpgradeHook(url, payload)
+			}
+
+			if err != nil {
+				log.Printf("Error notifying %s of upgrade of %s: %s", url, db.name, err)
+			}
+		}()
+	}
+
+	if command != "" {
+		go func() {
+			err := runUpgradeHook(command, payload)
+			if err != nil {
+				log.Printf("Error running upgrade hook for %s: %s", db.name, err)
+			}
+		}()
+	}
+}
+
+// postUpgradeHook POSTs the payload to the given url.
+func postUpgradeHook(url string, payload []byte) error {
+	client := http.Client{Timeout: upgradeHookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// runUpgradeHook runs the given command with a shell, passing it the payload on
+// stdin.
+func runUpgradeHook(command string, payload []byte) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+
+	done := make(chan error, 1)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(upgradeHookTimeout):
+		cmd.Process.Kill()
+		err = <-done
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out.Bytes()))
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/stripe/sequins/backend"
+	"github.com/stripe/sequins/blocks"
+)
+
+// runIndex handles 'sequins index <source> <dest>'. It builds the index for a
+// single version directory, and exits without binding anything or joining a
+// cluster.
+func runIndex(configPath, db, src, dest string) {
+	config, err := loadConfig(configPath)
+	if err == errNoConfig {
+		config = defaultConfig()
+	} else if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+
+	src, err = filepath.Abs(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// By default, the db is named after the directory the version is in, as it
+	// would be in a source.
+	if db == "" {
+		db = filepath.Base(filepath.Dir(src))
+	}
+
+	err = indexVersion(config, db, src, dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Built the index for version %s of %s in %s", filepath.Base(src), db, dest)
+}
+
+// indexVersion builds the index for the version directory at src, as the
+// given db, into dest. It uses the same code and configuration that a node
+// would use to load the version, but without a cluster, so every partition is
+// included. The result can be copied into a node's local store, under
+// data/<db>/<version>, and it'll be served from there without being loaded
+// again, as long as the node agrees on the number of partitions.
+func indexVersion(config sequinsConfig, db, src, dest string) error {
+	if entries, err := ioutil.ReadDir(dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s already exists, and isn't empty", dest)
+	}
+
+	// The version is loaded just like one set with serve_local, which skips
+	// the source and any coordination.
+	if config.DBs == nil {
+		config.DBs = make(map[string]dbConfig)
+	}
+
+	dbConfig := config.DBs[db]
+	dbConfig.ServeLocal = src
+	config.DBs[db] = dbConfig
+	config.ReadOnlyStore = false
+	config.Sharding.Enabled = false
+
+	config, err := validateConfig(config)
+	if err != nil {
+		return fmt.Errorf("configuration error: %s", err)
+	}
+
+	s := newSequins(backend.NewVersionDirBackend(db, src), config)
+	vs, err := newVersion(s, newDB(s, db), dest, filepath.Base(src))
+	if err != nil {
+		return err
+	}
+	defer vs.blockStore.Close()
+
+	vs.build()
+	if err := vs.load.err(); err != nil {
+		os.RemoveAll(dest)
+		return fmt.Errorf("building the index: %s", err)
+	}
+
+	// A version with no data is served without ever being saved, but the
+	// index needs a manifest to be picked up by a node.
+	if _, err := blocks.ReadManifest(dest); err == blocks.ErrNoManifest {
+		return vs.blockStore.Save(vs.partitions.getSelected())
+	}
+
+	return nil
+}
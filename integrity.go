@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+)
+
+// integrityScanMaxFailures is how many scans in a row a partition can fail
+// before the version is marked unhealthy and the partition is reloaded.
+const integrityScanMaxFailures = 3
+
+// integrityState tracks the integrity scans for a single version.
+type integrityState struct {
+	// failures is the number of scans in a row each partition has failed.
+	failures map[int]int
+
+	// unhealthy is set once any partition has failed integrityScanMaxFailures
+	// scans in a row, and cleared once a scan passes.
+	unhealthy bool
+}
+
+// scanIntegrity reads back a sample of the keys in the current version of each
+// db, according to 'storage.integrity_scan_sample_rate'. It's run periodically
+// in the background; see 'storage.integrity_scan_period'.
+func (s *sequins) scanIntegrity() {
+	s.dbsLock.RLock()
+	dbs := make([]*db, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.dbsLock.RUnlock()
+
+	for _, db := range dbs {
+		vs := db.mux.getCurrent()
+		if vs == nil {
+			continue
+		}
+
+		vs.scanIntegrity(s.config.Storage.IntegrityScanSampleRate)
+		db.mux.release(vs)
+	}
+}
+
+func (vs *version) scanIntegrity(rate float64) {
+	checked, failed := vs.blockStore.CheckSample(rate)
+	if expStats != nil {
+		expStats.incrIntegrityScan(checked, len(failed))
+	}
+
+	for partition, err := range failed {
+		logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "integrity_scan_failed"},
+			"Integrity scan failed for partition %d of %s version %s: %s", partition, vs.db.name, vs.name, err)
+	}
+
+	for _, partition := range vs.recordIntegrityScan(failed) {
+		if vs.sequins.config.ReadOnlyStore {
+			continue
+		}
+
+		vs.reloadPartition(partition, "repeated integrity scan failures")
+	}
+}
+
+// recordIntegrityScan updates the number of scans in a row each partition has
+// failed, and marks the version unhealthy if any of them have failed too many.
+// It returns the partitions that just reached the limit.
+func (vs *version) recordIntegrityScan(failed map[int]error) []int {
+	vs.stateLock.Lock()
+	defer vs.stateLock.Unlock()
+
+	if len(failed) == 0 {
+		if vs.integrity.unhealthy {
+			log.Printf("Integrity scan passed for %s version %s, marking it healthy again", vs.db.name, vs.name)
+		}
+
+		vs.integrity = integrityState{}
+		return nil
+	}
+
+	failures := make(map[int]int, len(failed))
+	var exceeded []int
+	for partition := range failed {
+		failures[partition] = vs.integrity.failures[partition] + 1
+		if failures[partition] == integrityScanMaxFailures {
+			exceeded = append(exceeded, partition)
+		}
+	}
+
+	vs.integrity.failures = failures
+	if len(exceeded) > 0 && !vs.integrity.unhealthy {
+		log.Printf("Marking %s version %s unhealthy after %d failed integrity scans", vs.db.name, vs.name, integrityScanMaxFailures)
+		vs.integrity.unhealthy = true
+	}
+
+	return exceeded
+}
+
+// unhealthy returns true if the version has repeatedly failed integrity
+// scans.
+func (vs *version) unhealthy() bool {
+	vs.stateLock.RLock()
+	defer vs.stateLock.RUnlock()
+
+	return vs.integrity.unhealthy
+}
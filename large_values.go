@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/stripe/sequins/blocks"
+)
+
+// errValueTooLarge is returned for values larger than 'max_value_size', and
+// served as a 413.
+var errValueTooLarge = errors.New("value is larger than max_value_size")
+
+// tooLarge returns true if a value of the given length is larger than
+// 'max_value_size', if it's set.
+func (s *sequins) tooLarge(valueLen uint64) bool {
+	max := s.config.MaxValueSize
+	return max > 0 && valueLen > uint64(max)
+}
+
+// shouldStream returns true if a value of the given length is at least
+// 'stream_threshold', if it's set. Such values are never held in memory in
+// full: they're not cached, and proxied requests for them aren't coalesced.
+func (s *sequins) shouldStream(valueLen int64) bool {
+	threshold := s.config.StreamThreshold
+	return threshold > 0 && valueLen >= threshold
+}
+
+// serveTooLarge serves a 413 for a value larger than 'max_value_size'.
+func (vs *version) serveTooLarge(w http.ResponseWriter) {
+	setErrorCode(w, codeValueTooLarge)
+	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set(proxiedFlagHeader, "false")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+}
+
+// copyRecord copies a value from the block store to w. Large values are read
+// in fixed-size chunks, rather than with the record's WriteTo, which can hand
+// back the whole value at once if the block isn't compressed.
+func (vs *version) copyRecord(w io.Writer, record *blocks.Record) (int64, error) {
+	if vs.sequins.shouldStream(int64(record.ValueLen)) {
+		return io.Copy(w, struct{ io.Reader }{record})
+	}
+
+	return io.Copy(w, record)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// listParam is the query parameter that makes a GET / list the dbs on this
+// node, rather than serving the status page.
+const listParam = "list"
+
+type dbListing struct {
+	Name           string `json:"name"`
+	CurrentVersion string `json:"current_version,omitempty"`
+}
+
+// serveList handles GET /?list, returning the dbs this node knows about, and
+// the version of each that it's currently serving, if any.
+func (s *sequins) serveList(w http.ResponseWriter, r *http.Request) {
+	s.dbsLock.RLock()
+	dbs := make([]dbListing, 0, len(s.dbs))
+	for name, db := range s.dbs {
+		listing := dbListing{Name: name}
+		if current := db.mux.getCurrent(); current != nil {
+			listing.CurrentVersion = current.name
+			db.mux.release(current)
+		}
+
+		dbs = append(dbs, listing)
+	}
+
+	s.dbsLock.RUnlock()
+
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].Name < dbs[j].Name })
+	jsonBytes, err := json.Marshal(dbs)
+	if err != nil {
+		log.Println("Error serving db list:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"syscall"
+)
+
+// listen opens the sockets to serve on. Normally that's just one, but with
+// 'listeners' set, there's one for each accept loop, all sharing the port with
+// SO_REUSEPORT. If the platform doesn't support SO_REUSEPORT or setting the
+// backlog, those options are ignored with a warning, rather than keeping
+// sequins from starting.
+func (s *sequins) listen() ([]net.Listener, error) {
+	n := s.config.Listeners
+	reusePort := s.config.ReusePort || n > 1
+	if reusePort && !reusePortSupported {
+		log.Println("SO_REUSEPORT isn't supported on this platform, so only opening one listener")
+		n = 1
+		reusePort = false
+	}
+
+	backlog := s.config.ListenBacklog
+	if backlog != 0 && !listenBacklogSupported {
+		log.Println("Setting the listen backlog isn't supported on this platform, so using the default")
+		backlog = 0
+	}
+
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return controlSocket(c, setReusePort)
+		}
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", s.config.Bind)
+		if err == nil && backlog != 0 {
+			err = setListenBacklog(l, backlog)
+		}
+
+		if err != nil {
+			if l != nil {
+				l.Close()
+			}
+
+			for _, opened := range listeners {
+				opened.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// setListenBacklog calls listen(2) again on an open listener, which changes the
+// length of its queue of pending connections.
+func setListenBacklog(l net.Listener, backlog int) error {
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+
+	c, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	return controlSocket(c, func(fd uintptr) error {
+		return listenWithBacklog(fd, backlog)
+	})
+}
+
+// controlSocket runs f against the raw socket, returning any error from it.
+func controlSocket(c syscall.RawConn, f func(fd uintptr) error) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = f(fd)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,23 @@
+//go:build 386 || amd64 || arm || arm64
+// +build 386 amd64 arm arm64
+
+package main
+
+import "syscall"
+
+const (
+	reusePortSupported     = true
+	listenBacklogSupported = true
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define for
+// linux. The value is different on some other architectures, like mips.
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+func listenWithBacklog(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,21 @@
+//go:build !linux || !(386 || amd64 || arm || arm64)
+// +build !linux !386,!amd64,!arm,!arm64
+
+package main
+
+import "errors"
+
+const (
+	reusePortSupported     = false
+	listenBacklogSupported = false
+)
+
+var errListenOptionUnsupported = errors.New("unsupported on this platform")
+
+func setReusePort(fd uintptr) error {
+	return errListenOptionUnsupported
+}
+
+func listenWithBacklog(fd uintptr, backlog int) error {
+	return errListenOptionUnsupported
+}
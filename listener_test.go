@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenReusePort(t *testing.T) {
+	config := defaultConfig()
+	config.Bind = fmt.Sprintf("localhost:%d", randomPort())
+	config.Listeners = 2
+	config.ListenBacklog = 16
+	s := &sequins{config: config}
+
+	listeners, err := s.listen()
+	require.NoError(t, err, "listening should work, even where the options aren't supported")
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if !reusePortSupported {
+		assert.Len(t, listeners, 1, "there should only be one listener without SO_REUSEPORT")
+		return
+	}
+
+	require.Len(t, listeners, 2, "there should be a listener for each accept loop")
+	assert.Equal(t, listeners[0].Addr().String(), listeners[1].Addr().String(), "the listeners should share the port")
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", config.Bind)
+		require.NoError(t, err, "connecting should work")
+		conn.Close()
+	}
+}
+
+func TestListenWithoutReusePort(t *testing.T) {
+	config := defaultConfig()
+	config.Bind = fmt.Sprintf("localhost:%d", randomPort())
+	s := &sequins{config: config}
+
+	listeners, err := s.listen()
+	require.NoError(t, err)
+	defer listeners[0].Close()
+	assert.Len(t, listeners, 1, "there should be a single listener by default")
+
+	_, err = s.listen()
+	assert.Error(t, err, "the port shouldn't be shared without SO_REUSEPORT")
+}
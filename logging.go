@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLogs is set if sequins is configured to log JSON. Everything logged with
+// the log package is written as JSON, and lines logged with logEvent get
+// extra fields.
+var jsonLogs *jsonLogWriter
+
+// logFields are the structured fields attached to a log line by logEvent.
+type logFields struct {
+	DB      string `json:"database,omitempty"`
+	Version string `json:"version,omitempty"`
+	Event   string `json:"event,omitempty"`
+}
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	logFields
+}
+
+// jsonLogWriter wraps each line written to it in a JSON object, one per line.
+type jsonLogWriter struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// setupLogging switches the output of the log package to the given format.
+// Text logs are left exactly as they are.
+func setupLogging(format string, out io.Writer) {
+	if format != logFormatJSON {
+		return
+	}
+
+	jsonLogs = &jsonLogWriter{out: out}
+	log.SetFlags(0)
+	log.SetOutput(jsonLogs)
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	err := w.write(strings.TrimSuffix(string(p), "\n"), logFields{})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) write(message string, fields logFields) error {
+	b, err := json.Marshal(logEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     logLevel(message),
+		Message:   message,
+		logFields: fields,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err = w.out.Write(append(b, '\n'))
+	return err
+}
+
+// logLevel guesses the level of a log line from how it starts, since the log
+// package doesn't have levels.
+func logLevel(message string) string {
+	if strings.HasPrefix(message, "Error") {
+		return "error"
+	} else if strings.HasPrefix(message, "Warning") {
+		return "warn"
+	}
+
+	return "info"
+}
+
+// logEvent logs a line like log.Printf, but for JSON logs, it also includes the
+// db, version and event as fields, so that things like version upgrades can be
+// picked out by machines. Text logs are unaffected.
+func logEvent(fields logFields, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	if jsonLogs != nil {
+		jsonLogs.write(message, fields)
+	} else {
+		log.Output(2, message)
+	}
+}
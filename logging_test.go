@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	setupLogging(logFormatJSON, buf)
+	defer func() {
+		jsonLogs = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}()
+
+	log.Println("Error doing a thing:", "oops")
+	logEvent(logFields{DB: "foo", Version: "2", Event: "version_switched"}, "Switching to version %s of %s!", "2", "foo")
+
+	// Other tests may have left goroutines running that log too, so look for the
+	// lines by message.
+	entries := make(map[string]map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]string
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), "each log line should be one line of valid JSON")
+		entries[entry["message"]] = entry
+	}
+
+	entry := entries["Error doing a thing: oops"]
+	require.NotNil(t, entry, "plain log lines should be logged as JSON")
+	assert.Equal(t, "error", entry["level"])
+	assert.NotEmpty(t, entry["time"])
+	assert.Empty(t, entry["database"], "plain log lines shouldn't have a database")
+
+	entry = entries["Switching to version 2 of foo!"]
+	require.NotNil(t, entry, "events should be logged as JSON")
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "foo", entry["database"])
+	assert.Equal(t, "2", entry["version"])
+	assert.Equal(t, "version_switched", entry["event"])
+}
+
+func TestTextLogs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	setupLogging(logFormatText, buf)
+	require.Nil(t, jsonLogs, "text logs shouldn't be wrapped")
+
+	logEvent(logFields{DB: "foo", Version: "2", Event: "version_switched"}, "Switching to version %s of %s!", "2", "foo")
+	assert.Contains(t, buf.String(), "Switching to version 2 of foo!\n", "text logs should be unchanged")
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -25,16 +27,28 @@ var (
 	localStore = kingpin.Flag("local-store", "Where to store local data. Overrides the config option of the same name.").Short('l').PlaceHolder("PATH").String()
 	configPath = kingpin.Flag("config", "The config file to use. By default, either sequins.conf in the local directory or /etc/sequins.conf will be used.").PlaceHolder("PATH").String()
 	debugBind  = kingpin.Flag("debug-bind", "Address to bind to for pprof and expvars. Overrides the config option of the same name.").PlaceHolder("ADDRESS").String()
+	serveLocal = kingpin.Flag("serve-local", "Serve a version directory on disk as a db, without checking the source for it. Can be repeated. Overrides the serve_local option for the db.").PlaceHolder("DB=PATH").StringMap()
+
+	serveCommand = kingpin.Command("serve", "Run the server. This is the default.").Default()
+
+	indexCommand = kingpin.Command("index", "Build the index for a single version directory, without running the server. The result can be copied into the local store of a node, under data/<db>/<version>.")
+	indexDB      = indexCommand.Flag("db", "The db the version belongs to, which determines the per-db config used. By default, the name of the directory the version is in.").PlaceHolder("NAME").String()
+	indexSource  = indexCommand.Arg("source", "The version directory to index.").Required().String()
+	indexDest    = indexCommand.Arg("dest", "Where to write the index. It must be empty or not exist.").Required().String()
 )
 
 func main() {
 	kingpin.Version("sequins version " + sequinsVersion)
-	kingpin.Parse()
+	if kingpin.Parse() == indexCommand.FullCommand() {
+		runIndex(*configPath, *indexDB, *indexSource, *indexDest)
+		return
+	}
 
 	config, err := loadConfig(*configPath)
 	if err == errNoConfig {
-		// If --source was specified, we can just use that and the default config.
-		if *source != "" {
+		// If --source or --serve-local was specified, we can just use that and the
+		// default config.
+		if *source != "" || len(*serveLocal) > 0 {
 			config = defaultConfig()
 		} else {
 			log.Fatal("No config file found! Please see the \"Getting Started\" guide for instructions: http://sequins.io/manual.")
@@ -60,9 +74,26 @@ func main() {
 		default:
 			config.Source = *source
 		}
+
+		config.Sources = nil
+	}
+
+	for db, path := range *serveLocal {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if config.DBs == nil {
+			config.DBs = make(map[string]dbConfig)
+		}
+
+		dbConfig := config.DBs[db]
+		dbConfig.ServeLocal = absPath
+		config.DBs[db] = dbConfig
 	}
 
-	if config.Source == "" {
+	if config.Source == "" && len(config.Sources) == 0 && !config.ReadOnlyStore && len(config.localDBs()) == 0 {
 		log.Fatal("The source root must be defined, either in the config file or with --source. Please see the README for instructions.")
 	}
 
@@ -88,24 +119,44 @@ func main() {
 		log.Fatalf("Configuration error: %s\n", err)
 	}
 
-	parsed, err := url.Parse(config.Source)
-	if err != nil {
-		log.Fatal(err)
-	}
+	setupLogging(config.LogFormat, os.Stderr)
 
+	// With a read-only store, the sources are ignored, and versions come from
+	// the local store instead.
 	var s *sequins
-	switch parsed.Scheme {
-	case "", "file":
-		s = localSetup(parsed.Path, config)
-	case "s3":
-		s = s3Setup(parsed.Host, parsed.Path, config)
-	case "hdfs":
-		s = hdfsSetup(parsed.Host, parsed.Path, config)
-	default:
-		log.Fatalf("Unrecognized scheme for path: %s://\n", parsed.Scheme)
+	if config.ReadOnlyStore {
+		s = newSequins(newStoreBackend(config.LocalStore), config)
+	} else {
+		var backends []backend.Backend
+		for _, source := range config.allSources() {
+			backends = append(backends, backendSetup(source, config))
+		}
+
+		if len(backends) > 1 {
+			backends = []backend.Backend{backend.NewMultiBackend(backends...)}
+		}
+
+		// Archives are extracted into the local store, next to the data.
+		if len(backends) > 0 && config.ArchiveFormat != "" {
+			backends[0] = backend.NewArchiveBackend(backends[0], config.ArchiveFormat, filepath.Join(config.LocalStore, "archives"))
+		}
+
+		// Local dbs sit alongside the dbs from the sources, and can't have the
+		// same names. They're never archives.
+		backends = append(backends, localBackends(config)...)
+
+		var b backend.Backend
+		if len(backends) == 1 {
+			b = backends[0]
+		} else {
+			b = backend.NewMultiBackend(backends...)
+		}
+
+		s = newSequins(b, config)
 	}
 
-	// Do a basic test that the backend is valid.
+	// Do a basic test that the backend is valid. With multiple sources, this
+	// also catches dbs with the same name in more than one.
 	_, err = s.backend.ListDBs()
 	if err != nil {
 		log.Fatalf("Error listing DBs from %s: %s", s.backend.DisplayPath(""), err)
@@ -117,21 +168,54 @@ func main() {
 	}
 
 	if config.Debug.Bind != "" {
-		startDebugServer(config)
+		startDebugServer(config, s)
 	}
 
 	s.start()
 }
 
-func localSetup(localPath string, config sequinsConfig) *sequins {
-	backend := backend.NewLocalBackend(localPath)
-	return newSequins(backend, config)
+// backendSetup creates the backend for a single source root.
+func backendSetup(source string, config sequinsConfig) backend.Backend {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch parsed.Scheme {
+	case "", "file":
+		return localSetup(parsed.Path)
+	case "s3":
+		return s3Setup(parsed.Host, parsed.Path, config)
+	case "gs":
+		return gcsSetup(parsed.Host, parsed.Path, config)
+	case "wasbs":
+		return azureSetup(parsed.User.Username(), parsed.Host, parsed.Path, config)
+	case "az":
+		return azureSetup(parsed.Host, config.Azure.Account+azureBlobHostSuffix, parsed.Path, config)
+	case "hdfs":
+		return hdfsSetup(parsed.Host, parsed.Path, config)
+	default:
+		log.Fatalf("Unrecognized scheme for path: %s://\n", parsed.Scheme)
+		return nil
+	}
 }
 
-func s3Setup(bucketName string, path string, config sequinsConfig) *sequins {
+func localSetup(localPath string) backend.Backend {
+	return backend.NewLocalBackend(localPath)
+}
+
+// defaultS3EndpointRegion is the region used with a custom S3 endpoint, if
+// none is configured.
+const defaultS3EndpointRegion = "us-east-1"
+
+func s3Setup(bucketName string, path string, config sequinsConfig) backend.Backend {
 	metadata := ec2metadata.New(session.New())
 	regionName := config.S3.Region
-	if regionName == "" {
+	if regionName == "" && config.S3.Endpoint != "" {
+		// S3-compatible stores generally don't care about the region, but requests
+		// still have to be signed with one.
+		regionName = defaultS3EndpointRegion
+	} else if regionName == "" {
 		var err error
 		regionName, err = metadata.Region()
 		if regionName == "" || err != nil {
@@ -148,21 +232,49 @@ func s3Setup(bucketName string, path string, config sequinsConfig) *sequins {
 		}},
 	})
 
-	sess := session.New(&aws.Config{
-		Region:      aws.String(regionName),
-		Credentials: creds,
-	})
+	awsConfig := &aws.Config{
+		Region:           aws.String(regionName),
+		Credentials:      creds,
+		S3ForcePathStyle: aws.Bool(config.S3.PathStyle),
+	}
+
+	if config.S3.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.S3.Endpoint)
+	}
+
+	sess := session.New(awsConfig)
+
+	return backend.NewS3Backend(bucketName, path, s3.New(sess))
+}
+
+func gcsSetup(bucketName string, path string, config sequinsConfig) backend.Backend {
+	client, err := backend.NewGCSClient(config.GCS.CredentialsFile)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Error setting up GCS credentials: %s", err))
+	}
+
+	return backend.NewGCSBackend(bucketName, path, client)
+}
+
+// azureBlobHostSuffix is appended to the storage account name to get the host
+// for az:// sources.
+const azureBlobHostSuffix = ".blob.core.windows.net"
+
+func azureSetup(container string, host string, path string, config sequinsConfig) backend.Backend {
+	account := strings.SplitN(host, ".", 2)[0]
+	client, err := backend.NewAzureClient(account, config.Azure.AccountKey, config.Azure.ClientID)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Error setting up Azure credentials: %s", err))
+	}
 
-	backend := backend.NewS3Backend(bucketName, path, s3.New(sess))
-	return newSequins(backend, config)
+	return backend.NewAzureBackend("https://"+host, container, path, client)
 }
 
-func hdfsSetup(namenode string, path string, config sequinsConfig) *sequins {
+func hdfsSetup(namenode string, path string, config sequinsConfig) backend.Backend {
 	client, err := hdfs.New(namenode)
 	if err != nil {
 		log.Fatal(fmt.Errorf("Error connecting to HDFS: %s", err))
 	}
 
-	backend := backend.NewHdfsBackend(client, namenode, path)
-	return newSequins(backend, config)
+	return backend.NewHdfsBackend(client, namenode, path)
 }
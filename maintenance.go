@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// maintenancePath puts the node in maintenance mode, or takes it out again.
+const maintenancePath = "/_maintenance"
+
+// maintenanceHeader is set on reads that are turned away because the node is
+// in maintenance mode.
+const maintenanceHeader = "X-Sequins-Maintenance"
+
+// serveMaintenance handles POST /_maintenance, which puts the node in
+// maintenance mode, and DELETE /_maintenance, which takes it out again. In
+// maintenance mode, reads from clients get a 503, but the node stays in the
+// cluster and keeps serving its peers, so that nothing has to move around
+// while it's drained from a load balancer. Nothing is reloaded when it's
+// turned off. Either way, it needs one of the 'admin_tokens', if they're set.
+func (s *sequins) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if atomic.CompareAndSwapInt32(&s.maintenance, 0, 1) {
+			log.Println("Entering maintenance mode, triggered by request from", r.RemoteAddr)
+		}
+	case "DELETE":
+		if atomic.CompareAndSwapInt32(&s.maintenance, 1, 0) {
+			log.Println("Leaving maintenance mode, triggered by request from", r.RemoteAddr)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inMaintenance returns true if the node is in maintenance mode.
+func (s *sequins) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// checkMaintenance writes a 503 and returns false if the node is in
+// maintenance mode and the request is from a client. Proxied requests are
+// still served, since peers route to this node as usual.
+func (s *sequins) checkMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	if !s.inMaintenance() || proxiedVersion(r) != "" {
+		return true
+	}
+
+	w.Header().Set(maintenanceHeader, "true")
+	setErrorCode(w, codeMaintenance)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/colinmarc/sequencefile"
+)
+
+// metadataSuffix marks sidecar files with per-key metadata. For a data file
+// named 'part-00000', the sidecar would be 'part-00000.metadata'. It's a
+// sequencefile with the same keys, and JSON objects for values.
+const metadataSuffix = ".metadata"
+
+// splitMetadataFiles separates any metadata sidecar files from the data files
+// in a version.
+func splitMetadataFiles(files []string) (data []string, metadata []string) {
+	for _, file := range files {
+		if strings.HasSuffix(file, metadataSuffix) {
+			metadata = append(metadata, file)
+		} else {
+			data = append(data, file)
+		}
+	}
+
+	return data, metadata
+}
+
+// addMetadataFile reads a metadata sidecar file, and adds the metadata for any
+// keys in the given partitions to the block store.
+func (vs *version) addMetadataFile(file string, partitions map[int]bool) error {
+	disp := vs.sequins.backend.DisplayPath(vs.db.name, vs.name, file)
+	log.Println("Reading metadata from", disp)
+
+	stream, err := vs.sequins.backend.Open(vs.db.name, vs.name, file)
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", disp, err)
+	}
+	defer stream.Close()
+
+	sf := sequencefile.NewReader(bufio.NewReader(vs.load.reader(stream)))
+	err = sf.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("reading header from %s: %s", disp, err)
+	}
+
+	for sf.Scan() {
+		key, metadata, err := unwrapKeyValue(sf)
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", disp, err)
+		}
+
+		key = vs.blockStore.NormalizeKey(key)
+		partition, alternatePartition := vs.blockStore.KeyPartition(key)
+		if !partitions[partition] && !partitions[alternatePartition] {
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(metadata, &fields)
+		if err != nil {
+			return fmt.Errorf("reading %s: invalid metadata for key %q: %s", disp, key, err)
+		}
+
+		err = vs.blockStore.AddMetadata(key, metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sf.Err() != nil {
+		return fmt.Errorf("reading %s: %s", disp, sf.Err())
+	}
+
+	return nil
+}
+
+// setMetadataHeaders sets a response header for each of the db's configured
+// metadata fields that the value has.
+func (vs *version) setMetadataHeaders(h http.Header, metadata []byte) {
+	if metadata == nil {
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(metadata, &fields)
+	if err != nil {
+		return
+	}
+
+	for field, header := range vs.db.config.MetadataHeaders {
+		raw, ok := fields[field]
+		if !ok {
+			continue
+		}
+
+		// Strings are unquoted; anything else is passed through as JSON.
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+
+		h.Set(header, s)
+	}
+}
+
+// copyMetadataHeaders copies the db's metadata headers from a peer's response.
+func (vs *version) copyMetadataHeaders(h http.Header, resp *http.Response) {
+	for _, header := range vs.db.config.MetadataHeaders {
+		if v := resp.Header.Get(header); v != "" {
+			h.Set(header, v)
+		}
+	}
+}
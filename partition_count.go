@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+)
+
+// partitionCountsZKPath is the path under which the number of partitions of
+// each version is recorded. Each version has a single persistent child, named
+// after the count.
+const partitionCountsZKPath = "partition_counts"
+
+func (db *db) partitionCountZKPath(version string) string {
+	return path.Join(partitionCountsZKPath, db.name, version)
+}
+
+// numPartitions returns the number of partitions to split a version with the
+// given number of files into: the db's 'partitions', if that's set, and one
+// per file otherwise. In a cluster, the first node to load the version records
+// the count with the coordinator, and every other node uses the recorded count,
+// so that nodes agree even if their configs don't.
+func (db *db) numPartitions(version string, numFiles int) (int, error) {
+	// A version without any data has no partitions, however it's configured.
+	if numFiles == 0 {
+		return 0, nil
+	}
+
+	n := numFiles
+	if db.config.Partitions > 0 {
+		n = db.config.Partitions
+	}
+
+	if db.coordinator() == nil {
+		return n, nil
+	}
+
+	node := db.partitionCountZKPath(version)
+	recorded, err := db.agreeOn(node, strconv.Itoa(n))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = strconv.Atoi(recorded)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid partition count at %s: %s", node, recorded)
+	}
+
+	return n, nil
+}
+
+// agreeOn records value as the single persistent child of node, unless there's
+// already a value recorded there, and returns whichever value is recorded. It's
+// used for the settings of a version that every node in a cluster has to agree
+// on: the first node to load the version decides.
+func (db *db) agreeOn(node, value string) (string, error) {
+	recorded, err := db.recordedValue(node)
+	if err != nil || recorded != "" {
+		return recorded, err
+	}
+
+	err = db.coordinator().setPersistentChild(node, value)
+	if err != nil {
+		return "", err
+	}
+
+	// Another node may have recorded a different value at the same time, in
+	// which case the last one to do so wins.
+	recorded, err = db.recordedValue(node)
+	if err == nil && recorded == "" {
+		err = fmt.Errorf("the value recorded at %s went missing", node)
+	}
+
+	return recorded, err
+}
+
+// recordedValue returns the value recorded at node, or an empty string if
+// there isn't one.
+func (db *db) recordedValue(node string) (string, error) {
+	children, err := db.coordinator().children(node)
+	if err != nil || len(children) == 0 {
+		return "", err
+	}
+
+	// There should only be one, but just in case, pick one the same way pins do.
+	return pinFromNodes(children), nil
+}
+
+// forgetPartitions removes the recorded partition count for a version, once
+// it's been removed.
+func (db *db) forgetPartitions(version string) {
+	if db.coordinator() == nil {
+		return
+	}
+
+	err := db.coordinator().setPersistentChild(db.partitionCountZKPath(version), "")
+	if err != nil {
+		log.Printf("Error removing the partition count for version %s of %s: %s", version, db.name, err)
+	}
+}
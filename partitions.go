@@ -3,54 +3,66 @@ package main
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // partitions represents a list of partitions for a single version and their
 // mapping to nodes, synced from zookeeper. It's also responsible for
 // advertising the partitions we have locally.
 type partitions struct {
-	peers     *peers
-	zkWatcher *zkWatcher
+	peers       *peers
+	coordinator coordinator
 
 	db      string
 	version string
 	zkPath  string
 
-	numPartitions int
-	replication   int
+	numPartitions  int
+	replication    int
+	minReplication int
 
 	selected        map[int]bool
 	local           map[int]bool
+	dropped         map[int]time.Time
 	remote          map[int][]string
 	numMissing      int
 	ready           chan bool
 	readyClosed     bool
 	shouldAdvertise bool
+	drained         bool
 
 	lock sync.RWMutex
 }
 
-func watchPartitions(zkWatcher *zkWatcher, peers *peers, db, version string, numPartitions, replication int) *partitions {
+func watchPartitions(coordinator coordinator, peers *peers, db, version string, numPartitions, replication, minReplication int, drained map[string]bool) *partitions {
 	p := &partitions{
-		peers:         peers,
-		zkWatcher:     zkWatcher,
-		db:            db,
-		version:       version,
-		zkPath:        path.Join("partitions", db, version),
-		numPartitions: numPartitions,
-		replication:   replication,
-		local:         make(map[int]bool),
-		remote:        make(map[int][]string),
-		ready:         make(chan bool),
+		peers:          peers,
+		coordinator:    coordinator,
+		db:             db,
+		version:        version,
+		zkPath:         path.Join("partitions", db, version),
+		numPartitions:  numPartitions,
+		replication:    replication,
+		minReplication: minReplication,
+		local:          make(map[int]bool),
+		dropped:        make(map[int]time.Time),
+		remote:         make(map[int][]string),
+		ready:          make(chan bool),
 	}
 
-	p.pickLocalPartitions()
+	// Without peers, there's only ever one copy of each partition.
+	if peers == nil || p.minReplication < 1 {
+		p.minReplication = 1
+	}
+
+	p.pickLocalPartitions(drained)
 
 	if peers != nil {
-		updates, _ := zkWatcher.watchChildren(p.zkPath)
+		updates, _ := coordinator.watchChildren(p.zkPath)
 		p.updateRemotePartitions(<-updates)
 		go p.sync(updates)
 	}
@@ -61,15 +73,16 @@ func watchPartitions(zkWatcher *zkWatcher, peers *peers, db, version string, num
 
 // pickLocalPartitions selects which partitions are local by iterating through
 // them all, and checking the hashring to see if this peer is one of the
-// replicas.
-func (p *partitions) pickLocalPartitions() {
+// replicas. Any nodes that have been drained of the db are left out of the
+// running.
+func (p *partitions) pickLocalPartitions(drained map[string]bool) {
 	selected := make(map[int]bool)
 
 	for i := 0; i < p.numPartitions; i++ {
 		if p.peers != nil {
 			partitionId := p.partitionId(i)
 
-			replicas := p.peers.pick(partitionId, p.replication)
+			replicas := p.peers.pick(partitionId, p.replication, drained)
 			for _, replica := range replicas {
 				if replica == peerSelf {
 					selected[i] = true
@@ -81,6 +94,42 @@ func (p *partitions) pickLocalPartitions() {
 	}
 
 	p.selected = selected
+	p.drained = p.peers != nil && drained[p.peers.address]
+}
+
+// repick recomputes which partitions are local after the set of drained nodes
+// changes. If this node has been drained, it stops advertising the partitions
+// it has, so that peers stop proxying requests to it; if it has been undrained,
+// it starts again. It returns true if there are newly selected partitions that
+// need to be built.
+func (p *partitions) repick(drained map[string]bool) bool {
+	if p.peers == nil {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	wasDrained := p.drained
+	p.pickLocalPartitions(drained)
+
+	if p.shouldAdvertise && p.drained != wasDrained {
+		for partition := range p.local {
+			if p.drained {
+				p.coordinator.removeEphemeral(p.partitionZKNode(partition))
+			} else {
+				p.coordinator.createEphemeral(p.partitionZKNode(partition))
+			}
+		}
+	}
+
+	for partition := range p.selected {
+		if !p.local[partition] {
+			return true
+		}
+	}
+
+	return false
 }
 
 // sync syncs the remote partitions from zoolander whenever they change.
@@ -101,16 +150,35 @@ func (p *partitions) updateLocalPartitions(local map[int]bool) {
 
 	for partition := range local {
 		p.local[partition] = true
+		delete(p.dropped, partition)
 	}
 	p.updateMissing()
 
-	if p.shouldAdvertise {
+	if p.shouldAdvertise && !p.drained {
 		for partition := range p.local {
-			p.zkWatcher.createEphemeral(p.partitionZKNode(partition))
+			p.coordinator.createEphemeral(p.partitionZKNode(partition))
 		}
 	}
 }
 
+// dropLocalPartition marks a partition as no longer available locally, and
+// stops advertising it, so that it's loaded again by the next build.
+func (p *partitions) dropLocalPartition(partition int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.local[partition] {
+		p.dropped[partition] = time.Now()
+	}
+
+	delete(p.local, partition)
+	p.updateMissing()
+
+	if p.peers != nil && p.shouldAdvertise && !p.drained {
+		p.coordinator.removeEphemeral(p.partitionZKNode(partition))
+	}
+}
+
 func (p *partitions) updateRemotePartitions(nodes []string) {
 	if p.peers == nil {
 		return
@@ -134,19 +202,18 @@ func (p *partitions) updateRemotePartitions(nodes []string) {
 }
 
 func (p *partitions) updateMissing() {
-	// Check for each partition. If every one is available on at least one node,
-	// then we're ready to rumble.
+	// Check for each partition. If every one is available on at least
+	// minReplication nodes (including this one), then we're ready to rumble.
 	missing := 0
 	for i := 0; i < p.numPartitions; i++ {
-		if _, ok := p.local[i]; ok {
-			continue
+		replicas := len(p.remote[i])
+		if p.local[i] {
+			replicas++
 		}
 
-		if _, ok := p.remote[i]; ok {
-			continue
+		if replicas < p.minReplication {
+			missing += 1
 		}
-
-		missing += 1
 	}
 
 	p.numMissing = missing
@@ -177,6 +244,122 @@ func (p *partitions) needed() map[int]bool {
 	return needed
 }
 
+// getSelected returns a copy of the set of partitions this node is responsible
+// for.
+func (p *partitions) getSelected() map[int]bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	selected := make(map[int]bool, len(p.selected))
+	for partition := range p.selected {
+		selected[partition] = true
+	}
+
+	return selected
+}
+
+// getLocal returns the partitions available locally, in order.
+func (p *partitions) getLocal() []int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	local := make([]int, 0, len(p.local))
+	for partition := range p.local {
+		local = append(local, partition)
+	}
+
+	sort.Ints(local)
+	return local
+}
+
+// availability returns the number of nodes responsible for at least one
+// partition (expected), and how many of those have advertised that they have
+// their partitions (available).
+func (p *partitions) availability(drained map[string]bool) (available, expected int) {
+	if p.peers == nil {
+		return 0, 0
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	responsible := make(map[string]bool)
+	for i := 0; i < p.numPartitions; i++ {
+		for _, addr := range p.peers.pick(p.partitionId(i), p.replication, drained) {
+			responsible[addr] = true
+		}
+	}
+
+	advertised := make(map[string]bool)
+	for _, addrs := range p.remote {
+		for _, addr := range addrs {
+			advertised[addr] = true
+		}
+	}
+
+	if len(p.local) > 0 && p.shouldAdvertise && !p.drained {
+		advertised[peerSelf] = true
+	}
+
+	for addr := range responsible {
+		if advertised[addr] {
+			available++
+		}
+	}
+
+	return available, len(responsible)
+}
+
+// partitionOwnership describes who has a single partition, as seen by this
+// node.
+type partitionOwnership struct {
+	Partition int      `json:"partition"`
+	Peers     []string `json:"peers"`
+	Local     bool     `json:"local"`
+	Selected  bool     `json:"selected"`
+}
+
+// ownership returns the full map of partitions to the peers that have
+// advertised them, from the same view that's used to proxy requests.
+func (p *partitions) ownership() []partitionOwnership {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ownership := make([]partitionOwnership, p.numPartitions)
+	for i := range ownership {
+		peers := make([]string, len(p.remote[i]))
+		copy(peers, p.remote[i])
+		sort.Strings(peers)
+
+		ownership[i] = partitionOwnership{
+			Partition: i,
+			Peers:     peers,
+			Local:     p.local[i],
+			Selected:  p.selected[i],
+		}
+	}
+
+	return ownership
+}
+
+// numLocal returns the number of partitions available locally.
+func (p *partitions) numLocal() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.local)
+}
+
+// droppedAt returns when a partition was dropped with dropLocalPartition, if it
+// was, and hasn't been loaded again since.
+func (p *partitions) droppedAt(partition int) (time.Time, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	t, ok := p.dropped[partition]
+	return t, ok
+}
+
 func (p *partitions) have(partition int) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -197,11 +380,24 @@ func (p *partitions) advertisePartitions() {
 	defer p.lock.Unlock()
 
 	p.shouldAdvertise = true
+	if p.drained {
+		return
+	}
+
 	for partition := range p.local {
-		p.zkWatcher.createEphemeral(p.partitionZKNode(partition))
+		p.coordinator.createEphemeral(p.partitionZKNode(partition))
 	}
 }
 
+// advertising returns true if advertisePartitions has been called, and
+// unadvertisePartitions hasn't since.
+func (p *partitions) advertising() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.shouldAdvertise
+}
+
 func (p *partitions) unadvertisePartitions() {
 	if p.peers == nil {
 		return
@@ -212,7 +408,7 @@ func (p *partitions) unadvertisePartitions() {
 
 	p.shouldAdvertise = false
 	for partition := range p.local {
-		p.zkWatcher.removeEphemeral(p.partitionZKNode(partition))
+		p.coordinator.removeEphemeral(p.partitionZKNode(partition))
 	}
 }
 
@@ -234,6 +430,18 @@ func (p *partitions) getPeers(partition int) []string {
 	return peers
 }
 
+// hasRemote returns true if any peer has advertised any partition.
+func (p *partitions) hasRemote() bool {
+	if p.peers == nil {
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.remote) > 0
+}
+
 // partitionId returns a string id for the given partition, to be used for the
 // consistent hashing ring. It's not really meant to be unique, but it should be
 // different for different versions with the same number of partitions, so that
@@ -249,6 +457,6 @@ func (p *partitions) close() {
 		p.lock.Lock()
 		defer p.lock.Unlock()
 
-		p.zkWatcher.removeWatch(p.zkPath)
+		p.coordinator.removeWatch(p.zkPath)
 	}
 }
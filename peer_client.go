@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// peerTransport keeps a separate pool of keep-alive connections to each peer,
+// so that the connections to a peer can be thrown away as soon as it leaves
+// the cluster, rather than waiting for them to time out or fail. It also adds
+// the peer secret to every request, if there is one.
+type peerTransport struct {
+	base   *http.Transport
+	hosts  map[string]*http.Transport
+	lock   sync.Mutex
+	secret string
+}
+
+// initPeerClient sets up the client used for requests to peers, using the
+// TLS config set up by initTLS.
+func (s *sequins) initPeerClient() {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = s.tlsPeerConfig
+	base.IdleConnTimeout = s.config.Sharding.ProxyIdleTimeout.Duration
+	base.DisableCompression = true
+
+	// Connecting (including the TLS handshake) and waiting for the response
+	// can be bounded separately, so that a dead peer fails fast while a slow
+	// one still gets time to respond. Either way, the whole request is still
+	// bounded by the proxy timeouts.
+	if connect := s.config.Sharding.ProxyConnectTimeout.Duration; connect > 0 {
+		dialer := &net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}
+		base.DialContext = dialer.DialContext
+		base.TLSHandshakeTimeout = connect
+	}
+
+	base.ResponseHeaderTimeout = s.config.Sharding.ProxyReadTimeout.Duration
+	if n := s.config.Sharding.ProxyMaxIdleConns; n > 0 {
+		base.MaxIdleConnsPerHost = n
+		base.MaxIdleConns = 0
+	} else {
+		base.DisableKeepAlives = true
+	}
+
+	s.peerTransport = &peerTransport{
+		base:   base,
+		hosts:  make(map[string]*http.Transport),
+		secret: s.config.Sharding.PeerSecret,
+	}
+
+	s.peerHTTPClient = &http.Client{Transport: s.peerTransport}
+
+	// Requests to the remote cluster use the same settings, but their own pool
+	// of connections. They never carry the peer secret or the peer TLS
+	// certificates, since the remote cluster isn't one of our peers.
+	remote := base.Clone()
+	remote.TLSClientConfig = nil
+	remote.DisableCompression = false
+	s.remoteHTTPClient = &http.Client{
+		Transport: remote,
+		Timeout:   s.config.Failover.Timeout.Duration,
+	}
+}
+
+// peerClient returns the client to use for requests to peers.
+func (s *sequins) peerClient() *http.Client {
+	if s.peerHTTPClient != nil {
+		return s.peerHTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+// remoteClient returns the client to use for requests to the remote cluster.
+func (s *sequins) remoteClient() *http.Client {
+	if s.remoteHTTPClient != nil {
+		return s.remoteHTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.secret != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(peerSecretHeader, t.secret)
+	}
+
+	return t.forHost(req.URL.Host).RoundTrip(req)
+}
+
+func (t *peerTransport) forHost(host string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	transport, ok := t.hosts[host]
+	if !ok {
+		transport = t.base.Clone()
+		t.hosts[host] = transport
+	}
+
+	return transport
+}
+
+// forget closes any idle connections to a peer, and throws away its pool, so
+// that later requests to the peer start with fresh connections. Connections
+// that are still in use are left to time out once they're idle.
+func (t *peerTransport) forget(host string) {
+	t.lock.Lock()
+	transport, ok := t.hosts[host]
+	delete(t.hosts, host)
+	t.lock.Unlock()
+
+	if ok {
+		transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerClientReusesConnections(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+
+	server.Start()
+	defer server.Close()
+
+	s := &sequins{config: defaultConfig()}
+	s.initPeerClient()
+
+	get := func() {
+		resp, err := s.peerClient().Get(server.URL)
+		require.NoError(t, err)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	get()
+	get()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conns), "the connection should be reused")
+
+	s.peerTransport.forget(httptestHost(server))
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&conns), "the pool should be thrown away when the peer leaves")
+}
+
+func TestPeerClientReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := &sequins{config: defaultConfig()}
+	s.config.Sharding.ProxyConnectTimeout = duration{time.Second}
+	s.config.Sharding.ProxyReadTimeout = duration{50 * time.Millisecond}
+	s.initPeerClient()
+
+	resp, err := s.peerClient().Get(server.URL + "/fast")
+	require.NoError(t, err, "a peer that responds quickly should succeed")
+	resp.Body.Close()
+
+	_, err = s.peerClient().Get(server.URL + "/slow")
+	assert.Error(t, err, "a peer that's slow to respond should time out")
+}
+
+func TestPeerClientSecret(t *testing.T) {
+	secrets := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets <- r.Header.Get(peerSecretHeader)
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.Sharding.PeerSecret = "hunter2"
+	s := &sequins{config: config}
+	s.initPeerClient()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	resp, err := s.peerClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "hunter2", <-secrets, "the peer secret should be sent to peers")
+	assert.Empty(t, req.Header.Get(peerSecretHeader), "the original request shouldn't be modified")
+}
@@ -0,0 +1,56 @@
+package main
+
+import "time"
+
+// preferReady reorders the given peer addresses, which all have a partition of
+// the version, so that peers that are still warming up come last. A peer is
+// warming up if it joined the cluster less than warmup ago, and hasn't yet
+// advertised every partition of the version that it's responsible for. Until
+// then it's likely still loading, and may not have the rest of the version.
+// Otherwise, the order is preserved.
+func (p *partitions) preferReady(addrs []string, warmup time.Duration) []string {
+	if p.peers == nil || warmup == 0 {
+		return addrs
+	}
+
+	ready := make([]string, 0, len(addrs))
+	var warming []string
+	for _, addr := range addrs {
+		if p.peers.joinedWithin(addr, warmup) && !p.hasLoaded(addr) {
+			warming = append(warming, addr)
+		} else {
+			ready = append(ready, addr)
+		}
+	}
+
+	return append(ready, warming...)
+}
+
+// hasLoaded returns true if the peer with the given address has advertised
+// every partition of the version that the hashring assigns to it.
+func (p *partitions) hasLoaded(addr string) bool {
+	advertised := make(map[int]bool)
+	p.lock.RLock()
+	for partition, peers := range p.remote {
+		for _, peer := range peers {
+			if peer == addr {
+				advertised[partition] = true
+			}
+		}
+	}
+	p.lock.RUnlock()
+
+	for i := 0; i < p.numPartitions; i++ {
+		if advertised[i] {
+			continue
+		}
+
+		for _, replica := range p.peers.pick(p.partitionId(i), p.replication, nil) {
+			if replica == addr {
+				return false
+			}
+		}
+	}
+
+	return true
+}
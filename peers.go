@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,17 +16,41 @@ import (
 
 const peerSelf = "(self)"
 
+// nodeWeightSuffix is appended to the name a node registers with, followed by
+// its weight, if the weight isn't 1.
+const nodeWeightSuffix = ";weight="
+
+// nodeZoneSuffix is appended to the name a node registers with, followed by its
+// zone, if it has one. It comes before the weight.
+const nodeZoneSuffix = ";zone="
+
 // peers represents a remote list of peers, synced with zookeeper. It's also
 // responsible for advertising this particular node's existence.
 type peers struct {
-	shardID string
-	address string
-
-	peers map[peer]bool
-	ring  *consistent.Consistent
-	lock  sync.RWMutex
+	shardID     string
+	address     string
+	weight      int
+	zone        string
+	node        string
+	coordinator coordinator
+
+	peers      map[peer]bool
+	zones      map[string]string
+	ring       hashring
+	ringShards map[string]string
+	lock       sync.RWMutex
 
 	resetConvergenceTimer chan bool
+	changes               chan bool
+	lastChange            time.Time
+
+	// joined is when each peer that joined after we first synced was first
+	// seen, by address. Peers that were already there aren't in it.
+	joined map[string]time.Time
+	synced bool
+
+	// lost is called with the address of any peer that leaves the cluster.
+	lost func(address string)
 }
 
 type peer struct {
@@ -33,24 +58,58 @@ type peer struct {
 	address string
 }
 
-func watchPeers(zkWatcher *zkWatcher, shardID, address string) *peers {
+func watchPeers(coordinator coordinator, shardID, address string, weight, virtualNodes int, zone string, lost func(address string)) *peers {
+	node := fmt.Sprintf("%s@%s", shardID, address)
+	if zone != "" {
+		node += nodeZoneSuffix + zone
+	}
+
+	if weight != 1 {
+		node += nodeWeightSuffix + strconv.Itoa(weight)
+	}
+
+	// The original ring is kept by default, so that existing clusters don't
+	// reshuffle every partition when they upgrade.
+	var ring hashring = consistent.New()
+	if virtualNodes > 0 {
+		ring = newVirtualNodeRing(virtualNodes)
+	}
+
 	p := &peers{
-		shardID: shardID,
-		address: address,
-		peers:   make(map[peer]bool),
-		ring:    consistent.New(),
+		shardID:               shardID,
+		address:               address,
+		weight:                weight,
+		zone:                  zone,
+		node:                  path.Join("nodes", node),
+		coordinator:           coordinator,
+		peers:                 make(map[peer]bool),
+		zones:                 make(map[string]string),
+		ring:                  ring,
 		resetConvergenceTimer: make(chan bool),
+		changes:               make(chan bool, 1),
+		lastChange:            time.Now(),
+		lost:                  lost,
 	}
 
-	node := path.Join("nodes", fmt.Sprintf("%s@%s", p.shardID, p.address))
-	zkWatcher.createEphemeral(node)
+	p.register()
 
-	updates, disconnected := zkWatcher.watchChildren("nodes")
+	updates, disconnected := coordinator.watchChildren("nodes")
 	go p.sync(updates, disconnected)
 
 	return p
 }
 
+// register advertises this node to the other nodes.
+func (p *peers) register() {
+	p.coordinator.createEphemeral(p.node)
+}
+
+// deregister removes this node from the list of peers, as seen by the other
+// nodes.
+func (p *peers) deregister() {
+	p.coordinator.removeEphemeral(p.node)
+}
+
 func (p *peers) sync(updates chan []string, disconnected chan bool) {
 	for {
 		var nodes []string
@@ -59,6 +118,10 @@ func (p *peers) sync(updates chan []string, disconnected chan bool) {
 		case <-disconnected:
 		}
 
+		p.lock.Lock()
+		p.lastChange = time.Now()
+		p.lock.Unlock()
+
 		select {
 		case p.resetConvergenceTimer <- true:
 		default:
@@ -74,26 +137,40 @@ func (p *peers) updatePeers(addrs []string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	if p.joined == nil {
+		p.joined = make(map[string]time.Time)
+	}
+
 	// Log any new peers.
 	newPeers := make(map[peer]bool)
-	shards := make(map[string]bool)
+	zones := make(map[string]string)
+	shards := make(map[string]int)
 	disp := make([]string, 0, len(addrs))
+	changed := false
 	for _, node := range addrs {
-		parts := strings.SplitN(node, "@", 2)
-		id := parts[0]
-		addr := parts[1]
-
+		id, addr, zone, weight := parseNode(node)
 		if addr == p.address {
 			continue
 		}
 
+		if zone != "" {
+			zones[addr] = zone
+		}
+
 		peer := peer{shardID: id, address: addr}
 		disp = append(disp, peer.display())
 		if !p.peers[peer] {
 			log.Println("New peer:", peer.display())
+			changed = true
+			if p.synced {
+				p.joined[addr] = time.Now()
+			}
+		}
+
+		if weight > shards[id] {
+			shards[id] = weight
 		}
 
-		shards[id] = true
 		newPeers[peer] = true
 	}
 
@@ -101,19 +178,49 @@ func (p *peers) updatePeers(addrs []string) {
 	for peer := range p.peers {
 		if !newPeers[peer] {
 			log.Println("Lost peer:", peer.display())
+			changed = true
+			delete(p.joined, peer.address)
+			if p.lost != nil {
+				p.lost(peer.address)
+			}
 		}
 	}
 
 	log.Println("Peers: ", disp)
 
-	shards[p.shardID] = true
-	allShards := make([]string, 0, len(shards))
-	for shard := range shards {
-		allShards = append(allShards, shard)
+	if p.weight > shards[p.shardID] {
+		shards[p.shardID] = p.weight
 	}
 
-	p.ring.Set(allShards)
+	// Shards with a weight above 1 get extra members on the hashring, so that
+	// they're picked for proportionally more partitions. If the nodes in a shard
+	// disagree, the highest weight wins, so that every node builds the same ring.
+	members := make([]string, 0, len(shards))
+	p.ringShards = make(map[string]string, len(shards))
+	for shard, weight := range shards {
+		for i := 0; i < weight; i++ {
+			member := shard
+			if i > 0 {
+				member = fmt.Sprintf("%s%s%d", shard, nodeWeightSuffix, i)
+			}
+
+			members = append(members, member)
+			p.ringShards[member] = shard
+		}
+	}
+
+	p.ring.Set(members)
 	p.peers = newPeers
+	p.zones = zones
+	p.synced = true
+
+	// Let anyone watching know that the membership of the cluster changed.
+	if changed {
+		select {
+		case p.changes <- true:
+		default:
+		}
+	}
 }
 
 func (p *peers) getAll() []string {
@@ -128,28 +235,91 @@ func (p *peers) getAll() []string {
 	return addrs
 }
 
-func (p *peers) pick(partitionId string, n int) []string {
+// pick returns the addresses of the nodes responsible for the given partition,
+// which are all the nodes belonging to the first n shards on the hashring. Any
+// nodes in excluded (keyed by address) are skipped, and if that leaves a shard
+// with no nodes at all, the partition falls through to the next shard on the
+// ring instead.
+func (p *peers) pick(partitionId string, n int, excluded map[string]bool) []string {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
-	picked, _ := p.ring.GetN(partitionId, n)
-	shards := make(map[string]bool)
-	for _, shard := range picked {
-		shards[shard] = true
+	// Walk the whole ring in order, so that we can skip over shards if
+	// necessary. Weighted shards show up more than once.
+	members, _ := p.ring.GetN(partitionId, len(p.ring.Members()))
+
+	addrs := make([]string, 0, n)
+	picked := 0
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		if picked == n {
+			break
+		}
+
+		shard := p.ringShards[member]
+		if seen[shard] {
+			continue
+		}
+
+		seen[shard] = true
+
+		found := false
+		for peer := range p.peers {
+			if peer.shardID == shard && !excluded[peer.address] {
+				addrs = append(addrs, peer.address)
+				found = true
+			}
+		}
+
+		if shard == p.shardID && !excluded[p.address] {
+			addrs = append(addrs, peerSelf)
+			found = true
+		}
+
+		if found {
+			picked++
+		}
 	}
 
-	addrs := make([]string, 0, len(shards))
-	for peer := range p.peers {
-		if shards[peer.shardID] {
-			addrs = append(addrs, peer.address)
+	return addrs
+}
+
+// preferZone reorders the given peer addresses so that any in the same zone as
+// this node come first. Otherwise, the order is preserved. If this node doesn't
+// have a zone, the peers are returned as-is.
+func (p *peers) preferZone(addrs []string) []string {
+	if p.zone == "" {
+		return addrs
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	reordered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if p.zones[addr] == p.zone {
+			reordered = append(reordered, addr)
 		}
 	}
 
-	if shards[p.shardID] {
-		addrs = append(addrs, peerSelf)
+	for _, addr := range addrs {
+		if p.zones[addr] != p.zone {
+			reordered = append(reordered, addr)
+		}
 	}
 
-	return addrs
+	return reordered
+}
+
+// joinedWithin returns true if the peer with the given address joined the
+// cluster less than dur ago. Peers that were already there when this node
+// started never count as having just joined.
+func (p *peers) joinedWithin(addr string, dur time.Duration) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	joined, ok := p.joined[addr]
+	return ok && time.Since(joined) < dur
 }
 
 func (p *peers) waitToConverge(dur time.Duration) {
@@ -166,6 +336,42 @@ func (p *peers) waitToConverge(dur time.Duration) {
 	}
 }
 
+// untilConverged returns how much longer the list of peers needs to stay the
+// same before we consider it stable, given the time it takes to converge. If
+// it's already stable, it returns 0.
+func (p *peers) untilConverged(dur time.Duration) time.Duration {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	remaining := dur - time.Now().Sub(p.lastChange)
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// parseNode parses the name a node registers with, which is the shard ID and
+// address separated by '@', optionally followed by the node's zone and weight.
+// Nodes without a weight have a weight of 1.
+func parseNode(node string) (shardID, address, zone string, weight int) {
+	weight = 1
+	if i := strings.LastIndex(node, nodeWeightSuffix); i != -1 {
+		if w, err := strconv.Atoi(node[i+len(nodeWeightSuffix):]); err == nil && w > 0 {
+			weight = w
+			node = node[:i]
+		}
+	}
+
+	if i := strings.LastIndex(node, nodeZoneSuffix); i != -1 {
+		zone = node[i+len(nodeZoneSuffix):]
+		node = node[:i]
+	}
+
+	parts := strings.SplitN(node, "@", 2)
+	return parts[0], parts[1], zone, weight
+}
+
 func (p *peer) display() string {
 	if p.shardID == p.address {
 		return p.address
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"stathat.com/c/consistent"
+)
+
+func testPeers(shardID, address string, nodes []string) *peers {
+	p := &peers{
+		shardID: shardID,
+		address: address,
+		weight:  1,
+		peers:   make(map[peer]bool),
+		ring:    consistent.New(),
+	}
+
+	p.updatePeers(nodes)
+	return p
+}
+
+func TestPeersPickExcluded(t *testing.T) {
+	var nodes []string
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, fmt.Sprintf("shard%d@host%d:9599", i, i))
+	}
+
+	p := testPeers("shard0", "host0:9599", nodes)
+
+	for i := 0; i < 100; i++ {
+		partitionId := fmt.Sprintf("partitions/db/version:%05d", i)
+
+		picked := p.pick(partitionId, 2, nil)
+		assert.Equal(t, 2, len(picked), "pick should return one node per shard")
+
+		excluded := map[string]bool{picked[0]: true}
+		if picked[0] == peerSelf {
+			excluded = map[string]bool{"host0:9599": true}
+		}
+
+		repicked := p.pick(partitionId, 2, excluded)
+		assert.Equal(t, 2, len(repicked), "pick should fall through to the next shard")
+		assert.NotContains(t, repicked, picked[0], "pick should skip excluded nodes")
+		assert.Contains(t, repicked, picked[1], "pick should keep the other replica")
+	}
+}
+
+func TestPeersUntilConverged(t *testing.T) {
+	p := testPeers("shard0", "host0:9599", nil)
+
+	p.lastChange = time.Now()
+	remaining := p.untilConverged(time.Minute)
+	assert.True(t, remaining > 0 && remaining <= time.Minute, "the peers shouldn't be converged right after a change")
+
+	p.lastChange = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, time.Duration(0), p.untilConverged(time.Minute), "the peers should be converged after the time to converge")
+}
+
+func TestPeersPickWeighted(t *testing.T) {
+	nodes := []string{"shard0@host0:9599;weight=2"}
+	for i := 1; i < 5; i++ {
+		nodes = append(nodes, fmt.Sprintf("shard%d@host%d:9599", i, i))
+	}
+
+	p := testPeers("shard1", "host1:9599", nodes)
+
+	owned := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		partitionId := fmt.Sprintf("partitions/db/version:%05d", i)
+
+		picked := p.pick(partitionId, 2, nil)
+		assert.Equal(t, 2, len(picked), "pick should return one node per shard")
+		assert.NotEqual(t, picked[0], picked[1], "pick shouldn't return a weighted shard twice")
+		for _, addr := range picked {
+			owned[addr]++
+		}
+	}
+
+	light := 0
+	for i := 1; i < 5; i++ {
+		addr := fmt.Sprintf("host%d:9599", i)
+		if i == 1 {
+			addr = peerSelf
+		}
+
+		light += owned[addr]
+	}
+
+	ratio := float64(owned["host0:9599"]) / (float64(light) / 4)
+	assert.InDelta(t, 2.0, ratio, 0.5, "a node with weight 2 should own about twice as many partitions")
+}
+
+func TestPeersPreferZone(t *testing.T) {
+	nodes := []string{
+		"shard0@host0:9599;zone=a",
+		"shard1@host1:9599;zone=a",
+		"shard2@host2:9599;zone=b",
+		"shard3@host3:9599;zone=b",
+		"shard4@host4:9599",
+	}
+
+	p := testPeers("shard0", "host0:9599", nodes)
+	p.zone = "a"
+
+	addrs := []string{"host3:9599", "host4:9599", "host1:9599", "host2:9599"}
+	for i := 0; i < 10; i++ {
+		reordered := p.preferZone(shuffle(addrs))
+		assert.Equal(t, "host1:9599", reordered[0], "the peer in the same zone should come first")
+		for _, addr := range addrs {
+			assert.Contains(t, reordered, addr, "no peers should be dropped")
+		}
+	}
+
+	assert.Equal(t, []string{"host3:9599", "host2:9599", "host4:9599"},
+		p.preferZone([]string{"host3:9599", "host2:9599", "host4:9599"}),
+		"with no peers in the same zone, the order should be preserved")
+
+	p.zone = ""
+	assert.Equal(t, addrs, p.preferZone(addrs), "a node without a zone shouldn't reorder peers")
+}
+
+func TestParseNode(t *testing.T) {
+	shardID, address, zone, weight := parseNode("shard0@host0:9599")
+	assert.Equal(t, "shard0", shardID)
+	assert.Equal(t, "host0:9599", address)
+	assert.Equal(t, "", zone, "nodes without a zone should have an empty zone")
+	assert.Equal(t, 1, weight, "nodes without a weight should have a weight of 1")
+
+	shardID, address, zone, weight = parseNode("shard0@host0:9599;weight=3")
+	assert.Equal(t, "shard0", shardID)
+	assert.Equal(t, "host0:9599", address)
+	assert.Equal(t, "", zone)
+	assert.Equal(t, 3, weight)
+
+	shardID, address, zone, weight = parseNode("shard0@host0:9599;zone=us-east-1a;weight=3")
+	assert.Equal(t, "shard0", shardID)
+	assert.Equal(t, "host0:9599", address)
+	assert.Equal(t, "us-east-1a", zone)
+	assert.Equal(t, 3, weight)
+}
+
+func TestPeersPickReshuffle(t *testing.T) {
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, fmt.Sprintf("shard%d@host%d:9599", i, i))
+	}
+
+	p := testPeers("shard0", "host0:9599", nil)
+	p.ring = newVirtualNodeRing(100)
+	p.updatePeers(nodes)
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		partitionId := fmt.Sprintf("partitions/db/version:%05d", i)
+		before[partitionId] = p.pick(partitionId, 1, nil)[0]
+	}
+
+	p.updatePeers(append(nodes, "shard3@host3:9599"))
+
+	moved := 0
+	for partitionId, owner := range before {
+		picked := p.pick(partitionId, 1, nil)[0]
+		if picked != owner {
+			assert.Equal(t, "host3:9599", picked, "partitions should only move to the new node")
+			moved++
+		}
+	}
+
+	// About a quarter of the partitions should move to the new node.
+	assert.True(t, moved > 150 && moved < 350, "adding a fourth node should only move about a quarter of the partitions (moved %d of 1000)", moved)
+}
+
+func TestPeersWarmup(t *testing.T) {
+	nodes := []string{"shard0@host0:9599", "shard1@host1:9599"}
+	p := testPeers("shard0", "host0:9599", nodes)
+	assert.False(t, p.joinedWithin("host1:9599", time.Minute), "peers that were there from the start shouldn't count as joined")
+
+	p.updatePeers(append(nodes, "shard2@host2:9599"))
+	assert.True(t, p.joinedWithin("host2:9599", time.Minute), "a late joiner should count as joined")
+
+	parts := &partitions{
+		peers:         p,
+		numPartitions: 20,
+		replication:   1,
+		zkPath:        "partitions/db/1",
+		ready:         make(chan bool),
+	}
+
+	// The late joiner is responsible for some of the partitions, but has only
+	// advertised the first of them so far. host1 has every partition.
+	var assigned []int
+	for i := 0; i < parts.numPartitions; i++ {
+		if p.pick(parts.partitionId(i), 1, nil)[0] == "host2:9599" {
+			assigned = append(assigned, i)
+		}
+	}
+
+	require.True(t, len(assigned) > 1, "setup: the late joiner should be assigned more than one partition")
+
+	var advertised []string
+	for i := 0; i < parts.numPartitions; i++ {
+		advertised = append(advertised, fmt.Sprintf("%05d@host1:9599", i))
+	}
+
+	parts.updateRemotePartitions(append(advertised, fmt.Sprintf("%05d@host2:9599", assigned[0])))
+	candidates := []string{"host2:9599", "host1:9599"}
+	assert.Equal(t, candidates, parts.preferReady(candidates, 0), "nothing should be reordered without a warmup period")
+	assert.Equal(t, []string{"host1:9599", "host2:9599"}, parts.preferReady(candidates, time.Minute),
+		"a late joiner that's still loading shouldn't be proxied to first")
+
+	for _, partition := range assigned {
+		advertised = append(advertised, fmt.Sprintf("%05d@host2:9599", partition))
+	}
+
+	parts.updateRemotePartitions(advertised)
+	assert.Equal(t, candidates, parts.preferReady(candidates, time.Minute),
+		"a late joiner should be proxied to normally once it's advertised all its partitions")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pinnedZKPath is the path under which versions are pinned. Each db that is
+// pinned has a single persistent child, named after the pinned version.
+const pinnedZKPath = "pinned"
+
+// pinRetryInterval is how often to retry loading a pinned version that's still
+// being removed.
+const pinRetryInterval = 1 * time.Second
+
+func (db *db) pinnedZKPath() string {
+	return path.Join(pinnedZKPath, db.name)
+}
+
+// watchPinned starts watching for the version of the db pinned through the
+// admin API, so that every node in the cluster holds the same version. Like
+// watchDrained, it blocks until the initial pin is known.
+func (db *db) watchPinned() {
+	updates, _ := db.coordinator().watchChildren(db.pinnedZKPath())
+	db.pinned = pinFromNodes(<-updates)
+
+	go func() {
+		for {
+			nodes, ok := <-updates
+			if !ok {
+				break
+			}
+
+			db.updatePinned(nodes)
+		}
+	}()
+}
+
+func (db *db) updatePinned(nodes []string) {
+	db.setPinned(pinFromNodes(nodes))
+}
+
+// pinFromNodes returns the pinned version, given the children of a db's pin
+// node. There should only be one, but if there are more, for example because of
+// concurrent pins, the last by name wins, so that nodes still agree.
+func pinFromNodes(nodes []string) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+
+	sort.Strings(nodes)
+	return nodes[len(nodes)-1]
+}
+
+// setPinned pins the db to the given version, or unpins it if version is empty.
+// Pinning takes effect immediately, but after unpinning, the db only moves on
+// to newer versions on the next refresh.
+func (db *db) setPinned(version string) {
+	db.pinnedLock.Lock()
+	changed := db.pinned != version
+	db.pinned = version
+	db.pinnedLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if version == "" {
+		logEvent(logFields{DB: db.name, Event: "version_unpinned"}, "Unpinned %s", db.name)
+		return
+	}
+
+	logEvent(logFields{DB: db.name, Version: version, Event: "version_pinned"},
+		"Pinned %s to version %s", db.name, version)
+	go db.refreshPinned(version)
+}
+
+// refreshPinned refreshes the db after it's pinned, so that the pin takes
+// effect immediately. If the pinned version is an old one that's still being
+// cleaned up, it waits for that to finish first.
+func (db *db) refreshPinned(version string) {
+	for {
+		err := db.refresh()
+		if err != errVersionRemoving {
+			if err != nil {
+				log.Printf("Error refreshing %s after pinning it: %s", db.name, err)
+			}
+
+			return
+		}
+
+		time.Sleep(pinRetryInterval)
+		if db.pinnedVersion() != version {
+			return
+		}
+	}
+}
+
+// pinnedVersion returns the version that the db is pinned to, or an empty
+// string if it isn't pinned. A pin set through the admin API takes precedence
+// over the 'pinned_version' option.
+func (db *db) pinnedVersion() string {
+	db.pinnedLock.RLock()
+	defer db.pinnedLock.RUnlock()
+
+	if db.pinned != "" {
+		return db.pinned
+	}
+
+	return db.config.PinnedVersion
+}
+
+// servePin handles PUT /db/_pin, which pins the db to the version named in the
+// body, and DELETE /db/_pin, which removes the pin. In a cluster, the pin is
+// stored in zookeeper, so it applies to every node.
+func (db *db) servePin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case "PUT":
+		var b []byte
+		b, err = ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		version := strings.TrimSpace(string(b))
+		if version == "" || strings.Contains(version, "/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		exists, err = db.versionExists(version)
+		if err != nil {
+			log.Printf("Error listing versions of %s: %s", db.name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err = db.pin(version)
+	case "DELETE":
+		err = db.unpin()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error updating the pin for %s: %s", db.name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// versionExists returns whether the version is in the backend, and complete, if
+// 'require_success_file' is set for the db.
+func (db *db) versionExists(version string) (bool, error) {
+	versions, err := db.sequins.backend.ListVersions(db.name, "", db.requireSuccessFile())
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range versions {
+		if v == version {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// pin pins the db to the given version, replacing any existing pin.
+func (db *db) pin(version string) error {
+	if db.coordinator() == nil {
+		db.setPinned(version)
+		return nil
+	}
+
+	log.Printf("Pinning %s to version %s across the cluster", db.name, version)
+	return db.coordinator().setPersistentChild(db.pinnedZKPath(), version)
+}
+
+// unpin reverses pin.
+func (db *db) unpin() error {
+	if db.coordinator() == nil {
+		db.setPinned("")
+		return nil
+	}
+
+	log.Printf("Unpinning %s across the cluster", db.name)
+	return db.coordinator().setPersistentChild(db.pinnedZKPath(), "")
+}
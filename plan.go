@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// planKey is the key used to fetch the plan for a db, with GET /<db>/_plan.
+const planKey = "_plan"
+
+// A plan describes what the next refresh of a db would do, without doing it.
+type plan struct {
+	CurrentVersion string `json:"current_version"`
+	PinnedVersion  string `json:"pinned_version,omitempty"`
+
+	// Version is the version the db would switch to, or the current one, if
+	// there's nothing newer. Upgrade is set if it's different from the current
+	// one.
+	Version string `json:"version"`
+	Upgrade bool   `json:"upgrade"`
+
+	SuccessFile bool `json:"success_file"`
+	NumFiles    int  `json:"num_files"`
+}
+
+// servePlan handles GET /<db>/_plan, which runs the same version selection as
+// a refresh, and reports the version that would be loaded, but doesn't load it
+// or change anything locally.
+func (db *db) servePlan(w http.ResponseWriter, r *http.Request) {
+	p, err := db.plan()
+	if err == errNoVersions {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error planning a refresh of %s: %s", db.name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(p)
+	if err != nil {
+		log.Println("Error serving plan:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// plan mirrors refresh, up to the point where it would create the version.
+func (db *db) plan() (plan, error) {
+	p := plan{PinnedVersion: db.pinnedVersion()}
+
+	current := db.mux.getCurrent()
+	db.mux.release(current)
+	if current != nil {
+		p.CurrentVersion = current.name
+	}
+
+	versions, err := db.listVersions(p.CurrentVersion)
+	if err != nil {
+		return p, err
+	} else if len(versions) == 0 {
+		if current == nil {
+			return p, errNoVersions
+		}
+
+		p.Version = p.CurrentVersion
+	} else {
+		p.Version = versions[len(versions)-1]
+	}
+
+	p.Upgrade = p.Version != p.CurrentVersion
+
+	files, err := db.sequins.backend.ListFiles(db.name, p.Version)
+	if err != nil {
+		return p, err
+	}
+
+	if len(db.config.MetadataHeaders) > 0 {
+		files, _ = splitMetadataFiles(files)
+	}
+
+	if db.sequins.config.Storage.VerifyChecksums {
+		files, _ = splitChecksumFiles(files)
+	}
+
+	p.NumFiles = len(files)
+
+	// The success file is never listed, so we have to check for it directly.
+	success, err := db.sequins.backend.Open(db.name, p.Version, "_SUCCESS")
+	if err == nil {
+		success.Close()
+		p.SuccessFile = true
+	}
+
+	return p, nil
+}
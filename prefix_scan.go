@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// prefixScanKey starts the key for requests to /db/_prefix/<prefix>, which
+// list all the keys starting with <prefix>, along with their values.
+const prefixScanKey = "_prefix/"
+
+type prefixScanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// servePrefix handles GET /db/_prefix/<prefix>. The response is a JSON array
+// of key/value pairs, streamed as the partitions are scanned. Values are
+// encoded according to the db's 'value_encoding', including in responses to
+// peers. Local partitions are scanned directly, and the rest are fetched from
+// peers, one request per partition. The order of the keys is not guaranteed,
+// even between requests.
+//
+// The 'limit' query parameter caps the number of pairs returned. If the
+// request was proxied, only the partition in the 'partition' query parameter
+// is scanned, and it must be available locally.
+func (vs *version) servePrefix(w http.ResponseWriter, r *http.Request, prefix string) {
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		limit = n
+	}
+
+	// Peers normalize the prefix themselves, so they're sent it as it was
+	// requested.
+	requested := prefix
+	var partitions []int
+	if vs.numPartitions != 0 {
+		prefix = string(vs.blockStore.NormalizeKey([]byte(prefix)))
+		partitions = vs.blockStore.PrefixPartitions([]byte(prefix))
+	}
+
+	if proxiedVersion(r) != "" {
+		partition, err := strconv.Atoi(r.URL.Query().Get("partition"))
+		if err != nil || !vs.partitions.have(partition) {
+			vs.serveError(w, prefixScanKey+prefix, errProxiedIncorrectly)
+			return
+		}
+
+		partitions = []int{partition}
+	}
+
+	var local, remote []int
+	for _, partition := range partitions {
+		if vs.partitions.have(partition) {
+			local = append(local, partition)
+		} else {
+			remote = append(remote, partition)
+		}
+	}
+
+	// Wait for all the peers to respond before writing anything, so that we can
+	// still return an error if one of them can't.
+	responses, err := vs.scanPeers(r, requested, remote, limit)
+	if err != nil {
+		vs.serveProxyError(w, prefixScanKey+prefix, err)
+		return
+	}
+
+	defer func() {
+		for _, resp := range responses {
+			resp.Body.Close()
+		}
+	}()
+
+	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set("Content-Type", "application/json")
+	sw := newPrefixScanWriter(w, limit, vs.db.encodeValues())
+	for _, partition := range local {
+		_, err := vs.blockStore.ScanPrefix(partition, []byte(prefix), sw.write)
+		if err == nil {
+			err = sw.err
+		}
+
+		if err != nil {
+			// We already wrote a 200 OK, so not much we can do here except log. The
+			// response will be invalid JSON, so the client can tell.
+			log.Printf("Error scanning for /%s/%s%s (version %s): %s", vs.db.name, prefixScanKey, prefix, vs.name, err)
+			return
+		}
+	}
+
+	for _, resp := range responses {
+		err := sw.copy(resp.Body)
+		if err != nil {
+			log.Printf("Error copying scan from peer for /%s/%s%s (version %s): %s", vs.db.name, prefixScanKey, prefix, vs.name, err)
+			return
+		}
+	}
+
+	sw.close()
+}
+
+// scanPeers asks peers to scan each of the given partitions, concurrently.
+// Each partition is proxied in the same way as a single key would be. If any
+// partition can't be fetched, the whole scan fails.
+func (vs *version) scanPeers(r *http.Request, prefix string, partitions []int, limit int) ([]*http.Response, error) {
+	responses := make([]*http.Response, len(partitions))
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var proxyErr error
+	sem := make(chan bool, batchConcurrency)
+	for i, partition := range partitions {
+		wg.Add(1)
+		sem <- true
+		go func(i, partition int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			peers := vs.candidatePeers(partition)
+			resp, _, err := vs.proxyWithRetries(vs.prefixRequest(r, prefix, partition, limit), partition, peers)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				err = fmt.Errorf("got %d", resp.StatusCode)
+			}
+
+			vs.sequins.metrics.countProxyRequest(vs.db.name, err)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if proxyErr == nil {
+					proxyErr = err
+				}
+			} else {
+				responses[i] = resp
+			}
+		}(i, partition)
+	}
+
+	wg.Wait()
+	if proxyErr != nil {
+		for _, resp := range responses {
+			if resp != nil {
+				resp.Body.Close()
+			}
+		}
+
+		return nil, proxyErr
+	}
+
+	return responses, nil
+}
+
+// prefixRequest returns a copy of r as a GET for a scan of a single partition,
+// which is what proxying expects.
+func (vs *version) prefixRequest(r *http.Request, prefix string, partition, limit int) *http.Request {
+	u := *r.URL
+	u.Path = "/" + vs.db.name + "/" + prefixScanKey + prefix
+	u.RawPath = ""
+	u.RawQuery = fmt.Sprintf("partition=%d", partition)
+	if limit != 0 {
+		u.RawQuery += fmt.Sprintf("&limit=%d", limit)
+	}
+
+	prefixRequest := new(http.Request)
+	*prefixRequest = *r
+	prefixRequest.Method = "GET"
+	prefixRequest.URL = &u
+	prefixRequest.Body = nil
+	return prefixRequest
+}
+
+// prefixScanWriter writes key/value pairs as a JSON array, stopping once it's
+// written 'limit' of them, if limit is nonzero. If encode is set, values are
+// base64 encoded, and values copied from peers are expected to be as well.
+type prefixScanWriter struct {
+	w      io.Writer
+	limit  int
+	encode bool
+	n      int
+	err    error
+}
+
+func newPrefixScanWriter(w io.Writer, limit int, encode bool) *prefixScanWriter {
+	sw := &prefixScanWriter{w: w, limit: limit, encode: encode}
+	_, sw.err = io.WriteString(w, "[")
+	return sw
+}
+
+// write writes a single pair. It returns false if the scan should stop,
+// either because the limit was reached or because there was an error.
+func (sw *prefixScanWriter) write(key, value []byte) bool {
+	if sw.done() {
+		return false
+	}
+
+	entry := prefixScanEntry{Key: string(key), Value: string(value)}
+	if sw.encode {
+		entry.Value = encodeValue(value)
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		sw.err = err
+		return false
+	}
+
+	if sw.n > 0 {
+		_, sw.err = io.WriteString(sw.w, ",")
+	}
+
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+
+	sw.n++
+	return !sw.done()
+}
+
+// copy writes the pairs from a peer's response, which is itself a JSON array.
+func (sw *prefixScanWriter) copy(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	tok, err := decoder.Token()
+	if err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return errors.New("expected a JSON array")
+	}
+
+	for !sw.done() && decoder.More() {
+		var entry prefixScanEntry
+		err := decoder.Decode(&entry)
+		if err != nil {
+			return err
+		}
+
+		value := []byte(entry.Value)
+		if sw.encode {
+			value, err = decodeValue(entry.Value)
+			if err != nil {
+				return err
+			}
+		}
+
+		sw.write([]byte(entry.Key), value)
+	}
+
+	return sw.err
+}
+
+func (sw *prefixScanWriter) done() bool {
+	return sw.err != nil || (sw.limit > 0 && sw.n >= sw.limit)
+}
+
+func (sw *prefixScanWriter) close() {
+	if sw.err == nil {
+		io.WriteString(sw.w, "]\n")
+	}
+}
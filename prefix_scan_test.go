@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixScanWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sw := newPrefixScanWriter(buf, 3, false)
+
+	assert.True(t, sw.write([]byte("foo"), []byte("bar")), "the writer should accept more pairs")
+	require.NoError(t, sw.copy(strings.NewReader(`[{"key":"baz","value":"qux"},{"key":"a","value":"b"},{"key":"c","value":"d"}]`)))
+	assert.False(t, sw.write([]byte("x"), []byte("y")), "the writer should stop at the limit")
+	sw.close()
+
+	assert.Equal(t, `[{"key":"foo","value":"bar"},{"key":"baz","value":"qux"},{"key":"a","value":"b"}]`+"\n", buf.String())
+
+	sw = newPrefixScanWriter(new(bytes.Buffer), 0, false)
+	assert.Error(t, sw.copy(strings.NewReader(`{"key":"foo"}`)), "a response that isn't an array should be an error")
+}
+
+func TestPrefixScanWriterEncoded(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sw := newPrefixScanWriter(buf, 0, true)
+
+	sw.write([]byte("foo"), []byte{0xff, 0x00})
+	require.NoError(t, sw.copy(strings.NewReader(`[{"key":"baz","value":"cXV4"}]`)))
+	sw.close()
+
+	assert.Equal(t, `[{"key":"foo","value":"/wA="},{"key":"baz","value":"cXV4"}]`+"\n", buf.String(),
+		"values should be base64 encoded, and values from peers shouldn't be encoded twice")
+
+	sw = newPrefixScanWriter(new(bytes.Buffer), 0, true)
+	assert.Error(t, sw.copy(strings.NewReader(`[{"key":"baz","value":"not base64!"}]`)), "a value that isn't base64 should be an error")
+}
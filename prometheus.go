@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prometheusPath is where metrics are served in the Prometheus text format,
+// when 'prometheus_enabled' is set.
+const prometheusPath = "/metrics"
+
+// prometheusMetrics keeps the counters that are exported to Prometheus. Gauges
+// are read from the current state of each db when the metrics are scraped.
+type prometheusMetrics struct {
+	requests        map[string]int64
+	proxyRequests   map[string]int64
+	proxyErrors     map[string]int64
+	remoteFallbacks map[string]int64
+
+	lock sync.Mutex
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		requests:        make(map[string]int64),
+		proxyRequests:   make(map[string]int64),
+		proxyErrors:     make(map[string]int64),
+		remoteFallbacks: make(map[string]int64),
+	}
+}
+
+func (m *prometheusMetrics) countRequest(db string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[db]++
+}
+
+func (m *prometheusMetrics) countProxyRequest(db string, err error) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.proxyRequests[db]++
+	if err != nil {
+		m.proxyErrors[db]++
+	}
+}
+
+func (m *prometheusMetrics) countRemoteFallback(db string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.remoteFallbacks[db]++
+}
+
+// servePrometheus writes out all the metrics in the Prometheus text format.
+func (s *sequins) servePrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	s.dbsLock.RLock()
+	dbs := make([]*db, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.dbsLock.RUnlock()
+
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].name < dbs[j].name })
+
+	s.metrics.lock.Lock()
+	writeCounter(w, "sequins_requests_total", "Requests for keys, by database.", s.metrics.requests)
+	writeCounter(w, "sequins_proxy_requests_total", "Requests proxied to peers, by database.", s.metrics.proxyRequests)
+	writeCounter(w, "sequins_proxy_errors_total", "Requests proxied to peers that failed, by database.", s.metrics.proxyErrors)
+	writeCounter(w, "sequins_remote_fallbacks_total", "Requests that fell back to the remote cluster, by database.", s.metrics.remoteFallbacks)
+	s.metrics.lock.Unlock()
+
+	writeHeader(w, "sequins_current_version", "gauge", "Set to 1 for the version of each database currently being served.")
+	for _, db := range dbs {
+		current := db.mux.getCurrent()
+		if current != nil {
+			fmt.Fprintf(w, "sequins_current_version{db=%s,version=%s} 1\n", promLabel(db.name), promLabel(current.name))
+		}
+
+		db.mux.release(current)
+	}
+
+	var versions []*version
+	for _, db := range dbs {
+		all := db.mux.getAll()
+		sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+		versions = append(versions, all...)
+	}
+
+	writeHeader(w, "sequins_version_load_duration_seconds", "gauge", "How long the last load of each version took.")
+	for _, vs := range versions {
+		if d := vs.getLoadDuration(); d != 0 {
+			fmt.Fprintf(w, "sequins_version_load_duration_seconds{db=%s,version=%s} %g\n",
+				promLabel(vs.db.name), promLabel(vs.name), d.Seconds())
+		}
+	}
+
+	writeHeader(w, "sequins_partitions", "gauge", "The number of partitions of each version available locally.")
+	for _, vs := range versions {
+		fmt.Fprintf(w, "sequins_partitions{db=%s,version=%s} %d\n",
+			promLabel(vs.db.name), promLabel(vs.name), vs.partitions.numLocal())
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]int64) {
+	writeHeader(w, name, "counter", help)
+
+	dbs := make([]string, 0, len(values))
+	for db := range values {
+		dbs = append(dbs, db)
+	}
+
+	sort.Strings(dbs)
+	for _, db := range dbs {
+		fmt.Fprintf(w, "%s{db=%s} %d\n", name, promLabel(db), values[db])
+	}
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabel quotes and escapes a label value.
+func promLabel(v string) string {
+	return `"` + promLabelEscaper.Replace(v) + `"`
+}
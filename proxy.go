@@ -12,6 +12,28 @@ import (
 
 const proxyHeader = "X-Sequins-Proxied-To"
 
+// proxiedFlagHeader is set to "true" on responses for keys that were proxied to
+// a peer, and "false" on ones served locally.
+const proxiedFlagHeader = "X-Sequins-Proxied"
+
+// lookupTimeHeader is set to the number of microseconds it took to look up a
+// key, locally or through a peer, if 'lookup_time_header' is set.
+const lookupTimeHeader = "X-Sequins-Lookup-Micros"
+
+// proxyOwnerHeader is set on responses to requests with ?proxy=false for keys
+// that this node doesn't have, listing the peers that would have served them.
+const proxyOwnerHeader = "X-Sequins-Proxy-Owner"
+
+// staleHeader is set to "true" on responses served from a local copy of a
+// partition that was dropped, because no peer had the partition. See
+// 'sharding.stale_serve_window'.
+const staleHeader = "X-Sequins-Stale"
+
+// noProxy is the value of the 'proxy' query parameter that clients can set to
+// only get values this node has locally. Otherwise, the parameter is set by
+// peers, to the version they want.
+const noProxy = "false"
+
 type proxyResponse struct {
 	resp *http.Response
 	peer string
@@ -61,7 +83,7 @@ func (vs *version) proxy(r *http.Request, peers []string) (*http.Response, strin
 			peer := peers[peerIndex]
 
 			attemptCtx, cancelAttempt := context.WithCancel(ctx)
-			req, err := vs.newProxyRequest(attemptCtx, r.URL.Path, peer)
+			req, err := vs.newProxyRequest(attemptCtx, proxyMethod(r), r.URL, peer)
 			if err != nil {
 				cancelAttempt()
 				log.Printf("Error initializing request to peer: %s", err)
@@ -102,14 +124,66 @@ func (vs *version) proxy(r *http.Request, peers []string) (*http.Response, strin
 	return nil, "", errNoAvailablePeers
 }
 
+// proxyWithRetries proxies the request to the given peers, which should all
+// have the partition, like proxy. If none of them can serve it, because they
+// all errored or the proxy timeout was hit, it tries again up to
+// 'proxy_retries' times, each time with a fresh timeout and a fresh list of
+// peers for the partition. Peers that haven't been tried yet go first, since
+// the ones that have may well be down.
+func (vs *version) proxyWithRetries(r *http.Request, partition int, peers []string) (*http.Response, string, error) {
+	resp, peer, err := vs.proxy(r, peers)
+
+	tried := make(map[string]bool)
+	for retry := 0; retry < vs.sequins.config.Sharding.ProxyRetries; retry++ {
+		if err != errNoAvailablePeers && err != errProxyTimeout {
+			break
+		}
+
+		for _, p := range peers {
+			tried[p] = true
+		}
+
+		peers = untriedFirst(vs.candidatePeers(partition), tried)
+		if len(peers) == 0 {
+			break
+		}
+
+		log.Printf("Retrying proxied request for %s after error: %s", r.URL.Path, err)
+		resp, peer, err = vs.proxy(r, peers)
+	}
+
+	return resp, peer, err
+}
+
+// untriedFirst reorders peers so that any that aren't in tried come first,
+// otherwise preserving the order.
+func untriedFirst(peers []string, tried map[string]bool) []string {
+	reordered := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if !tried[p] {
+			reordered = append(reordered, p)
+		}
+	}
+
+	for _, p := range peers {
+		if tried[p] {
+			reordered = append(reordered, p)
+		}
+	}
+
+	return reordered
+}
+
 func (vs *version) proxyAttempt(proxyRequest *http.Request, peer string, res chan proxyResponse) {
-	resp, err := http.DefaultClient.Do(proxyRequest)
+	resp, err := vs.sequins.peerClient().Do(proxyRequest)
 	if err != nil {
 		res <- proxyResponse{nil, peer, err}
 		return
 	}
 
-	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+	// A 413 means the value is larger than 'max_value_size', which every peer
+	// should agree on.
+	if resp.StatusCode != 200 && resp.StatusCode != 404 && resp.StatusCode != http.StatusRequestEntityTooLarge {
 		resp.Body.Close()
 		res <- proxyResponse{nil, peer, fmt.Errorf("got %d", resp.StatusCode)}
 		return
@@ -118,17 +192,48 @@ func (vs *version) proxyAttempt(proxyRequest *http.Request, peer string, res cha
 	res <- proxyResponse{resp, peer, nil}
 }
 
+// proxiedVersion returns the version a peer asked for, if the request was
+// proxied from one, and an empty string otherwise.
+func proxiedVersion(r *http.Request) string {
+	v := r.URL.Query().Get("proxy")
+	if v == noProxy {
+		return ""
+	}
+
+	return v
+}
+
+// proxyDisabled returns true if the client asked for the request not to be
+// proxied, with ?proxy=false.
+func proxyDisabled(r *http.Request) bool {
+	return r.URL.Query().Get("proxy") == noProxy
+}
+
+// proxyMethod returns the method to use for requests to peers on behalf of r.
+// HEAD requests are passed on as-is, so that the value isn't sent over the
+// network; everything else is a GET.
+func proxyMethod(r *http.Request) string {
+	if r.Method == "HEAD" {
+		return "HEAD"
+	}
+
+	return "GET"
+}
+
 // newProxyRequest creates a fresh request, to avoid passing on baggage like
-// 'Connection: close' headers.
-func (vs *version) newProxyRequest(ctx context.Context, path, peer string) (*http.Request, error) {
+// 'Connection: close' headers. The path and query are kept, with 'proxy' set
+// to the version.
+func (vs *version) newProxyRequest(ctx context.Context, method string, u *url.URL, peer string) (*http.Request, error) {
+	query := u.Query()
+	query.Set("proxy", vs.name)
 	url := &url.URL{
-		Scheme:   "http",
+		Scheme:   vs.sequins.peerScheme(),
 		Host:     peer,
-		Path:     path,
-		RawQuery: fmt.Sprintf("proxy=%s", vs.name),
+		Path:     u.Path,
+		RawQuery: query.Encode(),
 	}
 
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := http.NewRequest(method, url.String(), nil)
 	if err != nil {
 		return req, err
 	}
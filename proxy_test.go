@@ -7,11 +7,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/sequins/blocks"
 )
 
 var proxyTestVersion = &version{
@@ -101,6 +105,24 @@ func TestProxyErrorPeer(t *testing.T) {
 	assert.Equal(t, "all good\n", readAll(t, res.Body))
 }
 
+func TestProxyTooLargePeer(t *testing.T) {
+	tooLargePeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(413)
+	}))
+
+	notReachedPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Fail(t, "a 413 should be returned without trying another peer")
+	}))
+
+	peers := []string{httptestHost(tooLargePeer), httptestHost(notReachedPeer)}
+	r, _ := http.NewRequest("GET", "http://localhost", nil)
+	res, peer, err := proxyTestVersion.proxy(r, peers)
+
+	require.NoError(t, err, "a 413 from a peer should be returned")
+	assert.Equal(t, 413, res.StatusCode, "a 413 from a peer should be returned")
+	assert.Equal(t, httptestHost(tooLargePeer), peer, "the returned peer should be correct")
+}
+
 func TestProxySlowPeerErrorPeer(t *testing.T) {
 	slowPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(15 * time.Millisecond)
@@ -165,3 +187,213 @@ func TestProxyErrors(t *testing.T) {
 	assert.Nil(t, res, "proxying should return errNoAvailablePeers if all error")
 	assert.Equal(t, "", peer, "peer should be empty if proxying timed out")
 }
+
+func TestProxyRetries(t *testing.T) {
+	deadPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadPeer.Close()
+
+	goodPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "all good")
+	}))
+
+	vs := &version{
+		name: "foo",
+		sequins: &sequins{
+			config: sequinsConfig{
+				Sharding: shardingConfig{
+					ProxyTimeout:      duration{30 * time.Millisecond},
+					ProxyStageTimeout: duration{10 * time.Millisecond},
+				},
+			},
+		},
+		partitions: &partitions{
+			peers:  &peers{},
+			remote: map[int][]string{0: {httptestHost(deadPeer), httptestHost(goodPeer)}},
+		},
+	}
+
+	// The list of peers we start with is stale, and only has the dead peer.
+	peers := []string{httptestHost(deadPeer)}
+	r, _ := http.NewRequest("GET", "http://localhost", nil)
+	res, _, err := vs.proxyWithRetries(r, 0, peers)
+	assert.Equal(t, errNoAvailablePeers, err, "proxying shouldn't be retried if proxy_retries is 0")
+	assert.Nil(t, res)
+
+	vs.sequins.config.Sharding.ProxyRetries = 1
+	res, peer, err := vs.proxyWithRetries(r, 0, peers)
+	require.NoError(t, err, "proxying should be retried with the other replica")
+	require.NotNil(t, res, "proxying should be retried with the other replica")
+
+	assert.Equal(t, httptestHost(goodPeer), peer, "the returned peer should be correct")
+	assert.Equal(t, "all good\n", readAll(t, res.Body))
+}
+
+func TestProxyHead(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HEAD", r.Method, "a HEAD should be proxied as a HEAD")
+		w.Header().Set("Content-Length", "8")
+	}))
+	defer peer.Close()
+
+	vs := &version{
+		name: "foo",
+		sequins: &sequins{
+			config: sequinsConfig{
+				Sharding: shardingConfig{
+					ProxyTimeout:      duration{100 * time.Millisecond},
+					ProxyStageTimeout: duration{100 * time.Millisecond},
+				},
+			},
+		},
+	}
+
+	r, _ := http.NewRequest("HEAD", "http://localhost/db/key", nil)
+	res, _, err := vs.proxy(r, []string{httptestHost(peer)})
+	require.NoError(t, err, "proxying a HEAD should succeed")
+	defer res.Body.Close()
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(8), res.ContentLength, "the value length should be passed on")
+}
+
+func TestProxyDisabled(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(tmpDir)
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request shouldn't be proxied")
+	}))
+	defer peer.Close()
+
+	vs := &version{
+		name:          "foo",
+		db:            &db{name: "db"},
+		sequins:       proxyTestVersion.sequins,
+		numPartitions: 1,
+		blockStore:    blocks.New(tmpDir, 1, blocks.NoCompression, 8192, nil, blocks.KeyPrefix{}, blocks.JavaHash),
+		partitions: &partitions{
+			peers:  &peers{},
+			local:  map[int]bool{},
+			remote: map[int][]string{0: {httptestHost(peer)}},
+		},
+	}
+
+	r, _ := http.NewRequest("GET", "/db/key?proxy=false", nil)
+	w := httptest.NewRecorder()
+	vs.serveKey(w, r, "key")
+
+	assert.Equal(t, 404, w.Code, "keys in partitions this node doesn't have should 404")
+	assert.Equal(t, httptestHost(peer), w.HeaderMap.Get(proxyOwnerHeader), "the peer with the partition should be named")
+	assert.Equal(t, "", proxiedVersion(r), "proxy=false shouldn't look like a request from a peer")
+}
+
+func TestProxyHeaders(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sequins-test-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(tmpDir)
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(versionHeader, "foo")
+		w.Header().Set(proxiedFlagHeader, "false")
+		fmt.Fprint(w, "value")
+	}))
+	defer peer.Close()
+
+	s := &sequins{
+		config: sequinsConfig{
+			LookupTimeHeader: true,
+			Sharding: shardingConfig{
+				ProxyTimeout:      duration{100 * time.Millisecond},
+				ProxyStageTimeout: duration{100 * time.Millisecond},
+			},
+		},
+	}
+
+	vs := &version{
+		name:          "foo",
+		db:            &db{name: "db", sequins: s},
+		sequins:       s,
+		numPartitions: 1,
+		blockStore:    blocks.New(tmpDir, 1, blocks.NoCompression, 8192, nil, blocks.KeyPrefix{}, blocks.JavaHash),
+		partitions: &partitions{
+			peers:  &peers{},
+			local:  map[int]bool{},
+			remote: map[int][]string{0: {httptestHost(peer)}},
+		},
+	}
+
+	r, _ := http.NewRequest("GET", "/db/key", nil)
+	w := httptest.NewRecorder()
+	vs.serveKey(w, r, "key")
+
+	require.Equal(t, 200, w.Code, "the key should be proxied")
+	assert.Equal(t, "value", w.Body.String())
+	assert.Equal(t, "true", w.HeaderMap.Get(proxiedFlagHeader), "the response should be marked as proxied")
+	assert.Equal(t, httptestHost(peer), w.HeaderMap.Get(proxyHeader), "the peer should be named")
+
+	micros, err := strconv.Atoi(w.HeaderMap.Get(lookupTimeHeader))
+	require.NoError(t, err, "the lookup time should be set")
+	assert.True(t, micros >= 0)
+
+	vs.sequins.config.LookupTimeHeader = false
+	w = httptest.NewRecorder()
+	vs.serveKey(w, r, "key")
+	assert.Equal(t, "", w.HeaderMap.Get(lookupTimeHeader), "the lookup time should only be set if enabled")
+}
+
+func TestUntriedFirst(t *testing.T) {
+	peers := []string{"a", "b", "c", "d"}
+	tried := map[string]bool{"a": true, "c": true}
+	assert.Equal(t, []string{"b", "d", "a", "c"}, untriedFirst(peers, tried))
+}
+
+func TestProxyRemoteFallback(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEqual(t, "", r.Header.Get(failoverHeader), "requests to the remote cluster should be marked")
+		assert.Equal(t, "/db/key", r.URL.Path, "the remote cluster should get the original path")
+		fmt.Fprintln(w, "all good, from far away")
+	}))
+
+	errorRemote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+
+	vs := &version{
+		name: "foo",
+		db:   &db{name: "db"},
+		sequins: &sequins{
+			config: sequinsConfig{
+				Sharding: shardingConfig{ClusterName: "sequins"},
+				Failover: failoverConfig{
+					RemoteCluster: remote.URL,
+					Timeout:       duration{time.Second},
+				},
+			},
+			metrics: newPrometheusMetrics(),
+		},
+	}
+
+	vs.sequins.initPeerClient()
+
+	r, _ := http.NewRequest("GET", "http://localhost/db/key", nil)
+	res, peer, err := vs.fallBack(r, "key", nil, "", errProxyTimeout)
+	require.NoError(t, err, "falling back to the remote cluster should work")
+	require.NotNil(t, res, "falling back to the remote cluster should work")
+
+	assert.Equal(t, httptestHost(remote), peer, "the returned peer should be the remote cluster")
+	assert.Equal(t, "all good, from far away\n", readAll(t, res.Body))
+	assert.EqualValues(t, 1, vs.sequins.metrics.remoteFallbacks["db"], "the fallback should be counted")
+
+	_, _, err = vs.fallBack(r, "key", nil, "", errRequestCanceled)
+	assert.Equal(t, errRequestCanceled, err, "canceled requests shouldn't fall back")
+
+	r.Header.Set(failoverHeader, "other")
+	_, _, err = vs.fallBack(r, "key", nil, "", errNoAvailablePeers)
+	assert.Equal(t, errNoAvailablePeers, err, "requests from another cluster shouldn't fall back again")
+
+	vs.sequins.config.Failover.RemoteCluster = errorRemote.URL
+	r.Header.Del(failoverHeader)
+	_, _, err = vs.fallBack(r, "key", nil, "", errNoAvailablePeers)
+	assert.Equal(t, errNoAvailablePeers, err, "if the remote cluster fails, the original error should be returned")
+}
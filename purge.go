@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// storedVersionsPrefix is the prefix for admin actions on the versions in local
+// storage, like DELETE /db/versions/<version>.
+const storedVersionsPrefix = "versions/"
+
+var (
+	errVersionInUse     = errors.New("version is in use")
+	errVersionNotStored = errors.New("version isn't stored locally")
+)
+
+// serveDeleteVersion handles DELETE /db/versions/<version>, which deletes a
+// version from local storage to reclaim disk space. It returns a 409 if the
+// version is still in use, here or anywhere else in the cluster.
+func (db *db) serveDeleteVersion(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := db.deleteStoredVersion(name)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errVersionInUse:
+		w.WriteHeader(http.StatusConflict)
+	case errVersionNotStored:
+		w.WriteHeader(http.StatusNotFound)
+	case errReadOnlyStore:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		log.Printf("Error deleting version %s of %s: %s", name, db.name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// deleteStoredVersion deletes the local copy of a version, as long as this node
+// isn't serving, loading, or removing it, and no node in the cluster is still
+// advertising partitions for it.
+func (db *db) deleteStoredVersion(name string) error {
+	// Hold the refresh lock, so that we don't start loading the version while
+	// we're deleting it.
+	db.refreshLock.Lock()
+	defer db.refreshLock.Unlock()
+
+	if db.sequins.config.ReadOnlyStore {
+		return errReadOnlyStore
+	}
+
+	vs := db.mux.getVersion(name)
+	db.mux.release(vs)
+	if vs != nil || db.isRemoving(name) {
+		return errVersionInUse
+	}
+
+	if db.coordinator() != nil {
+		nodes, err := db.coordinator().children(path.Join("partitions", db.name, name))
+		if err != nil {
+			return err
+		} else if len(nodes) > 0 {
+			return errVersionInUse
+		}
+	}
+
+	localPath := db.localPath(name)
+	if _, err := os.Stat(localPath); os.IsNotExist(err) {
+		return errVersionNotStored
+	} else if err != nil {
+		return err
+	}
+
+	logEvent(logFields{DB: db.name, Version: name, Event: "version_deleted"},
+		"Deleting version %s of %s from local storage", name, db.name)
+	return os.RemoveAll(localPath)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle per-client buckets are cleaned up.
+const rateLimitSweepInterval = time.Minute
+
+// A rateLimiter is a token bucket limiting the rate of reads, either for the
+// whole node, or separately for each client IP. Each bucket holds up to a
+// second's worth of requests, so short bursts are allowed.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	perIP   bool
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, perIP bool) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   math.Max(rate, 1),
+		perIP:   perIP,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket for the request, if there is one. If
+// not, it returns false, along with how long until there will be.
+func (rl *rateLimiter) allow(r *http.Request, now time.Time) (bool, time.Duration) {
+	key := ""
+	if rl.perIP {
+		key = clientIP(r)
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if now.Sub(rl.swept) > rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	b := rl.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, updated: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = rl.refill(b, now)
+	b.updated = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(rl.burst, b.tokens+now.Sub(b.updated).Seconds()*rl.rate)
+}
+
+// sweep removes any buckets that have refilled completely, since they're no
+// different from new ones.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+
+	rl.swept = now
+}
+
+// clientIP returns the IP the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// checkRateLimit returns true if the request should be served. If
+// 'max_requests_per_second' is set and the limit has been reached, it instead
+// writes a 429 with a Retry-After header and returns false. Requests from
+// peers are never limited, since the client was already counted by the peer
+// that proxied them. Only the peer secret proves that a request came from a
+// peer; the proxy parameter alone can be set by anyone.
+func (s *sequins) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter == nil || s.isPeerRequest(r) {
+		return true
+	}
+
+	ok, wait := s.limiter.allow(r, time.Now())
+	if ok {
+		return true
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	setErrorCode(w, codeRateLimited)
+	w.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, false)
+	now := time.Now()
+
+	a, _ := http.NewRequest("GET", "/foo/bar", nil)
+	a.RemoteAddr = "10.0.0.1:1234"
+	b, _ := http.NewRequest("GET", "/foo/bar", nil)
+	b.RemoteAddr = "10.0.0.2:1234"
+
+	ok, _ := rl.allow(a, now)
+	assert.True(t, ok, "the first request should be allowed")
+	ok, _ = rl.allow(b, now)
+	assert.True(t, ok, "the second request should be allowed")
+
+	ok, wait := rl.allow(a, now)
+	assert.False(t, ok, "the third request should be limited")
+	assert.Equal(t, 500*time.Millisecond, wait, "the wait should be until the next token")
+
+	ok, _ = rl.allow(a, now.Add(500*time.Millisecond))
+	assert.True(t, ok, "a request should be allowed once the bucket refills")
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+	rl := newRateLimiter(1, true)
+	now := time.Now()
+
+	a, _ := http.NewRequest("GET", "/foo/bar", nil)
+	a.RemoteAddr = "10.0.0.1:1234"
+	b, _ := http.NewRequest("GET", "/foo/bar", nil)
+	b.RemoteAddr = "10.0.0.2:1234"
+
+	ok, _ := rl.allow(a, now)
+	assert.True(t, ok, "the first request from a should be allowed")
+	ok, _ = rl.allow(a, now)
+	assert.False(t, ok, "the second request from a should be limited")
+	ok, _ = rl.allow(b, now)
+	assert.True(t, ok, "the first request from b should be allowed")
+
+	rl.sweep(now.Add(time.Second))
+	assert.Empty(t, rl.buckets, "full buckets should be swept")
+}
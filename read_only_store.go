@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/stripe/sequins/backend"
+	"github.com/stripe/sequins/blocks"
+)
+
+var errReadOnlyStore = errors.New("the local store is read-only")
+
+// A storeBackend is the source for a node with 'read_only_store' set. It lists
+// the dbs and versions that another sequins process, sharing the same local
+// store, has finished loading. Versions are always loaded from their manifests,
+// so nothing is ever read from the backend itself.
+type storeBackend struct {
+	*backend.LocalBackend
+	path string
+}
+
+func newStoreBackend(localStore string) *storeBackend {
+	path := filepath.Join(localStore, "data")
+	return &storeBackend{
+		LocalBackend: backend.NewLocalBackend(path),
+		path:         path,
+	}
+}
+
+// ListVersions only lists versions with a manifest. The loading process writes
+// the manifest last, so this skips versions that are still being loaded. The
+// success file is never checked, since it only exists in the real source.
+func (sb *storeBackend) ListVersions(db, after string, checkForSuccessFile bool) ([]string, error) {
+	versions, err := sb.LocalBackend.ListVersions(db, after, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, version := range versions {
+		if _, err := blocks.ReadManifest(filepath.Join(sb.path, db, version)); err == nil {
+			res = append(res, version)
+		}
+	}
+
+	return res, nil
+}
+
+// ListFiles returns nothing, since versions aren't loaded from files.
+func (sb *storeBackend) ListFiles(db, version string) ([]string, error) {
+	return nil, nil
+}
+
+// storedPartitions returns the number of partitions in the copy of a version in
+// the local store.
+func storedPartitions(path string) (int, error) {
+	manifest, err := blocks.ReadManifest(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return manifest.NumPartitions, nil
+}
+
+// initReadOnlyBlockStore loads the version from its manifest, like
+// initBlockStore, but without ever discarding or creating anything.
+func (vs *version) initReadOnlyBlockStore(path string) error {
+	blockStore, manifest, err := blocks.NewFromManifest(path)
+	if err != nil {
+		return err
+	}
+
+	have := make(map[int]bool)
+	for _, partition := range manifest.SelectedPartitions {
+		have[partition] = true
+	}
+
+	vs.partitions.updateLocalPartitions(have)
+	vs.blockStore = blockStore
+	vs.advise()
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+)
+
+// sampleReadRepair returns true if a read should be cross-checked against
+// another replica, according to 'sharding.read_repair_sample_rate'.
+func (vs *version) sampleReadRepair() bool {
+	rate := vs.sequins.config.Sharding.ReadRepairSampleRate
+	return rate > 0 && vs.sequins.peers != nil && rand.Float64() < rate
+}
+
+// readRepair fetches a key that was just served locally from a peer with the
+// same partition, and compares the two values. If they don't match, it logs
+// the disagreement, and, if configured to, reloads the local copy of the
+// partition from the source. It's only diagnostic; the response to the client
+// has already been sent.
+func (vs *version) readRepair(r *http.Request, key string, partition int) {
+	peers := shuffle(vs.partitions.getPeers(partition))
+	if len(peers) == 0 {
+		return
+	}
+
+	local, localFound, err := vs.readLocal(key)
+	if err != nil {
+		log.Printf("Error reading /%s/%s (version %s) for read repair: %s", vs.db.name, key, vs.name, err)
+		return
+	}
+
+	resp, peer, err := vs.proxy(r.WithContext(context.Background()), peers)
+	if err != nil {
+		log.Printf("Error fetching /%s/%s (version %s) from peers for read repair: %s", vs.db.name, key, vs.name, err)
+		return
+	}
+
+	defer resp.Body.Close()
+	remote, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error fetching /%s/%s (version %s) from %s for read repair: %s", vs.db.name, key, vs.name, peer, err)
+		return
+	} else if resp.Header.Get(versionHeader) != vs.name {
+		return
+	}
+
+	remoteFound := resp.StatusCode == http.StatusOK
+	mismatch := localFound != remoteFound || !bytes.Equal(local, remote)
+	if expStats != nil {
+		expStats.incrReadRepair(mismatch)
+	}
+
+	if !mismatch {
+		return
+	}
+
+	log.Printf("Read repair: the value for /%s/%s (version %s) doesn't match the value on %s (found locally: %t, found on peer: %t)",
+		vs.db.name, key, vs.name, peer, localFound, remoteFound)
+
+	if vs.sequins.config.Sharding.ReadRepairReload {
+		vs.reloadPartition(partition, "a read repair mismatch")
+	}
+}
+
+// readLocal reads the whole value for a key from the local block store.
+func (vs *version) readLocal(key string) ([]byte, bool, error) {
+	record, err := vs.blockStore.Get(key)
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+
+	defer record.Close()
+	value, err := ioutil.ReadAll(record)
+	return value, true, err
+}
+
+// reloadPartition discards the local copy of a partition, and then loads it
+// again from the source. In the meantime, requests for the partition are
+// proxied to peers. Each partition is only reloaded once per version, so that
+// a persistent disagreement doesn't cause a reload loop.
+func (vs *version) reloadPartition(partition int, reason string) {
+	vs.stateLock.Lock()
+	if vs.repaired == nil {
+		vs.repaired = make(map[int]bool)
+	}
+
+	if vs.repaired[partition] {
+		vs.stateLock.Unlock()
+		return
+	}
+
+	vs.repaired[partition] = true
+	vs.stateLock.Unlock()
+
+	log.Printf("Reloading partition %d of %s version %s after %s", partition, vs.db.name, vs.name, reason)
+	vs.partitions.dropLocalPartition(partition)
+	vs.blockStore.DropPartition(partition)
+	vs.dropCachedValues()
+	vs.rebuild()
+}
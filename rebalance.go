@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// watchMembership waits for the set of peers to change, and then once it has
+// settled, rebalances the versions we already have.
+func (s *sequins) watchMembership() {
+	for range s.peers.changes {
+		s.peers.waitToConverge(s.config.Sharding.TimeToConverge.Duration)
+		s.rebalanceAll()
+	}
+}
+
+// rebalanceAll reassigns the partitions of every version across the current
+// set of peers, and loads any partitions newly assigned to this node. To avoid
+// every node hammering the backend at once after a scale-up, versions are
+// loaded one at a time, waiting for sharding.rebalance_throttle in between
+// (and for a random fraction of it before the first one).
+func (s *sequins) rebalanceAll() {
+	var versions []*version
+
+	s.dbsLock.RLock()
+	for _, db := range s.dbs {
+		drained := db.getDrained()
+		for _, vs := range db.mux.getAll() {
+			if vs.partitions.repick(drained) {
+				vs.setRebalancing(true)
+				versions = append(versions, vs)
+			}
+		}
+	}
+	s.dbsLock.RUnlock()
+
+	if len(versions) == 0 {
+		return
+	}
+
+	log.Println("Rebalancing", len(versions), "versions after the list of peers changed")
+	throttle := s.config.Sharding.RebalanceThrottle.Duration
+	for i, vs := range versions {
+		if throttle != 0 {
+			wait := throttle
+			if i == 0 {
+				wait = time.Duration(rand.Int63n(int64(throttle)))
+			}
+
+			time.Sleep(wait)
+		}
+
+		vs.rebuild()
+		vs.setRebalancing(false)
+	}
+
+	log.Println("Finished rebalancing", len(versions), "versions")
+}
+
+// rebuild loads any partitions which were assigned to the version after it was
+// first built.
+func (vs *version) rebuild() {
+	vs.buildLock.Lock()
+	vs.built = false
+	vs.buildLock.Unlock()
+
+	vs.build()
+}
+
+func (vs *version) setRebalancing(rebalancing bool) {
+	vs.stateLock.Lock()
+	defer vs.stateLock.Unlock()
+
+	vs.rebalancing = rebalancing
+}
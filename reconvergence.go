@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// With reconvergenceServe, requests are served from the node's current view
+	// of the cluster, even while it's changing.
+	reconvergenceServe = "serve"
+
+	// With reconvergenceRetry, requests that arrive while the list of peers is
+	// still settling get a 503 with a Retry-After header instead.
+	reconvergenceRetry = "retry"
+)
+
+// converged returns whether the list of peers has been stable for at least
+// sharding.time_to_converge.
+func (s *sequins) converged() bool {
+	if s.peers == nil {
+		return true
+	}
+
+	return s.peers.untilConverged(s.config.Sharding.TimeToConverge.Duration) == 0
+}
+
+// checkConverged returns true if the request should be served. If the node is
+// configured to turn requests away while the cluster is reconverging, and it
+// currently is, it instead writes a 503 with a Retry-After header and returns
+// false. Proxied requests are always served, since the peer has already
+// decided that we're responsible for the key.
+func (s *sequins) checkConverged(w http.ResponseWriter, r *http.Request) bool {
+	if s.peers == nil || s.config.Sharding.Reconvergence != reconvergenceRetry ||
+		proxiedVersion(r) != "" {
+		return true
+	}
+
+	remaining := s.peers.untilConverged(s.config.Sharding.TimeToConverge.Duration)
+	if remaining == 0 {
+		return true
+	}
+
+	seconds := int(math.Ceil(remaining.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	setErrorCode(w, codeNotConverged)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return false
+}
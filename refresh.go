@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// refreshPath triggers a refresh of every db, like sending a SIGHUP.
+const refreshPath = "/_refresh"
+
+// serveRefresh handles POST /_refresh. The refresh happens in the background,
+// so this returns immediately. Like the admin actions on a db, it needs one of
+// the 'admin_tokens', if they're set; peers it's passed on to get the peer
+// secret instead.
+func (s *sequins) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("Refreshing all dbs, triggered by request from", r.RemoteAddr)
+	go s.refreshAll()
+	if proxiedVersion(r) == "" {
+		s.refreshPeers(refreshPath)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveRefresh handles POST /<db>/_refresh, which is like POST /_refresh, but
+// only checks the one db for new versions.
+func (db *db) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("Refreshing", db.name, "triggered by request from", r.RemoteAddr)
+	go func() {
+		err := db.refresh()
+		if err != nil {
+			log.Printf("Error refreshing %s: %s", db.name, err)
+		}
+	}()
+
+	if proxiedVersion(r) == "" && db.peers() != nil {
+		db.sequins.refreshPeers(fmt.Sprintf("/%s/_refresh", db.name))
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// refreshPeers asynchronously passes a refresh request on to every peer, so
+// that a single request refreshes the whole cluster. Peers need to see a new
+// version before any of them can switch to it.
+func (s *sequins) refreshPeers(path string) {
+	if s.peers == nil {
+		return
+	}
+
+	for _, peer := range s.peers.getAll() {
+		go func(peer string) {
+			url := fmt.Sprintf("%s://%s%s?proxy=refresh", s.peerScheme(), peer, path)
+			resp, err := s.peerClient().Post(url, "", nil)
+			if err != nil {
+				log.Printf("Error triggering a refresh on peer %s: %s", peer, err)
+				return
+			}
+
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				log.Printf("Error triggering a refresh on peer %s: got %d", peer, resp.StatusCode)
+			}
+		}(peer)
+	}
+}
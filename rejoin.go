@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// rejoinPath makes a node leave the cluster and join it again, recomputing
+// which partitions it's responsible for from scratch.
+const rejoinPath = "/_rejoin"
+
+// serveRejoin handles POST /_rejoin. This node stops advertising itself and its
+// partitions, waits for in-flight reads to finish, and then registers again.
+// It's an escape hatch for when a node's view of the cluster gets into a bad
+// state, which would otherwise take a restart to fix. The rejoin happens in
+// the background, so this returns immediately. It needs one of the
+// 'admin_tokens', if they're set.
+func (s *sequins) serveRejoin(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r) {
+		return
+	}
+
+	// Rejoining only makes sense in a cluster.
+	if s.peers == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("Rejoining the cluster, triggered by request from", r.RemoteAddr)
+	go s.rejoin()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// rejoin deregisters this node, waits up to 'shutdown_timeout' for in-flight
+// reads to finish, and then registers it again. Every version picks its
+// partitions again, and builds any new ones; the versions that were advertising
+// their partitions before start again once they're picked.
+func (s *sequins) rejoin() {
+	s.rejoinLock.Lock()
+	defer s.rejoinLock.Unlock()
+
+	var advertised []*version
+	s.dbsLock.RLock()
+	for _, db := range s.dbs {
+		for _, vs := range db.mux.getAll() {
+			if vs.partitions.advertising() {
+				advertised = append(advertised, vs)
+			}
+		}
+	}
+
+	s.dbsLock.RUnlock()
+	s.deregister()
+
+	if !s.waitForReads(s.config.ShutdownTimeout.Duration) {
+		log.Println("Gave up waiting for in-flight reads to finish before rejoining")
+	}
+
+	s.peers.register()
+
+	s.dbsLock.RLock()
+	for _, db := range s.dbs {
+		drained := db.getDrained()
+		for _, vs := range db.mux.getAll() {
+			vs.rebalance(drained)
+		}
+	}
+
+	s.dbsLock.RUnlock()
+	for _, vs := range advertised {
+		vs.partitions.advertisePartitions()
+	}
+
+	log.Println("Rejoined the cluster")
+}
+
+// startRead counts a read as in-flight until the returned function is called.
+func (s *sequins) startRead() func() {
+	atomic.AddInt64(&s.readsInFlight, 1)
+	return func() {
+		atomic.AddInt64(&s.readsInFlight, -1)
+	}
+}
+
+// waitForReads waits for there to be no in-flight reads, returning false if
+// there still are after the timeout.
+func (s *sequins) waitForReads(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.readsInFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
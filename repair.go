@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// repairSuffix is the suffix for the admin action that repairs a version, like
+// POST /db/versions/<version>/_repair.
+const repairSuffix = "/_repair"
+
+// serveRepairVersion handles POST /db/versions/<version>/_repair, which loads
+// the local partitions of a version again from the source, in the background.
+// The existing copy keeps being served until the new one is ready, and then
+// it's swapped in. It returns a 404 if the version isn't loaded on this node,
+// and a 409 if it's already being repaired.
+func (db *db) serveRepairVersion(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if name == "" || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if db.sequins.config.ReadOnlyStore {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	vs := db.mux.getVersion(name)
+	if vs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !vs.startRepair() {
+		db.mux.release(vs)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	log.Println("Repairing version", name, "of", db.name, "triggered by request from", r.RemoteAddr)
+	go func() {
+		defer db.mux.release(vs)
+		vs.repair()
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// startRepair marks the version as being repaired, and returns false if it
+// already was.
+func (vs *version) startRepair() bool {
+	vs.stateLock.Lock()
+	defer vs.stateLock.Unlock()
+
+	if vs.repairing {
+		return false
+	}
+
+	vs.repairing = true
+	return true
+}
+
+// repair builds a fresh copy of the version's local partitions, alongside the
+// existing one, and then swaps it in. Unlike reloadPartition, nothing is
+// dropped in the meantime, so requests are still served from the existing
+// copy, even if it's corrupt. If the repair fails, the existing copy is kept.
+func (vs *version) repair() {
+	defer func() {
+		vs.stateLock.Lock()
+		vs.repairing = false
+		vs.stateLock.Unlock()
+	}()
+
+	// Hold the same locks as a build, so that nothing else writes to the
+	// version's directory in the meantime.
+	vs.buildLock.Lock()
+	defer vs.buildLock.Unlock()
+	if vs.sequins.buildLock != nil {
+		vs.sequins.buildLock.Lock()
+		defer vs.sequins.buildLock.Unlock()
+	}
+
+	defer vs.releaseSource()
+
+	partitions := make(map[int]bool)
+	for _, partition := range vs.partitions.getLocal() {
+		partitions[partition] = true
+	}
+
+	if len(partitions) == 0 {
+		log.Printf("Not repairing version %s of %s, since it has no local partitions", vs.name, vs.db.name)
+		return
+	}
+
+	logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_repairing"},
+		"Repairing %d partitions of %s version %s from %s",
+		len(partitions), vs.db.name, vs.name, vs.sequins.backend.DisplayPath(vs.db.name, vs.name))
+
+	// The fresh copy is built by a version that shares everything but the block
+	// store. Its blocks go in the same directory, next to the existing ones.
+	repaired := &version{
+		sequins:       vs.sequins,
+		db:            vs.db,
+		path:          vs.path,
+		name:          vs.name,
+		files:         vs.files,
+		metadataFiles: vs.metadataFiles,
+		checksumFiles: vs.checksumFiles,
+		numPartitions: vs.numPartitions,
+		partitions:    vs.partitions,
+		cancel:        vs.cancel,
+	}
+
+	repaired.blockStore = vs.newBlockStore()
+	err := repaired.addFilesWithRetries(partitions)
+	if err != nil {
+		repaired.blockStore.Discard()
+		if err != errCanceled {
+			logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_repair_failed"},
+				"Error repairing version %s of %s, still serving the existing copy: %s", vs.name, vs.db.name, err)
+		}
+
+		return
+	}
+
+	vs.blockStore.Replace(repaired.blockStore)
+	vs.dropCachedValues()
+	vs.advise()
+
+	vs.stateLock.Lock()
+	vs.integrity = integrityState{}
+	vs.repaired = nil
+	vs.stateLock.Unlock()
+
+	logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_repaired"},
+		"Repaired version %s of %s", vs.name, vs.db.name)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+var errEmptyRing = errors.New("no members on the hashring")
+
+// hashring assigns names, like partition ids, to members, like shards, such
+// that adding or removing a member only moves the names that hash nearest to
+// it.
+type hashring interface {
+	Set(members []string)
+	Members() []string
+	GetN(name string, n int) ([]string, error)
+}
+
+// virtualNodeRing is a consistent hashing ring which places each member at
+// virtualNodes points, using a well-distributed hash. It's used instead of the
+// default ring when 'sharding.virtual_nodes' is set, since the default ring
+// hashes with CRC32, which places the points for different members (and
+// similar partition ids) close together. That makes the assignments uneven,
+// and means that far more than 1/N of the partitions move when a node joins or
+// leaves.
+type virtualNodeRing struct {
+	virtualNodes int
+	members      []string
+	points       []uint64
+	owners       map[uint64]string
+}
+
+func newVirtualNodeRing(virtualNodes int) *virtualNodeRing {
+	return &virtualNodeRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint64]string),
+	}
+}
+
+func (r *virtualNodeRing) Set(members []string) {
+	r.members = make([]string, len(members))
+	copy(r.members, members)
+	sort.Strings(r.members)
+
+	r.points = make([]uint64, 0, len(members)*r.virtualNodes)
+	r.owners = make(map[uint64]string, len(members)*r.virtualNodes)
+	for _, member := range r.members {
+		for i := 0; i < r.virtualNodes; i++ {
+			point := ringHash(member + "#" + strconv.Itoa(i))
+
+			// Collisions are vanishingly unlikely, but every node has to resolve
+			// them the same way. Members are added in sorted order, so the first
+			// one wins.
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+
+			r.owners[point] = member
+			r.points = append(r.points, point)
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *virtualNodeRing) Members() []string {
+	return r.members
+}
+
+// GetN returns the first n distinct members found walking clockwise around the
+// ring from the name's hash.
+func (r *virtualNodeRing) GetN(name string, n int) ([]string, error) {
+	if len(r.points) == 0 {
+		return nil, errEmptyRing
+	}
+
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+
+	hash := ringHash(name)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+
+	res := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(r.points) && len(res) < n; i++ {
+		member := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[member] {
+			seen[member] = true
+			res = append(res, member)
+		}
+	}
+
+	return res, nil
+}
+
+func ringHash(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
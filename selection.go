@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// With versionSelectionName, the current version is the one that sorts last
+	// by name.
+	versionSelectionName = "name"
+
+	// With versionSelectionMtime, the current version is the one that was most
+	// recently modified in the backend.
+	versionSelectionMtime = "mtime"
+
+	// With versionSelectionPointer, the current version is the one named in a
+	// pointer file at the root of the db.
+	versionSelectionPointer = "pointer"
+)
+
+// versionPointerFile is the name of the pointer file used with
+// versionSelectionPointer.
+const versionPointerFile = "_CURRENT"
+
+// requireSuccessFile returns whether versions of the db need a _SUCCESS file
+// to be loaded. The per-db setting, if there is one, overrides the global one.
+func (db *db) requireSuccessFile() bool {
+	if db.config.RequireSuccessFile != nil {
+		return *db.config.RequireSuccessFile
+	}
+
+	return db.sequins.config.RequireSuccessFile
+}
+
+// listVersions returns the versions of the db that are candidates to become
+// current, ordered from oldest to newest according to the configured version
+// selection strategy. If after is set, versions that are older than it may be
+// left out.
+func (db *db) listVersions(after string) ([]string, error) {
+	// A local db only ever has the one version, which is always complete.
+	if db.isLocal() {
+		return db.sequins.backend.ListVersions(db.name, after, false)
+	}
+
+	requireSuccess := db.requireSuccessFile()
+
+	// A pinned version is the only candidate, whatever the strategy.
+	if pinned := db.pinnedVersion(); pinned != "" {
+		exists, err := db.versionExists(pinned)
+		if err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, fmt.Errorf("%s is pinned to a version that doesn't exist (or isn't complete): %s", db.name, pinned)
+		}
+
+		return []string{pinned}, nil
+	}
+
+	switch db.sequins.config.VersionSelection {
+	case versionSelectionMtime:
+		versions, err := db.sequins.backend.ListVersions(db.name, "", requireSuccess)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes := make(map[string]time.Time, len(versions))
+		for _, v := range versions {
+			modTime, err := db.versionModTime(v)
+			if err != nil {
+				return nil, err
+			}
+
+			modTimes[v] = modTime
+		}
+
+		sort.Slice(versions, func(i, j int) bool {
+			a, b := versions[i], versions[j]
+			if !modTimes[a].Equal(modTimes[b]) {
+				return modTimes[a].Before(modTimes[b])
+			}
+
+			return a < b
+		})
+
+		// With a skew tolerance, the newest version isn't necessarily the one
+		// that was modified last, so make sure it ends up at the end.
+		if len(versions) > 0 {
+			newest := len(versions) - 1
+			for i, v := range versions {
+				if db.newerModTime(v, modTimes[v], versions[newest], modTimes[versions[newest]]) {
+					newest = i
+				}
+			}
+
+			v := versions[newest]
+			versions = append(append(versions[:newest:newest], versions[newest+1:]...), v)
+		}
+
+		db.warnInversions(versions, modTimes)
+		return versions, nil
+	case versionSelectionPointer:
+		pointer, err := db.readVersionPointer()
+		if err != nil {
+			return nil, err
+		}
+
+		versions, err := db.sequins.backend.ListVersions(db.name, "", requireSuccess)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range versions {
+			if v == pointer {
+				return []string{pointer}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%s for %s points to a version that doesn't exist (or isn't complete): %s",
+			versionPointerFile, db.name, pointer)
+	default:
+		return db.sequins.backend.ListVersions(db.name, after, requireSuccess)
+	}
+}
+
+// readVersionPointer reads the name of the version to serve from the pointer
+// file at the root of the db.
+func (db *db) readVersionPointer() (string, error) {
+	r, err := db.sequins.backend.Open(db.name, "", versionPointerFile)
+	if err != nil {
+		return "", fmt.Errorf("reading %s for %s: %s", versionPointerFile, db.name, err)
+	}
+
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return "", fmt.Errorf("reading %s for %s: %s", versionPointerFile, db.name, err)
+	}
+
+	pointer := strings.TrimSpace(string(b))
+	if pointer == "" {
+		return "", fmt.Errorf("%s for %s is empty", versionPointerFile, db.name)
+	}
+
+	return pointer, nil
+}
+
+// versionModTime returns the modification time of the given version in the
+// backend. Versions don't change once they're written, so it's cached.
+func (db *db) versionModTime(name string) (time.Time, error) {
+	db.modTimesLock.Lock()
+	defer db.modTimesLock.Unlock()
+
+	if modTime, ok := db.modTimes[name]; ok {
+		return modTime, nil
+	}
+
+	modTime, err := db.sequins.backend.VersionModTime(db.name, name)
+	if err != nil {
+		return modTime, err
+	}
+
+	db.modTimes[name] = modTime
+	return modTime, nil
+}
+
+// newerModTime returns true if the version named a, modified at aModTime, is
+// newer than the version named b, modified at bModTime. Modification times
+// within 'version_skew_tolerance' of each other are considered the same, in
+// which case the name breaks the tie.
+func (db *db) newerModTime(a string, aModTime time.Time, b string, bModTime time.Time) bool {
+	tolerance := db.sequins.config.VersionSkewTolerance.Duration
+	diff := aModTime.Sub(bModTime)
+	if diff > tolerance || diff < -tolerance {
+		return diff > 0
+	}
+
+	return a > b
+}
+
+// warnInversions logs a warning for any version that sorts after the current
+// one by name, but was modified before it. Those versions will never be
+// loaded, which is usually a sign of clock skew on the hosts that wrote them.
+// Each version is only warned about once.
+func (db *db) warnInversions(versions []string, modTimes map[string]time.Time) {
+	current := db.mux.getCurrent()
+	db.mux.release(current)
+	if current == nil {
+		return
+	}
+
+	db.modTimesLock.Lock()
+	defer db.modTimesLock.Unlock()
+
+	for _, v := range versions {
+		if v <= current.name || db.inversions[v] {
+			continue
+		}
+
+		if db.newerModTime(current.name, current.modTime, v, modTimes[v]) {
+			logEvent(logFields{DB: db.name, Version: v, Event: "version_skipped"},
+				"Warning: version %s of %s was modified at %s, before the current version %s (modified at %s), so it won't be loaded. This may be caused by clock skew.",
+				v, db.name, modTimes[v].UTC().Format(time.RFC3339), current.name, current.modTime.UTC().Format(time.RFC3339))
+
+			db.inversions[v] = true
+			if expStats != nil {
+				expStats.incrVersionInversions()
+			}
+		}
+	}
+}
+
+// newer returns true if a should replace b as the current version, according
+// to the configured version selection strategy. This is what guarantees that
+// the db never rolls backwards, so it has to agree with listVersions.
+func (db *db) newer(a, b *version) bool {
+	// The pinned version beats any other, so that pinning can roll back.
+	if pinned := db.pinnedVersion(); pinned != "" && (a.name == pinned) != (b.name == pinned) {
+		return a.name == pinned
+	}
+
+	switch db.sequins.config.VersionSelection {
+	case versionSelectionMtime:
+		return db.newerModTime(a.name, a.modTime, b.name, b.modTime)
+	case versionSelectionPointer:
+		// Whatever version was pointed to most recently wins, even if it's
+		// older by name, so that the pointer can be used to roll back.
+		return a.created.After(b.created)
+	default:
+		return a.name > b.name
+	}
+}
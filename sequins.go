@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -8,15 +10,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/nightlyone/lockfile"
-	"github.com/tylerb/graceful"
 
 	"github.com/stripe/sequins/backend"
 	"github.com/stripe/sequins/multilock"
@@ -32,26 +33,90 @@ type sequins struct {
 	dbs     map[string]*db
 	dbsLock sync.RWMutex
 
-	peers     *peers
-	zkWatcher *zkWatcher
+	// disabled is the set of dbs, by name, that aren't being served; see
+	// disableDB.
+	disabled     map[string]bool
+	disabledLock sync.RWMutex
+
+	peers       *peers
+	coordinator coordinator
+	rejoinLock  sync.Mutex
+
+	// readsInFlight counts the reads being served, so that rejoin can wait for
+	// them to finish.
+	readsInFlight int64
+
+	// maintenance is 1 while the node is in maintenance mode; see
+	// serveMaintenance.
+	maintenance int32
 
 	refreshLock   sync.Mutex
+	evictLock     sync.Mutex
 	buildLock     *multilock.Multilock
 	refreshTicker *time.Ticker
 	sighups       chan os.Signal
 
+	// integrityTicker is nil unless 'storage.integrity_scan_period' is set.
+	integrityTicker *time.Ticker
+
 	storeLock lockfile.Lockfile
+
+	// metrics is nil unless 'prometheus_enabled' is set.
+	metrics *prometheusMetrics
+
+	// cache is nil unless 'cache_bytes' is set.
+	cache *valueCache
+
+	// limiter is nil unless 'max_requests_per_second' is set.
+	limiter *rateLimiter
+
+	// loads tracks every load on the node, for /debug/loads.
+	loads *loadTracker
+
+	// tlsConfig and tlsPeerConfig are nil unless 'tls_cert' is set.
+	tlsConfig     *tls.Config
+	tlsPeerConfig *tls.Config
+
+	// peerTransport keeps connections open to peers; see initPeerClient.
+	peerTransport  *peerTransport
+	peerHTTPClient *http.Client
+
+	// remoteHTTPClient is used to fall back to 'failover.remote_cluster'.
+	remoteHTTPClient *http.Client
 }
 
 func newSequins(backend backend.Backend, config sequinsConfig) *sequins {
-	return &sequins{
+	s := &sequins{
 		config:      config,
 		backend:     backend,
 		refreshLock: sync.Mutex{},
+		disabled:    make(map[string]bool),
+		loads:       newLoadTracker(),
+	}
+
+	if config.PrometheusEnabled {
+		s.metrics = newPrometheusMetrics()
+	}
+
+	if config.CacheBytes > 0 {
+		s.cache = newValueCache(config.CacheBytes)
 	}
+
+	if config.MaxRequestsPerSecond > 0 {
+		s.limiter = newRateLimiter(config.MaxRequestsPerSecond, config.RateLimitPerIP)
+	}
+
+	return s
 }
 
 func (s *sequins) init() error {
+	err := s.initTLS()
+	if err != nil {
+		return err
+	}
+
+	s.initPeerClient()
+
 	if s.config.Sharding.Enabled {
 		err := s.initCluster()
 		if err != nil {
@@ -60,7 +125,7 @@ func (s *sequins) init() error {
 	}
 
 	// Create local directories, and load any cached versions we have.
-	err := s.initLocalStore()
+	err = s.initLocalStore()
 	if err != nil {
 		return fmt.Errorf("error initializing local store: %s", err)
 	}
@@ -71,6 +136,10 @@ func (s *sequins) init() error {
 		s.buildLock = multilock.New(maxLoads)
 	}
 
+	for _, name := range s.config.DisabledDatabases {
+		s.disableDB(name)
+	}
+
 	// Trigger loads before we start up.
 	s.refreshAll()
 	s.refreshLock.Lock()
@@ -83,7 +152,19 @@ func (s *sequins) init() error {
 		go func() {
 			log.Println("Automatically checking for new versions every", refresh.String())
 			for range s.refreshTicker.C {
-				s.refreshAll()
+				s.refreshDBs(true)
+			}
+		}()
+	}
+
+	// Scan for corruption in the background, if configured to do so.
+	scan := s.config.Storage.IntegrityScanPeriod.Duration
+	if scan != 0 {
+		s.integrityTicker = time.NewTicker(scan)
+		go func() {
+			log.Println("Scanning local data for corruption every", scan.String())
+			for range s.integrityTicker.C {
+				s.scanIntegrity()
 			}
 		}()
 	}
@@ -108,14 +189,12 @@ func (s *sequins) initCluster() error {
 		s.config.Sharding.ProxyStageTimeout = duration{stageTimeout}
 	}
 
-	prefix := path.Join("/", s.config.Sharding.ClusterName)
-	zkWatcher, err := connectZookeeper(s.config.ZK.Servers, prefix,
-		s.config.ZK.ConnectTimeout.Duration, s.config.ZK.SessionTimeout.Duration)
+	coordinator, err := s.connectCoordinator()
 	if err != nil {
 		return err
 	}
 
-	go zkWatcher.triggerCleanup()
+	go coordinator.triggerCleanup()
 
 	hostname := s.config.Sharding.AdvertisedHostname
 	if hostname == "" {
@@ -130,21 +209,40 @@ func (s *sequins) initCluster() error {
 		return err
 	}
 
+	if s.config.Sharding.AdvertisedPort != 0 {
+		port = strconv.Itoa(s.config.Sharding.AdvertisedPort)
+	}
+
 	routableAddress := net.JoinHostPort(hostname, port)
 	shardID := s.config.Sharding.ShardID
 	if shardID == "" {
 		shardID = routableAddress
 	}
 
-	peers := watchPeers(zkWatcher, shardID, routableAddress)
+	peers := watchPeers(coordinator, shardID, routableAddress, s.config.Sharding.NodeWeight, s.config.Sharding.VirtualNodes, s.config.Sharding.Zone, s.peerTransport.forget)
 	peers.waitToConverge(s.config.Sharding.TimeToConverge.Duration)
 
-	s.zkWatcher = zkWatcher
+	s.coordinator = coordinator
 	s.peers = peers
+
+	if s.config.Sharding.Rebalance {
+		go s.watchMembership()
+	}
+
+	if s.config.Sharding.PartialAvailabilityThreshold > 0 {
+		go s.watchAvailability()
+	}
+
 	return nil
 }
 
 func (s *sequins) initLocalStore() error {
+	// Another process owns a read-only store, and holds the lock.
+	if s.config.ReadOnlyStore {
+		log.Println("Serving versions from the read-only local store at", s.config.LocalStore)
+		return nil
+	}
+
 	dataPath := filepath.Join(s.config.LocalStore, "data")
 	err := os.MkdirAll(dataPath, 0755|os.ModeDir)
 	if err != nil {
@@ -174,8 +272,142 @@ func (s *sequins) start() {
 		h = trackQueries(s)
 	}
 
-	log.Println("Listening on", s.config.Bind)
-	graceful.Run(s.config.Bind, time.Second, h)
+	// The timeouts keep slow or idle clients from holding on to connections
+	// forever. A zero timeout means no limit.
+	s.http = &http.Server{
+		Addr:         s.config.Bind,
+		Handler:      h,
+		TLSConfig:    s.tlsConfig,
+		ReadTimeout:  s.config.ReadTimeout.Duration,
+		WriteTimeout: s.config.WriteTimeout.Duration,
+		IdleTimeout:  s.config.IdleTimeout.Duration,
+	}
+
+	// Stop serving gracefully on SIGINT or SIGTERM.
+	stopped := make(chan bool)
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-terms
+		signal.Stop(terms)
+		log.Printf("Received %s, waiting for in-flight requests to finish", sig)
+		s.stopServing()
+		close(stopped)
+	}()
+
+	if s.config.WaitForVersionOnStartup {
+		s.waitForVersion(s.config.WaitForVersionTimeout.Duration, stopped)
+	}
+
+	listeners, err := s.listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if s.tlsConfig == nil {
+		log.Println("Listening on", s.config.Bind)
+	} else {
+		log.Println("Listening on", s.config.Bind, "with TLS")
+	}
+
+	// Each listener gets its own accept loop.
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if s.tlsConfig == nil {
+				errs <- s.http.Serve(l)
+			} else {
+				errs <- s.http.ServeTLS(l, "", "")
+			}
+		}(l)
+	}
+
+	for range listeners {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+
+	<-stopped
+}
+
+// waitForVersion blocks until at least one db has a current version, so that
+// we don't start taking requests we can only 404. It gives up after the
+// timeout, or if stopped is closed.
+func (s *sequins) waitForVersion(timeout time.Duration, stopped chan bool) {
+	if s.hasVersion() {
+		return
+	}
+
+	log.Printf("Waiting up to %v for a version to load before listening", timeout)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.hasVersion() {
+				return
+			}
+		case <-deadline.C:
+			log.Printf("Gave up waiting for a version to load after %v, listening anyway", timeout)
+			return
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// hasVersion returns true if any db has a current version.
+func (s *sequins) hasVersion() bool {
+	s.dbsLock.RLock()
+	defer s.dbsLock.RUnlock()
+
+	for _, db := range s.dbs {
+		vs := db.mux.getCurrent()
+		db.mux.release(vs)
+		if vs != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stopServing removes this node's registrations from the coordinator, so that
+// peers stop proxying requests to it, and then stops the HTTP server, waiting
+// up to 'shutdown_timeout' for in-flight requests to finish.
+func (s *sequins) stopServing() {
+	s.deregister()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout.Duration)
+	defer cancel()
+
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		log.Println("Gave up waiting for in-flight requests to finish:", err)
+	}
+}
+
+// deregister removes the ephemeral nodes advertising this node and its
+// partitions. They would disappear anyway once the coordinator session is
+// closed, but peers stop routing requests here sooner this way.
+func (s *sequins) deregister() {
+	if s.peers == nil {
+		return
+	}
+
+	s.dbsLock.RLock()
+	for _, db := range s.dbs {
+		for _, vs := range db.mux.getAll() {
+			vs.partitions.unadvertisePartitions()
+		}
+	}
+
+	s.dbsLock.RUnlock()
+	s.peers.deregister()
 }
 
 func (s *sequins) shutdown() {
@@ -186,9 +418,13 @@ func (s *sequins) shutdown() {
 		s.refreshTicker.Stop()
 	}
 
-	zk := s.zkWatcher
-	if zk != nil {
-		zk.close()
+	if s.integrityTicker != nil {
+		s.integrityTicker.Stop()
+	}
+
+	coordinator := s.coordinator
+	if coordinator != nil {
+		coordinator.close()
 	}
 
 	// TODO: figure out how to cancel in-progress downloads
@@ -199,10 +435,19 @@ func (s *sequins) shutdown() {
 	// 	db.close()
 	// }
 
-	s.storeLock.Unlock()
+	if !s.config.ReadOnlyStore {
+		s.storeLock.Unlock()
+	}
 }
 
 func (s *sequins) refreshAll() {
+	s.refreshDBs(false)
+}
+
+// refreshDBs adds any new dbs, removes deleted ones, and checks existing ones
+// for new versions. If periodic is set, dbs with their own 'refresh_period'
+// aren't checked, since they're refreshed on their own schedule.
+func (s *sequins) refreshDBs(periodic bool) {
 	s.refreshLock.Lock()
 	defer s.refreshLock.Unlock()
 
@@ -220,16 +465,21 @@ func (s *sequins) refreshAll() {
 	newDBs := make(map[string]*db)
 	var backfills sync.WaitGroup
 	for _, name := range dbs {
+		if s.isDisabled(name) {
+			continue
+		}
+
 		db := s.dbs[name]
 		if db == nil {
 			db = newDB(s, name)
+			db.refreshPeriodically()
 
 			backfills.Add(1)
 			go func() {
 				db.backfillVersions()
 				backfills.Done()
 			}()
-		} else {
+		} else if !periodic || !db.hasOwnRefreshPeriod() {
 			go func() {
 				err := db.refresh()
 				if err != nil {
@@ -265,20 +515,49 @@ func (s *sequins) refreshAll() {
 	s.dbsLock.RUnlock()
 
 	// Cleanup any zkNodes for deleted versions and dbs.
-	if s.zkWatcher != nil {
-		s.zkWatcher.triggerCleanup()
+	if s.coordinator != nil {
+		s.coordinator.triggerCleanup()
 	}
 }
 
 func (s *sequins) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	if r.URL.Path == "/" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := r.URL.Query()[listParam]; ok {
+			s.serveList(w, r)
+			return
+		}
+
 		s.serveStatus(w, r)
 		return
+	} else if r.URL.Path == prometheusPath && s.metrics != nil {
+		s.servePrometheus(w, r)
+		return
+	} else if r.URL.Path == livenessPath {
+		s.serveLiveness(w, r)
+		return
+	} else if r.URL.Path == readinessPath {
+		s.serveReadiness(w, r)
+		return
+	} else if r.URL.Path == statsPath {
+		s.serveStats(w, r)
+		return
+	} else if r.URL.Path == refreshPath {
+		s.serveRefresh(w, r)
+		return
+	} else if r.URL.Path == rejoinPath {
+		s.serveRejoin(w, r)
+		return
+	} else if r.URL.Path == maintenancePath {
+		s.serveMaintenance(w, r)
+		return
+	} else if strings.HasPrefix(r.URL.Path, clusterVersionsPath) {
+		s.serveClusterVersions(w, r)
+		return
 	}
 
 	var dbName, key string
@@ -297,6 +576,21 @@ func (s *sequins) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients that accept JSON get a body with an error code for failed reads.
+	isRead := r.Method == "GET" || r.Method == "HEAD" || (r.Method == "POST" && key == "")
+	if isRead && acceptsJSON(r) {
+		w = &jsonErrorWriter{ResponseWriter: w}
+	}
+
+	if s.isDisabled(dbName) {
+		s.serveDisabledDB(w, r, dbName, key)
+		return
+	}
+
+	if s.degraded() {
+		w.Header().Set(degradedHeader, "true")
+	}
+
 	s.dbsLock.RLock()
 	db := s.dbs[dbName]
 	s.dbsLock.RUnlock()
@@ -307,14 +601,68 @@ func (s *sequins) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// happen). So we use 501 Not Implemented to indicate the former. To users,
 	// we present a uniform 404.
 	if db == nil {
-		if r.URL.Query().Get("proxy") != "" {
+		if proxiedVersion(r) != "" {
 			w.WriteHeader(http.StatusNotImplemented)
 		} else {
+			setErrorCode(w, codeDatabaseNotFound)
 			w.WriteHeader(http.StatusNotFound)
 		}
 
 		return
 	}
 
+	if db.accessLogEnabled() {
+		l := logAccess(w)
+		defer l.done(r)
+		w = l
+	}
+
+	if r.Method == "HEAD" && key == "" && s.config.DBETags {
+		db.serveETag(w, r)
+		return
+	}
+
+	// Reads are requests for keys, including HEADs, and batches.
+	isRead = ((r.Method == "GET" || r.Method == "HEAD") && key != "") || (r.Method == "POST" && key == "")
+	if isRead && !db.checkReadAuth(w, r) {
+		return
+	}
+
+	if isRead && !s.checkMaintenance(w, r) {
+		return
+	}
+
+	if isRead && !s.checkRateLimit(w, r) {
+		return
+	}
+
+	if isRead {
+		defer s.startRead()()
+	}
+
+	// Responses to reads can be compressed, except for HEADs, which have no body.
+	if isRead && r.Method != "HEAD" && s.shouldCompress(r) {
+		cw := compressResponse(w)
+		defer cw.close()
+		w = cw
+	}
+
+	// A POST to the db itself fetches a batch of keys.
+	if r.Method == "POST" && key == "" {
+		db.serveBatch(w, r)
+		return
+	}
+
+	// Anything other than a GET (or a HEAD for a key) is an admin action, like
+	// draining the db.
+	if r.Method != "GET" && !(r.Method == "HEAD" && key != "") {
+		db.serveAdmin(w, r, key)
+		return
+	}
+
+	if key != "" {
+		s.metrics.countRequest(dbName)
+	}
+
 	db.serveKey(w, r, key)
 }
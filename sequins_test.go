@@ -1,17 +1,26 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,6 +29,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/stripe/sequins/backend"
+	"github.com/stripe/sequins/blocks"
 )
 
 type tuple struct {
@@ -48,129 +58,2353 @@ func init() {
 }
 
 func getSequins(t *testing.T, backend backend.Backend, localStore string) *sequins {
+	return getSequinsWithConfig(t, backend, localStore, defaultConfig())
+}
+
+func getSequinsWithConfig(t *testing.T, backend backend.Backend, localStore string, config sequinsConfig) *sequins {
 	if localStore == "" {
 		tmpDir, err := ioutil.TempDir("", "sequins-")
 		require.NoError(t, err)
 
-		localStore = tmpDir
+		localStore = tmpDir
+	}
+
+	config.Bind = "localhost:9599"
+	config.LocalStore = localStore
+	config.MaxParallelLoads = 1
+
+	s := newSequins(backend, config)
+	require.NoError(t, s.init())
+
+	// This is a hack to wait until all DBs are ready.
+	dbs, err := backend.ListDBs()
+	require.NoError(t, err)
+	for _, dbName := range dbs {
+		for !s.isDisabled(dbName) {
+			versions, err := backend.ListVersions(dbName, "", false)
+			require.NoError(t, err)
+			if len(versions) == 0 {
+				break
+			}
+
+			s.dbsLock.RLock()
+			db := s.dbs[dbName]
+			s.dbsLock.RUnlock()
+
+			if db != nil {
+				current := db.mux.getCurrent()
+				db.mux.release(current)
+				if current != nil {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return s
+}
+
+func testBasicSequins(t *testing.T, ts *sequins, expectedDBPath string) {
+	for i := 0; i < 20; i++ {
+		tuple := babyNames[rand.Intn(len(babyNames))]
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/baby-names/%s", tuple.key), nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
+		assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "when fetching an existing key, the sequins version header should be set")
+		assert.Equal(t, "false", w.HeaderMap.Get(proxiedFlagHeader), "a key served locally shouldn't be marked as proxied")
+	}
+
+	req, _ := http.NewRequest("GET", "/baby-names/foo", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "fetching a nonexistent key should 404")
+	assert.Equal(t, "", w.Body.String(), "fetching a nonexistent key should return no body")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "when fetchin a nonexistent key, the sequins version header should still be set")
+
+	req, _ = http.NewRequest("GET", "/otherdb/foo", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "fetching from a nonexistent db should 404")
+	assert.Equal(t, "", w.Body.String(), "fetching from a nonexistent db should return no body")
+	assert.Equal(t, "", w.HeaderMap.Get(versionHeader), "when fetching from a nonexistent db, the sequins version header shouldn't be set")
+
+	testBasicStatus(t, ts, expectedDBPath)
+}
+
+func testBasicStatus(t *testing.T, ts *sequins, expectedDBPath string) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	status := status{}
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	require.NoError(t, err, "fetching global status should work and be valid")
+	assert.Equal(t, 200, w.Code, "fetching global status should work and be valid")
+
+	require.Equal(t, 1, len(status.DBs), "there should be a single db")
+	validateStatus(t, status.DBs["baby-names"], expectedDBPath)
+
+	req, _ = http.NewRequest("GET", "/baby-names/", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	dbStatus := dbStatus{}
+	err = json.Unmarshal(w.Body.Bytes(), &dbStatus)
+	require.NoError(t, err, "fetching db status should work and be valid")
+	assert.Equal(t, 200, w.Code, "fetching db status should work and be valid")
+	validateStatus(t, dbStatus, expectedDBPath)
+}
+
+func validateStatus(t *testing.T, status dbStatus, expectedPath string) {
+	require.Equal(t, 1, len(status.Versions), "dbStatus should have one version registered")
+
+	versionStatus := status.Versions["1"]
+	assert.Equal(t, expectedPath, versionStatus.Path, "versionStatus path should be correct")
+	for _, nodeStatus := range versionStatus.Nodes {
+		assert.True(t, nodeStatus.Current, "dbStatus should be registered as the current one")
+	}
+}
+
+func TestSequins(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequins(t, backend, "")
+	testBasicSequins(t, ts, filepath.Join(scratch, "baby-names/1"))
+}
+
+func TestSequinsVerifySample(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.Storage.VerifySampleSize = 100
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequinsWithConfig(t, backend, "", config)
+	testBasicSequins(t, ts, filepath.Join(scratch, "baby-names/1"))
+}
+
+func TestSequinsVerifySampleFailure(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.Storage.VerifySampleSize = 1000
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	// Write the same key twice in the next version, with different values, so
+	// that one of them can't be read back as it was written.
+	v2 := filepath.Join(scratch, "baby-names", "2")
+	require.NoError(t, directoryCopy(t, v2, "test/baby-names/1"), "setup: copy data")
+	dup := babyNames[0]
+	writeTestSequenceFile(t, filepath.Join(v2, "part-99999"), []tuple{{dup.key, "not " + dup.value}})
+	require.NoError(t, db.refresh())
+
+	var failed bool
+	for i := 0; i < 100 && !failed; i++ {
+		for _, vs := range db.mux.getAll() {
+			if vs.name == "2" && vs.stats().State == versionError {
+				failed = true
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, failed, "a version that fails verification should fail to load")
+
+	current := db.mux.getCurrent()
+	db.mux.release(current)
+	assert.Equal(t, "1", current.name, "the previous version should keep being served")
+
+	req, _ := http.NewRequest("GET", "/baby-names/"+dup.key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, "the previous version should keep being served")
+	assert.Equal(t, dup.value, w.Body.String(), "the previous version should keep being served")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "the previous version should keep being served")
+}
+
+func TestSequinsRecoverCorruptStore(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	localStore, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	config := defaultConfig()
+	config.Storage.RecoverCorruptStore = true
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequinsWithConfig(t, backend, localStore, config)
+	ts.shutdown()
+
+	// Truncate all the blocks, as if the disk had gone bad.
+	blocks, err := filepath.Glob(filepath.Join(localStore, "data", "baby-names", "1", "block-*"))
+	require.NoError(t, err, "setup")
+	require.NotEmpty(t, blocks, "setup: there should be blocks in the local store")
+	for _, block := range blocks {
+		require.NoError(t, os.Truncate(block, 10), "setup: truncate block")
+	}
+
+	ts = getSequinsWithConfig(t, backend, localStore, config)
+	testBasicSequins(t, ts, filepath.Join(scratch, "baby-names/1"))
+}
+
+// testVersionSelection starts sequins with versions 1 and 2 of baby-names, and
+// returns the version that ends up current. Both versions are built at startup,
+// and either one can finish first, so it waits up to a few seconds for the
+// expected one to win.
+func testVersionSelection(t *testing.T, config sequinsConfig, expected string, setup func(scratch string)) string {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	for _, v := range []string{"1", "2"} {
+		dst := filepath.Join(scratch, "baby-names", v)
+		require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	}
+
+	setup(scratch)
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequinsWithConfig(t, backend, "", config)
+
+	db := ts.dbs["baby-names"]
+	currentVersion := func() string {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current == nil {
+			return ""
+		}
+
+		return current.name
+	}
+
+	for i := 0; i < 100 && currentVersion() != expected; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	current := currentVersion()
+	require.NotEqual(t, "", current, "there should be a current version")
+	return current
+}
+
+func TestSequinsVersionSelectionMtime(t *testing.T) {
+	config := defaultConfig()
+	config.VersionSelection = versionSelectionMtime
+	current := testVersionSelection(t, config, "1", func(scratch string) {
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(scratch, "baby-names", "2"), old, old), "setup: set mtime")
+	})
+
+	assert.Equal(t, "1", current, "the most recently modified version should be current")
+}
+
+func TestSequinsVersionSelectionSkewTolerance(t *testing.T) {
+	config := defaultConfig()
+	config.VersionSelection = versionSelectionMtime
+	config.VersionSkewTolerance = duration{5 * time.Minute}
+
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	// Add version 2 only once version 1 is current, so that the order they're
+	// built in doesn't matter.
+	v2 := filepath.Join(scratch, "baby-names", "2")
+	require.NoError(t, directoryCopy(t, v2, "test/baby-names/1"), "setup: copy data")
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(v2, old, old), "setup: set mtime")
+	require.NoError(t, db.refresh())
+
+	currentVersion := func() string {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current == nil {
+			return ""
+		}
+
+		return current.name
+	}
+
+	for i := 0; i < 100 && currentVersion() != "2"; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	assert.Equal(t, "2", currentVersion(), "versions modified within the skew tolerance should be ordered by name")
+}
+
+func TestSequinsVersionSelectionPointer(t *testing.T) {
+	config := defaultConfig()
+	config.VersionSelection = versionSelectionPointer
+	current := testVersionSelection(t, config, "1", func(scratch string) {
+		pointer := filepath.Join(scratch, "baby-names", versionPointerFile)
+		require.NoError(t, ioutil.WriteFile(pointer, []byte("1\n"), 0644), "setup: write pointer")
+	})
+
+	assert.Equal(t, "1", current, "the version in the pointer file should be current")
+}
+
+func TestSequinsVersionSelectionPinned(t *testing.T) {
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {PinnedVersion: "1"}}
+	current := testVersionSelection(t, config, "1", func(scratch string) {})
+
+	assert.Equal(t, "1", current, "the pinned version should be current")
+}
+
+func TestSequinsRequireSuccessFilePerDB(t *testing.T) {
+	writeSuccess := func(scratch string) {
+		success := filepath.Join(scratch, "baby-names", "1", "_SUCCESS")
+		require.NoError(t, ioutil.WriteFile(success, nil, 0644), "setup: write _SUCCESS")
+	}
+
+	yes, no := true, false
+
+	config := defaultConfig()
+	config.RequireSuccessFile = true
+	config.DBs = map[string]dbConfig{"baby-names": {RequireSuccessFile: &no}}
+	current := testVersionSelection(t, config, "2", writeSuccess)
+	assert.Equal(t, "2", current, "the db should load versions without a _SUCCESS file")
+
+	config = defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {RequireSuccessFile: &yes}}
+	current = testVersionSelection(t, config, "1", writeSuccess)
+	assert.Equal(t, "1", current, "the db should only load versions with a _SUCCESS file")
+}
+
+func TestSequinsArchive(t *testing.T) {
+	source, err := ioutil.TempDir("", "sequins-archive-")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+
+	require.NoError(t, os.Mkdir(filepath.Join(source, "baby-names"), 0755))
+	f, err := os.Create(filepath.Join(source, "baby-names", "1.tar"))
+	require.NoError(t, err)
+
+	tw := tar.NewWriter(f)
+	infos, err := ioutil.ReadDir("test/baby-names/1")
+	require.NoError(t, err)
+	for _, info := range infos {
+		b, err := ioutil.ReadFile(filepath.Join("test/baby-names/1", info.Name()))
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: info.Name(), Mode: 0644, Size: int64(len(b))}))
+		_, err = tw.Write(b)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	localStore, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err)
+	defer os.RemoveAll(localStore)
+
+	archives := filepath.Join(localStore, "archives")
+	ab := backend.NewArchiveBackend(backend.NewLocalBackend(source), "tar", archives)
+	ts := getSequins(t, ab, localStore)
+
+	for _, tuple := range babyNames[:20] {
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
+		assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "the version should be named for the archive")
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
+	}
+
+	_, err = os.Stat(filepath.Join(archives, "baby-names", "1"))
+	assert.True(t, os.IsNotExist(err), "the extracted archive should be removed once the version is loaded")
+}
+
+func TestSequinsPartitions(t *testing.T) {
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {Partitions: 3}}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	db := ts.dbs["baby-names"]
+	current := db.mux.getCurrent()
+	defer db.mux.release(current)
+	require.NotNil(t, current)
+	assert.Equal(t, 3, current.numPartitions, "the configured number of partitions should be used")
+
+	for _, tuple := range babyNames[:20] {
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
+	}
+}
+
+func TestSequinsDebugPartitions(t *testing.T) {
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {Partitions: 3}}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	req, _ := http.NewRequest("GET", "/debug/partitions/baby-names", nil)
+	w := httptest.NewRecorder()
+	ts.serveDebugPartitions(w, req)
+	require.Equal(t, 200, w.Code, "fetching the partitions should 200")
+
+	var dp debugPartitions
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &dp), "the response should be valid JSON")
+	assert.Equal(t, "baby-names", dp.DB)
+	assert.Equal(t, "1", dp.Version)
+	require.Len(t, dp.Partitions, 3, "every partition should be listed")
+	for i, p := range dp.Partitions {
+		assert.Equal(t, i, p.Partition)
+		assert.True(t, p.Local, "every partition should be local without a cluster")
+		assert.Empty(t, p.Peers, "no peers should have the partition without a cluster")
+	}
+
+	req, _ = http.NewRequest("GET", "/debug/partitions/foo", nil)
+	w = httptest.NewRecorder()
+	ts.serveDebugPartitions(w, req)
+	assert.Equal(t, 404, w.Code, "fetching the partitions for a nonexistent db should 404")
+}
+
+func TestSequinsDebugLoads(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+
+	// A load that's still waiting for the build locks.
+	ts.loads.queue("foo", "2")
+
+	req, _ := http.NewRequest("GET", "/debug/loads", nil)
+	w := httptest.NewRecorder()
+	ts.serveDebugLoads(w, req)
+	require.Equal(t, 200, w.Code, "fetching the loads should 200")
+
+	var loads []loadStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &loads), "the response should be valid JSON")
+	require.Len(t, loads, 2, "every load should be listed")
+
+	assert.Equal(t, "baby-names", loads[0].DB)
+	assert.Equal(t, "1", loads[0].Version)
+	assert.Equal(t, loadDone, loads[0].State, "the initial load should be done")
+	assert.True(t, loads[0].Bytes > 0, "the bytes read from the source should be counted")
+	assert.NotNil(t, loads[0].Started, "the load should have a start time")
+	assert.NotNil(t, loads[0].Finished, "the load should have a finish time")
+
+	assert.Equal(t, "foo", loads[1].DB)
+	assert.Equal(t, loadQueued, loads[1].State, "the new load should be queued")
+	assert.Nil(t, loads[1].Started, "a queued load shouldn't have a start time")
+}
+
+func TestSequinsCache(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.CacheBytes = 1024 * 1024
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	get := func(version string) {
+		tuple := babyNames[0]
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code, "fetching an existing key should 200")
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key should return the value")
+		assert.Equal(t, version, w.HeaderMap.Get(versionHeader), "the value should come from the current version")
+	}
+
+	get("1")
+	get("1")
+	st := ts.cache.stats()
+	assert.EqualValues(t, 1, st.Misses, "the first request should miss")
+	assert.EqualValues(t, 1, st.Hits, "the second request should hit")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "2"), "test/baby-names/1"), "setup: copy data")
+	require.NoError(t, db.refresh())
+	for i := 0; i < 100; i++ {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current.name == "2" {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get("2")
+	st = ts.cache.stats()
+	assert.EqualValues(t, 2, st.Misses, "the first request after upgrading should miss")
+	assert.EqualValues(t, 1, st.Hits)
+}
+
+func TestSequinsFallbackToPreviousVersion(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	v1 := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, v1, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(v1, "part-99999"), []tuple{{"only-in-1", "old"}})
+
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {FallbackToPreviousVersion: true}}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "2"), "test/baby-names/1"), "setup: copy data")
+	require.NoError(t, db.refresh())
+	for i := 0; i < 100; i++ {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current.name == "2" {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tuple := babyNames[0]
+	req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "fetching an existing key should 200")
+	assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key should return the value")
+	assert.Equal(t, "2", w.HeaderMap.Get(versionHeader), "a key in the current version should come from it")
+
+	req, _ = http.NewRequest("GET", "/baby-names/only-in-1", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "a key missing from the current version should be found in the previous one")
+	assert.Equal(t, "old", w.Body.String(), "a key missing from the current version should return the previous value")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "the version header should be set to the previous version")
+
+	req, _ = http.NewRequest("GET", "/baby-names/foo", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "a key missing from both versions should 404")
+	assert.Equal(t, "", w.Body.String(), "a key missing from both versions should return no body")
+	assert.Equal(t, "2", w.HeaderMap.Get(versionHeader), "a key missing from both versions should be tagged with the current version")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_v/2/only-in-1", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "requests for a specific version shouldn't fall back")
+}
+
+func TestSequinsStreamThreshold(t *testing.T) {
+	config := defaultConfig()
+	config.CacheBytes = 1024 * 1024
+	config.StreamThreshold = 1
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	for i := 0; i < 2; i++ {
+		tuple := babyNames[0]
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code, "fetching an existing key should 200")
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key should return the streamed value")
+		assert.Equal(t, strconv.Itoa(len(tuple.value)), w.HeaderMap.Get("Content-Length"), "the Content-Length should be set")
+	}
+
+	st := ts.cache.stats()
+	assert.EqualValues(t, 0, st.Hits, "streamed values shouldn't be cached")
+}
+
+func TestSequinsMaxValueSize(t *testing.T) {
+	short, long := babyNames[0], babyNames[0]
+	for _, tuple := range babyNames {
+		if len(tuple.value) < len(short.value) {
+			short = tuple
+		} else if len(tuple.value) > len(long.value) {
+			long = tuple
+		}
+	}
+
+	require.True(t, len(short.value) < len(long.value), "setup: the values should have different lengths")
+
+	config := defaultConfig()
+	config.MaxValueSize = int64(len(long.value) - 1)
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	req, _ := http.NewRequest("GET", "/baby-names/"+short.key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, "a value under max_value_size should 200")
+	assert.Equal(t, short.value, w.Body.String(), "a value under max_value_size should be returned")
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, _ = http.NewRequest(method, "/baby-names/"+long.key, nil)
+		w = httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		assert.Equal(t, 413, w.Code, "a value over max_value_size should 413 for a %s", method)
+		assert.Equal(t, "", w.Body.String(), "a value over max_value_size shouldn't be returned")
+	}
+
+	body, _ := json.Marshal([]string{short.key, long.key})
+	req, _ = http.NewRequest("POST", "/baby-names", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 413, w.Code, "a batch with a value over max_value_size should 413")
+}
+
+func TestSequinsServeLocal(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	// The local version doesn't have a _SUCCESS file, and the source has
+	// nothing for the db, so it can only come from the directory.
+	dir := filepath.Join(scratch, "local", "20180101")
+	require.NoError(t, directoryCopy(t, dir, "test/baby-names/1"), "setup")
+
+	config := defaultConfig()
+	config.RequireSuccessFile = true
+	config.DBs = map[string]dbConfig{"names": {ServeLocal: dir}}
+
+	source := filepath.Join(scratch, "source")
+	require.NoError(t, directoryCopy(t, filepath.Join(source, "baby-names", "1"), "test/baby-names/1"), "setup")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "baby-names", "1", "_SUCCESS"), nil, 0644), "setup")
+
+	b := backend.NewMultiBackend(backend.NewLocalBackend(source), backend.NewVersionDirBackend("names", dir))
+	ts := getSequinsWithConfig(t, b, "", config)
+
+	for _, db := range []string{"baby-names", "names"} {
+		req, _ := http.NewRequest("GET", "/"+db+"/"+babyNames[0].key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code, "fetching a key from %s should 200", db)
+		assert.Equal(t, babyNames[0].value, w.Body.String(), "fetching a key from %s should return the right value", db)
+	}
+
+	req, _ := http.NewRequest("GET", "/names/"+babyNames[0].key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, "20180101", w.HeaderMap.Get("X-Sequins-Version"), "the version should be named after the directory")
+}
+
+func TestSequinsRateLimit(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.MaxRequestsPerSecond = 0.1
+	config.Sharding.PeerSecret = "hunter2"
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	get := func(path, secret string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if secret != "" {
+			req.Header.Set(peerSecretHeader, secret)
+		}
+
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w
+	}
+
+	key := "/baby-names/" + babyNames[0].key
+	w := get(key, "")
+	assert.Equal(t, 200, w.Code, "the first request should be allowed")
+
+	w = get(key, "")
+	assert.Equal(t, 429, w.Code, "the second request should be limited")
+	assert.Equal(t, "10", w.HeaderMap.Get("Retry-After"), "the response should say when to retry")
+
+	w = get(key+"?proxy=1", "hunter2")
+	assert.Equal(t, 200, w.Code, "proxied requests from peers shouldn't be limited")
+
+	w = get(key+"?proxy=x", "")
+	assert.Equal(t, 429, w.Code, "requests that only claim to be proxied should be limited")
+
+	req, _ := http.NewRequest("HEAD", key, nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 429, w.Code, "HEADs for keys should be limited")
+
+	w = get("/baby-names", "")
+	assert.Equal(t, 200, w.Code, "status requests shouldn't be limited")
+}
+
+func TestSequinsPlan(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+
+	getPlan := func() plan {
+		req, _ := http.NewRequest("GET", "/baby-names/_plan", nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, "fetching the plan should 200")
+
+		var p plan
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p), "the plan should be valid JSON")
+		return p
+	}
+
+	p := getPlan()
+	assert.Equal(t, "1", p.CurrentVersion)
+	assert.Equal(t, "1", p.Version, "with nothing newer, the plan should be to stay on the current version")
+	assert.False(t, p.Upgrade)
+
+	dst := filepath.Join(scratch, "baby-names", "2")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "_SUCCESS"), nil, 0644), "setup: write success file")
+	files, err := ioutil.ReadDir("test/baby-names/1")
+	require.NoError(t, err, "setup")
+
+	p = getPlan()
+	assert.Equal(t, "2", p.Version, "the plan should be to upgrade to the new version")
+	assert.True(t, p.Upgrade)
+	assert.True(t, p.SuccessFile)
+	assert.Equal(t, len(files), p.NumFiles)
+
+	current := ts.dbs["baby-names"].mux.getCurrent()
+	defer ts.dbs["baby-names"].mux.release(current)
+	assert.Equal(t, "1", current.name, "planning shouldn't load anything")
+	assert.Nil(t, ts.dbs["baby-names"].mux.getVersion("2"), "planning shouldn't load anything")
+}
+
+// persistentCoordinator is a coordinator that only keeps persistent children,
+// in memory.
+type persistentCoordinator struct {
+	coordinator
+	nodes map[string][]string
+}
+
+func (c *persistentCoordinator) children(node string) ([]string, error) {
+	return c.nodes[node], nil
+}
+
+func (c *persistentCoordinator) setPersistentChild(node, child string) error {
+	if child == "" {
+		delete(c.nodes, node)
+	} else {
+		c.nodes[node] = []string{child}
+	}
+
+	return nil
+}
+
+func TestSequinsPartitionsRecorded(t *testing.T) {
+	c := &persistentCoordinator{nodes: make(map[string][]string)}
+	db := &db{name: "baby-names", sequins: &sequins{coordinator: c}}
+
+	n, err := db.numPartitions("1", 20)
+	require.NoError(t, err)
+	assert.Equal(t, 20, n, "without 'partitions' set, there should be one partition per file")
+	assert.Equal(t, []string{"20"}, c.nodes[db.partitionCountZKPath("1")], "the count should be recorded")
+
+	// A node with a different setting should still agree with the first.
+	db.config.Partitions = 3
+	n, err = db.numPartitions("1", 20)
+	require.NoError(t, err)
+	assert.Equal(t, 20, n, "the recorded count should win")
+
+	n, err = db.numPartitions("2", 20)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n, "new versions should use the new setting")
+
+	db.forgetPartitions("1")
+	assert.Nil(t, c.nodes[db.partitionCountZKPath("1")], "the count should be removed with the version")
+}
+
+func TestSequinsTimeToConvergeRecorded(t *testing.T) {
+	c := &persistentCoordinator{nodes: make(map[string][]string)}
+	db := &db{name: "baby-names", sequins: &sequins{coordinator: c}}
+	db.config.TimeToConverge = duration{30 * time.Second}
+
+	d, err := db.timeToConverge("1")
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, d)
+	assert.Equal(t, []string{"30s"}, c.nodes[db.convergenceTimeZKPath("1")], "the time should be recorded")
+
+	// A node with a different setting should still agree with the first.
+	db.config.TimeToConverge = duration{0}
+	d, err = db.timeToConverge("1")
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, d, "the recorded time should win")
+
+	d, err = db.timeToConverge("2")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d, "new versions should use the new setting")
+
+	db.forgetConvergenceTime("1")
+	assert.Nil(t, c.nodes[db.convergenceTimeZKPath("1")], "the time should be removed with the version")
+}
+
+// flakyBackend fails to open files for the given version until it's been
+// asked to a certain number of times.
+type flakyBackend struct {
+	backend.Backend
+	version  string
+	failures int32
+	attempts int32
+}
+
+func (b *flakyBackend) Open(db, version, file string) (io.ReadCloser, error) {
+	if version == b.version && file == "part-00000" {
+		if atomic.AddInt32(&b.attempts, 1) <= b.failures {
+			return nil, errors.New("transient error")
+		}
+	}
+
+	return b.Backend.Open(db, version, file)
+}
+
+func TestSequinsLoadRetries(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.LoadMaxRetries = 3
+	config.LoadRetryBackoff = duration{10 * time.Millisecond}
+	flaky := &flakyBackend{Backend: backend.NewLocalBackend(scratch), version: "2", failures: 2}
+	ts := getSequinsWithConfig(t, flaky, "", config)
+	db := ts.dbs["baby-names"]
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "2"), "test/baby-names/1"), "setup: copy data")
+	require.NoError(t, db.refresh())
+
+	var current *version
+	for i := 0; i < 100; i++ {
+		current = db.mux.getCurrent()
+		db.mux.release(current)
+		if current.name == "2" {
+			break
+		}
+
+		// The old version should keep being served while the new one is retried.
+		tuple := babyNames[0]
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, "the current version should be served during retries")
+		assert.Equal(t, "1", w.HeaderMap.Get(versionHeader))
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Equal(t, "2", current.name, "the new version should load after retrying")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&flaky.attempts), "the load should succeed on the third attempt")
+	assert.Equal(t, versionAvailable, current.stats().State, "the version should never be marked as failed")
+}
+
+func TestSequinsLoadRetryReleasesSlot(t *testing.T) {
+	config := defaultConfig()
+	config.MaxParallelLoads = 1
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+	db := ts.dbs["baby-names"]
+
+	vs := db.mux.getCurrent()
+	defer db.mux.release(vs)
+	require.NotNil(t, vs, "setup: there should be a current version")
+
+	// Hold the only load slot, as a build would, and then wait to retry.
+	ts.buildLock.Lock()
+	retried := make(chan bool)
+	go func() { retried <- vs.waitToRetry(200 * time.Millisecond) }()
+
+	acquired := make(chan bool)
+	go func() {
+		ts.buildLock.Lock()
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the load slot should be released while waiting to retry")
+	}
+
+	ts.buildLock.Unlock()
+	select {
+	case ok := <-retried:
+		assert.True(t, ok, "the wait should finish, since the version wasn't canceled")
+	case <-time.After(time.Second):
+		t.Fatal("the load slot should be taken back after waiting to retry")
+	}
+
+	ts.buildLock.Unlock()
+}
+
+// writeChecksums writes an md5sum-style sidecar for every file in dir.
+func writeChecksums(t *testing.T, dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err, "setup: list files")
+
+	for _, info := range infos {
+		b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		require.NoError(t, err, "setup: read file")
+
+		sidecar := fmt.Sprintf("%x  %s\n", md5.Sum(b), info.Name())
+		err = ioutil.WriteFile(filepath.Join(dir, info.Name()+checksumSuffix), []byte(sidecar), 0644)
+		require.NoError(t, err, "setup: write checksum")
+	}
+}
+
+func TestSequinsVerifyChecksums(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	v1 := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, v1, "test/baby-names/1"), "setup: copy data")
+	writeChecksums(t, v1)
+
+	config := defaultConfig()
+	config.Storage.VerifyChecksums = true
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	current := db.mux.getCurrent()
+	db.mux.release(current)
+	require.NotNil(t, current, "a version with matching checksums should load")
+	assert.Equal(t, "1", current.name)
+	assert.Len(t, current.checksumFiles, len(current.files), "the sidecars shouldn't be loaded as data")
+
+	// Corrupt the checksum of one file in the next version.
+	v2 := filepath.Join(scratch, "baby-names", "2")
+	require.NoError(t, directoryCopy(t, v2, "test/baby-names/1"), "setup: copy data")
+	writeChecksums(t, v2)
+	err = ioutil.WriteFile(filepath.Join(v2, "part-00000"+checksumSuffix), []byte("d41d8cd98f00b204e9800998ecf8427e\n"), 0644)
+	require.NoError(t, err, "setup: write checksum")
+	require.NoError(t, db.refresh())
+
+	var failed bool
+	for i := 0; i < 100 && !failed; i++ {
+		for _, vs := range db.mux.getAll() {
+			if vs.name == "2" && vs.stats().State == versionError {
+				failed = true
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, failed, "a version with a mismatched checksum should fail to load")
+
+	current = db.mux.getCurrent()
+	db.mux.release(current)
+	assert.Equal(t, "1", current.name, "the previous version should keep being served")
+}
+
+// listStore lists every file in a local store.
+func listStore(t *testing.T, store string) []string {
+	var files []string
+	err := filepath.Walk(store, func(path string, info os.FileInfo, err error) error {
+		files = append(files, path)
+		return err
+	})
+
+	require.NoError(t, err)
+	return files
+}
+
+func TestSequinsReadOnlyStore(t *testing.T) {
+	store, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(store)
+
+	getSequins(t, backend.NewLocalBackend("test"), store)
+
+	// A version that's still being loaded has no manifest yet.
+	require.NoError(t, os.MkdirAll(filepath.Join(store, "data", "baby-names", "2"), 0755))
+	sb := newStoreBackend(store)
+	versions, err := sb.ListVersions("baby-names", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, versions, "only versions with a manifest should be listed")
+
+	before := listStore(t, store)
+
+	config := defaultConfig()
+	config.ReadOnlyStore = true
+	ts := getSequinsWithConfig(t, sb, store, config)
+
+	for _, tuple := range babyNames[:20] {
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/baby-names/versions/2", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code, "deleting a stored version should 403")
+
+	db := ts.dbs["baby-names"]
+	current := db.mux.getCurrent()
+	db.mux.release(current)
+	require.NotNil(t, current)
+	db.removeVersion(current, false)
+	assert.Equal(t, before, listStore(t, store), "the local store shouldn't be modified")
+}
+
+func TestSequinsIndex(t *testing.T) {
+	store, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(store)
+
+	src, err := filepath.Abs("test/baby-names/1")
+	require.NoError(t, err, "setup")
+
+	dest := filepath.Join(store, "data", "baby-names", "1")
+	require.NoError(t, indexVersion(defaultConfig(), "baby-names", src, dest), "building the index should succeed")
+	assert.Error(t, indexVersion(defaultConfig(), "baby-names", src, dest), "building an index over an existing one should fail")
+
+	// The node should pick up the prebuilt index, rather than loading the
+	// version again.
+	before := listStore(t, dest)
+	ts := getSequins(t, backend.NewLocalBackend("test"), store)
+	testBasicSequins(t, ts, "test/baby-names/1")
+	assert.Equal(t, before, listStore(t, dest), "the prebuilt index should be served as-is")
+}
+
+func TestSequinsPin(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	for _, v := range []string{"1", "2"} {
+		dst := filepath.Join(scratch, "baby-names", v)
+		require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	}
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequins(t, backend, "")
+	db := ts.dbs["baby-names"]
+
+	currentVersion := func() string {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current == nil {
+			return ""
+		}
+
+		return current.name
+	}
+
+	waitForVersion := func(name, msg string) {
+		for i := 0; i < 100 && currentVersion() != name; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		assert.Equal(t, name, currentVersion(), msg)
+	}
+
+	require.Equal(t, "2", currentVersion(), "the newest version should be current")
+
+	req, _ := http.NewRequest("PUT", "/baby-names/_pin", strings.NewReader("3"))
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "pinning a nonexistent version should 404")
+
+	req, _ = http.NewRequest("PUT", "/baby-names/_pin", strings.NewReader("1\n"))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 202, w.Code, "pinning a version should 202")
+	waitForVersion("1", "the db should roll back to the pinned version")
+
+	require.NoError(t, db.refresh())
+	assert.Equal(t, "1", currentVersion(), "refreshing shouldn't move past the pinned version")
+
+	req, _ = http.NewRequest("DELETE", "/baby-names/_pin", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 202, w.Code, "unpinning should 202")
+	assert.Equal(t, "1", currentVersion(), "unpinning shouldn't take effect until the next refresh")
+
+	// Version 2 might still be being cleaned up.
+	err = errVersionRemoving
+	for i := 0; i < 100 && err == errVersionRemoving; i++ {
+		err = db.refresh()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	require.NoError(t, err)
+	waitForVersion("2", "the db should move on to the newest version after unpinning")
+}
+
+func TestSequinsPinRemovingVersion(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "2"), "test/baby-names/1"), "setup: copy data")
+
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+	db := ts.dbs["baby-names"]
+
+	currentVersion := func() string {
+		current := db.mux.getCurrent()
+		db.mux.release(current)
+		if current == nil {
+			return ""
+		}
+
+		return current.name
+	}
+
+	require.Equal(t, "2", currentVersion(), "setup: version 2 should be current")
+
+	// Load version 1 without switching to it, and then mark it as being removed,
+	// as if it had been preempted while it was building.
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+	vs, err := newVersion(ts, db, db.localPath("1"), "1")
+	require.NoError(t, err)
+	db.mux.prepare(vs)
+	vs.build()
+	<-vs.ready
+
+	db.setRemoving("1", true)
+	db.setPinned("1")
+	defer func() {
+		db.setPinned("")
+		db.setRemoving("1", false)
+		db.mux.remove(vs, false)
+	}()
+
+	assert.Equal(t, errVersionRemoving, db.refresh(), "refreshing should wait for the pinned version to be removed")
+
+	// The build finishing shouldn't switch to the version, even though it's now
+	// pinned.
+	db.upgrade(vs)
+	assert.Equal(t, "2", currentVersion(), "the db shouldn't switch to a version that's being removed")
+}
+
+func TestSequinsDeleteStoredVersion(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+	db := ts.dbs["baby-names"]
+
+	defunct := db.localPath("0")
+	require.NoError(t, os.MkdirAll(defunct, 0755), "setup: create a defunct version")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(defunct, "block-00000.spl"), []byte("foo"), 0644), "setup: create a defunct version")
+
+	req, _ := http.NewRequest("DELETE", "/baby-names/versions/1", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 409, w.Code, "deleting the current version should 409")
+	_, err := os.Stat(db.localPath("1"))
+	assert.NoError(t, err, "the current version should still be stored")
+
+	req, _ = http.NewRequest("DELETE", "/baby-names/versions/0", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 204, w.Code, "deleting an unused version should 204")
+	_, err = os.Stat(defunct)
+	assert.True(t, os.IsNotExist(err), "the unused version should be deleted")
+
+	req, _ = http.NewRequest("DELETE", "/baby-names/versions/0", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "deleting a version that isn't stored should 404")
+}
+
+func TestSequinsRepairDropsCachedValues(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	v1 := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, v1, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(v1, "part-99999"), []tuple{{"canary", "corrupt"}})
+
+	config := defaultConfig()
+	config.CacheBytes = 1 << 20
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	db := ts.dbs["baby-names"]
+
+	get := func() string {
+		req, _ := http.NewRequest("GET", "/baby-names/canary", nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, "fetching the canary should 200")
+		return w.Body.String()
+	}
+
+	require.Equal(t, "corrupt", get(), "setup: the canary should be cached")
+
+	// Fix the source, as if the local copy had been corrupted, and repair the
+	// version from it.
+	writeTestSequenceFile(t, filepath.Join(v1, "part-99999"), []tuple{{"canary", "repaired"}})
+	vs := db.mux.getCurrent()
+	require.NotNil(t, vs)
+	defer db.mux.release(vs)
+	vs.repair()
+
+	assert.Equal(t, "repaired", get(), "the repaired value should be served, rather than the cached one")
+}
+
+func TestSequinsRepairVersion(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+	db := ts.dbs["baby-names"]
+
+	vs := db.mux.getCurrent()
+	require.NotNil(t, vs)
+	defer db.mux.release(vs)
+
+	vs.recordIntegrityScan(map[int]error{0: errors.New("corrupt")})
+	oldBlocks := make(map[string]bool)
+	for _, block := range vs.blockStore.Blocks {
+		oldBlocks[block.Name] = true
+	}
+
+	req, _ := http.NewRequest("POST", "/baby-names/versions/2/_repair", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code, "repairing a version that isn't loaded should 404")
+
+	req, _ = http.NewRequest("POST", "/baby-names/versions/1/_repair", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 202, w.Code, "repairing the current version should 202")
+
+	for vs.status().Nodes["localhost"].Repairing {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NotEmpty(t, vs.blockStore.Blocks, "the repaired version should have blocks")
+	for _, block := range vs.blockStore.Blocks {
+		assert.False(t, oldBlocks[block.Name], "the repaired version should have all new blocks")
+	}
+
+	vs.stateLock.RLock()
+	failures := len(vs.integrity.failures)
+	vs.stateLock.RUnlock()
+	assert.Equal(t, 0, failures, "the integrity scan failures should be cleared")
+
+	for _, tuple := range babyNames[:20] {
+		req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
+		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
+	}
+
+	manifest, err := blocks.ReadManifest(vs.path)
+	require.NoError(t, err)
+	for _, block := range manifest.Blocks {
+		assert.False(t, oldBlocks[block.Name], "the manifest should only have the new blocks")
+	}
+}
+
+func TestSequinsEmptyValue(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(dst, "part-99999"), []tuple{{"empty-value", ""}})
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequins(t, backend, "")
+
+	req, _ := http.NewRequest("GET", "/baby-names/empty-value", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "fetching a key with an empty value should 200")
+	assert.Equal(t, "", w.Body.String(), "fetching a key with an empty value should return no body")
+	assert.Equal(t, "0", w.HeaderMap.Get("Content-Length"), "fetching a key with an empty value should set the Content-Length")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "fetching a key with an empty value should set the version header")
+
+	req, _ = http.NewRequest("GET", "/baby-names/missing-value", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "fetching a nonexistent key should still 404")
+}
+
+func TestSequinsURLDecodeNormalization(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(dst, "part-99999"), []tuple{{"Foo%20Bar", "encoded"}})
+
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{"baby-names": {KeyNormalization: []blocks.KeyNormalization{
+		blocks.URLDecodeNormalization, blocks.LowercaseNormalization,
+	}}}
+
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	// The first is decoded once by HTTP, and the second twice.
+	for _, path := range []string{"/baby-names/foo%20bar", "/baby-names/FOO%2520BAR"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "fetching %s should 200", path)
+		assert.Equal(t, "encoded", w.Body.String(), "fetching %s should return the decoded key's value", path)
+	}
+
+	req, _ := http.NewRequest("GET", "/baby-names/Foo+Bar", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code, "a '+' shouldn't be decoded to a space")
+
+	req, _ = http.NewRequest("POST", "/baby-names", strings.NewReader(`["Foo%20Bar"]`))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, "fetching a batch should 200")
+	assert.JSONEq(t, `{"Foo%20Bar": "ZW5jb2RlZA=="}`, w.Body.String(), "batches should be normalized too, and keyed by the requested key")
+}
+
+func TestSequinsCompressedResponses(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	bigValue := strings.Repeat("sequins ", 1000)
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(dst, "part-99999"), []tuple{{"big-value", bigValue}})
+
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+	get := func(ts *sequins, path, acceptEncoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, "fetching %s should 200", path)
+		return w
+	}
+
+	w := get(ts, "/baby-names/big-value", "gzip, deflate")
+	assert.Equal(t, "gzip", w.HeaderMap.Get("Content-Encoding"), "a large value should be compressed")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Length"), "a compressed value shouldn't have a Content-Length")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "a compressed value should still have the version header")
+	assert.True(t, w.Body.Len() < len(bigValue), "the compressed value should be smaller")
+
+	r, err := gzip.NewReader(w.Body)
+	require.NoError(t, err, "the compressed value should be valid gzip")
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err, "the compressed value should be valid gzip")
+	assert.Equal(t, bigValue, string(b), "the compressed value should decompress to the value")
+
+	w = get(ts, "/baby-names/big-value", "")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Encoding"), "a value shouldn't be compressed if the client doesn't ask")
+	assert.Equal(t, bigValue, w.Body.String())
+
+	w = get(ts, "/baby-names/big-value", "gzip;q=0, *")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Encoding"), "a value shouldn't be compressed if the client refuses gzip")
+
+	w = get(ts, "/baby-names/big-value?proxy=1", "gzip")
+	assert.Equal(t, "gzip", w.HeaderMap.Get("Content-Encoding"), "the proxy parameter alone shouldn't turn off compression")
+
+	w = get(ts, "/baby-names/"+babyNames[0].key, "gzip")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Encoding"), "a small value shouldn't be compressed")
+	assert.Equal(t, babyNames[0].value, w.Body.String())
+
+	config := defaultConfig()
+	config.Sharding.PeerSecret = "hunter2"
+	ts = getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	req, _ := http.NewRequest("GET", "/baby-names/big-value?proxy=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set(peerSecretHeader, "hunter2")
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code, "fetching a value with the peer secret should 200")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Encoding"), "a request from a peer shouldn't be compressed")
+	assert.Equal(t, bigValue, w.Body.String())
+
+	config = defaultConfig()
+	config.CompressResponses = false
+	ts = getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	w = get(ts, "/baby-names/big-value", "gzip")
+	assert.Equal(t, "", w.HeaderMap.Get("Content-Encoding"), "a value shouldn't be compressed with compress_responses unset")
+	assert.Equal(t, bigValue, w.Body.String())
+}
+
+func TestSequinsBatch(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	keys := []string{babyNames[0].key, babyNames[1].key, "missing-value"}
+	body, _ := json.Marshal(keys)
+	req, _ := http.NewRequest("POST", "/baby-names", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "fetching a batch should 200")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "fetching a batch should set the version header")
+
+	var values map[string]*string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &values), "the batch response should be a JSON object")
+	require.Len(t, values, 3, "every key in the batch should be in the response")
+	require.NotNil(t, values[babyNames[0].key])
+	assert.Equal(t, encodeValue([]byte(babyNames[0].value)), *values[babyNames[0].key], "values should be base64 encoded by default")
+	require.NotNil(t, values[babyNames[1].key])
+	assert.Equal(t, encodeValue([]byte(babyNames[1].value)), *values[babyNames[1].key], "values should be base64 encoded by default")
+	assert.Nil(t, values["missing-value"], "a nonexistent key should be null")
+
+	ts.dbs["baby-names"].config.ValueEncoding = valueEncodingRaw
+	req, _ = http.NewRequest("POST", "/baby-names", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "fetching a batch should 200")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &values), "the batch response should be a JSON object")
+	require.NotNil(t, values[babyNames[0].key])
+	assert.Equal(t, babyNames[0].value, *values[babyNames[0].key], "values shouldn't be encoded with value_encoding = \"raw\"")
+
+	req, _ = http.NewRequest("POST", "/baby-names", strings.NewReader("not json"))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code, "an invalid batch should 400")
+
+	req, _ = http.NewRequest("POST", "/nonexistent", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "fetching a batch from a nonexistent db should 404")
+}
+
+func TestSequinsPrefixScan(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	expected := make(map[string]string)
+	for _, tuple := range babyNames {
+		if strings.HasPrefix(tuple.key, "190") {
+			expected[tuple.key] = tuple.value
+		}
+	}
+
+	require.NotEmpty(t, expected, "the test data should have keys with the prefix")
+
+	req, _ := http.NewRequest("GET", "/baby-names/_prefix/190", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "a prefix scan should 200")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "a prefix scan should set the version header")
+	assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"))
+
+	var entries []prefixScanEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries), "the prefix scan response should be a JSON array")
+
+	found := make(map[string]string)
+	for _, entry := range entries {
+		value, err := decodeValue(entry.Value)
+		require.NoError(t, err, "values should be base64 encoded by default")
+		found[entry.Key] = string(value)
+	}
+
+	assert.Len(t, entries, len(expected), "each key should only be returned once")
+	assert.Equal(t, expected, found, "the prefix scan should return every key with the prefix")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_prefix/190?limit=2", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "a prefix scan with a limit should 200")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	assert.Len(t, entries, 2, "the limit should be respected")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_prefix/not-a-name", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "a prefix scan with no results should 200")
+	assert.Equal(t, "[]\n", w.Body.String(), "a prefix scan with no results should be an empty array")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_prefix/190?limit=foo", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code, "an invalid limit should 400")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_prefix/190?proxy=1&partition=100", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 500, w.Code, "a proxied prefix scan for a partition we don't have should 500")
+
+	// Without any peers, a partition we don't have can't be scanned at all.
+	current := ts.dbs["baby-names"].mux.getCurrent()
+	current.partitions.dropLocalPartition(0)
+	ts.dbs["baby-names"].mux.release(current)
+
+	req, _ = http.NewRequest("GET", "/baby-names/_prefix/190", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 502, w.Code, "a prefix scan with a missing partition should 502")
+}
+
+func TestSequinsIntegrityScan(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	readyz := func() int {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	db := ts.dbs["baby-names"]
+	vs := db.mux.getCurrent()
+	defer db.mux.release(vs)
+
+	ts.scanIntegrity()
+	assert.False(t, vs.unhealthy(), "the version should be healthy after a clean scan")
+	assert.Equal(t, 200, readyz(), "/readyz should 200 after a clean scan")
+
+	failed := map[int]error{0: errors.New("bad disk")}
+	for i := 1; i < integrityScanMaxFailures; i++ {
+		assert.Empty(t, vs.recordIntegrityScan(failed), "the partition shouldn't be reloaded until it fails enough scans")
+	}
+
+	assert.False(t, vs.unhealthy(), "the version shouldn't be unhealthy until it fails enough scans")
+	assert.Equal(t, []int{0}, vs.recordIntegrityScan(failed), "the partition should be reloaded once it fails enough scans")
+	assert.True(t, vs.unhealthy(), "the version should be unhealthy once it fails enough scans")
+	assert.Equal(t, 503, readyz(), "/readyz should 503 while the version is unhealthy")
+
+	vs.scanIntegrity(1.0)
+	assert.False(t, vs.unhealthy(), "the version should be healthy again after a clean scan")
+	assert.Equal(t, 200, readyz(), "/readyz should 200 again after a clean scan")
+}
+
+func TestSequinsStaleServe(t *testing.T) {
+	config := defaultConfig()
+	config.Sharding.StaleServeWindow = duration{time.Minute}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/baby-names/"+babyNames[0].key, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w
+	}
+
+	db := ts.dbs["baby-names"]
+	vs := db.mux.getCurrent()
+	defer db.mux.release(vs)
+
+	w := get()
+	require.Equal(t, 200, w.Code, "fetching an existing key should 200")
+	assert.Equal(t, "", w.HeaderMap.Get(staleHeader), "a fresh value shouldn't be marked stale")
+
+	// Pretend the partition was dropped, and isn't available anywhere else.
+	partition, _ := vs.blockStore.KeyPartition([]byte(babyNames[0].key))
+	vs.partitions.dropLocalPartition(partition)
+	vs.blockStore.DropPartition(partition)
+
+	w = get()
+	require.Equal(t, 200, w.Code, "fetching a key from a dropped partition should 200 within the window")
+	assert.Equal(t, babyNames[0].value, w.Body.String(), "the stale value should be served")
+	assert.Equal(t, "true", w.HeaderMap.Get(staleHeader), "the value should be marked stale")
+
+	ts.config.Sharding.StaleServeWindow = duration{time.Nanosecond}
+	w = get()
+	assert.Equal(t, 502, w.Code, "fetching a key from a dropped partition should 502 after the window")
+}
+
+func TestSequinsClusterVersions(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+
+	req, _ := http.NewRequest("GET", "/cluster/versions/baby-names", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "fetching the cluster versions should 200")
+
+	var versions map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &versions), "the cluster versions should be valid json")
+	assert.Equal(t, map[string]string{ts.config.Bind: "1"}, versions, "the only node should be serving version 1")
+
+	req, _ = http.NewRequest("GET", "/cluster/versions/nonexistent", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "fetching the cluster versions for a nonexistent db should 404")
+}
+
+func TestSequinsHealthChecks(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, "%s should 200 once everything is loaded", path)
+	}
+
+	// Pretend one of the partitions is still being loaded.
+	db := ts.dbs["baby-names"]
+	vs := db.mux.getCurrent()
+	vs.partitions.dropLocalPartition(0)
+	db.mux.release(vs)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 503, w.Code, "/readyz should 503 while partitions are loading")
+	assert.Contains(t, w.Body.String(), "baby-names", "/readyz should say which db isn't ready")
+
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "/healthz should 200 regardless")
+}
+
+func TestSequinsStats(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	req, _ := http.NewRequest("GET", "/stats", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code, "/stats should 200")
+	assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"))
+
+	var st stats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st), "/stats should return valid JSON")
+
+	db, ok := st.DBs["baby-names"]
+	require.True(t, ok, "the stats should include baby-names")
+	assert.Equal(t, "1", db.CurrentVersion, "the current version should be reported")
+	assert.NotNil(t, db.LastLoadedAt, "the last load time should be reported")
+
+	vs, ok := db.Versions["1"]
+	require.True(t, ok, "the stats should include the current version")
+	assert.True(t, vs.Current)
+	assert.Equal(t, versionAvailable, vs.State)
+	assert.Equal(t, vs.NumPartitions, len(vs.PartitionsOwned), "all the partitions should be owned locally")
+	assert.Equal(t, 0, vs.PartitionsProxied, "no partitions should be proxied")
+	assert.Equal(t, len(babyNames), vs.Keys, "all the keys should be counted")
+
+	// Pretend one of the partitions is still being loaded.
+	current := ts.dbs["baby-names"].mux.getCurrent()
+	current.partitions.dropLocalPartition(0)
+	ts.dbs["baby-names"].mux.release(current)
+
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.Equal(t, 1, st.DBs["baby-names"].Versions["1"].PartitionsProxied, "the dropped partition should be proxied")
+}
+
+func TestSequinsHead(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+	tuple := babyNames[0]
+
+	req, _ := http.NewRequest("HEAD", "/baby-names/"+tuple.key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "a HEAD for an existing key should 200")
+	assert.Equal(t, "", w.Body.String(), "a HEAD should have no body")
+	assert.Equal(t, strconv.Itoa(len(tuple.value)), w.HeaderMap.Get("Content-Length"), "a HEAD should include the value's length")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "a HEAD should set the version header")
+
+	req, _ = http.NewRequest("HEAD", "/baby-names/nonexistent-key", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code, "a HEAD for a missing key should 404")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "a HEAD for a missing key should set the version header")
+}
+
+func TestSequinsEvictVersions(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+	db := ts.dbs["baby-names"]
+
+	// Pretend there's an older version still waiting for peers to stop
+	// requesting it.
+	old := &version{name: "0", db: db, created: time.Now().Add(-time.Hour)}
+	db.mux.prepare(old)
+	require.NoError(t, os.MkdirAll(db.localPath(old.name), 0755), "setup")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(db.localPath(old.name), "block"), []byte("old data"), 0644), "setup")
+
+	removed := make(chan *version)
+	go func() { removed <- db.mux.remove(old, true) }()
+
+	// Under the limit, nothing should be evicted.
+	ts.evictVersions(1 << 40)
+	select {
+	case <-removed:
+		t.Fatal("the old version shouldn't be evicted while under the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ts.evictVersions(1)
+	select {
+	case vs := <-removed:
+		assert.Equal(t, old, vs, "the old version should be evicted")
+	case <-time.After(time.Second):
+		t.Fatal("the old version should be evicted once the store is over the limit")
+	}
+
+	current := db.mux.getCurrent()
+	defer db.mux.release(current)
+	require.NotNil(t, current, "the current version should never be evicted")
+	assert.Equal(t, "1", current.name)
+}
+
+func TestSequinsWaitForVersion(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+
+	start := time.Now()
+	ts.waitForVersion(time.Minute, make(chan bool))
+	assert.True(t, time.Since(start) < time.Second, "it shouldn't wait if there's already a version")
+
+	empty := &sequins{dbs: map[string]*db{"baby-names": {mux: newVersionMux(0)}}}
+	start = time.Now()
+	empty.waitForVersion(200*time.Millisecond, make(chan bool))
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "it should wait until the timeout if there's no version")
+
+	stopped := make(chan bool)
+	close(stopped)
+	start = time.Now()
+	empty.waitForVersion(time.Minute, stopped)
+	assert.True(t, time.Since(start) < time.Second, "it should stop waiting on shutdown")
+}
+
+func TestSequinsList(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+
+	list := func() []dbListing {
+		req, _ := http.NewRequest("GET", "/?list", nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code, "/?list should 200")
+		assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"))
+
+		var dbs []dbListing
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &dbs), "/?list should return valid JSON")
+		return dbs
+	}
+
+	assert.Equal(t, []dbListing{{Name: "baby-names", CurrentVersion: "1"}}, list())
+
+	// New dbs should show up after a refresh.
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "more-names", "1"), "test/baby-names/1"), "setup: copy data")
+	ts.refreshAll()
+
+	// The new db's version may still be loading.
+	dbs := list()
+	require.Equal(t, 2, len(dbs), "the new db should be listed")
+	assert.Equal(t, "baby-names", dbs[0].Name)
+	assert.Equal(t, "more-names", dbs[1].Name)
+}
+
+func TestSequinsStopServing(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	// Make the request slow, so that it's still in flight when we stop.
+	started := make(chan bool)
+	ts.http = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		ts.ServeHTTP(w, r)
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "setup")
+
+	served := make(chan error)
+	go func() {
+		served <- ts.http.Serve(listener)
+	}()
+
+	tuple := babyNames[rand.Intn(len(babyNames))]
+	url := fmt.Sprintf("http://%s/baby-names/%s", listener.Addr(), tuple.key)
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(url)
+		assert.NoError(t, err, "the in-flight request should succeed")
+		responses <- resp
+	}()
+
+	<-started
+	ts.stopServing()
+
+	resp := <-responses
+	require.NotNil(t, resp)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode, "the in-flight request should finish")
+	assert.Equal(t, tuple.value, string(body), "the in-flight request should finish")
+	assert.Equal(t, http.ErrServerClosed, <-served, "the server should stop")
+
+	_, err = http.Get(url)
+	assert.Error(t, err, "new requests should be refused")
+}
+
+func TestSequinsContentType(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	for _, name := range []string{"json", "raw", "text"} {
+		require.NoError(t, directoryCopy(t, filepath.Join(scratch, name, "1"), "test/baby-names/1"), "setup: copy data")
+	}
+
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{
+		"json": {ContentType: "application/json"},
+	}
+
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	req, _ := http.NewRequest("GET", "/json/"+babyNames[0].key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"), "the configured content type should be set")
+
+	req, _ = http.NewRequest("GET", "/raw/"+babyNames[0].key, nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/octet-stream", w.HeaderMap.Get("Content-Type"), "the content type should default to application/octet-stream")
+
+	// A global content type applies to dbs without their own.
+	ts.config.ContentType = "text/plain"
+	req, _ = http.NewRequest("GET", "/text/"+babyNames[0].key, nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/plain", w.HeaderMap.Get("Content-Type"), "the global content type should be set")
+
+	// Proxied responses get the same content type.
+	vs := ts.dbs["json"].mux.getCurrent()
+	defer ts.dbs["json"].mux.release(vs)
+
+	w = httptest.NewRecorder()
+	vs.writeProxiedHeader(w, &http.Response{StatusCode: 200, Header: make(http.Header)}, "peer")
+	assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"), "the configured content type should be set on proxied responses")
+}
+
+func TestSequinsPerDBRefreshPeriod(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	for _, name := range []string{"fast", "slow"} {
+		require.NoError(t, directoryCopy(t, filepath.Join(scratch, name, "1"), "test/baby-names/1"), "setup: copy data")
+	}
+
+	config := defaultConfig()
+	config.DBs = map[string]dbConfig{
+		"fast": {RefreshPeriod: &duration{50 * time.Millisecond}},
+	}
+
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+	fast := ts.dbs["fast"]
+	slow := ts.dbs["slow"]
+	defer fast.close()
+
+	for _, name := range []string{"fast", "slow"} {
+		require.NoError(t, directoryCopy(t, filepath.Join(scratch, name, "2"), "test/baby-names/1"), "setup: copy data")
+	}
+
+	currentVersion := func(db *db) string {
+		vs := db.mux.getCurrent()
+		defer db.mux.release(vs)
+		if vs == nil {
+			return ""
+		}
+
+		return vs.name
+	}
+
+	for i := 0; i < 100 && currentVersion(fast) != "2"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, "2", currentVersion(fast), "the db with its own refresh period should be refreshed")
+	assert.Equal(t, "1", currentVersion(slow), "the db without one should use the global refresh period, which is disabled")
+}
+
+func TestSequinsRefreshEndpoints(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+
+	currentVersion := func(name string) string {
+		ts.dbsLock.RLock()
+		db := ts.dbs[name]
+		ts.dbsLock.RUnlock()
+		if db == nil {
+			return ""
+		}
+
+		vs := db.mux.getCurrent()
+		defer db.mux.release(vs)
+		if vs == nil {
+			return ""
+		}
+
+		return vs.name
+	}
+
+	req, _ := http.NewRequest("GET", "/_refresh", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 405, w.Code, "only POST should trigger a refresh")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "2"), "test/baby-names/1"), "setup: copy data")
+	req, _ = http.NewRequest("POST", "/baby-names/_refresh", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 202, w.Code, "refreshing a db should 202")
+
+	for i := 0; i < 100 && currentVersion("baby-names") != "2"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, "2", currentVersion("baby-names"), "refreshing the db should load the new version")
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "names", "1"), "test/baby-names/1"), "setup: copy data")
+	req, _ = http.NewRequest("POST", "/_refresh", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 202, w.Code, "refreshing all dbs should 202")
+
+	for i := 0; i < 100 && currentVersion("names") != "1"; i++ {
+		time.Sleep(100 * time.Millisecond)
 	}
 
+	assert.Equal(t, "1", currentVersion("names"), "refreshing all dbs should pick up new dbs")
+}
+
+func TestSequinsDisableDB(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+	defer os.RemoveAll(scratch)
+
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "baby-names", "1"), "test/baby-names/1"), "setup: copy data")
+	require.NoError(t, directoryCopy(t, filepath.Join(scratch, "names", "1"), "test/baby-names/1"), "setup: copy data")
+
 	config := defaultConfig()
-	config.Bind = "localhost:9599"
-	config.LocalStore = localStore
-	config.MaxParallelLoads = 1
+	config.DisabledDatabases = []string{"names"}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
 
-	s := newSequins(backend, config)
-	require.NoError(t, s.init())
+	key := babyNames[0].key
+	get := func(path string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w.Code
+	}
 
-	// This is a hack to wait until all DBs are ready.
-	dbs, err := backend.ListDBs()
-	require.NoError(t, err)
-	for _, dbName := range dbs {
-		for {
-			versions, err := backend.ListVersions(dbName, "", false)
-			require.NoError(t, err)
-			if len(versions) == 0 {
-				break
-			}
+	post := func(path string) int {
+		req, _ := http.NewRequest("POST", path, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w.Code
+	}
 
-			s.dbsLock.RLock()
-			db := s.dbs[dbName]
-			s.dbsLock.RUnlock()
+	assert.Equal(t, 503, get("/names/"+key), "a db in disabled_databases should 503")
+	assert.Equal(t, 503, post("/names/_refresh"), "a disabled db shouldn't be refreshed")
+	assert.Equal(t, 200, get("/baby-names/"+key), "other dbs should be served as usual")
 
-			if db != nil {
-				current := db.mux.getCurrent()
-				db.mux.release(current)
-				if current != nil {
-					break
-				}
-			}
+	assert.Equal(t, 405, get("/names/_enable"), "only POST should enable a db")
+	assert.Equal(t, 202, post("/names/_enable"), "enabling a db should 202")
+	for i := 0; i < 100 && get("/names/"+key) != 200; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
 
-			time.Sleep(time.Millisecond)
+	assert.Equal(t, 200, get("/names/"+key), "enabling a db should load it")
+
+	assert.Equal(t, 202, post("/baby-names/_disable"), "disabling a db should 202")
+	assert.Equal(t, 202, post("/baby-names/_disable"), "disabling a db again should 202")
+	assert.Equal(t, 503, get("/baby-names/"+key), "a disabled db should 503")
+	assert.Equal(t, 503, post("/baby-names"), "batches for a disabled db should 503")
+	assert.Equal(t, 200, get("/names/"+key), "other dbs should be served as usual")
+
+	ts.refreshAll()
+	assert.Equal(t, 503, get("/baby-names/"+key), "a disabled db shouldn't be loaded again by a refresh")
+
+	_, err = os.Stat(filepath.Join(ts.config.LocalStore, "data", "baby-names", "1"))
+	assert.NoError(t, err, "disabling a db shouldn't remove its data")
+}
+
+func TestSequinsReadTokens(t *testing.T) {
+	config := defaultConfig()
+	config.ReadTokens = []string{"foo", "bar"}
+	config.Sharding.PeerSecret = "hunter2"
+	config.DBs = map[string]dbConfig{"baby-names": {ReadTokens: []string{"baz"}}}
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	get := func(header, value string) int {
+		req, _ := http.NewRequest("GET", "/baby-names/"+babyNames[0].key, nil)
+		if header != "" {
+			req.Header.Set(header, value)
 		}
+
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w.Code
 	}
 
-	return s
+	assert.Equal(t, 401, get("", ""), "a request without a token should 401")
+	assert.Equal(t, 401, get("Authorization", "Bearer foo"), "the db's own tokens should replace the global ones")
+	assert.Equal(t, 401, get("Authorization", "Basic baz"), "only bearer tokens should be accepted")
+	assert.Equal(t, 200, get("Authorization", "Bearer baz"), "a request with the right token should 200")
+	assert.Equal(t, 401, get(peerSecretHeader, "wrong"), "a request with the wrong peer secret should 401")
+	assert.Equal(t, 200, get(peerSecretHeader, "hunter2"), "a request with the peer secret should 200")
+
+	req, _ := http.NewRequest("POST", "/baby-names", strings.NewReader(`["foo"]`))
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code, "batches should need a token too")
+
+	req, _ = http.NewRequest("GET", "/baby-names/", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, "the db status shouldn't need a token")
 }
 
-func testBasicSequins(t *testing.T, ts *sequins, expectedDBPath string) {
-	for i := 0; i < 20; i++ {
-		tuple := babyNames[rand.Intn(len(babyNames))]
+func TestSequinsAdminTokens(t *testing.T) {
+	config := defaultConfig()
+	config.AdminTokens = []string{"foo"}
+	config.Sharding.PeerSecret = "hunter2"
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend("test"), "", config)
+
+	admin := func(method, path, header, value string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
 
-		req, _ := http.NewRequest("GET", fmt.Sprintf("/baby-names/%s", tuple.key), nil)
 		w := httptest.NewRecorder()
 		ts.ServeHTTP(w, req)
+		return w.Code
+	}
 
-		assert.Equal(t, 200, w.Code, "fetching an existing key (%s) should 200", tuple.key)
-		assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) should return the value", tuple.key)
-		assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "when fetching an existing key, the sequins version header should be set")
+	assert.Equal(t, 401, admin("DELETE", "/baby-names/versions/0", "", ""), "an admin action without a token should 401")
+	assert.Equal(t, 401, admin("DELETE", "/baby-names/versions/0", "Authorization", "Bearer bar"), "an admin action with the wrong token should 401")
+	assert.Equal(t, 404, admin("DELETE", "/baby-names/versions/0", "Authorization", "Bearer foo"), "an admin action with the right token should go through")
+	assert.Equal(t, 404, admin("DELETE", "/baby-names/versions/0", peerSecretHeader, "hunter2"), "an admin action with the peer secret should go through")
+	assert.Equal(t, 401, admin("POST", "/baby-names/versions/1/_repair", "", ""), "repairing a version should need a token")
+	assert.Equal(t, 401, admin("PUT", "/baby-names/_pin", "", ""), "pinning should need a token")
+	assert.Equal(t, 401, admin("POST", "/baby-names/_drain", "", ""), "draining should need a token")
+	assert.Equal(t, 401, admin("POST", "/baby-names/_disable", "", ""), "disabling should need a token")
+	assert.False(t, ts.isDisabled("baby-names"), "the db shouldn't be disabled without a token")
+	assert.Equal(t, 401, admin("POST", "/_refresh", "", ""), "refreshing every db should need a token")
+	assert.Equal(t, 401, admin("POST", "/baby-names/_refresh", "", ""), "refreshing a db should need a token")
+	assert.Equal(t, 202, admin("POST", "/_refresh", "Authorization", "Bearer foo"), "refreshing with the right token should 202")
+	assert.Equal(t, 401, admin("POST", "/_rejoin", "", ""), "rejoining should need a token")
+	assert.Equal(t, 401, admin("POST", "/_maintenance", "", ""), "entering maintenance mode should need a token")
+	assert.False(t, ts.inMaintenance(), "the node shouldn't enter maintenance mode without a token")
+	assert.Equal(t, 200, admin("GET", "/baby-names/"+babyNames[0].key, "", ""), "reads shouldn't need an admin token")
+
+	assert.Equal(t, 202, admin("POST", "/baby-names/_disable", "Authorization", "Bearer foo"), "disabling with the right token should 202")
+	assert.Equal(t, 401, admin("POST", "/baby-names/_enable", "", ""), "enabling should need a token")
+	assert.True(t, ts.isDisabled("baby-names"), "the db shouldn't be enabled without a token")
+	assert.Equal(t, 202, admin("POST", "/baby-names/_enable", "Authorization", "Bearer foo"), "enabling with the right token should 202")
+}
+
+func TestSequinsRejoin(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+
+	req, _ := http.NewRequest("POST", "/_rejoin", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code, "rejoining should 400 outside of a cluster")
+
+	done := ts.startRead()
+	assert.False(t, ts.waitForReads(50*time.Millisecond), "waiting for reads should time out while one is in flight")
+
+	done()
+	assert.True(t, ts.waitForReads(50*time.Millisecond), "waiting for reads should finish once none are in flight")
+}
+
+func TestSequinsMaintenance(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+	tuple := babyNames[0]
+
+	get := func(path string, proxied bool) *httptest.ResponseRecorder {
+		if proxied {
+			path += "?proxy=1"
+		}
+
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w
 	}
 
-	req, _ := http.NewRequest("GET", "/baby-names/foo", nil)
+	req, _ := http.NewRequest("POST", "/_maintenance", nil)
 	w := httptest.NewRecorder()
 	ts.ServeHTTP(w, req)
+	assert.Equal(t, 204, w.Code, "entering maintenance mode should 204")
 
-	assert.Equal(t, 404, w.Code, "fetching a nonexistent key should 404")
-	assert.Equal(t, "", w.Body.String(), "fetching a nonexistent key should return no body")
-	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "when fetchin a nonexistent key, the sequins version header should still be set")
+	w = get("/baby-names/"+tuple.key, false)
+	assert.Equal(t, 503, w.Code, "reads should 503 in maintenance mode")
+	assert.Equal(t, "true", w.HeaderMap.Get(maintenanceHeader), "reads turned away should be marked")
 
-	req, _ = http.NewRequest("GET", "/otherdb/foo", nil)
+	w = get("/baby-names/"+tuple.key, true)
+	assert.Equal(t, 200, w.Code, "proxied reads should still be served in maintenance mode")
+	assert.Equal(t, tuple.value, w.Body.String())
+
+	w = get("/readyz", false)
+	assert.Equal(t, 503, w.Code, "/readyz should 503 in maintenance mode")
+	assert.Contains(t, w.Body.String(), "maintenance", "/readyz should say why it isn't ready")
+
+	req, _ = http.NewRequest("DELETE", "/_maintenance", nil)
 	w = httptest.NewRecorder()
 	ts.ServeHTTP(w, req)
+	assert.Equal(t, 204, w.Code, "leaving maintenance mode should 204")
 
-	assert.Equal(t, 404, w.Code, "fetching from a nonexistent db should 404")
-	assert.Equal(t, "", w.Body.String(), "fetching from a nonexistent db should return no body")
-	assert.Equal(t, "", w.HeaderMap.Get(versionHeader), "when fetching from a nonexistent db, the sequins version header shouldn't be set")
+	w = get("/baby-names/"+tuple.key, false)
+	assert.Equal(t, 200, w.Code, "reads should be served again right away")
+	assert.Equal(t, tuple.value, w.Body.String())
 
-	testBasicStatus(t, ts, expectedDBPath)
+	req, _ = http.NewRequest("GET", "/_maintenance", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	assert.Equal(t, 405, w.Code, "only POST and DELETE should be allowed")
 }
 
-func testBasicStatus(t *testing.T, ts *sequins, expectedDBPath string) {
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set("Accept", "application/json")
+func TestSequinsErrorCodes(t *testing.T) {
+	ts := getSequins(t, backend.NewLocalBackend("test"), "")
+
+	get := func(path string, json bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if json {
+			req.Header.Set("Accept", "application/json")
+		}
+
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/baby-names/foo", false)
+	assert.Equal(t, 404, w.Code, "fetching a nonexistent key should 404")
+	assert.Equal(t, "key_not_found", w.HeaderMap.Get(errorCodeHeader), "the error code should be set as a header")
+	assert.Equal(t, "", w.Body.String(), "there should be no body unless the client accepts JSON")
+
+	cases := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/baby-names/foo", 404, "key_not_found"},
+		{"/otherdb/foo", 404, "database_not_found"},
+		{"/baby-names/_v/2/foo", 409, "version_not_available"},
+		{"/baby-names/_v/1", 400, "bad_request"},
+	}
+
+	for _, c := range cases {
+		w = get(c.path, true)
+		assert.Equal(t, c.status, w.Code, "fetching %s should %d", c.path, c.status)
+		assert.Equal(t, "application/json", w.HeaderMap.Get("Content-Type"), "fetching %s should return JSON", c.path)
+		assert.JSONEq(t, fmt.Sprintf(`{"code": %q, "status": %d}`, c.code, c.status), w.Body.String(),
+			"fetching %s should return the error code", c.path)
+	}
+
+	tuple := babyNames[0]
+	w = get("/baby-names/"+tuple.key, true)
+	assert.Equal(t, 200, w.Code, "fetching an existing key should still 200")
+	assert.Equal(t, tuple.value, w.Body.String(), "a value shouldn't be wrapped in JSON")
+
+	atomic.StoreInt32(&ts.maintenance, 1)
+	w = get("/baby-names/"+tuple.key, true)
+	assert.Equal(t, 503, w.Code, "reads should 503 in maintenance mode")
+	assert.JSONEq(t, `{"code": "maintenance", "status": 503}`, w.Body.String())
+}
+
+func TestSequinsSpecificVersion(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	backend := backend.NewLocalBackend(scratch)
+	ts := getSequins(t, backend, "")
+
+	tuple := babyNames[rand.Intn(len(babyNames))]
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/baby-names/_v/1/%s", tuple.key), nil)
 	w := httptest.NewRecorder()
 	ts.ServeHTTP(w, req)
 
-	status := status{}
-	err := json.Unmarshal(w.Body.Bytes(), &status)
-	require.NoError(t, err, "fetching global status should work and be valid")
-	assert.Equal(t, 200, w.Code, "fetching global status should work and be valid")
+	assert.Equal(t, 200, w.Code, "fetching an existing key (%s) from a specific version should 200", tuple.key)
+	assert.Equal(t, tuple.value, w.Body.String(), "fetching an existing key (%s) from a specific version should return the value", tuple.key)
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader), "the sequins version header should be set")
 
-	require.Equal(t, 1, len(status.DBs), "there should be a single db")
-	validateStatus(t, status.DBs["baby-names"], expectedDBPath)
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/baby-names/_v/2/%s", tuple.key), nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
 
-	req, _ = http.NewRequest("GET", "/baby-names/", nil)
-	req.Header.Set("Accept", "application/json")
+	assert.Equal(t, 409, w.Code, "fetching a key from a nonexistent version should 409")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_v/1", nil)
 	w = httptest.NewRecorder()
 	ts.ServeHTTP(w, req)
 
-	dbStatus := dbStatus{}
-	err = json.Unmarshal(w.Body.Bytes(), &dbStatus)
-	require.NoError(t, err, "fetching db status should work and be valid")
-	assert.Equal(t, 200, w.Code, "fetching db status should work and be valid")
-	validateStatus(t, dbStatus, expectedDBPath)
+	assert.Equal(t, 400, w.Code, "fetching a specific version without a key should 400")
 }
 
-func validateStatus(t *testing.T, status dbStatus, expectedPath string) {
-	require.Equal(t, 1, len(status.Versions), "dbStatus should have one version registered")
+func TestSequinsVersionOverride(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
 
-	versionStatus := status.Versions["1"]
-	assert.Equal(t, expectedPath, versionStatus.Path, "versionStatus path should be correct")
-	for _, nodeStatus := range versionStatus.Nodes {
-		assert.True(t, nodeStatus.Current, "dbStatus should be registered as the current one")
+	v1 := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, v1, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(v1, "part-99999"), []tuple{{"canary", "old"}})
+
+	ts := getSequins(t, backend.NewLocalBackend(scratch), "")
+	db := ts.dbs["baby-names"]
+
+	v2 := filepath.Join(scratch, "baby-names", "2")
+	require.NoError(t, directoryCopy(t, v2, "test/baby-names/1"), "setup: copy data")
+	writeTestSequenceFile(t, filepath.Join(v2, "part-99999"), []tuple{{"canary", "new"}})
+
+	// Load version 2 without switching to it, as if the rest of the cluster
+	// hadn't caught up yet.
+	vs, err := newVersion(ts, db, db.localPath("2"), "2")
+	require.NoError(t, err)
+	db.mux.prepare(vs)
+	vs.build()
+	<-vs.ready
+	defer db.mux.remove(vs, false)
+
+	get := func(path, header string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if header != "" {
+			req.Header.Set(versionHeader, header)
+		}
+
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, req)
+		return w
 	}
+
+	w := get("/baby-names/canary", "")
+	assert.Equal(t, "old", w.Body.String(), "the current version should be served by default")
+	assert.Equal(t, "1", w.HeaderMap.Get(versionHeader))
+
+	w = get("/baby-names/canary", "2")
+	assert.Equal(t, 200, w.Code, "asking for a loaded version with the header should 200")
+	assert.Equal(t, "new", w.Body.String(), "the value should come from the version asked for")
+	assert.Equal(t, "2", w.HeaderMap.Get(versionHeader), "the version header should be set to the version asked for")
+
+	w = get("/baby-names/canary?version=2", "")
+	assert.Equal(t, 200, w.Code, "asking for a loaded version with the parameter should 200")
+	assert.Equal(t, "new", w.Body.String(), "the value should come from the version asked for")
+
+	w = get("/baby-names/canary?version=1", "2")
+	assert.Equal(t, "old", w.Body.String(), "the parameter should win over the header")
+
+	w = get("/baby-names/canary", "3")
+	assert.Equal(t, 409, w.Code, "asking for a version that isn't loaded should 409")
 }
 
-func TestSequins(t *testing.T) {
+func TestSequinsUpgradeHook(t *testing.T) {
+	events := make(chan upgradeEvent, 1)
+	var attempts int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt, to check that it's retried.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event upgradeEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event), "the upgrade hook payload should be valid")
+		events <- event
+	}))
+	defer hook.Close()
+
 	scratch, err := ioutil.TempDir("", "sequins-")
 	require.NoError(t, err, "setup")
 
 	dst := filepath.Join(scratch, "baby-names", "1")
 	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
 
+	config := defaultConfig()
+	config.UpgradeHookURL = hook.URL
+
 	backend := backend.NewLocalBackend(scratch)
-	ts := getSequins(t, backend, "")
-	testBasicSequins(t, ts, filepath.Join(scratch, "baby-names/1"))
+	getSequinsWithConfig(t, backend, "", config)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "baby-names", event.DB, "the upgrade event should have the db")
+		assert.Equal(t, "", event.OldVersion, "the upgrade event should have no old version")
+		assert.Equal(t, "1", event.NewVersion, "the upgrade event should have the new version")
+		assert.Equal(t, "localhost:9599", event.Node, "the upgrade event should have the node")
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "the upgrade hook should have been called")
+	}
 }
 
 func TestEmptyVersionSequins(t *testing.T) {
@@ -269,6 +2503,35 @@ func TestSequinsThreadsafe(t *testing.T) {
 	os.RemoveAll(scratch)
 }
 
+// writeTestSequenceFile writes an uncompressed SequenceFile[BytesWritable,
+// BytesWritable] with the given records.
+func writeTestSequenceFile(t *testing.T, path string, records []tuple) {
+	className := sequencefile.BytesWritableClassName
+	syncMarker := bytes.Repeat([]byte{0xab}, sequencefile.SyncSize)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("SEQ\x06")
+	for i := 0; i < 2; i++ {
+		buf.WriteByte(byte(len(className)))
+		buf.WriteString(className)
+	}
+
+	buf.Write([]byte{0, 0})
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	buf.Write(syncMarker)
+
+	for _, record := range records {
+		binary.Write(buf, binary.BigEndian, uint32(len(record.key)+len(record.value)+8))
+		binary.Write(buf, binary.BigEndian, uint32(len(record.key)+4))
+		binary.Write(buf, binary.BigEndian, uint32(len(record.key)))
+		buf.WriteString(record.key)
+		binary.Write(buf, binary.BigEndian, uint32(len(record.value)))
+		buf.WriteString(record.value)
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644), "setup: write sequencefile")
+}
+
 func directoryCopy(t *testing.T, dest, src string) error {
 	t.Logf("Copying %s -> %s\n", src, dest)
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
@@ -332,3 +2595,107 @@ func createTestIndex(t *testing.T, scratch string, i int) {
 	_, err := os.Create(filepath.Join(path, "_SUCCESS"))
 	require.NoError(t, err)
 }
+
+func TestSequinsDBETag(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.DBETags = true
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	req, _ := http.NewRequest("GET", "/baby-names/_etag", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	etag := w.HeaderMap.Get("ETag")
+	assert.Equal(t, 200, w.Code, "fetching the db etag should 200")
+	assert.True(t, strings.HasPrefix(etag, `"1-`), "the etag should include the version")
+	assert.Equal(t, strings.Trim(etag, `"`)+"\n", w.Body.String(), "the body should be the fingerprint")
+
+	req, _ = http.NewRequest("HEAD", "/baby-names", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "a HEAD request for the db should 200")
+	assert.Equal(t, etag, w.HeaderMap.Get("ETag"), "a HEAD request for the db should return the same etag")
+	assert.Equal(t, "", w.Body.String(), "a HEAD request for the db should have no body")
+
+	req, _ = http.NewRequest("GET", "/baby-names/_etag", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code, "a conditional request with a matching etag should 304")
+}
+
+func TestSequinsPrometheus(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "sequins-")
+	require.NoError(t, err, "setup")
+
+	dst := filepath.Join(scratch, "baby-names", "1")
+	require.NoError(t, directoryCopy(t, dst, "test/baby-names/1"), "setup: copy data")
+
+	config := defaultConfig()
+	config.PrometheusEnabled = true
+	ts := getSequinsWithConfig(t, backend.NewLocalBackend(scratch), "", config)
+
+	req, _ := http.NewRequest("GET", "/baby-names/foo", nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code, "fetching metrics should work")
+
+	body := w.Body.String()
+	assert.Contains(t, body, "sequins_requests_total{db=\"baby-names\"} 1\n", "requests should be counted")
+	assert.Contains(t, body, "sequins_current_version{db=\"baby-names\",version=\"1\"} 1\n", "the current version should be exported")
+	assert.Contains(t, body, "sequins_partitions{db=\"baby-names\",version=\"1\"} 20\n", "the number of partitions should be exported")
+	assert.Contains(t, body, "sequins_version_load_duration_seconds{db=\"baby-names\",version=\"1\"}", "the load duration should be exported")
+}
+
+// disconnectedCoordinator is a coordinator that's lost its connection. Only
+// connected is implemented.
+type disconnectedCoordinator struct {
+	coordinator
+}
+
+func (c disconnectedCoordinator) connected() bool {
+	return false
+}
+
+func TestSequinsDegraded(t *testing.T) {
+	backend := backend.NewLocalBackend("test")
+	ts := getSequins(t, backend, "")
+
+	tuple := babyNames[0]
+	req, _ := http.NewRequest("GET", "/baby-names/"+tuple.key, nil)
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.HeaderMap.Get(degradedHeader), "the degraded header shouldn't be set normally")
+
+	ts.coordinator = disconnectedCoordinator{}
+	defer func() { ts.coordinator = nil }()
+
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "the node should keep serving while disconnected")
+	assert.Equal(t, tuple.value, w.Body.String(), "the node should keep serving while disconnected")
+	assert.Equal(t, "true", w.HeaderMap.Get(degradedHeader), "the degraded header should be set while disconnected")
+
+	req, _ = http.NewRequest("GET", "/stats", nil)
+	w = httptest.NewRecorder()
+	ts.ServeHTTP(w, req)
+
+	var st stats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.True(t, st.Degraded, "/stats should report that the node is degraded")
+}
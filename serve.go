@@ -2,124 +2,356 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/stripe/sequins/blocks"
 )
 
 // serveKey is the entrypoint for incoming HTTP requests. It looks up the value
 // locally, for, failing that, asks a peer that has it. If the request was
-// already proxied to us, it is not proxied further.
+// already proxied to us, it is not proxied further. HEAD requests get the same
+// status and headers, including the length of the value, but no body.
 func (vs *version) serveKey(w http.ResponseWriter, r *http.Request, key string) {
+	start := time.Now()
+
 	// If we don't have any data for this version at all, that's a 404.
 	if vs.numPartitions == 0 {
 		vs.serveNotFound(w)
 		return
 	}
 
-	partition, alternatePartition := blocks.KeyPartition([]byte(key), vs.numPartitions)
+	// The key is normalized the same way it was when the version was built.
+	key = string(vs.blockStore.NormalizeKey([]byte(key)))
+	partition, alternatePartition := vs.blockStore.KeyPartition([]byte(key))
 	if vs.partitions.have(partition) || vs.partitions.have(alternatePartition) {
+		if cache := vs.sequins.cache; cache != nil {
+			if cached, ok := cache.get(vs, key); ok {
+				vs.setLookupTime(w.Header(), start)
+				vs.serveCached(w, r, cached)
+				return
+			}
+		}
+
 		record, err := vs.blockStore.Get(key)
 		if err != nil {
 			vs.serveError(w, key, err)
 			return
 		}
 
-		vs.serveLocal(w, key, record)
-	} else if r.URL.Query().Get("proxy") == "" {
+		vs.setLookupTime(w.Header(), start)
+		vs.serveLocal(w, r, key, record)
+
+		// Read repair reads the whole value, so large ones are skipped.
+		small := record == nil || !vs.sequins.shouldStream(int64(record.ValueLen))
+		if partition == alternatePartition && r.Method != "HEAD" && small && vs.sampleReadRepair() {
+			go vs.readRepair(r, key, partition)
+		}
+	} else if proxyDisabled(r) {
+		vs.serveNotLocal(w, partition)
+	} else if proxiedVersion(r) == "" {
+		if vs.canServeStale(partition) {
+			vs.serveStale(w, r, key)
+			return
+		}
+
 		vs.serveProxied(w, r, key, partition, alternatePartition)
 	} else {
 		vs.serveError(w, key, errProxiedIncorrectly)
 	}
 }
 
-func (vs *version) serveLocal(w http.ResponseWriter, key string, record *blocks.Record) {
+func (vs *version) serveLocal(w http.ResponseWriter, r *http.Request, key string, record *blocks.Record) {
 	if record == nil {
 		vs.serveNotFound(w)
 		return
 	}
 
 	defer record.Close()
-	w.Header().Set(versionHeader, vs.name)
-	w.Header().Set("Content-Length", strconv.FormatUint(record.ValueLen, 10))
-	w.Header().Set("Last-Modified", vs.created.UTC().Format(http.TimeFormat))
-	_, err := io.Copy(w, record)
+	if vs.sequins.tooLarge(record.ValueLen) {
+		vs.serveTooLarge(w)
+		return
+	}
+
+	// If the value is small enough, read it into the cache, if there is one, so
+	// that the next request for it doesn't touch the block store.
+	cache := vs.sequins.cache
+	if cache != nil && r.Method != "HEAD" && cache.fits(record.ValueLen) && !vs.sequins.shouldStream(int64(record.ValueLen)) {
+		value, err := ioutil.ReadAll(record)
+		if err != nil {
+			vs.serveError(w, key, err)
+			return
+		}
+
+		metadata := append([]byte(nil), record.Metadata...)
+		cache.add(vs, key, value, metadata)
+		vs.serveCached(w, r, &cachedValue{value: value, metadata: metadata})
+		return
+	}
+
+	vs.serveRecord(w, r, key, record)
+}
+
+// serveRecord streams a value straight from the block store.
+func (vs *version) serveRecord(w http.ResponseWriter, r *http.Request, key string, record *blocks.Record) {
+	vs.setLocalHeaders(w.Header(), record.ValueLen, record.Metadata)
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, err := vs.copyRecord(w, record)
 	if err != nil {
 		// We already wrote a 200 OK, so not much we can do here except log.
 		log.Printf("Error streaming response for /%s/%s (version %s): %s", vs.db.name, key, vs.name, err)
 	}
 }
 
+// canServeStale returns true if a key in the partition should be served from
+// the dropped local copy, because 'sharding.stale_serve_window' is set, the
+// partition was dropped less than that long ago, and no peer has advertised
+// it. As soon as a peer does, or the partition is loaded again locally, the
+// stale copy is no longer used.
+func (vs *version) canServeStale(partition int) bool {
+	window := vs.sequins.config.Sharding.StaleServeWindow.Duration
+	if window == 0 {
+		return false
+	}
+
+	dropped, ok := vs.partitions.droppedAt(partition)
+	if !ok || time.Since(dropped) > window {
+		return false
+	}
+
+	return len(vs.partitions.getPeers(partition)) == 0
+}
+
+// serveStale serves a key from the dropped local copy of its partition. The
+// value is never cached, since it may not match the one that's loaded next.
+func (vs *version) serveStale(w http.ResponseWriter, r *http.Request, key string) {
+	record, err := vs.blockStore.GetDropped(key)
+	if err != nil {
+		vs.serveError(w, key, err)
+		return
+	}
+
+	w.Header().Set(staleHeader, "true")
+	if record == nil {
+		vs.serveNotFound(w)
+		return
+	}
+
+	defer record.Close()
+	if vs.sequins.tooLarge(record.ValueLen) {
+		vs.serveTooLarge(w)
+		return
+	}
+
+	vs.serveRecord(w, r, key, record)
+}
+
+// serveCached serves a value from the cache, in the same way as serveLocal.
+func (vs *version) serveCached(w http.ResponseWriter, r *http.Request, cached *cachedValue) {
+	vs.setLocalHeaders(w.Header(), uint64(len(cached.value)), cached.metadata)
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Write(cached.value)
+}
+
+func (vs *version) setLocalHeaders(h http.Header, valueLen uint64, metadata []byte) {
+	h.Set(versionHeader, vs.name)
+	h.Set(proxiedFlagHeader, "false")
+	h.Set("Content-Length", strconv.FormatUint(valueLen, 10))
+	h.Set("Last-Modified", vs.created.UTC().Format(http.TimeFormat))
+	h.Set("Content-Type", vs.db.contentType())
+	vs.setMetadataHeaders(h, metadata)
+}
+
 func (vs *version) serveProxied(w http.ResponseWriter, r *http.Request,
 	key string, partition, alternatePartition int) {
 
+	// HEAD requests are cheap, and can't share a response with a GET.
+	if vs.sequins.config.Sharding.CoalesceProxiedRequests && r.Method != "HEAD" {
+		vs.serveCoalesced(w, r, key, partition, alternatePartition)
+		return
+	}
+
+	vs.serveUncoalesced(w, r, key, partition, alternatePartition)
+}
+
+// serveUncoalesced fetches the key from a peer, and streams the response back.
+func (vs *version) serveUncoalesced(w http.ResponseWriter, r *http.Request,
+	key string, partition, alternatePartition int) {
+
+	start := time.Now()
+	resp, peer, err := vs.fetchProxied(r, key, partition, alternatePartition)
+	if err != nil {
+		vs.serveProxyError(w, key, err)
+		return
+	}
+
+	vs.setLookupTime(w.Header(), start)
+	vs.copyProxied(w, r, key, resp, peer)
+}
+
+// copyProxied writes a response from a peer, streaming the body through.
+func (vs *version) copyProxied(w http.ResponseWriter, r *http.Request, key string, resp *http.Response, peer string) {
+	vs.writeProxiedHeader(w, resp, peer)
+	if r.Method == "HEAD" {
+		resp.Body.Close()
+		return
+	}
+
+	// TODO: Apparently in 1.7 the client always asks for gzip by default. If our
+	// client asks for gzip too, we should be able to pass through without
+	// decompressing.
+	defer resp.Body.Close()
+	_, err := io.Copy(w, resp.Body)
+	if err != nil {
+		// We already wrote a 200 OK, so not much we can do here except log.
+		log.Printf("Error copying response from peer for /%s/%s (version %s): %s", vs.db.name, key, vs.name, err)
+	}
+}
+
+// fetchProxied fetches the key from a peer that has the partition, or, if the
+// key is missing, one that has the alternate partition. If no peer can serve
+// the request, it falls back to the remote cluster, if one is configured.
+func (vs *version) fetchProxied(r *http.Request, key string, partition, alternatePartition int) (*http.Response, string, error) {
 	// Shuffle the peers, so we try them in a random order.
 	// TODO: We don't want to blacklist nodes, but we can weight them lower
-	peers := shuffle(vs.partitions.getPeers(partition))
+	peers := vs.candidatePeers(partition)
 	if len(peers) == 0 {
-		log.Printf("No peers available for /%s/%s (version %s)", vs.db.name, key, vs.name)
-		w.WriteHeader(http.StatusBadGateway)
-		return
+		return vs.fallBack(r, key, nil, "", errNoAvailablePeers)
 	}
 
-	resp, peer, err := vs.proxy(r, peers)
+	resp, peer, err := vs.proxyWithRetries(r, partition, peers)
 	if err == nil && resp.StatusCode == 404 && alternatePartition != partition {
 		log.Println("Trying alternate partition for pathological key", key)
 
 		resp.Body.Close()
-		alternatePeers := shuffle(vs.partitions.getPeers(alternatePartition))
-		resp, peer, err = vs.proxy(r, alternatePeers)
+		alternatePeers := vs.candidatePeers(alternatePartition)
+		resp, peer, err = vs.proxyWithRetries(r, alternatePartition, alternatePeers)
 	}
 
+	vs.sequins.metrics.countProxyRequest(vs.db.name, err)
+	return vs.fallBack(r, key, resp, peer, err)
+}
+
+func (vs *version) serveProxyError(w http.ResponseWriter, key string, err error) {
 	if err == errNoAvailablePeers {
 		// Either something is wrong with sharding, or all peers errored for some
 		// other reason. 502
 		log.Printf("No peers available for /%s/%s (version %s)", vs.db.name, key, vs.name)
+		vs.setProxyErrorCode(w, codeProxyUnavailable)
 		w.WriteHeader(http.StatusBadGateway)
-		return
 	} else if err == errProxyTimeout {
 		// All of our peers failed us. 504.
 		log.Printf("All peers timed out for /%s/%s (version %s)", vs.db.name, key, vs.name)
+		vs.setProxyErrorCode(w, codeProxyTimeout)
 		w.WriteHeader(http.StatusGatewayTimeout)
-		return
-	} else if err != nil {
+	} else {
 		// Some other error. 500.
 		vs.serveError(w, key, err)
-		return
 	}
+}
+
+// setProxyErrorCode sets the error code for a failed proxy request. If the node
+// has lost its connection to the coordinator, the list of peers is stale, which
+// is the more likely cause, so the code is "degraded" instead.
+func (vs *version) setProxyErrorCode(w http.ResponseWriter, code string) {
+	if vs.sequins.degraded() {
+		code = codeDegraded
+	}
+
+	setErrorCode(w, code)
+}
 
+// writeProxiedHeader writes the headers and status from a peer's response.
+func (vs *version) writeProxiedHeader(w http.ResponseWriter, resp *http.Response, peer string) {
 	// Proxying can produce inconsistent versions if something is broken. Use the
 	// one the peer set.
 	w.Header().Set(versionHeader, resp.Header.Get(versionHeader))
 	w.Header().Set(proxyHeader, peer)
-	w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+	w.Header().Set(proxiedFlagHeader, "true")
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		w.Header().Set("Content-Length", contentLength)
+	}
 	w.Header().Set("Last-Modified", vs.created.UTC().Format(http.TimeFormat))
+	if resp.StatusCode == http.StatusOK {
+		w.Header().Set("Content-Type", vs.db.contentType())
+	}
+
+	if code := resp.Header.Get(errorCodeHeader); code != "" {
+		setErrorCode(w, code)
+	}
+
+	vs.copyMetadataHeaders(w.Header(), resp)
 	w.WriteHeader(resp.StatusCode)
+}
 
-	// TODO: Apparently in 1.7 the client always asks for gzip by default. If our
-	// client asks for gzip too, we should be able to pass through without
-	// decompressing.
-	defer resp.Body.Close()
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		// We already wrote a 200 OK, so not much we can do here except log.
-		log.Printf("Error copying response from peer for /%s/%s (version %s): %s", vs.db.name, key, vs.name, err)
+// serveNotLocal serves a 404 for a key that would have been proxied, if the
+// client hadn't disabled proxying, with a header listing the peers that have
+// the partition.
+func (vs *version) serveNotLocal(w http.ResponseWriter, partition int) {
+	if peers := vs.partitions.getPeers(partition); len(peers) > 0 {
+		sort.Strings(peers)
+		w.Header().Set(proxyOwnerHeader, strings.Join(peers, ", "))
 	}
+
+	setErrorCode(w, codeKeyNotLocal)
+	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set(proxiedFlagHeader, "false")
+	w.WriteHeader(http.StatusNotFound)
 }
 
 func (vs *version) serveNotFound(w http.ResponseWriter) {
+	setErrorCode(w, codeKeyNotFound)
 	w.Header().Set(versionHeader, vs.name)
+	w.Header().Set(proxiedFlagHeader, "false")
 	w.WriteHeader(http.StatusNotFound)
 }
 
 func (vs *version) serveError(w http.ResponseWriter, key string, err error) {
+	if err == errValueTooLarge {
+		vs.serveTooLarge(w)
+		return
+	}
+
 	log.Printf("Error fetching value for /%s/%s: %s\n", vs.db.name, key, err)
+	setErrorCode(w, codeInternalError)
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
+// setLookupTime sets a header with the time since start, if
+// 'lookup_time_header' is set.
+func (vs *version) setLookupTime(h http.Header, start time.Time) {
+	if vs.sequins.config.LookupTimeHeader {
+		h.Set(lookupTimeHeader, strconv.FormatInt(int64(time.Since(start)/time.Microsecond), 10))
+	}
+}
+
+// candidatePeers returns the peers that have the given partition, in the order
+// they should be tried for a proxied request: randomly, but with peers in the
+// same zone first, if 'zone_aware_proxying' is set, and peers that are still
+// warming up last, if 'peer_warmup_period' is set.
+func (vs *version) candidatePeers(partition int) []string {
+	peers := shuffle(vs.partitions.getPeers(partition))
+	if vs.sequins.config.Sharding.ZoneAwareProxying && vs.sequins.peers != nil {
+		peers = vs.sequins.peers.preferZone(peers)
+	}
+
+	return vs.partitions.preferReady(peers, vs.sequins.config.Sharding.PeerWarmupPeriod.Duration)
+}
+
 func shuffle(vs []string) []string {
 	shuffled := make([]string, len(vs))
 	perm := rand.Perm(len(vs))
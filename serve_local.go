@@ -0,0 +1,53 @@
+package main
+
+import "github.com/stripe/sequins/backend"
+
+// isLocal returns true if the db is served straight from a local directory,
+// set with 'serve_local' or --serve-local, rather than from the source. Such a
+// db has a single version, and isn't coordinated with the rest of the cluster:
+// every node that has it serves the whole thing by itself.
+func (db *db) isLocal() bool {
+	return db.config.ServeLocal != ""
+}
+
+// coordinator returns the coordinator to use for the db, which is nil if the
+// db is local or sharding isn't enabled.
+func (db *db) coordinator() coordinator {
+	if db.isLocal() {
+		return nil
+	}
+
+	return db.sequins.coordinator
+}
+
+// peers returns the peers to share the db with, which is nil if the db is
+// local or sharding isn't enabled.
+func (db *db) peers() *peers {
+	if db.isLocal() {
+		return nil
+	}
+
+	return db.sequins.peers
+}
+
+// localDBs returns the directory to serve for each local db, by name.
+func (config sequinsConfig) localDBs() map[string]string {
+	dirs := make(map[string]string)
+	for name, dbConfig := range config.DBs {
+		if dbConfig.ServeLocal != "" {
+			dirs[name] = dbConfig.ServeLocal
+		}
+	}
+
+	return dirs
+}
+
+// localBackends returns a backend for each local db.
+func localBackends(config sequinsConfig) []backend.Backend {
+	var backends []backend.Backend
+	for name, dir := range config.localDBs() {
+		backends = append(backends, backend.NewVersionDirBackend(name, dir))
+	}
+
+	return backends
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// statsPath serves a JSON summary of this node's dbs and versions. Unlike the
+// status page, it only ever describes the local node, and never makes
+// requests to peers, so it's cheap enough to poll.
+const statsPath = "/stats"
+
+type stats struct {
+	DBs map[string]dbStats `json:"dbs"`
+
+	// Degraded is set if the node has lost its connection to the coordinator,
+	// and is serving what it has without cluster coordination.
+	Degraded bool `json:"degraded"`
+
+	// Cache is only set if 'cache_bytes' is.
+	Cache *cacheStats `json:"cache,omitempty"`
+}
+
+type dbStats struct {
+	CurrentVersion string                  `json:"current_version"`
+	LastLoadedAt   *time.Time              `json:"last_loaded_at,omitempty"`
+	Versions       map[string]versionStats `json:"versions"`
+}
+
+type versionStats struct {
+	State       versionState `json:"state"`
+	Current     bool         `json:"current"`
+	CreatedAt   time.Time    `json:"created_at"`
+	AvailableAt *time.Time   `json:"available_at,omitempty"`
+	LoadSeconds float64      `json:"load_seconds,omitempty"`
+
+	NumPartitions     int   `json:"num_partitions"`
+	PartitionsOwned   []int `json:"partitions_owned"`
+	PartitionsProxied int   `json:"partitions_proxied"`
+	Keys              int   `json:"keys"`
+}
+
+// serveStats handles GET /stats.
+func (s *sequins) serveStats(w http.ResponseWriter, r *http.Request) {
+	s.dbsLock.RLock()
+	st := stats{DBs: make(map[string]dbStats, len(s.dbs))}
+	for name, db := range s.dbs {
+		st.DBs[name] = db.stats()
+	}
+
+	s.dbsLock.RUnlock()
+
+	st.Degraded = s.degraded()
+	if s.cache != nil {
+		st.Cache = s.cache.stats()
+	}
+
+	jsonBytes, err := json.Marshal(st)
+	if err != nil {
+		log.Println("Error serving stats:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+func (db *db) stats() dbStats {
+	st := dbStats{Versions: make(map[string]versionStats)}
+
+	current := db.mux.getCurrent()
+	if current != nil {
+		st.CurrentVersion = current.name
+		db.mux.release(current)
+	}
+
+	for _, vs := range db.mux.getAll() {
+		vst := vs.stats()
+		vst.Current = (vs.name == st.CurrentVersion)
+		st.Versions[vs.name] = vst
+
+		if vst.AvailableAt != nil && (st.LastLoadedAt == nil || vst.AvailableAt.After(*st.LastLoadedAt)) {
+			st.LastLoadedAt = vst.AvailableAt
+		}
+	}
+
+	return st
+}
+
+func (vs *version) stats() versionStats {
+	vs.stateLock.RLock()
+	st := versionStats{
+		State:         vs.state,
+		CreatedAt:     vs.created.UTC(),
+		LoadSeconds:   vs.loadTime.Seconds(),
+		NumPartitions: vs.numPartitions,
+	}
+
+	if !vs.available.IsZero() {
+		available := vs.available.UTC()
+		st.AvailableAt = &available
+	}
+
+	vs.stateLock.RUnlock()
+
+	st.PartitionsOwned = vs.partitions.getLocal()
+	st.PartitionsProxied = vs.numPartitions - len(st.PartitionsOwned)
+	st.Keys = vs.blockStore.NumKeys()
+	return st
+}
@@ -32,6 +32,10 @@ func init() {
 
 type status struct {
 	DBs map[string]dbStatus `json:"dbs"`
+
+	// Converged is whether this node considers the list of peers to be stable.
+	// It's always true if sharding isn't enabled.
+	Converged bool `json:"converged"`
 }
 
 type dbStatus struct {
@@ -56,6 +60,12 @@ type nodeVersionStatus struct {
 	Current     bool         `json:"current"`
 	State       versionState `json:"state"`
 	Partitions  []int        `json:"partitions"`
+	Rebalancing bool         `json:"rebalancing,omitempty"`
+	Repairing   bool         `json:"repairing,omitempty"`
+
+	// PeakIndexingMemory is an estimate of the most memory used to index a
+	// single block of the version while building it, in bytes.
+	PeakIndexingMemory int64 `json:"peak_indexing_memory,omitempty"`
 }
 
 type versionState string
@@ -79,7 +89,7 @@ func (s *sequins) serveStatus(w http.ResponseWriter, r *http.Request) {
 
 	// By default, serve our peers' statuses merged with ours. We take
 	// extra care not to mutate local status structs.
-	if r.URL.Query().Get("proxy") == "" && s.peers != nil {
+	if proxiedVersion(r) == "" && s.peers != nil {
 		for _, p := range s.peers.getAll() {
 			peerStatus, err := s.getPeerStatus(p, "")
 			if err != nil {
@@ -106,6 +116,8 @@ func (s *sequins) serveStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	status.Converged = s.converged()
+
 	if acceptsJSON(r) {
 		jsonBytes, err := json.Marshal(status)
 		if err != nil {
@@ -128,8 +140,8 @@ func (db *db) serveStatus(w http.ResponseWriter, r *http.Request) {
 	s := db.status()
 
 	// By default, serve our peers' statuses merged with ours.
-	if r.URL.Query().Get("proxy") == "" && db.sequins.peers != nil {
-		for _, p := range db.sequins.peers.getAll() {
+	if proxiedVersion(r) == "" && db.peers() != nil {
+		for _, p := range db.peers().getAll() {
 			peerStatus, err := db.sequins.getPeerStatus(p, db.name)
 			if err != nil {
 				log.Printf("Error fetching status from peer %s: %s", p, err)
@@ -168,7 +180,7 @@ func (db *db) serveStatus(w http.ResponseWriter, r *http.Request) {
 // getPeerStatus fetches a peer's status for the given db. If db is empty, it
 // returns the status for all dbs.
 func (s *sequins) getPeerStatus(peer string, db string) (status, error) {
-	url := fmt.Sprintf("http://%s/%s?proxy=status", peer, db)
+	url := fmt.Sprintf("%s://%s/%s?proxy=status", s.peerScheme(), peer, db)
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
@@ -180,7 +192,7 @@ func (s *sequins) getPeerStatus(peer string, db string) (status, error) {
 		return status, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.peerClient().Do(req)
 	if err != nil {
 		return status, err
 	}
@@ -304,16 +316,21 @@ func (vs *version) status() versionStatus {
 		Nodes:         make(map[string]nodeVersionStatus),
 	}
 
-	partitions := make([]int, 0, len(vs.partitions.selected))
-	for p := range vs.partitions.selected {
+	selected := vs.partitions.getSelected()
+	partitions := make([]int, 0, len(selected))
+	for p := range selected {
 		partitions = append(partitions, p)
 	}
 
 	sort.Ints(partitions)
 	nodeStatus := nodeVersionStatus{
-		CreatedAt:  vs.created.UTC().Truncate(time.Second),
-		State:      vs.state,
-		Partitions: partitions,
+		CreatedAt:   vs.created.UTC().Truncate(time.Second),
+		State:       vs.state,
+		Partitions:  partitions,
+		Rebalancing: vs.rebalancing,
+		Repairing:   vs.repairing,
+
+		PeakIndexingMemory: vs.blockStore.PeakIndexingMemory(),
 	}
 
 	if !vs.available.IsZero() {
@@ -340,3 +357,17 @@ func (vs *version) setState(state versionState) {
 		}
 	}
 }
+
+func (vs *version) setLoadDuration(d time.Duration) {
+	vs.stateLock.Lock()
+	defer vs.stateLock.Unlock()
+
+	vs.loadTime = d
+}
+
+func (vs *version) getLoadDuration() time.Duration {
+	vs.stateLock.RLock()
+	defer vs.stateLock.RUnlock()
+
+	return vs.loadTime
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// initTLS loads the certificates for serving over TLS, if 'tls_cert' is set.
+// Peers are expected to be configured the same way, so the same certificate is
+// used as a client certificate when talking to them, and their certificates are
+// verified against the system roots, plus 'tls_client_ca' if it's set.
+func (s *sequins) initTLS() error {
+	if s.config.TLSCert == "" {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %s", err)
+	}
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if s.config.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(s.config.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("loading TLS client CA: %s", err)
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("loading TLS client CA: no certificates found in %s", s.config.TLSClientCA)
+		}
+
+		serverConfig.ClientCAs = clientCAs
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		rootCAs.AppendCertsFromPEM(pem)
+	}
+
+	s.tlsConfig = serverConfig
+	s.tlsPeerConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}
+
+	return nil
+}
+
+// peerScheme returns the URL scheme to use for requests to peers.
+func (s *sequins) peerScheme() string {
+	if s.config.TLSCert != "" {
+		return "https"
+	}
+
+	return "http"
+}
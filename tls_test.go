@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestCerts writes out a CA, and a certificate and key signed by it for
+// 127.0.0.1, to a temporary directory.
+func createTestCerts(t *testing.T) (dir, cert, key, ca string) {
+	dir, err := ioutil.TempDir("", "sequins-tls-")
+	require.NoError(t, err, "setup")
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "setup")
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sequins test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err, "setup")
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "setup")
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sequins test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caTemplate, &leafKey.PublicKey, caKey)
+	require.NoError(t, err, "setup")
+
+	leafKeyDER, err := x509.MarshalECPrivateKey(leafKey)
+	require.NoError(t, err, "setup")
+
+	cert = filepath.Join(dir, "cert.pem")
+	key = filepath.Join(dir, "key.pem")
+	ca = filepath.Join(dir, "ca.pem")
+	writePEM(t, cert, "CERTIFICATE", leafDER)
+	writePEM(t, key, "EC PRIVATE KEY", leafKeyDER)
+	writePEM(t, ca, "CERTIFICATE", caDER)
+	return dir, cert, key, ca
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	require.NoError(t, err, "setup")
+}
+
+func TestTLSPeerClient(t *testing.T) {
+	dir, cert, key, ca := createTestCerts(t)
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.TLSCert = cert
+	config.TLSKey = key
+	config.TLSClientCA = ca
+
+	s := &sequins{config: config}
+	require.NoError(t, s.initTLS(), "initTLS should succeed")
+	assert.Equal(t, "https", s.peerScheme(), "peers should be contacted over https")
+	s.initPeerClient()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = s.tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := s.peerClient().Get(server.URL)
+	require.NoError(t, err, "the peer client should be able to talk to a peer")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	_, err = anonymous.Get(server.URL)
+	assert.Error(t, err, "clients without a certificate should be rejected")
+}
+
+func TestTLSDisabled(t *testing.T) {
+	s := &sequins{config: defaultConfig()}
+	require.NoError(t, s.initTLS())
+
+	assert.Nil(t, s.tlsConfig)
+	assert.Equal(t, "http", s.peerScheme())
+	assert.Equal(t, http.DefaultClient, s.peerClient())
+}
@@ -0,0 +1,28 @@
+package main
+
+import "encoding/base64"
+
+const (
+	// With valueEncodingBase64, values in JSON responses are base64 encoded, so
+	// that binary values survive intact. This is the default.
+	valueEncodingBase64 = "base64"
+
+	// With valueEncodingRaw, values in JSON responses are plain strings. That's
+	// more convenient for text, but any invalid UTF-8 is replaced.
+	valueEncodingRaw = "raw"
+)
+
+// encodeValues returns whether values should be base64 encoded in the JSON
+// responses for batch fetches and prefix scans. Single keys are always served
+// as-is.
+func (db *db) encodeValues() bool {
+	return db.config.ValueEncoding != valueEncodingRaw
+}
+
+func encodeValue(value []byte) string {
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeValue(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(value)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+)
+
+// keySample is a uniform random sample of the key/value pairs added to a
+// version while it's being built, collected with reservoir sampling. Once the
+// version is built, the sample is read back through the block store as a
+// smoke test.
+type keySample struct {
+	size   int
+	seen   int
+	keys   [][]byte
+	values [][]byte
+}
+
+func newKeySample(size int) *keySample {
+	return &keySample{
+		size:   size,
+		keys:   make([][]byte, 0, size),
+		values: make([][]byte, 0, size),
+	}
+}
+
+// add considers a key/value pair for the sample. The key and value are copied,
+// since the sequencefile reader reuses its buffers.
+func (s *keySample) add(key, value []byte) {
+	if s == nil || s.size == 0 {
+		return
+	}
+
+	s.seen++
+	if len(s.keys) < s.size {
+		s.keys = append(s.keys, copyBytes(key))
+		s.values = append(s.values, copyBytes(value))
+	} else if i := rand.Intn(s.seen); i < s.size {
+		s.keys[i] = copyBytes(key)
+		s.values[i] = copyBytes(value)
+	}
+}
+
+// verify reads each sampled key back from the block store, and checks that it
+// is there, with the value it was written with.
+func (vs *version) verify(sample *keySample) error {
+	if sample == nil {
+		return nil
+	}
+
+	for i, key := range sample.keys {
+		record, err := vs.blockStore.Get(string(key))
+		if err != nil {
+			return fmt.Errorf("verifying key %q: %s", key, err)
+		} else if record == nil {
+			return fmt.Errorf("verifying key %q: not found", key)
+		}
+
+		value, err := ioutil.ReadAll(record)
+		record.Close()
+		if err != nil {
+			return fmt.Errorf("verifying key %q: %s", key, err)
+		} else if !bytes.Equal(value, sample.values[i]) {
+			return fmt.Errorf("verifying key %q: value doesn't match", key)
+		}
+	}
+
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
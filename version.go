@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -11,6 +12,10 @@ import (
 
 const versionHeader = "X-Sequins-Version"
 
+// versionParam asks for a key from a specific version, like versionHeader on a
+// request.
+const versionParam = "version"
+
 var (
 	errNoAvailablePeers   = errors.New("no available peers")
 	errProxiedIncorrectly = errors.New("this server doesn't have the requested partition")
@@ -27,18 +32,35 @@ type version struct {
 	name          string
 	blockStore    *blocks.BlockStore
 	partitions    *partitions
+	coalescer     *coalescer
 	numPartitions int
 	files         []string
+	metadataFiles []string
+	checksumFiles []string
+	fingerprint   string
+
+	// timeToConverge is how long to wait once every partition is available
+	// before switching to the version.
+	timeToConverge time.Duration
 
-	state     versionState
-	created   time.Time
-	available time.Time
-	stateLock sync.RWMutex
+	state       versionState
+	created     time.Time
+	modTime     time.Time
+	available   time.Time
+	loadTime    time.Duration
+	rebalancing bool
+	repaired    map[int]bool
+	integrity   integrityState
+	repairing   bool
+	stateLock   sync.RWMutex
 
 	ready     chan bool
 	cancel    chan bool
 	built     bool
 	buildLock sync.Mutex
+
+	// load tracks the progress of the current build, for /debug/loads.
+	load *loadProgress
 }
 
 func newVersion(sequins *sequins, db *db, path, name string) (*version, error) {
@@ -47,13 +69,49 @@ func newVersion(sequins *sequins, db *db, path, name string) (*version, error) {
 		return nil, err
 	}
 
+	// Metadata sidecars are only picked out for dbs that use them, so that
+	// other dbs aren't affected by the naming scheme.
+	var metadataFiles []string
+	if len(db.config.MetadataHeaders) > 0 {
+		files, metadataFiles = splitMetadataFiles(files)
+	}
+
+	// The same goes for checksum sidecars.
+	var checksumFiles []string
+	if sequins.config.Storage.VerifyChecksums {
+		files, checksumFiles = splitChecksumFiles(files)
+	}
+
+	// With a read-only store, the version was already loaded by another
+	// process, so it has however many partitions that process gave it.
+	var numPartitions int
+	if sequins.config.ReadOnlyStore {
+		numPartitions, err = storedPartitions(path)
+	} else {
+		numPartitions, err = db.numPartitions(name, len(files))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeToConverge, err := db.timeToConverge(name)
+	if err != nil {
+		return nil, err
+	}
+
 	vs := &version{
 		sequins:       sequins,
 		db:            db,
 		path:          path,
 		name:          name,
 		files:         files,
-		numPartitions: len(files),
+		metadataFiles: metadataFiles,
+		checksumFiles: checksumFiles,
+		numPartitions: numPartitions,
+		coalescer:     newCoalescer(),
+
+		timeToConverge: timeToConverge,
 
 		created: time.Now(),
 		state:   versionBuilding,
@@ -62,14 +120,24 @@ func newVersion(sequins *sequins, db *db, path, name string) (*version, error) {
 		cancel: make(chan bool),
 	}
 
-	vs.partitions = watchPartitions(sequins.zkWatcher, sequins.peers,
-		db.name, name, len(files), sequins.config.Sharding.Replication)
+	if sequins.config.VersionSelection == versionSelectionMtime {
+		vs.modTime, err = db.versionModTime(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vs.partitions = watchPartitions(db.coordinator(), db.peers(),
+		db.name, name, numPartitions, sequins.config.Sharding.Replication,
+		sequins.config.Sharding.MinReplication, db.getDrained())
 
 	err = vs.initBlockStore(path)
 	if err != nil {
 		return nil, err
 	}
 
+	vs.fingerprint = vs.computeFingerprint()
+
 	// If we're running in non-distributed mode, ready gets closed once the block
 	// store is built.
 	if vs.partitions != nil {
@@ -92,15 +160,36 @@ func newVersion(sequins *sequins, db *db, path, name string) (*version, error) {
 }
 
 func (vs *version) initBlockStore(path string) error {
+	if vs.sequins.config.ReadOnlyStore {
+		return vs.initReadOnlyBlockStore(path)
+	}
+
 	// Try loading anything we have locally. If it doesn't work out, that's ok.
 	blockStore, manifest, err := blocks.NewFromManifest(path)
 	if err != nil && err != blocks.ErrNoManifest {
 		log.Println("Error loading", vs.db.name, "version", vs.name, "from manifest:", err)
+		if vs.sequins.config.Storage.RecoverCorruptStore {
+			vs.discardCorruptStore(path, err)
+		}
+	} else if blockStore != nil && manifest.NumPartitions != vs.numPartitions {
+		// The partition count changed since we built this, so the keys are in the
+		// wrong partitions.
+		log.Printf("Discarding the local copy of version %s of %s, which has %d partitions rather than %d",
+			vs.name, vs.db.name, manifest.NumPartitions, vs.numPartitions)
+		blockStore.Close()
+		blockStore = nil
+		os.RemoveAll(path)
+	} else if blockStore != nil && vs.sequins.config.Storage.RecoverCorruptStore {
+		err = blockStore.Check()
+		if err != nil {
+			blockStore.Close()
+			blockStore = nil
+			vs.discardCorruptStore(path, err)
+		}
 	}
 
 	if blockStore == nil {
-		blockStore = blocks.New(vs.path, vs.numPartitions,
-			vs.sequins.config.Storage.Compression, vs.sequins.config.Storage.BlockSize)
+		blockStore = vs.newBlockStore()
 	} else {
 		have := make(map[int]bool)
 		for _, partition := range manifest.SelectedPartitions {
@@ -108,12 +197,110 @@ func (vs *version) initBlockStore(path string) error {
 		}
 
 		vs.partitions.updateLocalPartitions(have)
+		vs.setIndexingMemoryBudget(blockStore)
+		vs.setBloomFilter(blockStore)
 	}
 
 	vs.blockStore = blockStore
+	vs.advise()
 	return nil
 }
 
+// newBlockStore creates an empty block store for the version, in its local
+// directory.
+func (vs *version) newBlockStore() *blocks.BlockStore {
+	blockStore := blocks.New(vs.path, vs.numPartitions,
+		vs.sequins.config.Storage.Compression, vs.sequins.config.Storage.BlockSize,
+		vs.db.config.KeyNormalization, vs.db.config.keyPrefix(), vs.db.config.PartitionHash)
+
+	vs.setIndexingMemoryBudget(blockStore)
+	vs.setBloomFilter(blockStore)
+	return blockStore
+}
+
+// setBloomFilter makes new blocks build bloom filters, if the db has
+// 'build_bloom_filter' set.
+func (vs *version) setBloomFilter(blockStore *blocks.BlockStore) {
+	if !vs.db.config.BuildBloomFilter {
+		return
+	}
+
+	rate := vs.db.config.BloomFalsePositiveRate
+	if rate == 0 {
+		rate = blocks.DefaultBloomFalsePositiveRate
+	}
+
+	blockStore.SetBloomFilter(rate)
+}
+
+func (vs *version) setIndexingMemoryBudget(blockStore *blocks.BlockStore) {
+	// Splitting partitions into multiple blocks would separate keys from their
+	// metadata, which is added afterwards, so the budget only applies to dbs
+	// without metadata.
+	if budget := vs.sequins.config.Storage.IndexingMemoryBudgetMB; budget > 0 {
+		if len(vs.metadataFiles) == 0 {
+			blockStore.SetIndexingMemoryBudget(int64(budget) * 1024 * 1024)
+		} else {
+			log.Println("Ignoring the indexing memory budget for", vs.db.name, "version", vs.name, "because it has metadata")
+		}
+	}
+}
+
+// discardCorruptStore deletes the local copy of the version, so that it gets
+// downloaded again from scratch.
+func (vs *version) discardCorruptStore(path string, corruption error) {
+	logEvent(logFields{DB: vs.db.name, Version: vs.name, Event: "version_corrupted"},
+		"Discarding the local copy of version %s of %s, which is corrupted (%s). It will be downloaded again.",
+		vs.name, vs.db.name, corruption)
+
+	// The version may have been served before, if it's being loaded again.
+	vs.dropCachedValues()
+
+	err := os.RemoveAll(path)
+	if err != nil {
+		log.Printf("Error discarding the local copy of version %s of %s: %s", vs.name, vs.db.name, err)
+	}
+}
+
+// advise applies the configured madvise hint, if any, to the block store's
+// files.
+func (vs *version) advise() {
+	advice := vs.sequins.config.Storage.Madvise
+	if advice == "" {
+		return
+	}
+
+	err := vs.blockStore.Advise(advice)
+	if err != nil {
+		log.Printf("Error applying madvise hint to version %s of %s: %s", vs.name, vs.db.name, err)
+	}
+}
+
+// warm reads the version's index into the page cache, if
+// 'storage.warm_on_load' is set, so that the first requests after switching to
+// it don't all go to disk. If the db has a time_to_converge, warming stops once
+// that much time has passed, so that it fits in roughly the time the version
+// would have spent converging anyway.
+func (vs *version) warm() {
+	if !vs.sequins.config.Storage.WarmOnLoad {
+		return
+	}
+
+	var deadline time.Time
+	start := time.Now()
+	if vs.timeToConverge > 0 {
+		deadline = start.Add(vs.timeToConverge)
+	}
+
+	n, err := vs.blockStore.Warm(deadline)
+	if err != nil {
+		log.Printf("Error warming version %s of %s: %s", vs.name, vs.db.name, err)
+		return
+	}
+
+	log.Printf("Warmed %d bytes of version %s of %s in %s", n, vs.name, vs.db.name, time.Since(start))
+}
+
 func (vs *version) close() {
 	close(vs.cancel)
 
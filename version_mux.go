@@ -41,6 +41,7 @@ type versionReferenceCount struct {
 	count      *sync.WaitGroup
 	closeTimer *time.Timer
 	removing   bool
+	evicted    bool
 }
 
 func newVersionMux(overrideVersionRemoveTimeout time.Duration) *versionMux {
@@ -61,7 +62,33 @@ func newVersionMux(overrideVersionRemoveTimeout time.Duration) *versionMux {
 
 // serveKey is the entrypoint for HTTP requests.
 func (mux *versionMux) serveKey(w http.ResponseWriter, r *http.Request, key string) {
-	proxyVersion := r.URL.Query().Get("proxy")
+	vs := mux.getRequested(w, r)
+	if vs == nil {
+		return
+	}
+
+	vs.serveKey(w, r, key)
+	mux.release(vs)
+}
+
+// servePrefix handles prefix scans, picking a version in the same way as
+// serveKey.
+func (mux *versionMux) servePrefix(w http.ResponseWriter, r *http.Request, prefix string) {
+	vs := mux.getRequested(w, r)
+	if vs == nil {
+		return
+	}
+
+	vs.servePrefix(w, r, prefix)
+	mux.release(vs)
+}
+
+// getRequested returns the version a request should be served from: the one
+// a peer asked for, if it was proxied, and the current one otherwise. It
+// increments the reference count for the version. If there's no version to
+// serve, it writes an error response and returns nil.
+func (mux *versionMux) getRequested(w http.ResponseWriter, r *http.Request) *version {
+	proxyVersion := proxiedVersion(r)
 	var vs *version
 
 	if proxyVersion != "" {
@@ -78,20 +105,45 @@ func (mux *versionMux) serveKey(w http.ResponseWriter, r *http.Request, key stri
 			// returning a 404, which might indicate that we do have the dataset but
 			// that key doesn't exist. We use http 501 for this.
 			if vs == nil {
+				setErrorCode(w, codeNoVersion)
 				w.WriteHeader(http.StatusNotImplemented)
-				return
+				return nil
 			}
 		}
 	} else {
 		vs = mux.getCurrent()
 		if vs == nil {
+			setErrorCode(w, codeNoVersion)
 			w.WriteHeader(http.StatusNotFound)
-			return
+			return nil
 		}
 	}
 
+	return vs
+}
+
+// serveVersionKey serves a key from a specific version, rather than the current
+// one. If the version isn't available, either because we don't know about it
+// or because the cluster doesn't have a full set of partitions for it, that's
+// a 409.
+func (mux *versionMux) serveVersionKey(w http.ResponseWriter, r *http.Request, name, key string) {
+	vs := mux.getVersion(name)
+	if vs == nil {
+		setErrorCode(w, codeVersionNotAvailable)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	defer mux.release(vs)
+	select {
+	case <-vs.ready:
+	default:
+		setErrorCode(w, codeVersionNotAvailable)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
 	vs.serveKey(w, r, key)
-	mux.release(vs)
 }
 
 // getCurrent returns the current version and increments the reference count
@@ -103,7 +155,7 @@ func (mux *versionMux) getCurrent() *version {
 	vs := mux.currentVersion
 	if vs.version != nil {
 		vs.count.Add(1)
-		if vs.closeTimer != nil {
+		if vs.closeTimer != nil && !vs.evicted {
 			vs.closeTimer.Reset(mux.versionRemoveTimeout)
 		}
 	}
@@ -121,7 +173,7 @@ func (mux *versionMux) getVersion(name string) *version {
 	vs := mux.versions[name]
 	if vs.version != nil {
 		vs.count.Add(1)
-		if vs.closeTimer != nil {
+		if vs.closeTimer != nil && !vs.evicted {
 			vs.closeTimer.Reset(mux.versionRemoveTimeout)
 		}
 	}
@@ -129,6 +181,39 @@ func (mux *versionMux) getVersion(name string) *version {
 	return vs.version
 }
 
+// getPrevious returns the newest version that's older than current, according
+// to newer, and that was ready to serve, and increments the reference count
+// for it. Unlike getVersion, it doesn't reset the timer for a version that's
+// being removed, so that falling back to it doesn't keep it around. It returns
+// nil if there is no such version.
+func (mux *versionMux) getPrevious(current *version, newer func(a, b *version) bool) *version {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+
+	var previous versionReferenceCount
+	for _, vs := range mux.versions {
+		if vs.version == current || !newer(current, vs.version) {
+			continue
+		}
+
+		select {
+		case <-vs.ready:
+		default:
+			continue
+		}
+
+		if previous.version == nil || newer(vs.version, previous.version) {
+			previous = vs
+		}
+	}
+
+	if previous.version != nil {
+		previous.count.Add(1)
+	}
+
+	return previous.version
+}
+
 // getAll returns a snapshot of all known versions.
 func (mux *versionMux) getAll() []*version {
 	mux.lock.RLock()
@@ -142,6 +227,16 @@ func (mux *versionMux) getAll() []*version {
 	return versions
 }
 
+// has returns true if the given version is in the mux, and hasn't been replaced
+// by a different version of the same name.
+func (mux *versionMux) has(version *version) bool {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+
+	vs, ok := mux.versions[version.name]
+	return ok && vs.version == version
+}
+
 // release signifies that a request is done with a version, decrementing the
 // reference count.
 func (mux *versionMux) release(version *version) {
@@ -213,10 +308,15 @@ func (mux *versionMux) remove(version *version, shouldWait bool) *version {
 	}
 
 	// Set the timer, then wait for it. Any request from here on will reset the
-	// timer.
+	// timer, unless the version has been evicted.
 	if shouldWait {
 		mux.lock.Lock()
 		timer := time.NewTimer(mux.versionRemoveTimeout)
+		vs.evicted = mux.versions[version.name].evicted
+		if vs.evicted {
+			timer.Reset(0)
+		}
+
 		vs.closeTimer = timer
 		mux.versions[version.name] = vs
 		mux.lock.Unlock()
@@ -234,6 +334,29 @@ func (mux *versionMux) remove(version *version, shouldWait bool) *version {
 	return version
 }
 
+// evict marks a version so that when it's removed, it's removed right away,
+// without waiting for requests to it to stop. If it's already waiting, the wait
+// is cut short. Like remove, it still waits for the reference count to drop to
+// zero. It returns false if the version isn't in the mux, or was already
+// evicted.
+func (mux *versionMux) evict(version *version) bool {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	vs, ok := mux.versions[version.name]
+	if !ok || vs.version != version || vs.evicted {
+		return false
+	}
+
+	vs.evicted = true
+	if vs.closeTimer != nil {
+		vs.closeTimer.Reset(0)
+	}
+
+	mux.versions[version.name] = vs
+	return true
+}
+
 func (mux *versionMux) mustGet(version *version) versionReferenceCount {
 	vs, ok := mux.versions[version.name]
 	if !ok {
@@ -7,6 +7,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	zk "launchpad.net/gozk/zookeeper"
@@ -25,15 +26,22 @@ var defaultZkACL = zk.WorldACL(zk.PERM_ALL)
 // to directories and managing ephemeral nodes. It lazily connects and
 // reconnects to zookeeper, and tries its best to be resilient to failures, but
 // defaults to silently not providing updates.
+//
+// It can be given multiple zookeeper ensembles, in which case it connects to
+// the first one, and fails over to the next one if the current one is
+// unreachable for longer than failoverTimeout.
 type zkWatcher struct {
 	sync.RWMutex
-	zkServers      []string
-	connectTimeout time.Duration
-	sessionTimeout time.Duration
-	prefix         string
-	conn           *zk.Conn
-	errs           chan error
-	shutdown       chan bool
+	ensembles       [][]string
+	current         int
+	connectTimeout  time.Duration
+	sessionTimeout  time.Duration
+	failoverTimeout time.Duration
+	prefix          string
+	conn            *zk.Conn
+	errs            chan error
+	shutdown        chan bool
+	isConnected     int32
 
 	hooksLock      sync.Mutex
 	ephemeralNodes map[string]bool
@@ -47,18 +55,42 @@ type watchedNode struct {
 }
 
 func connectZookeeper(zkServers []string, prefix string, connectTimeout, sessionTimeout time.Duration) (*zkWatcher, error) {
+	return connectZookeeperEnsembles([][]string{zkServers}, prefix, connectTimeout, sessionTimeout, 0)
+}
+
+func connectZookeeperEnsembles(ensembles [][]string, prefix string, connectTimeout, sessionTimeout, failoverTimeout time.Duration) (*zkWatcher, error) {
+	for _, ensemble := range ensembles {
+		for i, s := range ensemble {
+			if strings.Index(s, ":") < 0 {
+				ensemble[i] = fmt.Sprintf("%s:%d", s, defaultZKPort)
+			}
+		}
+	}
+
 	w := &zkWatcher{
-		zkServers:      zkServers,
-		connectTimeout: connectTimeout,
-		sessionTimeout: sessionTimeout,
-		prefix:         path.Join(prefix, coordinationVersion),
-		errs:           make(chan error, 1),
-		shutdown:       make(chan bool),
-		ephemeralNodes: make(map[string]bool),
-		watchedNodes:   make(map[string]watchedNode),
+		ensembles:       ensembles,
+		connectTimeout:  connectTimeout,
+		sessionTimeout:  sessionTimeout,
+		failoverTimeout: failoverTimeout,
+		prefix:          path.Join(prefix, coordinationVersion),
+		errs:            make(chan error, 1),
+		shutdown:        make(chan bool),
+		ephemeralNodes:  make(map[string]bool),
+		watchedNodes:    make(map[string]watchedNode),
+	}
+
+	// On startup, try each ensemble in turn.
+	var err error
+	for i := range ensembles {
+		w.current = i
+		err = w.reconnect()
+		if err == nil {
+			break
+		}
+
+		log.Println("Error connecting to zookeeper:", err)
 	}
 
-	err := w.reconnect()
 	if err != nil {
 		return nil, fmt.Errorf("Zookeeper error: %s", err)
 	}
@@ -72,16 +104,10 @@ func (w *zkWatcher) reconnect() error {
 	var events <-chan zk.Event
 	var err error
 
-	for i, s := range w.zkServers {
-		if strings.Index(s, ":") < 0 {
-			w.zkServers[i] = fmt.Sprintf("%s:%d", s, defaultZKPort)
-		}
-	}
-
 	w.Lock()
 	defer w.Unlock()
 
-	servers := strings.Join(w.zkServers, ",")
+	servers := strings.Join(w.ensembles[w.current], ",")
 	log.Println("Connecting to zookeeper at", servers)
 	conn, events, err = zk.Dial(servers, w.sessionTimeout)
 	if err != nil {
@@ -163,9 +189,23 @@ func (w *zkWatcher) cancelWatches() {
 	}
 }
 
+// failover switches to the next ensemble, if there is more than one.
+func (w *zkWatcher) failover() {
+	if len(w.ensembles) < 2 {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.current = (w.current + 1) % len(w.ensembles)
+	log.Println("Failing over to zookeeper at", strings.Join(w.ensembles[w.current], ","))
+}
+
 // sync runs the main loop. On any errors, it resets the connection.
 func (w *zkWatcher) run() {
 	first := true
+	var disconnectedAt time.Time
 
 Reconnect:
 	for {
@@ -181,6 +221,13 @@ Reconnect:
 			err := w.reconnect()
 			if err != nil {
 				log.Println("Error reconnecting to zookeeper:", err)
+
+				// If the ensemble has been down for too long, try the next one.
+				if w.failoverTimeout != 0 && time.Since(disconnectedAt) > w.failoverTimeout {
+					w.failover()
+					disconnectedAt = time.Now()
+				}
+
 				continue Reconnect
 			}
 
@@ -190,16 +237,21 @@ Reconnect:
 				log.Println("Error running zookeeper hooks:", err)
 				continue Reconnect
 			}
+
+			log.Println("Reconnected to zookeeper")
 		} else {
 			first = false
 		}
 
+		atomic.StoreInt32(&w.isConnected, 1)
 		select {
 		case <-w.shutdown:
 			break Reconnect
 		case err := <-w.errs:
 			log.Println("Disconnecting from zookeeper because of error:", err)
+			atomic.StoreInt32(&w.isConnected, 0)
 			w.cancelWatches()
+			disconnectedAt = time.Now()
 			continue Reconnect
 		}
 	}
@@ -256,6 +308,56 @@ func (w *zkWatcher) hookCreateEphemeral(node string) error {
 	return nil
 }
 
+// setPersistentChild replaces the children of node with a single persistent
+// child, or removes them all if child is empty. Unlike ephemeral nodes, the
+// child outlives the connection, so it isn't recreated on reconnect.
+func (w *zkWatcher) setPersistentChild(node, child string) error {
+	w.RLock()
+	defer w.RUnlock()
+
+	node = path.Join(w.prefix, node)
+	if child != "" {
+		err := w.createAll(path.Join(node, child))
+		if err != nil {
+			return err
+		}
+	}
+
+	children, _, err := w.conn.Children(node)
+	if isNoNode(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		if c == child {
+			continue
+		}
+
+		err = w.conn.Delete(path.Join(node, c), -1)
+		if err != nil && !isNoNode(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// children returns the children of node once, without watching it. A node that
+// doesn't exist has no children.
+func (w *zkWatcher) children(node string) ([]string, error) {
+	w.RLock()
+	defer w.RUnlock()
+
+	children, _, err := w.conn.Children(path.Join(w.prefix, node))
+	if isNoNode(err) {
+		return nil, nil
+	}
+
+	return children, err
+}
+
 func (w *zkWatcher) watchChildren(node string) (chan []string, chan bool) {
 	w.hooksLock.Lock()
 	defer w.hooksLock.Unlock()
@@ -397,6 +499,15 @@ func (w *zkWatcher) cleanupTree(node string) {
 		return
 	} else if stat.EphemeralOwner() != 0 {
 		return
+	} else if path.Dir(path.Dir(node)) == path.Join(w.prefix, pinnedZKPath) {
+		// Pins are empty, but have to stick around.
+		return
+	} else if path.Dir(path.Dir(path.Dir(node))) == path.Join(w.prefix, partitionCountsZKPath) {
+		// So are partition counts.
+		return
+	} else if path.Dir(path.Dir(path.Dir(node))) == path.Join(w.prefix, convergenceTimesZKPath) {
+		// And times to converge.
+		return
 	}
 
 	for _, child := range children {
@@ -414,14 +525,8 @@ func (w *zkWatcher) close() {
 	w.conn.Close()
 }
 
-// sendErr sends the error over the channel, or discards it if the error is full.
-func sendErr(errs chan error, err error) {
-	log.Println("Zookeeper error:", err)
-
-	select {
-	case errs <- err:
-	default:
-	}
+func (w *zkWatcher) connected() bool {
+	return atomic.LoadInt32(&w.isConnected) == 1
 }
 
 func isNodeExists(err error) bool {
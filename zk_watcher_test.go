@@ -130,9 +130,11 @@ func TestZKWatcherReconnect(t *testing.T) {
 		w.createEphemeral("/foo/baz")
 	}()
 
+	assert.True(t, w.connected(), "the watcher should be connected at first")
 	expectWatchUpdate(t, nil, updates, "the list of children should be updated to be empty first")
 	expectWatchUpdate(t, []string{"bar"}, updates, "the list of children should be updated with the new node")
 	expectWatchUpdate(t, []string{"bar", "baz"}, updates, "the list of children should be updated with the second new node")
+	assert.True(t, w.connected(), "the watcher should be connected again after reconnecting")
 }
 
 func TestZKWatchesCanceled(t *testing.T) {